@@ -90,6 +90,12 @@ func Run() {
 			deleteTorrents(c, args...)
 			count++
 		}
+	case "recheck":
+		for count < swarms {
+			c := rpc.NewClient(rpcURL, count)
+			recheckTorrents(c, args...)
+			count++
+		}
 	case "set-piece-window":
 		for count < swarms {
 			c := rpc.NewClient(rpcURL, count)
@@ -104,7 +110,7 @@ func Run() {
 }
 
 func printHelp(cmd string) {
-	fmt.Println(t.T("usage: %s [help|version|list|add http://somesite.i2p/some.torrent|set-piece-window n|remove infohash|delete infohash|stop infohash|start infohash]", cmd))
+	fmt.Println(t.T("usage: %s [help|version|list|add http://somesite.i2p/some.torrent|set-piece-window n|remove infohash|delete infohash|stop infohash|start infohash|recheck infohash]", cmd))
 }
 
 func setPieceWindow(c *rpc.Client, str string) {
@@ -130,7 +136,7 @@ func addTorrents(c *rpc.Client, urls ...string) {
 func startTorrents(c *rpc.Client, ih ...string) {
 	for idx := range ih {
 		fmt.Println(t.T("start %s ... ", ih[idx]))
-		err := c.AddTorrent(ih[idx])
+		err := c.StartTorrent(ih[idx])
 		if err == nil {
 			fmt.Println(t.T("OK"))
 		} else {
@@ -163,6 +169,18 @@ func removeTorrents(c *rpc.Client, ih ...string) {
 	}
 }
 
+func recheckTorrents(c *rpc.Client, ih ...string) {
+	for idx := range ih {
+		fmt.Println(t.T("recheck %s ... ", ih[idx]))
+		err := c.RecheckTorrent(ih[idx])
+		if err == nil {
+			fmt.Println(t.T("OK"))
+		} else {
+			fmt.Println(t.E(err))
+		}
+	}
+}
+
 func deleteTorrents(c *rpc.Client, ih ...string) {
 	for idx := range ih {
 		fmt.Println(t.T("delete %s ... ", ih[idx]))
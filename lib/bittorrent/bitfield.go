@@ -3,6 +3,7 @@ package bittorrent
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/majestrate/XD/lib/common"
 	"io"
@@ -10,6 +11,9 @@ import (
 	"github.com/zeebo/bencode"
 )
 
+// ErrSpareBitsSet is returned for bitfield messages with bits set past the last piece
+var ErrSpareBitsSet = errors.New("bitfield has spare bits set")
+
 // Bitfield is a serializable bitmap for bittorrent
 type Bitfield struct {
 	// length in bits
@@ -180,8 +184,29 @@ func (bf *Bitfield) BDecode(r io.Reader) (err error) {
 }
 
 // ToWireMessage serializes to bittorrent wire message
+// the payload is exactly as long as the spec says with the spare bits at the end zeroed
 func (bf *Bitfield) ToWireMessage() common.WireMessage {
-	return common.NewWireMessage(common.BitField, bf.Data[:])
+	data := make([]byte, (bf.Length+7)/8)
+	copy(data, bf.Data)
+	if spare := bf.Length % 8; spare != 0 && len(data) > 0 {
+		data[len(data)-1] &= byte(0xff << (8 - spare))
+	}
+	return common.NewWireMessage(common.BitField, data)
+}
+
+// SpareBitsSet returns true if any bit past Length is set
+func (bf *Bitfield) SpareBitsSet() bool {
+	for idx, b := range bf.Data {
+		first := uint32(idx) * 8
+		if first >= bf.Length {
+			if b != 0 {
+				return true
+			}
+		} else if first+8 > bf.Length && b&byte(0xff>>(bf.Length-first)) != 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // Unset unsets a big at index
@@ -0,0 +1,31 @@
+package bittorrent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitfieldWireSpareBits(t *testing.T) {
+	bf := NewBitfield(10, []byte{0xff, 0xff})
+	if !bf.SpareBitsSet() {
+		t.Error("spare bits not seen")
+	}
+	if got := bf.ToWireMessage().Payload(); !bytes.Equal(got, []byte{0xff, 0xc0}) {
+		t.Errorf("bitfield message is %x, expected ffc0", got)
+	}
+	bf = NewBitfield(10, []byte{0xff, 0xc0})
+	if bf.SpareBitsSet() {
+		t.Error("no spare bits set but saw some")
+	}
+	// a whole number of bytes has no spare bits and takes no extra byte
+	bf = NewBitfield(8, nil)
+	for idx := uint32(0); idx < 8; idx++ {
+		bf.Set(idx)
+	}
+	if bf.SpareBitsSet() {
+		t.Error("no spare bits set but saw some")
+	}
+	if got := bf.ToWireMessage().Payload(); !bytes.Equal(got, []byte{0xff}) {
+		t.Errorf("bitfield message is %x, expected ff", got)
+	}
+}
@@ -24,6 +24,8 @@ type Message struct {
 	Payload      interface{}       `bencode:"-"`
 	PayloadRaw   []byte            `bencode:"-"`
 	MetainfoSize *uint32           `bencode:"metadata_size,omitempty"`
+	UploadOnly   *int              `bencode:"upload_only,omitempty"`
+	RequestQueue int               `bencode:"reqq,omitempty"`
 }
 
 // I2PPEX returns true if i2p PEX is supported
@@ -46,6 +48,21 @@ func (opts Message) MetaData() bool {
 	return opts.IsSupported(UTMetaData.String())
 }
 
+// IsUploadOnly returns true if the sender only uploads (BEP 21)
+func (opts Message) IsUploadOnly() bool {
+	return opts.UploadOnly != nil && *opts.UploadOnly != 0
+}
+
+// SetUploadOnly sets if we only upload (BEP 21)
+// once set it is always sent, so peers also hear when we stop
+func (opts *Message) SetUploadOnly(only bool) {
+	v := 0
+	if only {
+		v = 1
+	}
+	opts.UploadOnly = &v
+}
+
 // SetSupported sets a bittorrent extension as supported
 func (opts *Message) SetSupported(ext Extension) {
 	// get max id
@@ -93,6 +110,8 @@ func (opts Message) Copy() Message {
 		Extensions:   ext,
 		Payload:      opts.Payload,
 		MetainfoSize: opts.MetainfoSize,
+		UploadOnly:   opts.UploadOnly,
+		RequestQueue: opts.RequestQueue,
 	}
 	if opts.PayloadRaw != nil {
 		m.PayloadRaw = make([]byte, len(opts.PayloadRaw))
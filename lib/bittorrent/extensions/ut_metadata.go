@@ -18,6 +18,9 @@ const UTData = 1
 // UTReject msg_type for reject messages
 const UTReject = 2
 
+// MetadataSliceSize is how big each slice of the info dict is
+const MetadataSliceSize = 16 * 1024
+
 // MetaData ut_metadata extension message
 type MetaData struct {
 	Type  int    `bencode:"msg_type"`
@@ -39,9 +39,42 @@ func (r *Reserved) Set(bit ReservedBit) {
 // Extension is ReservedBit for bittorrent extensions
 const Extension = ReservedBit(44)
 
+// Fast is ReservedBit for the fast extension
+const Fast = ReservedBit(62)
+
 // DHT is ReservedBit for BT DHT
 const DHT = ReservedBit(64)
 
+// Capabilities are the protocol features advertised in reserved data
+type Capabilities struct {
+	Extended bool
+	Fast     bool
+	DHT      bool
+}
+
+// Reserved builds reserved data advertising these capabilities
+func (c Capabilities) Reserved() (r Reserved) {
+	if c.Extended {
+		r.Set(Extension)
+	}
+	if c.Fast {
+		r.Set(Fast)
+	}
+	if c.DHT {
+		r.Set(DHT)
+	}
+	return
+}
+
+// Capabilities gets the capabilities this reserved data advertises
+func (r Reserved) Capabilities() Capabilities {
+	return Capabilities{
+		Extended: r.Has(Extension),
+		Fast:     r.Has(Fast),
+		DHT:      r.Has(DHT),
+	}
+}
+
 // ErrInvalidHandshake is returned when a handshake contained invalid format
 var ErrInvalidHandshake = errors.New("invalid bittorrent handshake")
 
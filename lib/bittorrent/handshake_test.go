@@ -0,0 +1,35 @@
+package bittorrent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCapabilitiesReserved(t *testing.T) {
+	caps := Capabilities{Extended: true, Fast: true, DHT: true}
+	r := caps.Reserved()
+	expected := [8]uint8{0, 0, 0, 0, 0, 0x10, 0, 0x05}
+	if r.data != expected {
+		t.Errorf("reserved bytes are %x, expected %x", r.data, expected)
+	}
+	if got := (Capabilities{Extended: true}).Reserved(); got.data != [8]uint8{0, 0, 0, 0, 0, 0x10, 0, 0} {
+		t.Errorf("extended only reserved bytes are %x", got.data)
+	}
+
+	// read back from what a peer sent
+	var buff bytes.Buffer
+	h := Handshake{Reserved: r}
+	if err := h.Send(&buff); err != nil {
+		t.Fatal(err)
+	}
+	var got Handshake
+	if err := got.Recv(&buff); err != nil {
+		t.Fatal(err)
+	}
+	if c := got.Reserved.Capabilities(); c != caps {
+		t.Errorf("parsed capabilities are %+v, expected %+v", c, caps)
+	}
+	if c := (Reserved{}).Capabilities(); c != (Capabilities{}) {
+		t.Errorf("empty reserved bytes have capabilities %+v", c)
+	}
+}
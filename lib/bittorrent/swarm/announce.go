@@ -1,6 +1,8 @@
 package swarm
 
 import (
+	"errors"
+	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/log"
 	"github.com/majestrate/XD/lib/sync"
 	"github.com/majestrate/XD/lib/tracker"
@@ -12,52 +14,210 @@ import (
 const DefaultAnnounceNumWant = 10
 const DefaultAnnouncePort = 6881
 
+// how many trackers we announce to at the same time per torrent by default
+const DefaultMaxParallelAnnounces = 4
+
+// AnnounceOutage is how long announces to a tracker can fail before we assume it forgot us and announce started again
+const AnnounceOutage = time.Minute * 30
+
+// QuietAnnounceFactor is how many times the tracker's interval we wait to announce again when seeding to a swarm with no leechers
+const QuietAnnounceFactor = 2
+
+// ErrAnnounceTooSoon is returned when forcing an announce before the tracker's min interval is up
+var ErrAnnounceTooSoon = errors.New("tracker min interval not up yet")
+
 type torrentAnnounce struct {
-	access   sync.Mutex
-	next     time.Time
+	access sync.Mutex
+	// when the tracker's interval is up and we announce again on our own
+	next time.Time
+	// when its min interval is up, we never announce before this unless stopping
+	minNext  time.Time
 	fails    time.Duration
 	announce tracker.Announcer
 	t        *Torrent
+	// set once the tracker knows about us, cleared when we stop or it has been failing for AnnounceOutage
+	started bool
+	lastOK  time.Time
+	// seeders and leechers the tracker last told us about, not under access so they can be read while announcing
+	countsMtx sync.Mutex
+	seeders   int
+	leechers  int
+}
+
+// get the port we tell others to connect to us on
+func (t *Torrent) listenPort() (port int, err error) {
+	la := t.Network().Addr()
+	if la.Network() == "i2p" {
+		port = DefaultAnnouncePort
+	} else {
+		var p string
+		_, p, err = net.SplitHostPort(la.String())
+		if err == nil {
+			port, err = strconv.Atoi(p)
+		}
+	}
+	return
+}
+
+// make an announce request with our current totals
+func (t *Torrent) announceRequest(ev tracker.Event) (req *tracker.Request, err error) {
+	req = &tracker.Request{
+		Infohash: t.st.Infohash(),
+		PeerID:   t.id,
+		Key:      t.key,
+		NoPeerID: t.NoPeerID,
+		Event:    ev,
+		NumWant:  DefaultAnnounceNumWant,
+		// bytes transfered this session
+		Downloaded: t.rxRate.Total(),
+		Uploaded:   t.txRate.Total(),
+		Left:       t.st.DownloadRemaining(),
+		Addr:       t.localAddr(),
+		UserAgent:  t.UserAgent,
+		GetNetwork: t.Network,
+		RewriteURL: t.RewriteAnnounce,
+	}
+	if req.Addr != nil {
+		req.Addrs = t.externalAddrs(req.Addr)
+		req.Addr = t.advertisedAddr(req.Addr)
+	}
+	req.Port, err = t.listenPort()
+	if ev == tracker.Stopped {
+		req.NumWant = 0
+	}
+	return
+}
+
+// announce if it is time to or if we are stopping, returns the peers the tracker gave us
+func (a *torrentAnnounce) tryAnnounce(ev tracker.Event) (peers []common.Peer, err error) {
+	return a.announceIf(ev, false)
+}
+
+// announce even if it is not time to yet
+func (a *torrentAnnounce) forceAnnounce(ev tracker.Event) (peers []common.Peer, err error) {
+	return a.announceIf(ev, true)
+}
+
+// is it time to announce ? forced announces only wait on the min interval
+// stopped and forced completed always go out, trackers only hear them once
+// call with access held
+func (a *torrentAnnounce) shouldAnnounce(now time.Time, ev tracker.Event, force bool) bool {
+	if ev == tracker.Stopped || ev == tracker.Completed && force {
+		return true
+	}
+	if force {
+		return !now.Before(a.minNext)
+	}
+	return !now.Before(a.next)
 }
 
-func (a *torrentAnnounce) tryAnnounce(ev tracker.Event) (err error) {
+func (a *torrentAnnounce) announceIf(ev tracker.Event, force bool) (peers []common.Peer, err error) {
 	a.access.Lock()
-	if time.Now().After(a.next) {
-		la := a.t.Network().Addr()
-		if la.Network() == "i2p" {
-		}
-		req := &tracker.Request{
-			Infohash:   a.t.st.Infohash(),
-			PeerID:     a.t.id,
-			Event:      ev,
-			NumWant:    DefaultAnnounceNumWant,
-			Downloaded: a.t.st.DownloadedSize(),
-			Left:       a.t.st.DownloadRemaining(),
-			Uploaded:   a.t.tx,
-			GetNetwork: a.t.Network,
-		}
-		if la.Network() == "i2p" {
-			req.Port = DefaultAnnouncePort
-		} else {
-			var port string
-			_, port, err = net.SplitHostPort(la.String())
-			req.Port, err = strconv.Atoi(port)
-			if err != nil {
-				return
-			}
+	if force && !a.shouldAnnounce(a.t.clock.Now(), ev, force) {
+		err = ErrAnnounceTooSoon
+	} else if a.shouldAnnounce(a.t.clock.Now(), ev, force) {
+		if ev == tracker.Nop && !a.started {
+			// the tracker never heard from us or forgot us
+			ev = tracker.Started
 		}
-		if ev == tracker.Stopped {
-			req.NumWant = 0
+		var req *tracker.Request
+		req, err = a.t.announceRequest(ev)
+		if err != nil {
+			a.access.Unlock()
+			return
 		}
 		var resp *tracker.Response
 		log.Infof("announcing to %s", a.announce.Name())
-		resp, err = a.announce.Announce(req)
+		a.t.NetPool.Do(func() {
+			resp, err = a.announce.Announce(req)
+		})
 		backoff := a.fails * time.Minute
-		a.next = resp.NextAnnounce.Add(backoff)
+		if resp != nil && err == nil {
+			a.t.gotExternalIP(resp.ExternalIP)
+			a.countsMtx.Lock()
+			a.seeders = resp.Complete
+			a.leechers = resp.Incomplete
+			a.countsMtx.Unlock()
+			a.next = a.nextAnnounce(resp).Add(backoff)
+			a.minNext = a.t.clock.Now().Add(time.Duration(resp.MinInterval) * time.Second)
+		} else if resp != nil {
+			a.next = resp.NextAnnounce.Add(backoff)
+		} else {
+			a.next = a.t.clock.Now().Add(time.Minute + backoff)
+		}
+		now := a.t.clock.Now()
+		if err == nil {
+			a.started = ev != tracker.Stopped
+			a.lastOK = now
+		} else if a.started && now.Sub(a.lastOK) >= AnnounceOutage {
+			log.Warnf("announces to %s failing for %s, will announce started again", a.announce.Name(), now.Sub(a.lastOK))
+			a.started = false
+		}
 		if err == nil && ev != tracker.Stopped {
-			a.t.addPeers(resp.Peers)
+			peers = resp.Peers
+		}
+	}
+	a.access.Unlock()
+	return
+}
+
+// when to announce again after a good response from the tracker
+// the torrent's AnnounceInterval is used in place of the tracker's interval if set but never goes under its min interval
+// without it we wait longer than the tracker asks when seeding and it says nobody is downloading
+func (a *torrentAnnounce) nextAnnounce(resp *tracker.Response) time.Time {
+	interval := a.t.AnnounceInterval
+	if interval <= 0 {
+		if resp.Incomplete == 0 && resp.Complete > 0 && a.t.Done() {
+			wait := resp.NextAnnounce.Sub(a.t.clock.Now())
+			return resp.NextAnnounce.Add(wait * (QuietAnnounceFactor - 1))
+		}
+		return resp.NextAnnounce
+	}
+	min := time.Duration(resp.MinInterval) * time.Second
+	if interval < min {
+		interval = min
+	}
+	return a.t.clock.Now().Add(interval)
+}
+
+// SwarmSize gets the most seeders and leechers any of our trackers told us about
+func (t *Torrent) SwarmSize() (seeders, leechers int) {
+	t.announceMtx.Lock()
+	defer t.announceMtx.Unlock()
+	for _, a := range t.announcers {
+		a.countsMtx.Lock()
+		if a.seeders > seeders {
+			seeders = a.seeders
+		}
+		if a.leechers > leechers {
+			leechers = a.leechers
 		}
+		a.countsMtx.Unlock()
+	}
+	return
+}
+
+// make it time to announce as soon as the min interval allows
+func (a *torrentAnnounce) reset() {
+	a.access.Lock()
+	a.next = a.t.clock.Now()
+	if a.next.Before(a.minNext) {
+		a.next = a.minNext
 	}
+	a.fails = 0
 	a.access.Unlock()
+}
+
+// remove duplicate peers from a list of peers gotten from many sources
+func uniquePeers(peers []common.Peer) (unique []common.Peer) {
+	seen := make(map[string]bool)
+	for _, p := range peers {
+		k := p.Key()
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		unique = append(unique, p)
+	}
 	return
 }
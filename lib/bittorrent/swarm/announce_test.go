@@ -0,0 +1,834 @@
+package swarm
+
+import (
+	"fmt"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/metainfo"
+	"github.com/majestrate/XD/lib/sync"
+	"github.com/majestrate/XD/lib/tracker"
+	"github.com/majestrate/XD/lib/util"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAnnounceAllBounded(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	tr.MaxParallelAnnounces = 3
+
+	var mtx sync.Mutex
+	active, most := 0, 0
+	shared := common.Peer{IP: "10.0.0.1", Port: 6881}
+	var names []string
+	for idx := 0; idx < 20; idx++ {
+		name := fmt.Sprintf("tracker-%d", idx)
+		tr.Trackers[name] = &testTracker{
+			name:  name,
+			delay: time.Millisecond * 10,
+			peers: []common.Peer{shared, {IP: "10.0.1.1", Port: 1000 + idx}},
+			onAnnounce: func(_ *tracker.Request) {
+				mtx.Lock()
+				active++
+				if active > most {
+					most = active
+				}
+				mtx.Unlock()
+			},
+			afterAnnounce: func() {
+				mtx.Lock()
+				active--
+				mtx.Unlock()
+			},
+		}
+		tr.nextAnnounceFor(name)
+		names = append(names, name)
+	}
+	tr.announceAll(tracker.Started, names)
+
+	if most > 3 {
+		t.Errorf("%d announces at once but max is 3", most)
+	}
+	if most == 0 {
+		t.Error("no announces happened")
+	}
+
+	// wait for dials to start
+	time.Sleep(time.Millisecond * 100)
+	if d := n.numDials(shared.Key()); d != 1 {
+		t.Errorf("peer from every tracker was dialed %d times", d)
+	}
+	for idx := 0; idx < 20; idx++ {
+		addr := fmt.Sprintf("10.0.1.1:%d", 1000+idx)
+		if d := n.numDials(addr); d != 1 {
+			t.Errorf("%s was dialed %d times", addr, d)
+		}
+	}
+}
+
+func TestUniquePeers(t *testing.T) {
+	peers := []common.Peer{
+		{IP: "10.0.0.1", Port: 1},
+		{IP: "10.0.0.2", Port: 1},
+		{IP: "10.0.0.1", Port: 1},
+		{IP: "10.0.0.1", Port: 2},
+	}
+	if l := len(uniquePeers(peers)); l != 3 {
+		t.Errorf("got %d unique peers, expected 3", l)
+	}
+}
+
+func TestSamePeerFromManySourcesDialedOnce(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	peer := common.Peer{IP: "10.0.0.1", Port: 6881}
+	for _, name := range []string{"a", "b"} {
+		tr.Trackers[name] = &testTracker{
+			name:  name,
+			peers: []common.Peer{peer},
+		}
+		tr.nextAnnounceFor(name)
+		// separate announce cycles
+		tr.announceAll(tracker.Started, []string{name})
+	}
+	// same peer from pex
+	tr.addPeers([]common.Peer{peer})
+	time.Sleep(time.Millisecond * 100)
+	if d := n.numDials(peer.Key()); d != 1 {
+		t.Errorf("peer was dialed %d times", d)
+	}
+}
+
+func TestAnnounceDialsOnlyWhatFits(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.MaxPeers = 10
+	var peers []common.Peer
+	for idx := 0; idx < 200; idx++ {
+		peers = append(peers, common.Peer{IP: fmt.Sprintf("10.0.%d.%d", idx/250, idx%250+1), Port: 6881})
+	}
+	tr.Trackers["test"] = &testTracker{
+		name:  "test",
+		peers: peers,
+	}
+	tr.nextAnnounceFor("test")
+	tr.announceAll(tracker.Started, []string{"test"})
+	dials := func() (total int) {
+		time.Sleep(time.Millisecond * 100)
+		for _, p := range peers {
+			total += n.numDials(p.Key())
+		}
+		return
+	}
+	if d := dials(); d != 10 {
+		t.Errorf("started %d connections with room for 10", d)
+	}
+	if q := tr.QueuedPeers(); q != 190 {
+		t.Errorf("%d peers queued, expected 190", q)
+	}
+	// still no room
+	tr.dialQueuedPeers()
+	if d := dials(); d != 10 {
+		t.Errorf("started %d connections after dialing queued peers with no room", d)
+	}
+	// room for 5 more
+	tr.MaxPeers = 15
+	tr.dialQueuedPeers()
+	if d := dials(); d != 15 {
+		t.Errorf("started %d connections with room for 15", d)
+	}
+	if q := tr.QueuedPeers(); q != 185 {
+		t.Errorf("%d peers queued, expected 185", q)
+	}
+}
+
+func TestQueuedPeersNotDuplicated(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	var peers []common.Peer
+	for idx := 0; idx < 20; idx++ {
+		peers = append(peers, common.Peer{IP: fmt.Sprintf("10.0.0.%d", idx+1), Port: 6881})
+	}
+	// every announce hands us the same peers again
+	tr.queuePeers(peers)
+	tr.queuePeers(peers[5:])
+	tr.queuePeers(append(peers[:3:3], peers[:3]...))
+	if q := tr.QueuedPeers(); q != len(peers) {
+		t.Errorf("%d peers queued, expected %d", q, len(peers))
+	}
+}
+
+func TestAnnounceKeyReused(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	tr.key = tracker.GenerateKey()
+	tr.NoPeerID = true
+	var keys []string
+	tr.Trackers["a"] = &testTracker{
+		name: "a",
+		onAnnounce: func(req *tracker.Request) {
+			if !req.NoPeerID {
+				t.Error("no_peer_id not set in request")
+			}
+			keys = append(keys, req.Key)
+		},
+	}
+	for idx := 0; idx < 2; idx++ {
+		tr.nextAnnounceFor("a")
+		// make it time to announce again
+		tr.announcers["a"].next = time.Now()
+		tr.announceAll(tracker.Nop, []string{"a"})
+	}
+	if len(keys) != 2 {
+		t.Fatalf("announced %d times, expected 2", len(keys))
+	}
+	if keys[0] == "" {
+		t.Error("no key in announce")
+	}
+	if keys[0] != keys[1] {
+		t.Errorf("key changed between announces: %q then %q", keys[0], keys[1])
+	}
+}
+
+func TestStoppedAnnounceTotals(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	var reqs []*tracker.Request
+	tr.Trackers["a"] = &testTracker{
+		name: "a",
+		onAnnounce: func(req *tracker.Request) {
+			reqs = append(reqs, req)
+		},
+	}
+	tr.nextAnnounceFor("a")
+	tr.announceAll(tracker.Started, []string{"a"})
+
+	// transfer some data then stop before the next announce is due
+	tr.st.(*testStorage).setPiece(0)
+	tr.rxRate.Add(BlockSize + 100)
+	tr.txRate.Add(3000)
+	tr.txRate.Add(500)
+	tr.StopAnnouncing(true)
+
+	if len(reqs) != 2 {
+		t.Fatalf("announced %d times, expected 2", len(reqs))
+	}
+	req := reqs[1]
+	if req.Event != tracker.Stopped {
+		t.Errorf("last announce was %q not stopped", req.Event)
+	}
+	if req.NumWant != 0 {
+		t.Errorf("stopped announce wants %d peers", req.NumWant)
+	}
+	if req.Uploaded != 3500 {
+		t.Errorf("uploaded is %d, expected 3500", req.Uploaded)
+	}
+	if req.Downloaded != BlockSize+100 {
+		t.Errorf("downloaded is %d, expected %d", req.Downloaded, BlockSize+100)
+	}
+	if req.Left != BlockSize*3 {
+		t.Errorf("left is %d, expected %d", req.Left, BlockSize*3)
+	}
+}
+
+func TestAddrChangeReannounces(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	var mtx sync.Mutex
+	var reqs []tracker.Request
+	tr.Trackers["test"] = &testTracker{
+		name: "test",
+		onAnnounce: func(req *tracker.Request) {
+			mtx.Lock()
+			reqs = append(reqs, *req)
+			mtx.Unlock()
+		},
+	}
+	tr.nextAnnounceFor("test")
+	if tr.addrChanged() {
+		t.Error("address changed before we knew it")
+	}
+	tr.announceAll(tracker.Started, tr.trackerNames())
+	if tr.addrChanged() {
+		t.Error("address changed when it was the same")
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	n.setAddr(addr)
+	if !tr.addrChanged() {
+		t.Fatal("address change not seen")
+	}
+	tr.reannounce()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d announces, expected 2", len(reqs))
+	}
+	req := reqs[1]
+	if req.Event != tracker.Started {
+		t.Errorf("re-announce event is %s, expected started", req.Event)
+	}
+	if req.Addr == nil || req.Addr.String() != addr.String() {
+		t.Errorf("re-announce from %s, expected %s", req.Addr, addr)
+	}
+	if tr.nextAnnounceFor("test").Before(time.Now().Add(time.Second * 30)) {
+		t.Error("next announce not scheduled after re-announce")
+	}
+}
+
+func TestAnnounceFollowsClock(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	var mtx sync.Mutex
+	announces := 0
+	tr.Trackers["test"] = &testTracker{
+		name:  "test",
+		clock: clock,
+		onAnnounce: func(_ *tracker.Request) {
+			mtx.Lock()
+			announces++
+			mtx.Unlock()
+		},
+	}
+	waitFor := func(expected int) {
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			mtx.Lock()
+			got := announces
+			mtx.Unlock()
+			if got == expected {
+				return
+			}
+			if got > expected || time.Now().After(deadline) {
+				t.Fatalf("%d announces but expected %d", got, expected)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	tr.StartAnnouncing()
+	defer tr.StopAnnouncing(false)
+	waitFor(1)
+	// the tracker wants us back every minute
+	for idx := 2; idx <= 4; idx++ {
+		clock.Advance(time.Second * 65)
+		waitFor(idx)
+	}
+	// not time yet
+	clock.Advance(time.Second * 30)
+	time.Sleep(time.Millisecond * 50)
+	waitFor(4)
+}
+
+func TestAnnounceIntervalOverride(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	// the tracker wants us back every minute and no sooner than every 30 seconds
+	tr.Trackers["test"] = &testTracker{name: "test", clock: clock, minInterval: 30}
+	tr.nextAnnounceFor("test")
+	a := tr.announcers["test"]
+	for _, test := range []struct {
+		override time.Duration
+		expected time.Duration
+	}{
+		{0, time.Minute},
+		{time.Second * 10, time.Second * 30},
+		{time.Second * 45, time.Second * 45},
+		{time.Hour, time.Hour},
+	} {
+		tr.AnnounceInterval = test.override
+		if _, err := a.forceAnnounce(tracker.Nop); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(test.expected - time.Second)
+		if tr.shouldAnnounce("test") {
+			t.Errorf("override of %s announces before %s", test.override, test.expected)
+		}
+		clock.Advance(time.Second)
+		if !tr.shouldAnnounce("test") {
+			t.Errorf("override of %s does not announce after %s", test.override, test.expected)
+		}
+	}
+}
+
+func TestAnnounceMinInterval(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	announces := 0
+	// back every minute and no sooner than every 30 seconds
+	tr.Trackers["test"] = &testTracker{
+		name:        "test",
+		clock:       clock,
+		minInterval: 30,
+		onAnnounce: func(*tracker.Request) {
+			announces++
+		},
+	}
+	tr.nextAnnounceFor("test")
+	a := tr.announcers["test"]
+	if _, err := a.forceAnnounce(tracker.Started); err != nil {
+		t.Fatal(err)
+	}
+
+	// forced announces wait on the min interval
+	clock.Advance(time.Second * 10)
+	if _, err := a.forceAnnounce(tracker.Nop); err != ErrAnnounceTooSoon {
+		t.Errorf("forced announce before the min interval gave %v", err)
+	}
+	if err := tr.ReannounceTracker("test"); err != ErrAnnounceTooSoon {
+		t.Errorf("reannouncing before the min interval gave %v", err)
+	}
+	a.tryAnnounce(tracker.Nop)
+	if announces != 1 {
+		t.Fatalf("announced %d times before the min interval, expected 1", announces)
+	}
+	clock.Advance(time.Second * 20)
+	if _, err := a.forceAnnounce(tracker.Nop); err != nil {
+		t.Errorf("forced announce after the min interval gave %v", err)
+	}
+	if announces != 2 {
+		t.Fatalf("announced %d times after the min interval, expected 2", announces)
+	}
+
+	// scheduled ones wait on the whole interval
+	clock.Advance(time.Second * 59)
+	a.tryAnnounce(tracker.Nop)
+	if tr.shouldAnnounce("test") || announces != 2 {
+		t.Errorf("announced %d times before the interval, expected 2", announces)
+	}
+	clock.Advance(time.Second)
+	if !tr.shouldAnnounce("test") {
+		t.Error("not time to announce once the interval is up")
+	}
+	a.tryAnnounce(tracker.Nop)
+	if announces != 3 {
+		t.Errorf("announced %d times once the interval was up, expected 3", announces)
+	}
+
+	// stopping never waits
+	if _, err := a.forceAnnounce(tracker.Stopped); err != nil || announces != 4 {
+		t.Errorf("stopping right after an announce gave %v", err)
+	}
+}
+
+func TestAnnounceSwarmCounts(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	tr.Trackers["a"] = &testTracker{name: "a", clock: clock, seeders: 5, leechers: 1}
+	tr.Trackers["b"] = &testTracker{name: "b", clock: clock, seeders: 2, leechers: 7}
+	tr.nextAnnounceFor("a")
+	tr.nextAnnounceFor("b")
+	tr.announceAll(tracker.Started, []string{"a", "b"})
+	if status := tr.GetStatus(); status.Seeders != 5 || status.Leechers != 7 {
+		t.Errorf("status has %d seeders and %d leechers, expected 5 and 7", status.Seeders, status.Leechers)
+	}
+	// downloading keeps to the tracker's interval
+	if next := tr.nextAnnounceFor("a").Sub(clock.Now()); next != time.Minute {
+		t.Errorf("announcing again in %s while downloading", next)
+	}
+
+	// seeding with nobody to seed to backs off
+	tr.st.(*testStorage).bf.Set(0)
+	quiet := &testTracker{name: "c", clock: clock, seeders: 3}
+	tr.Trackers["c"] = quiet
+	tr.nextAnnounceFor("c")
+	tr.announceAll(tracker.Completed, []string{"c"})
+	if next := tr.nextAnnounceFor("c").Sub(clock.Now()); next != time.Minute*QuietAnnounceFactor {
+		t.Errorf("announcing again in %s to a swarm with no leechers", next)
+	}
+	quiet.leechers = 1
+	tr.announceTracker("c", tracker.Nop, true)
+	if next := tr.nextAnnounceFor("c").Sub(clock.Now()); next != time.Minute {
+		t.Errorf("announcing again in %s once there is a leecher", next)
+	}
+}
+
+func TestDisabledTrackerSkipped(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	var mtx sync.Mutex
+	announces := make(map[string]int)
+	for _, name := range []string{"good", "flaky"} {
+		tr.Trackers[name] = &testTracker{
+			name:  name,
+			clock: clock,
+			onAnnounce: func(name string) func(*tracker.Request) {
+				return func(_ *tracker.Request) {
+					mtx.Lock()
+					announces[name]++
+					mtx.Unlock()
+				}
+			}(name),
+		}
+	}
+	if err := tr.SetTrackerEnabled("flaky", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.SetTrackerEnabled("nope", false); err != ErrNoSuchTracker {
+		t.Errorf("disabling a tracker we don't have gave %v", err)
+	}
+	count := func(name string) int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return announces[name]
+	}
+	waitFor := func(name string, expected int) {
+		deadline := time.Now().Add(time.Second * 5)
+		for count(name) < expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s got %d announces but expected %d", name, count(name), expected)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	tr.StartAnnouncing()
+	defer tr.StopAnnouncing(false)
+	for idx := 1; idx <= 3; idx++ {
+		waitFor("good", idx)
+		clock.Advance(time.Second * 65)
+	}
+	if got := count("flaky"); got != 0 {
+		t.Errorf("disabled tracker got %d announces", got)
+	}
+	if err := tr.ReannounceTracker("flaky"); err != ErrTrackerDisabled {
+		t.Errorf("reannouncing to a disabled tracker gave %v", err)
+	}
+	if _, ok := tr.Trackers["flaky"]; !ok {
+		t.Error("disabled tracker was removed")
+	}
+
+	tr.SetTrackerEnabled("flaky", true)
+	clock.Advance(time.Second * 65)
+	waitFor("flaky", 1)
+}
+
+func TestAnnounceStartedAfterOutage(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	var events []tracker.Event
+	tt := &testTracker{
+		name:  "test",
+		clock: clock,
+		onAnnounce: func(req *tracker.Request) {
+			events = append(events, req.Event)
+		},
+	}
+	tr.Trackers["test"] = tt
+	tr.nextAnnounceFor("test")
+	a := tr.announcers["test"]
+	last := func() tracker.Event {
+		return events[len(events)-1]
+	}
+
+	// the first announce failing means the next one still says started
+	tt.err = errTestRefused
+	a.forceAnnounce(tracker.Started)
+	tt.err = nil
+	a.forceAnnounce(tracker.Nop)
+	if ev := last(); ev != tracker.Started {
+		t.Errorf("announce after the first one failed was %q", ev)
+	}
+	a.forceAnnounce(tracker.Nop)
+	if ev := last(); ev != tracker.Nop {
+		t.Errorf("announce after started was %q", ev)
+	}
+
+	// a short blip does not make us start over
+	tt.err = errTestRefused
+	clock.Advance(time.Minute)
+	a.forceAnnounce(tracker.Nop)
+	tt.err = nil
+	a.forceAnnounce(tracker.Nop)
+	if ev := last(); ev != tracker.Nop {
+		t.Errorf("announce after a short outage was %q", ev)
+	}
+
+	// everything failing for a long time does
+	tt.err = errTestRefused
+	for elapsed := time.Duration(0); elapsed <= AnnounceOutage; elapsed += time.Minute * 5 {
+		clock.Advance(time.Minute * 5)
+		a.forceAnnounce(tracker.Nop)
+	}
+	tt.err = nil
+	a.forceAnnounce(tracker.Nop)
+	if ev := last(); ev != tracker.Started {
+		t.Errorf("announce after an outage was %q", ev)
+	}
+	a.forceAnnounce(tracker.Nop)
+	if ev := last(); ev != tracker.Nop {
+		t.Errorf("announce after started again was %q", ev)
+	}
+}
+
+func TestReannounceTracker(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	var mtx sync.Mutex
+	announces := make(map[string]int)
+	for _, name := range []string{"one", "two"} {
+		name := name
+		tr.Trackers[name] = &testTracker{
+			name: name,
+			onAnnounce: func(_ *tracker.Request) {
+				mtx.Lock()
+				announces[name]++
+				mtx.Unlock()
+			},
+		}
+	}
+	tr.nextAnnounceFor("one")
+	tr.nextAnnounceFor("two")
+	// after this neither is due for a minute
+	tr.announceAll(tracker.Started, []string{"one", "two"})
+	if announces["one"] != 1 || announces["two"] != 1 {
+		t.Fatalf("announces before reannouncing: %v", announces)
+	}
+	if err := tr.ReannounceTracker("one"); err != nil {
+		t.Fatal(err)
+	}
+	if announces["one"] != 2 {
+		t.Errorf("tracker announced %d times, expected 2", announces["one"])
+	}
+	if announces["two"] != 1 {
+		t.Errorf("other tracker announced %d times, expected 1", announces["two"])
+	}
+	if err := tr.ReannounceTracker("three"); err != ErrNoSuchTracker {
+		t.Errorf("reannouncing to unknown tracker gave %v", err)
+	}
+}
+
+func TestReannounceTrackerFails(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	tr.Trackers["test"] = &testTracker{
+		name: "test",
+		err:  errTestRefused,
+	}
+	tr.nextAnnounceFor("test")
+	if err := tr.ReannounceTracker("test"); err != errTestRefused {
+		t.Errorf("reannouncing to a failing tracker gave %v", err)
+	}
+}
+
+func TestReannounceDoneTorrent(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.st.(*testStorage).bf.Set(0)
+	var events []tracker.Event
+	tr.Trackers["test"] = &testTracker{
+		name: "test",
+		onAnnounce: func(req *tracker.Request) {
+			events = append(events, req.Event)
+		},
+	}
+	tr.nextAnnounceFor("test")
+	tr.announceAll(tracker.Completed, []string{"test"})
+	clock := util.NewFakeClock(time.Now().Add(time.Hour))
+	tr.clock = clock
+	for idx := 0; idx < 2; idx++ {
+		if err := tr.ReannounceTracker("test"); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Hour)
+	}
+	if len(events) != 3 || events[1] != tracker.Nop || events[2] != tracker.Nop {
+		t.Errorf("announced %q, expected completed once then no event", events)
+	}
+}
+
+func TestStartedSentOnce(t *testing.T) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	events := make(chan tracker.Event, 8)
+	tr.Trackers["test"] = &testTracker{
+		name:  "test",
+		clock: clock,
+		onAnnounce: func(req *tracker.Request) {
+			events <- req.Event
+		},
+	}
+	expect := func(ev tracker.Event) {
+		select {
+		case got := <-events:
+			if got != ev {
+				t.Fatalf("announced %q, expected %q", got, ev)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("no announce, expected %q", ev)
+		}
+	}
+	tr.StartAnnouncing()
+	expect(tracker.Started)
+	// paused without telling the tracker
+	tr.StopAnnouncing(false)
+	clock.Advance(time.Second * 65)
+	tr.StartAnnouncing()
+	expect(tracker.Nop)
+	// the tracker was told we stopped so it needs started again
+	tr.StopAnnouncing(true)
+	expect(tracker.Stopped)
+	clock.Advance(time.Second * 65)
+	tr.StartAnnouncing()
+	expect(tracker.Started)
+	tr.StopAnnouncing(false)
+}
+
+func TestTrackerExternalIP(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.addr = n.Addr()
+	ext := net.IPv4(203, 0, 113, 7)
+	var addrs []string
+	tr.Trackers["a"] = &testTracker{
+		name:       "a",
+		externalIP: ext,
+		onAnnounce: func(req *tracker.Request) {
+			addrs = append(addrs, req.Addr.String())
+		},
+	}
+	for idx := 0; idx < 2; idx++ {
+		tr.nextAnnounceFor("a")
+		tr.announcers["a"].next = time.Now()
+		tr.announceAll(tracker.Nop, []string{"a"})
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("announced %d times, expected 2", len(addrs))
+	}
+	if addrs[0] != n.Addr().String() {
+		t.Errorf("first announce advertised %s before the tracker told us anything", addrs[0])
+	}
+	if addrs[1] != "203.0.113.7:6881" {
+		t.Errorf("advertised %s after the tracker saw us at %s", addrs[1], ext)
+	}
+	// peers giving us our own external address back are us
+	if !tr.isSelf(&net.TCPAddr{IP: ext, Port: 6881}) {
+		t.Error("our external address is not self")
+	}
+	// a tracker on the other ip family saw us too, trackers get our address on both
+	tr.gotExternalIP(net.ParseIP("2001:db8::7"))
+	req, err := tr.announceRequest(tracker.Nop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Addrs) != 2 || req.Addrs[0].String() != "203.0.113.7:6881" || req.Addrs[1].String() != "[2001:db8::7]:6881" {
+		t.Errorf("announce has addresses %v", req.Addrs)
+	}
+}
+
+func TestRewriteAnnounceURL(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.RewriteAnnounce = func(u *url.URL) *url.URL {
+		u.RawQuery = "passkey=secret"
+		return u
+	}
+	var announced string
+	tr.Trackers["a"] = &testTracker{
+		name: "a",
+		onAnnounce: func(req *tracker.Request) {
+			u, _ := url.Parse("http://tracker.example/announce")
+			if req.RewriteURL != nil {
+				u = req.RewriteURL(u)
+			}
+			announced = u.String()
+		},
+	}
+	tr.nextAnnounceFor("a")
+	tr.announceAll(tracker.Started, []string{"a"})
+	if announced != "http://tracker.example/announce?passkey=secret" {
+		t.Errorf("announced to %q, expected the passkey put in", announced)
+	}
+}
+
+// dht for tests that records what torrents told it
+type testDHT struct {
+	mtx       sync.Mutex
+	announced map[common.Infohash]int
+	nodes     []string
+}
+
+func (d *testDHT) AnnouncePeer(ih common.Infohash, port int) error {
+	d.mtx.Lock()
+	if d.announced == nil {
+		d.announced = make(map[common.Infohash]int)
+	}
+	d.announced[ih] = port
+	d.mtx.Unlock()
+	return nil
+}
+
+func (d *testDHT) AddNode(hostport string) {
+	d.mtx.Lock()
+	d.nodes = append(d.nodes, hostport)
+	d.mtx.Unlock()
+}
+
+func (d *testDHT) portFor(ih common.Infohash) (port int, ok bool) {
+	d.mtx.Lock()
+	port, ok = d.announced[ih]
+	d.mtx.Unlock()
+	return
+}
+
+// run a torrent that has every piece until it is seeding
+func seedTestTorrent(t *testing.T, meta *metainfo.TorrentFile) (*testDHT, common.Infohash) {
+	tr, n := newTestTorrent(meta)
+	defer closeTestTorrent(tr, n)
+	d := new(testDHT)
+	tr.DHT = d
+	for idx := uint32(0); idx < meta.Info.NumPieces(); idx++ {
+		tr.st.(*testStorage).setPiece(idx)
+	}
+	go tr.run()
+	deadline := time.Now().Add(time.Second * 5)
+	for tr.State() != Seeding {
+		if time.Now().After(deadline) {
+			t.Fatal("torrent never started seeding")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return d, tr.Infohash()
+}
+
+func TestSeedAnnouncesToDHT(t *testing.T) {
+	d, ih := seedTestTorrent(t, testMetaInfo(2, BlockSize))
+	deadline := time.Now().Add(time.Second * 5)
+	port, ok := d.portFor(ih)
+	for !ok {
+		if time.Now().After(deadline) {
+			t.Fatal("no dht announce when we started seeding")
+		}
+		time.Sleep(time.Millisecond * 10)
+		port, ok = d.portFor(ih)
+	}
+	if port != 6881 {
+		t.Errorf("announced port %d, expected 6881", port)
+	}
+}
+
+func TestPrivateSeedSkipsDHT(t *testing.T) {
+	meta := testMetaInfo(2, BlockSize)
+	private := uint64(1)
+	meta.Info.Private = &private
+	d, ih := seedTestTorrent(t, meta)
+	// give it time to announce if it was going to
+	time.Sleep(time.Millisecond * 50)
+	if _, ok := d.portFor(ih); ok {
+		t.Error("private torrent was announced to the dht")
+	}
+}
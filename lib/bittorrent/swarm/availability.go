@@ -0,0 +1,108 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/sync"
+	"math/rand"
+)
+
+// counts how many of our peers have each piece so we can pick the rarest ones
+type pieceAvailability struct {
+	mtx    sync.Mutex
+	counts []uint32
+	// breaks ties, nil to use the global source
+	rnd *rand.Rand
+}
+
+// break ties with src from now on, nil to go back to the global source
+func (a *pieceAvailability) setSource(src rand.Source) {
+	a.mtx.Lock()
+	if src == nil {
+		a.rnd = nil
+	} else {
+		a.rnd = rand.New(src)
+	}
+	a.mtx.Unlock()
+}
+
+func (a *pieceAvailability) grow(n uint32) {
+	if uint32(len(a.counts)) < n {
+		counts := make([]uint32, n)
+		copy(counts, a.counts)
+		a.counts = counts
+	}
+}
+
+// a peer told us every piece it has
+func (a *pieceAvailability) addBitfield(bf *bittorrent.Bitfield) {
+	a.mtx.Lock()
+	a.grow(bf.Length)
+	for idx := uint32(0); idx < bf.Length; idx++ {
+		if bf.Has(idx) {
+			a.counts[idx]++
+		}
+	}
+	a.mtx.Unlock()
+}
+
+// a peer went away or replaced its bitfield
+func (a *pieceAvailability) removeBitfield(bf *bittorrent.Bitfield) {
+	a.mtx.Lock()
+	for idx := uint32(0); idx < bf.Length && idx < uint32(len(a.counts)); idx++ {
+		if bf.Has(idx) && a.counts[idx] > 0 {
+			a.counts[idx]--
+		}
+	}
+	a.mtx.Unlock()
+}
+
+// a peer got a new piece
+func (a *pieceAvailability) addHave(idx uint32) {
+	a.mtx.Lock()
+	a.grow(idx + 1)
+	a.counts[idx]++
+	a.mtx.Unlock()
+}
+
+// Count gets how many peers have piece idx
+func (a *pieceAvailability) Count(idx uint32) (n uint32) {
+	a.mtx.Lock()
+	if idx < uint32(len(a.counts)) {
+		n = a.counts[idx]
+	}
+	a.mtx.Unlock()
+	return
+}
+
+// find the piece remote has that the fewest peers have, skipping pieces exclude returns true for
+// ties go to whichever comes first from a random starting point so peers don't all pick the same piece
+func (a *pieceAvailability) rarest(remote *bittorrent.Bitfield, exclude func(uint32) bool) (idx uint32, has bool) {
+	if remote.Length == 0 {
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	min := ^uint32(0)
+	var start uint32
+	if a.rnd == nil {
+		start = rand.Uint32() % remote.Length
+	} else {
+		start = a.rnd.Uint32() % remote.Length
+	}
+	for n := uint32(0); n < remote.Length; n++ {
+		i := (start + n) % remote.Length
+		if !remote.Has(i) || exclude(i) {
+			continue
+		}
+		var count uint32
+		if i < uint32(len(a.counts)) {
+			count = a.counts[i]
+		}
+		if count < min {
+			min = count
+			idx = i
+			has = true
+		}
+	}
+	return
+}
@@ -0,0 +1,101 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// PieceBudget limits how many pieces and how many bytes of them all torrents sharing it download at once
+// once it is used up torrents finish the pieces they have going before starting new ones
+type PieceBudget struct {
+	mtx       sync.Mutex
+	limit     uint64
+	used      uint64
+	maxPieces int
+	pieces    int
+}
+
+// NewPieceBudget makes a budget of limit bytes in at most maxPieces pieces, 0 for no limit on either
+func NewPieceBudget(limit uint64, maxPieces int) *PieceBudget {
+	return &PieceBudget{
+		limit:     limit,
+		maxPieces: maxPieces,
+	}
+}
+
+// Used gets how many bytes of pieces are in progress
+func (b *PieceBudget) Used() (n uint64) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	n = b.used
+	b.mtx.Unlock()
+	return
+}
+
+// Pieces gets how many pieces are in progress
+func (b *PieceBudget) Pieces() (n int) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	n = b.pieces
+	b.mtx.Unlock()
+	return
+}
+
+// are as many pieces in progress as we allow ?
+func (b *PieceBudget) full() bool {
+	if b == nil {
+		return false
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.maxPieces > 0 && b.pieces >= b.maxPieces
+}
+
+// would a piece of n bytes fit ?
+func (b *PieceBudget) fits(n uint64) bool {
+	if b == nil {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.limit == 0 || b.used+n <= b.limit
+}
+
+// take n bytes for a new piece, returns false if they don't fit or there are as many pieces as we allow
+// with always set the bytes are taken anyway so a torrent with nothing going can make progress with a piece bigger than the limit
+func (b *PieceBudget) take(n uint64, always bool) bool {
+	if b == nil {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.maxPieces > 0 && b.pieces >= b.maxPieces {
+		return false
+	}
+	if !always && b.limit > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	b.pieces++
+	return true
+}
+
+// give back n bytes of pieces that are no longer in progress
+func (b *PieceBudget) give(n uint64, pieces int) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	if n > b.used {
+		n = b.used
+	}
+	b.used -= n
+	if pieces > b.pieces {
+		pieces = b.pieces
+	}
+	b.pieces -= pieces
+	b.mtx.Unlock()
+}
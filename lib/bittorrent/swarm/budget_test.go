@@ -0,0 +1,115 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"testing"
+)
+
+func TestPieceBudgetBoundsPieces(t *testing.T) {
+	const pieceLen = BlockSize * 4
+	budget := NewPieceBudget(pieceLen*3, 0)
+	var torrents []*Torrent
+	for idx := 0; idx < 2; idx++ {
+		tr, n := newTestTorrent(testMetaInfo(10, pieceLen))
+		defer closeTestTorrent(tr, n)
+		tr.SetMaxInProgressPieces(0)
+		tr.SetPieceBudget(budget)
+		torrents = append(torrents, tr)
+	}
+	remote := bittorrent.NewBitfield(10, nil)
+	for idx := uint32(0); idx < 10; idx++ {
+		remote.Set(idx)
+	}
+
+	requests := 0
+	for round := 0; round < 20; round++ {
+		for _, tr := range torrents {
+			if tr.pt.NextRequest(remote, nil) != nil {
+				requests++
+			}
+		}
+		pieces := torrents[0].pt.NumPending() + torrents[1].pt.NumPending()
+		if pieces > 3 {
+			t.Fatalf("%d pieces in progress with a budget of 3", pieces)
+		}
+		if used := budget.Used(); used > pieceLen*3 {
+			t.Fatalf("%d bytes of pieces in progress with a budget of %d", used, pieceLen*3)
+		}
+	}
+	// every block of the pieces in progress got asked for instead of starting more
+	if requests != 3*4 {
+		t.Errorf("made %d requests, expected %d", requests, 3*4)
+	}
+
+	// finishing a piece lets a new one start
+	done := torrents[0].pt.PendingPieces()[0]
+	torrents[0].pt.removePiece(done)
+	if torrents[1].pt.NextRequest(remote, nil) == nil {
+		t.Error("no new piece started after one finished")
+	}
+	if used := budget.Used(); used != pieceLen*3 {
+		t.Errorf("%d bytes of pieces in progress, expected %d", used, pieceLen*3)
+	}
+}
+
+func TestPieceBudgetFreedOnClose(t *testing.T) {
+	const pieceLen = BlockSize * 4
+	budget := NewPieceBudget(pieceLen*3, 0)
+	tr, n := newTestTorrent(testMetaInfo(10, pieceLen))
+	defer closeTestTorrent(tr, n)
+	tr.SetMaxInProgressPieces(0)
+	tr.SetPieceBudget(budget)
+	remote := bittorrent.NewBitfield(10, nil)
+	for idx := uint32(0); idx < 10; idx++ {
+		remote.Set(idx)
+	}
+	// ask for blocks until the whole budget is in progress
+	for tr.pt.NextRequest(remote, nil) != nil {
+	}
+	if used := budget.Used(); used != pieceLen*3 {
+		t.Fatalf("%d bytes of pieces in progress, expected %d", used, pieceLen*3)
+	}
+	tr.Close()
+	if used := budget.Used(); used != 0 {
+		t.Errorf("%d bytes of pieces still in progress after close", used)
+	}
+	if pieces := tr.pt.NumPending(); pieces != 0 {
+		t.Errorf("%d pieces still in progress after close", pieces)
+	}
+	if pieces := budget.Pieces(); pieces != 0 {
+		t.Errorf("budget counts %d pieces in progress after close", pieces)
+	}
+}
+
+func TestPieceBudgetMaxPieces(t *testing.T) {
+	budget := NewPieceBudget(0, 2)
+	var torrents []*Torrent
+	for idx := 0; idx < 2; idx++ {
+		tr, n := newTestTorrent(testMetaInfo(10, BlockSize*4))
+		defer closeTestTorrent(tr, n)
+		tr.SetPieceBudget(budget)
+		torrents = append(torrents, tr)
+	}
+	remote := bittorrent.NewBitfield(10, nil)
+	for idx := uint32(0); idx < 10; idx++ {
+		remote.Set(idx)
+	}
+	for round := 0; round < 20; round++ {
+		for _, tr := range torrents {
+			tr.pt.NextRequest(remote, nil)
+		}
+		if pieces := torrents[0].pt.NumPending() + torrents[1].pt.NumPending(); pieces > 2 {
+			t.Fatalf("%d pieces in progress across torrents with a cap of 2", pieces)
+		}
+	}
+	if pieces := budget.Pieces(); pieces != 2 {
+		t.Fatalf("budget counts %d pieces in progress, expected 2", pieces)
+	}
+	torrents[0].pt.removePiece(torrents[0].pt.PendingPieces()[0])
+	if torrents[1].pt.NextRequest(remote, nil) == nil {
+		t.Error("no new piece started after one finished")
+	}
+	if pieces := budget.Pieces(); pieces != 2 {
+		t.Errorf("budget counts %d pieces in progress, expected 2", pieces)
+	}
+}
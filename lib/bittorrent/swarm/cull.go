@@ -0,0 +1,91 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/log"
+	"time"
+)
+
+// how long a connection gets to prove itself before it can be culled
+const CullGracePeriod = time.Second * 30
+
+// a peer that wants to trade or isn't choking us counts as this many bytes per second each
+const CullPeerBonus = 16 * 1024
+
+// what a peer we know nothing about yet is worth
+const NewPeerValue = CullPeerBonus
+
+// DefaultPeerIdleTimeout is how long a peer can go sending us nothing but keepalives before we close it
+const DefaultPeerIdleTimeout = time.Minute * 5
+
+// DefaultRequestTimeout is how long a peer can leave all our requests unanswered before we ask others for those blocks
+const DefaultRequestTimeout = time.Minute
+
+// how much a peer is worth keeping connected, higher is better
+func (c *PeerConn) value() (v float64) {
+	v = c.rx.Rate() + c.tx.Rate()
+	c.access.Lock()
+	interested := c.usInterested || c.peerInterested
+	unchoked := !c.peerChoke
+	c.access.Unlock()
+	if interested {
+		v += CullPeerBonus
+	}
+	if unchoked {
+		v += CullPeerBonus
+	}
+	return
+}
+
+// close the least valuable peer connected for longer than CullGracePeriod if it is worth less than v
+// returns true if a peer was closed to make room
+func (t *Torrent) cullWorstPeer(v float64) bool {
+	now := t.clock.Now()
+	var worst *PeerConn
+	var worstValue float64
+	t.VisitPeers(func(c *PeerConn) {
+		if c.isClosing() || now.Sub(c.connectedAt) < CullGracePeriod {
+			return
+		}
+		cv := c.value()
+		if worst == nil || cv < worstValue {
+			worst = c
+			worstValue = cv
+		}
+	})
+	if worst == nil || worstValue >= v {
+		return false
+	}
+	log.Debugf("culling %s from %s to make room for a new peer", worst.id.String(), t.Name())
+	worst.Close()
+	return true
+}
+
+// close peers that sent us nothing useful for PeerIdleTimeout, keepalives alone don't keep a connection open
+func (t *Torrent) closeIdlePeers(now time.Time) {
+	t.VisitPeers(func(c *PeerConn) {
+		last := c.lastActiveAt()
+		if last.Before(c.connectedAt) {
+			last = c.connectedAt
+		}
+		if !c.isClosing() && t.PeerIdleTimeout > 0 && now.Sub(last) >= t.PeerIdleTimeout {
+			log.Debugf("%s sent nothing but keepalives for %s, closing", c.id.String(), now.Sub(last))
+			c.Close()
+		}
+	})
+}
+
+// take back the requests of peers that answered none of them for RequestTimeout so other peers get asked
+// the connection stays open, it is only asked for more once it had time to catch up
+func (t *Torrent) snubStalledPeers(now time.Time) {
+	if t.RequestTimeout <= 0 {
+		return
+	}
+	t.VisitPeers(func(c *PeerConn) {
+		if c.isClosing() || !c.requestsStalled(now, t.RequestTimeout) {
+			return
+		}
+		log.Debugf("%s answered none of our requests for %s, asking others", c.id.String(), t.RequestTimeout)
+		c.cancelPendingDownloads()
+		c.holdRequestsUntil(now.Add(t.RequestTimeout))
+	})
+}
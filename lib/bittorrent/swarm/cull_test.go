@@ -0,0 +1,196 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/util"
+	"net"
+	"testing"
+	"time"
+)
+
+// make a peer connection from 10.0.0.n
+func testPeerFrom(tr *Torrent, n byte) *PeerConn {
+	local, _ := net.Pipe()
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, n), Port: 6881}
+	return makePeerConn(addrConn{local, a}, tr, common.GeneratePeerID(), extensions.Message{})
+}
+
+// add a peer connected long enough ago that it can be culled
+func addOldTestPeer(tr *Torrent, n byte) *PeerConn {
+	c := testPeerFrom(tr, n)
+	c.connectedAt = time.Now().Add(-CullGracePeriod * 2)
+	tr.addOBPeer(c)
+	return c
+}
+
+func TestCullWorstPeerWhenFull(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.MaxPeers = 2
+
+	fast := addOldTestPeer(tr, 1)
+	fast.rx.Add(1024 * 1024)
+	useful := addOldTestPeer(tr, 2)
+	useful.peerChoke = false
+	// choking us, nothing to trade and no traffic
+	worst := addOldTestPeer(tr, 3)
+	worst.usInterested = false
+	if tr.NeedsPeers() {
+		t.Fatal("torrent not full")
+	}
+
+	c := testPeerFrom(tr, 4)
+	tr.onNewPeer(c)
+	if c.closing || !tr.HasIBConn(c.c.RemoteAddr()) {
+		t.Error("new peer rejected")
+	}
+	if !worst.closing {
+		t.Error("worst peer not culled")
+	}
+	if fast.closing || useful.closing {
+		t.Error("a good peer was culled")
+	}
+}
+
+func TestCullSparesNewConnections(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.MaxPeers = 1
+	young := testPeerFrom(tr, 1)
+	young.usInterested = false
+	tr.addOBPeer(young)
+	old := addOldTestPeer(tr, 2)
+	old.peerChoke = false
+	if tr.NeedsPeers() {
+		t.Fatal("torrent not full")
+	}
+
+	c := testPeerFrom(tr, 3)
+	tr.onNewPeer(c)
+	if !c.closing {
+		t.Error("new peer accepted with no peer worth culling")
+	}
+	if young.closing || old.closing {
+		t.Error("peer culled that should have been kept")
+	}
+}
+
+func TestKeepAliveOnlyPeerClosed(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	quiet := testPeerFrom(tr, 1)
+	tr.addOBPeer(quiet)
+	chatty := testPeerFrom(tr, 2)
+	tr.addOBPeer(chatty)
+	// peers tick on the real clock, nothing reads their tickers here
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	quiet.connectedAt = clock.Now()
+	chatty.connectedAt = clock.Now()
+	for elapsed := time.Duration(0); elapsed < DefaultPeerIdleTimeout; elapsed += time.Minute {
+		clock.Advance(time.Minute)
+		for idx := 0; idx < 100; idx++ {
+			quiet.recv(common.KeepAlive)
+		}
+		chatty.recv(common.NewHave(uint32(elapsed / time.Minute % 4)))
+		tr.closeIdlePeers(clock.Now())
+		if elapsed+time.Minute < DefaultPeerIdleTimeout && quiet.closing {
+			t.Fatalf("peer closed after %s of keepalives", elapsed+time.Minute)
+		}
+	}
+	if !quiet.closing {
+		t.Error("peer sending only keepalives was not closed")
+	}
+	if chatty.closing {
+		t.Error("active peer was closed")
+	}
+}
+
+// ask c for the next block it has
+func requestFrom(t *testing.T, c *PeerConn) *common.PieceRequest {
+	r := c.t.pt.NextRequest(c.bf, nil)
+	if r == nil {
+		t.Fatal("nothing to request")
+	}
+	c.queueDownload(r)
+	return r
+}
+
+func TestRequestTimeoutTakesBackRequests(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	all := bittorrent.NewBitfield(4, nil)
+	for idx := uint32(0); idx < 4; idx++ {
+		all.Set(idx)
+	}
+	stalled := addOldTestPeer(tr, 1)
+	answering := addOldTestPeer(tr, 2)
+	stalled.bf = all
+	answering.bf = all
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	tr.PeerIdleTimeout = time.Hour
+	tr.RequestTimeout = time.Minute
+	requestFrom(t, stalled)
+	r := requestFrom(t, answering)
+
+	clock.Advance(time.Second * 30)
+	answering.gotDownload(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: make([]byte, r.Length)})
+	requestFrom(t, answering)
+	for elapsed := time.Second * 40; elapsed <= time.Minute; elapsed += time.Second * 10 {
+		clock.Advance(time.Second * 10)
+		stalled.recv(common.NewHave(0))
+		tr.closeIdlePeers(clock.Now())
+		tr.snubStalledPeers(clock.Now())
+		if elapsed < time.Minute && stalled.numDownloading() == 0 {
+			t.Fatalf("requests taken back after %s", elapsed)
+		}
+	}
+	if stalled.numDownloading() != 0 {
+		t.Error("requests of a peer that answered none were kept")
+	}
+	if stalled.mayRequestAt(clock.Now()) || !stalled.mayRequestAt(clock.Now().Add(tr.RequestTimeout+time.Second)) {
+		t.Error("stalled peer not held back for RequestTimeout on the torrent clock")
+	}
+	if answering.numDownloading() != 1 {
+		t.Error("requests of a peer that is answering were taken back")
+	}
+	if stalled.closing || answering.closing {
+		t.Error("peer closed by the request timeout")
+	}
+}
+
+func TestPeerIdleTimeoutKeepsRequests(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	all := bittorrent.NewBitfield(4, nil)
+	for idx := uint32(0); idx < 4; idx++ {
+		all.Set(idx)
+	}
+	quiet := addOldTestPeer(tr, 1)
+	quiet.bf = all
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	quiet.connectedAt = clock.Now()
+	tr.PeerIdleTimeout = time.Minute
+	tr.RequestTimeout = time.Hour
+	requestFrom(t, quiet)
+	clock.Advance(time.Second * 59)
+	tr.closeIdlePeers(clock.Now())
+	tr.snubStalledPeers(clock.Now())
+	if quiet.closing || quiet.numDownloading() != 1 {
+		t.Fatal("acted on the peer before either timeout")
+	}
+	clock.Advance(time.Second)
+	quiet.recv(common.KeepAlive)
+	tr.closeIdlePeers(clock.Now())
+	tr.snubStalledPeers(clock.Now())
+	if !quiet.closing {
+		t.Error("idle peer was not closed")
+	}
+	if quiet.numDownloading() != 1 {
+		t.Error("idle timeout took back requests before the request timeout")
+	}
+}
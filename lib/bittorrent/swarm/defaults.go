@@ -6,3 +6,6 @@ import "github.com/majestrate/XD/lib/bittorrent/extensions"
 
 const DefaultMaxParallelRequests = 4
 const DefaultPEXDialect = extensions.I2PPeerExchange
+
+// peers on private ranges are no use on the internet
+const DefaultAllowLANPeers = false
@@ -6,3 +6,6 @@ import "github.com/majestrate/XD/lib/bittorrent/extensions"
 
 const DefaultMaxParallelRequests = 48
 const DefaultPEXDialect = extensions.LokinetPeerExchange
+
+// lokinet hands out addresses on private ranges
+const DefaultAllowLANPeers = true
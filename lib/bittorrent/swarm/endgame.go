@@ -0,0 +1,139 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"sort"
+)
+
+// EndgameDuplicates is how many peers we ask for the same block at most in endgame
+const EndgameDuplicates = 2
+
+// blocks of this piece we asked for but don't have yet
+func (p *cachedPiece) pendingRequests() (reqs []*common.PieceRequest) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for begin := uint32(0); begin < p.length; begin += BlockSize {
+		idx := p.bitfieldIndex(begin)
+		if !p.pending.Has(idx) || p.obtained.Has(idx) {
+			continue
+		}
+		l := uint32(BlockSize)
+		if begin+l > p.length {
+			l = p.length - begin
+		}
+		reqs = append(reqs, &common.PieceRequest{
+			Index:  p.index,
+			Begin:  begin,
+			Length: l,
+		})
+	}
+	return
+}
+
+// does this piece have blocks nobody was asked for yet ?
+func (p *cachedPiece) hasFreeBlocks() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for begin := uint32(0); begin < p.length; begin += BlockSize {
+		idx := p.bitfieldIndex(begin)
+		if !p.pending.Has(idx) && !p.obtained.Has(idx) {
+			return true
+		}
+	}
+	return false
+}
+
+// are we in endgame ? that is every block we still need was asked for already
+func (pt *pieceTracker) inEndgame() bool {
+	bf := pt.st.Bitfield()
+	missing := int(bf.Length) - bf.CountSet()
+	if missing == 0 {
+		return false
+	}
+	pt.mtx.Lock()
+	inProgress := len(pt.requests)
+	pt.mtx.Unlock()
+	if inProgress < missing {
+		return false
+	}
+	free := false
+	for _, idx := range pt.PendingPieces() {
+		pt.visitInProgress(idx, func(cp *cachedPiece) {
+			free = free || cp.hasFreeBlocks()
+		})
+	}
+	return !free
+}
+
+// get the blocks left to get that remote has
+func (pt *pieceTracker) endgameRequests(remote *bittorrent.Bitfield) (reqs []*common.PieceRequest) {
+	if remote == nil {
+		return
+	}
+	for _, idx := range pt.PendingPieces() {
+		if remote.Has(idx) {
+			pt.visitInProgress(idx, func(cp *cachedPiece) {
+				reqs = append(reqs, cp.pendingRequests()...)
+			})
+		}
+	}
+	return
+}
+
+// return true if we asked this peer for r
+func (c *PeerConn) isDownloading(r *common.PieceRequest) (has bool) {
+	c.access.Lock()
+	for _, req := range c.downloading {
+		if req.Equals(r) {
+			has = true
+			break
+		}
+	}
+	c.access.Unlock()
+	return
+}
+
+// get our peers fastest first
+func (t *Torrent) peersByRate() (peers []*PeerConn) {
+	t.VisitPeers(func(c *PeerConn) {
+		peers = append(peers, c)
+	})
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].rx.Rate() > peers[j].rx.Rate()
+	})
+	return
+}
+
+// count how many peers we asked for r
+func (t *Torrent) numRequesting(r *common.PieceRequest) (n int) {
+	t.VisitPeers(func(c *PeerConn) {
+		if c.isDownloading(r) {
+			n++
+		}
+	})
+	return
+}
+
+// ask more peers for the last blocks, peers come fastest first so when the fast one delivers the slower duplicates get a cancel
+func (t *Torrent) tickEndgame(peers []*PeerConn) {
+	if !t.pt.inEndgame() {
+		return
+	}
+	for _, c := range peers {
+		if !c.runDownload || c.isClosing() || c.RemoteChoking() || !c.isUsInterested() {
+			continue
+		}
+		for _, r := range t.pt.endgameRequests(c.bf) {
+			if c.numDownloading() >= c.maxRequests() {
+				break
+			}
+			if c.isDownloading(r) || !c.canTakePiece(r.Index) || t.numRequesting(r) >= EndgameDuplicates {
+				continue
+			}
+			log.Debugf("endgame: ask %s for %d %d too", c.id.String(), r.Index, r.Begin)
+			c.queueDownload(r)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/common"
+	"testing"
+)
+
+func TestEndgameAsksFastestFirst(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	slowest := unchokedTestSeed(tr, 1)
+	slow := unchokedTestSeed(tr, 2)
+	slow.rx.Add(1024)
+	fast := unchokedTestSeed(tr, 3)
+	fast.rx.Add(1024 * 1024)
+
+	tr.tick()
+	r := &common.PieceRequest{Index: 0, Begin: 0, Length: BlockSize}
+	if !fast.isDownloading(r) {
+		t.Fatal("fastest peer not asked for the last block")
+	}
+	if !slow.isDownloading(r) {
+		t.Fatal("no backup asked for the last block")
+	}
+	if slowest.isDownloading(r) {
+		t.Errorf("last block asked from more than %d peers", EndgameDuplicates)
+	}
+	// drain what was sent so far
+	for len(slow.send) > 0 {
+		<-slow.send
+	}
+
+	fast.gotDownload(&common.PieceData{Index: 0, Begin: 0, Data: make([]byte, BlockSize)})
+	if slow.isDownloading(r) {
+		t.Error("slow duplicate still pending after the fast peer delivered")
+	}
+	canceled := false
+	for len(slow.send) > 0 {
+		msg := <-slow.send
+		canceled = canceled || msg.MessageID() == common.Cancel
+	}
+	if !canceled {
+		t.Error("slow peer did not get a cancel for the duplicate")
+	}
+}
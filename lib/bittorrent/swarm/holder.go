@@ -5,6 +5,7 @@ import (
 	"github.com/majestrate/XD/lib/network"
 	"github.com/majestrate/XD/lib/storage"
 	"github.com/majestrate/XD/lib/sync"
+	"time"
 )
 
 // torrent swarm container
@@ -15,6 +16,31 @@ type Holder struct {
 	torrentsByID sync.Map
 	MaxReq       int
 	QueueSize    int
+	RateWindow   time.Duration
+	NoPeerID     bool
+	MaxPieces    int
+	SendQueue    int
+	SendBuffer   int
+	NoDelay      bool
+	IdleSeed     time.Duration
+	UploadSlots  int
+	PieceBudget  *PieceBudget
+	NetPool      *NetPool
+	Queue        *DownloadQueue
+	LazyBitfield bool
+	LeechOnly    bool
+	FirstLast    bool
+	Quota        uint64
+	LANPeers     bool
+	PeerIdle     time.Duration
+	RequestWait  time.Duration
+	ResumeFlush  time.Duration
+	StopWhenDone bool
+	TraceMsgs    bool
+	RandBlocks   bool
+	BgVerify     bool
+	LargeBlock   uint32
+	LargeRate    uint64
 }
 
 func (h *Holder) TorrentIDs() (ids map[int64]string) {
@@ -39,6 +65,45 @@ func (h *Holder) addTorrent(t storage.Torrent, getNet func() network.Network) {
 	}
 	tr := newTorrent(t, getNet)
 	tr.MaxRequests = h.MaxReq
+	if h.RateWindow > 0 {
+		tr.SetRateWindow(h.RateWindow)
+	}
+	tr.NoPeerID = h.NoPeerID
+	if h.MaxPieces != 0 {
+		tr.SetMaxInProgressPieces(h.MaxPieces)
+	}
+	if h.SendQueue > 0 {
+		tr.SendQueueSize = h.SendQueue
+	}
+	tr.SendBufferSize = h.SendBuffer
+	tr.NoDelay = h.NoDelay
+	tr.IdleSeedTimeout = h.IdleSeed
+	tr.MaxUploadSlots = h.UploadSlots
+	tr.SetPieceBudget(h.PieceBudget)
+	tr.NetPool = h.NetPool
+	tr.Queue = h.Queue
+	tr.LazyBitfield = h.LazyBitfield
+	tr.LeechOnly = h.LeechOnly
+	tr.FirstLastPieces = h.FirstLast
+	tr.DownloadQuota = h.Quota
+	tr.AllowLANPeers = h.LANPeers
+	tr.StopWhenDone = h.StopWhenDone
+	tr.TraceMessages = h.TraceMsgs
+	tr.SetRandomBlocks(h.RandBlocks)
+	tr.SetBackgroundVerify(h.BgVerify)
+	tr.LargeBlockSize = h.LargeBlock
+	if h.LargeRate > 0 {
+		tr.LargeBlockRate = h.LargeRate
+	}
+	if h.PeerIdle > 0 {
+		tr.PeerIdleTimeout = h.PeerIdle
+	}
+	if h.RequestWait > 0 {
+		tr.RequestTimeout = h.RequestWait
+	}
+	if h.ResumeFlush > 0 {
+		tr.ResumeFlushInterval = h.ResumeFlush
+	}
 	h.torrents.Store(t.Infohash().Hex(), tr)
 	h.torrentsByID.Store(tr.TID, tr)
 }
@@ -49,6 +114,45 @@ func (h *Holder) addMagnet(ih common.Infohash, getNet func() network.Network) {
 	}
 	tr := newTorrent(h.st.EmptyTorrent(ih), getNet)
 	tr.MaxRequests = h.MaxReq
+	if h.RateWindow > 0 {
+		tr.SetRateWindow(h.RateWindow)
+	}
+	tr.NoPeerID = h.NoPeerID
+	if h.MaxPieces != 0 {
+		tr.SetMaxInProgressPieces(h.MaxPieces)
+	}
+	if h.SendQueue > 0 {
+		tr.SendQueueSize = h.SendQueue
+	}
+	tr.SendBufferSize = h.SendBuffer
+	tr.NoDelay = h.NoDelay
+	tr.IdleSeedTimeout = h.IdleSeed
+	tr.MaxUploadSlots = h.UploadSlots
+	tr.SetPieceBudget(h.PieceBudget)
+	tr.NetPool = h.NetPool
+	tr.Queue = h.Queue
+	tr.LazyBitfield = h.LazyBitfield
+	tr.LeechOnly = h.LeechOnly
+	tr.FirstLastPieces = h.FirstLast
+	tr.DownloadQuota = h.Quota
+	tr.AllowLANPeers = h.LANPeers
+	tr.StopWhenDone = h.StopWhenDone
+	tr.TraceMessages = h.TraceMsgs
+	tr.SetRandomBlocks(h.RandBlocks)
+	tr.SetBackgroundVerify(h.BgVerify)
+	tr.LargeBlockSize = h.LargeBlock
+	if h.LargeRate > 0 {
+		tr.LargeBlockRate = h.LargeRate
+	}
+	if h.PeerIdle > 0 {
+		tr.PeerIdleTimeout = h.PeerIdle
+	}
+	if h.RequestWait > 0 {
+		tr.RequestTimeout = h.RequestWait
+	}
+	if h.ResumeFlush > 0 {
+		tr.ResumeFlushInterval = h.ResumeFlush
+	}
 	h.torrents.Store(ih.Hex(), tr)
 	h.torrentsByID.Store(tr.TID, tr)
 }
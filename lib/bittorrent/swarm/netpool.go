@@ -0,0 +1,83 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// DefaultNetWorkers is how many announces and dials all torrents do at once by default
+const DefaultNetWorkers = 64
+
+// NetPool limits how many announces and dials all torrents sharing it do at once
+// the rest wait their turn
+type NetPool struct {
+	slots   chan struct{}
+	mtx     sync.Mutex
+	queued  int
+	running int
+}
+
+// NewNetPool makes a pool that does n network operations at once, 0 for no limit
+func NewNetPool(n int) *NetPool {
+	p := new(NetPool)
+	if n > 0 {
+		p.slots = make(chan struct{}, n)
+	}
+	return p
+}
+
+// Size gets how many operations run at once, 0 for no limit
+func (p *NetPool) Size() int {
+	if p == nil {
+		return 0
+	}
+	return cap(p.slots)
+}
+
+// Queued gets how many operations are waiting for their turn
+func (p *NetPool) Queued() (n int) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	n = p.queued
+	p.mtx.Unlock()
+	return
+}
+
+// Running gets how many operations are going right now
+func (p *NetPool) Running() (n int) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	n = p.running
+	p.mtx.Unlock()
+	return
+}
+
+// Do runs fn once there is room, blocks until it is done
+func (p *NetPool) Do(fn func()) {
+	if p == nil {
+		fn()
+		return
+	}
+	p.mtx.Lock()
+	p.queued++
+	p.mtx.Unlock()
+	if p.slots != nil {
+		p.slots <- struct{}{}
+	}
+	p.mtx.Lock()
+	p.queued--
+	p.running++
+	p.mtx.Unlock()
+	defer func() {
+		p.mtx.Lock()
+		p.running--
+		p.mtx.Unlock()
+		if p.slots != nil {
+			<-p.slots
+		}
+	}()
+	fn()
+}
@@ -0,0 +1,61 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/sync"
+	"testing"
+	"time"
+)
+
+func TestNetPoolBoundsOperations(t *testing.T) {
+	const size = 3
+	p := NewNetPool(size)
+	var mtx sync.Mutex
+	going := 0
+	most := 0
+	mostQueued := 0
+	var wg sync.WaitGroup
+	for idx := 0; idx < 20; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Do(func() {
+				mtx.Lock()
+				going++
+				if going > most {
+					most = going
+				}
+				if q := p.Queued(); q > mostQueued {
+					mostQueued = q
+				}
+				if r := p.Running(); r > size {
+					t.Errorf("pool says %d operations are running with a size of %d", r, size)
+				}
+				mtx.Unlock()
+				time.Sleep(time.Millisecond * 5)
+				mtx.Lock()
+				going--
+				mtx.Unlock()
+			})
+		}()
+	}
+	wg.Wait()
+	if most > size {
+		t.Errorf("%d operations at once with a pool of %d", most, size)
+	}
+	if most == 0 {
+		t.Error("nothing ran")
+	}
+	if mostQueued == 0 {
+		t.Error("queue depth never went up")
+	}
+	if q, r := p.Queued(), p.Running(); q != 0 || r != 0 {
+		t.Errorf("%d queued and %d running once everything is done", q, r)
+	}
+	// no pool is no limit
+	var none *NetPool
+	ran := false
+	none.Do(func() { ran = true })
+	if !ran {
+		t.Error("nil pool did not run the operation")
+	}
+}
@@ -13,6 +13,25 @@ import (
 	"time"
 )
 
+// how long we wait to send our last messages when closing a connection
+const CloseWriteTimeout = time.Second * 5
+
+// how many messages we queue to send to a peer by default
+const DefaultSendQueueSize = 128
+
+// DefaultSendBufferSize is how many bytes of small messages we hold on to so they go out to a peer in one write
+const DefaultSendBufferSize = 1000
+
+// DefaultNoDelay is if we turn off nagle on peer connections by default
+const DefaultNoDelay = true
+
+// ChokeFlapWindow is how long we remember a peer choking or unchoking us
+const ChokeFlapWindow = time.Second * 10
+
+// MaxChokeToggles is how many times a peer can choke or unchoke us in ChokeFlapWindow
+// past that we stay choked until it leaves us unchoked for a whole window
+const MaxChokeToggles = 4
+
 // a peer connection
 type PeerConn struct {
 	writeBuff           util.Buffer
@@ -31,9 +50,9 @@ type PeerConn struct {
 	sentInterested      bool
 	Done                func()
 	lastSend            time.Time
-	tx                  *util.Rate
+	tx                  *util.RateMeter
 	lastRecv            time.Time
-	rx                  *util.Rate
+	rx                  *util.RateMeter
 	downloading         []*common.PieceRequest
 	lastRequest         *common.PieceRequest
 	ourOpts             extensions.Message
@@ -41,12 +60,35 @@ type PeerConn struct {
 	MaxParalellRequests int
 	access              sync.Mutex
 	close               chan bool
-	ticker              *time.Ticker
-	tickstats           bool
+	ticker              util.Ticker
 	closing             bool
+	broken              bool
+	droppedRequests     uint64
 	uploading           bool
 	runDownload         bool
 	nextPieceRequest    time.Time
+	connectedAt         time.Time
+	slotChoked          bool
+	queuedUploads       int
+	// requests waiting to be read off the disk
+	reads   []*common.PieceRequest
+	reading bool
+	// a request taken off reads is being read and queued to send
+	serving bool
+	// gets a value when a piece we queued for this peer was written out
+	uploadSent chan bool
+	// what the peer last told us, peerChoke stays set while it flaps
+	theirChoke   bool
+	chokeToggles []time.Time
+	flapUntil    time.Time
+	// last time the peer sent anything but a keepalive
+	lastActive time.Time
+	// last time the peer sent a block we asked for or when we started waiting on one
+	lastPiece time.Time
+	// log every message to and from the peer
+	trace bool
+	// metadata slices we asked this peer for and did not get yet
+	metaRequests []uint32
 }
 
 func (c *PeerConn) Bitfield() *bittorrent.Bitfield {
@@ -59,18 +101,27 @@ func (c *PeerConn) Bitfield() *bittorrent.Bitfield {
 // get stats for this connection
 func (c *PeerConn) Stats() (st *PeerConnStats) {
 	st = &PeerConnStats{}
-	st.TX = c.tx.Mean()
-	st.RX = c.rx.Mean()
+	st.TX = c.tx.Rate()
+	st.RX = c.rx.Rate()
 	st.Addr = c.c.RemoteAddr().String()
+	if _, port, err := net.SplitHostPort(st.Addr); err == nil {
+		st.Port, _ = strconv.Atoi(port)
+	}
+	st.ClientVersion = c.theirOpts.Version
 	st.ID = c.id.String()
-	st.UsInterested = c.usInterested
-	st.ThemInterested = c.peerInterested
-	st.UsChoking = c.usChoke
-	st.ThemChoking = c.peerChoke
+	st.UsInterested = c.isUsInterested()
+	st.ThemInterested = c.isPeerInterested()
+	st.UsChoking = c.Chocking()
+	st.ThemChoking = c.RemoteChoking()
 	st.Client = util.ClientNameFromID(c.id[:])
 	st.Downloading = c.numDownloading() > 0
 	st.Inbound = c.inbound
 	st.Uploading = c.uploading
+	st.Dropped = c.DroppedRequests()
+	if info, ok := c.t.peerGeoIP(c.c.RemoteAddr()); ok {
+		st.Country = info.Country
+		st.ASN = info.ASN
+	}
 	if c.bf != nil {
 		st.Bitfield.CopyFrom(c.bf)
 	}
@@ -79,27 +130,39 @@ func (c *PeerConn) Stats() (st *PeerConnStats) {
 
 func makePeerConn(c net.Conn, t *Torrent, id common.PeerID, ourOpts extensions.Message) *PeerConn {
 	p := t.getNextPeer()
+	if nd, ok := c.(interface{ SetNoDelay(bool) error }); ok {
+		nd.SetNoDelay(t.NoDelay)
+	}
 	p.c = c
 	p.t = t
-	p.tx = util.NewRate(10)
-	p.rx = util.NewRate(10)
-	p.ticker = time.NewTicker(time.Millisecond * 500)
+	p.tx = util.NewRateMeter(t.RateWindow)
+	p.rx = util.NewRateMeter(t.RateWindow)
+	p.ticker = t.clock.NewTicker(time.Millisecond * 500)
 	p.ourOpts = ourOpts
 	p.peerChoke = true
+	p.theirChoke = true
 	p.usChoke = true
 	p.usInterested = true
 	copy(p.id[:], id[:])
 	p.MaxParalellRequests = t.MaxRequests
+	p.trace = t.TraceMessages
 	p.downloading = []*common.PieceRequest{}
-	p.send = make(chan common.WireMessage, 128)
+	p.send = make(chan common.WireMessage, t.SendQueueSize)
+	p.uploadSent = make(chan bool, 1)
+	// we hold on to as many requests as fit in the send queue, tell them so they don't ask for more
+	p.ourOpts.RequestQueue = t.SendQueueSize
+	p.close = make(chan bool, 1)
+	p.closing = false
+	p.broken = false
+	p.droppedRequests = 0
+	p.connectedAt = t.clock.Now()
 	return p
 }
 
 func (c *PeerConn) appendSend(msg common.WireMessage) {
-	if c.writeBuff.Len() > 1000 {
+	if c.writeBuff.Len() > c.t.SendBufferSize {
 		if c.flushSend() != nil {
-			c.closing = true
-			c.doClose()
+			c.writeFailed()
 			return
 		}
 	}
@@ -109,17 +172,11 @@ func (c *PeerConn) appendSend(msg common.WireMessage) {
 func (c *PeerConn) run() {
 	for {
 		select {
-		case <-c.ticker.C:
+		case <-c.ticker.Chan():
 			if c.flushSend() != nil {
-				c.closing = true
-				c.doClose()
+				c.writeFailed()
 				continue
 			}
-			if c.tickstats {
-				c.tx.Tick()
-				c.rx.Tick()
-			}
-			c.tickstats = !c.tickstats
 		case <-c.close:
 			c.doClose()
 			return
@@ -127,22 +184,24 @@ func (c *PeerConn) run() {
 			if msg == nil {
 				continue
 			}
-			if msg.Len() > 1000 {
+			if int(msg.Len()) > c.t.SendBufferSize {
 				if c.flushSend() == nil {
 					// write big messages right away
 					if c.processWrite(c.c, msg) != nil {
-						c.closing = true
-						c.doClose()
+						c.writeFailed()
 						continue
 					}
 				} else {
-					c.closing = true
-					c.doClose()
+					c.writeFailed()
 					continue
 				}
 			} else {
 				c.appendSend(msg)
 			}
+			// nothing else queued, send what we have now instead of on the next tick
+			if len(c.send) == 0 && c.flushSend() != nil {
+				c.writeFailed()
+			}
 		}
 	}
 }
@@ -166,9 +225,18 @@ func (c *PeerConn) btPeer() (p common.Peer) {
 	return
 }
 
+// log a message going to or coming from the peer, only called with trace set so it costs nothing otherwise
+func (c *PeerConn) traceMessage(dir string, msg common.WireMessage) {
+	name := "KeepAlive"
+	if !msg.KeepAlive() {
+		name = msg.MessageID().String()
+	}
+	log.Infof("trace %s %s %s %d bytes", c.id.String(), dir, name, msg.Len())
+}
+
 func (c *PeerConn) processWrite(w io.Writer, msg common.WireMessage) (err error) {
 	if msg != nil {
-		now := time.Now()
+		now := c.t.clock.Now()
 		c.lastSend = now
 		if c.RemoteChoking() && msg.MessageID() == common.Request {
 			// drop
@@ -177,11 +245,22 @@ func (c *PeerConn) processWrite(w io.Writer, msg common.WireMessage) (err error)
 			return
 		}
 		log.Debugf("writing %d bytes", msg.Len())
+		if c.trace {
+			c.traceMessage("->", msg)
+		}
+		if msg.MessageID() == common.Piece {
+			c.queuedUpload(-1)
+			select {
+			case c.uploadSent <- true:
+			default:
+			}
+		}
 		err = util.WriteFull(w, msg)
 		if err == nil {
 			if msg.MessageID() == common.Piece {
 				n := uint64(msg.Len())
-				c.tx.AddSample(n)
+				c.tx.Add(n)
+				c.t.txRate.Add(n)
 				c.t.statsTracker.AddSample(RateUpload, n)
 			}
 		}
@@ -196,50 +275,127 @@ func (c *PeerConn) Send(msg common.WireMessage) {
 	}
 }
 
+// queue a send without blocking, returns false if the send queue is full
+func (c *PeerConn) trySend(msg common.WireMessage) bool {
+	send := c.send
+	if send == nil {
+		return false
+	}
+	select {
+	case send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// DroppedRequests gets how many piece requests from this peer we dropped because they asked for more than their reqq
+func (c *PeerConn) DroppedRequests() (n uint64) {
+	c.access.Lock()
+	n = c.droppedRequests
+	c.access.Unlock()
+	return
+}
+
+// last time the peer sent anything but a keepalive
+func (c *PeerConn) lastActiveAt() time.Time {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.lastActive
+}
+
+func (c *PeerConn) dropRequest(r *common.PieceRequest) {
+	c.access.Lock()
+	c.droppedRequests++
+	c.access.Unlock()
+	log.Debugf("dropped request from %s for %d %d-%d", c.id.String(), r.Index, r.Begin, r.Begin+r.Length)
+}
+
 func (c *PeerConn) recv(msg common.WireMessage) (err error) {
-	c.lastRecv = time.Now()
+	c.lastRecv = c.t.clock.Now()
+	if !msg.KeepAlive() {
+		c.access.Lock()
+		c.lastActive = c.lastRecv
+		c.access.Unlock()
+	}
 	if (!msg.KeepAlive()) && msg.MessageID() == common.Piece {
 		n := uint64(msg.Len())
-		c.rx.AddSample(n)
+		c.rx.Add(n)
+		c.t.rxRate.Add(n)
 		c.t.statsTracker.AddSample(RateDownload, n)
 	}
 	log.Debugf("got %d bytes from %s", msg.Len(), c.id)
+	if c.trace {
+		c.traceMessage("<-", msg)
+	}
 	err = c.inboundMessage(msg)
 	return
 }
 
 // send choke
 func (c *PeerConn) Choke() {
+	c.access.Lock()
 	if c.usChoke {
+		c.access.Unlock()
 		log.Warnf("multiple chokes sent to %s", c.id.String())
-	} else {
-		log.Debugf("choke peer %s", c.id.String())
-		c.Send(common.NewWireMessage(common.Choke, nil))
-		c.usChoke = true
+		return
 	}
+	c.usChoke = true
+	c.access.Unlock()
+	log.Debugf("choke peer %s", c.id.String())
+	c.Send(common.NewWireMessage(common.Choke, nil))
+	// choking throws away what they asked for, they ask again once unchoked
+	c.dropReads()
 }
 
-// send unchoke
+// send unchoke, never in leech only mode
 func (c *PeerConn) Unchoke() {
-	if c.usChoke {
-		log.Debugf("unchoke peer %s", c.id.String())
-		c.Send(common.NewWireMessage(common.UnChoke, nil))
-		c.usChoke = false
+	c.access.Lock()
+	if !c.usChoke || c.t.LeechOnly {
+		c.access.Unlock()
+		return
 	}
+	c.usChoke = false
+	c.access.Unlock()
+	log.Debugf("unchoke peer %s", c.id.String())
+	c.Send(common.NewWireMessage(common.UnChoke, nil))
 }
 
 func (c *PeerConn) gotDownload(p *common.PieceData) {
 	c.access.Lock()
 	var downloading []*common.PieceRequest
+	got := false
 	for idx := range c.downloading {
 		if c.downloading[idx].Matches(p) {
 			c.t.pt.handlePieceData(p)
+			got = true
+			c.lastPiece = c.t.clock.Now()
 		} else {
 			downloading = append(downloading, c.downloading[idx])
 		}
 	}
 	c.downloading = downloading
 	c.access.Unlock()
+	if got {
+		c.t.cancelBlock(c, p)
+	} else {
+		log.Debugf("%s sent us %d %d which we did not ask for", c.id.String(), p.Index, p.Begin)
+	}
+}
+
+// cancel our requests for a block we already got from someone else
+func (c *PeerConn) cancelBlock(p *common.PieceData) {
+	c.access.Lock()
+	var downloading []*common.PieceRequest
+	for _, r := range c.downloading {
+		if r.Matches(p) {
+			c.Send(r.Cancel())
+		} else {
+			downloading = append(downloading, r)
+		}
+	}
+	c.downloading = downloading
+	c.access.Unlock()
 }
 
 func (c *PeerConn) cancelDownload(req *common.PieceRequest) {
@@ -256,6 +412,27 @@ func (c *PeerConn) cancelDownload(req *common.PieceRequest) {
 	c.access.Unlock()
 }
 
+// are we waiting on requests the peer answered none of for timeout ?
+func (c *PeerConn) requestsStalled(now time.Time, timeout time.Duration) bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return len(c.downloading) > 0 && now.Sub(c.lastPiece) >= timeout
+}
+
+// return true if we may ask the remote peer for another block at now
+func (c *PeerConn) mayRequestAt(now time.Time) bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return now.After(c.nextPieceRequest)
+}
+
+// do not ask the remote peer for more blocks before at
+func (c *PeerConn) holdRequestsUntil(at time.Time) {
+	c.access.Lock()
+	c.nextPieceRequest = at
+	c.access.Unlock()
+}
+
 func (c *PeerConn) numDownloading() int {
 	c.access.Lock()
 	i := len(c.downloading)
@@ -266,6 +443,10 @@ func (c *PeerConn) numDownloading() int {
 func (c *PeerConn) queueDownload(req *common.PieceRequest) {
 	c.lastRequest = req
 	c.access.Lock()
+	if len(c.downloading) == 0 {
+		// the wait for an answer starts now
+		c.lastPiece = c.t.clock.Now()
+	}
 	c.downloading = append(c.downloading, req)
 	c.access.Unlock()
 	log.Debugf("ask %s for %d %d %d", c.id.String(), req.Index, req.Begin, req.Length)
@@ -293,30 +474,120 @@ func (c *PeerConn) HasPiece(piece uint32) bool {
 
 // return true if this peer is choking us otherwise return false
 func (c *PeerConn) RemoteChoking() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
 	return c.peerChoke
 }
 
+// how many requests we can have out to this peer at once
+// never more than the peer said it queues in its extended handshake
+func (c *PeerConn) maxRequests() int {
+	if q := c.theirOpts.RequestQueue; q > 0 && q < c.MaxParalellRequests {
+		return q
+	}
+	return c.MaxParalellRequests
+}
+
+// the extended options we send to this peer
+func (c *PeerConn) ourOptions() extensions.Message {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.ourOpts
+}
+
+// tell the peer if we only upload, does nothing if it already knows (BEP 21)
+func (c *PeerConn) setUploadOnly(only bool) {
+	c.access.Lock()
+	// peers without extensions have no options from us
+	if c.ourOpts.Extensions == nil || c.ourOpts.IsUploadOnly() == only {
+		c.access.Unlock()
+		return
+	}
+	c.ourOpts.SetUploadOnly(only)
+	msg := c.ourOpts.ToWireMessage()
+	c.access.Unlock()
+	c.Send(msg)
+}
+
+// UploadOnly returns true if the remote peer said it only uploads (BEP 21)
+func (c *PeerConn) UploadOnly() bool {
+	return c.theirOpts.IsUploadOnly()
+}
+
 // return true if we are choking the remote peer otherwise return false
 func (c *PeerConn) Chocking() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
 	return c.usChoke
 }
 
 func (c *PeerConn) remoteUnchoke() {
-	if !c.peerChoke {
+	now := c.t.clock.Now()
+	c.access.Lock()
+	if !c.theirChoke {
+		c.access.Unlock()
 		log.Warnf("remote peer %s sent multiple unchokes", c.id.String())
+		return
+	}
+	c.theirChoke = false
+	flapping := c.chokeToggled(now)
+	if !flapping {
+		c.peerChoke = false
+	}
+	c.access.Unlock()
+	if flapping {
+		log.Debugf("%s unchoked us but keeps flapping, staying choked for now", c.id.String())
+		return
 	}
-	c.peerChoke = false
 	log.Debugf("%s unchoked us", c.id.String())
 }
 
 func (c *PeerConn) remoteChoke() {
-	if c.peerChoke {
-		log.Warnf("remote peer %s sent multiple chokes", c.id.String())
+	now := c.t.clock.Now()
+	c.access.Lock()
+	again := c.theirChoke
+	if !again {
+		c.theirChoke = true
+		c.chokeToggled(now)
 	}
 	c.peerChoke = true
+	c.access.Unlock()
+	if again {
+		log.Warnf("remote peer %s sent multiple chokes", c.id.String())
+	}
 	log.Debugf("%s choked us", c.id.String())
 }
 
+// remember the peer changed its choke, returns true if it did that too often lately
+// must hold c.access
+func (c *PeerConn) chokeToggled(now time.Time) bool {
+	cutoff := now.Add(-ChokeFlapWindow)
+	toggles := c.chokeToggles[:0]
+	for _, at := range c.chokeToggles {
+		if at.After(cutoff) {
+			toggles = append(toggles, at)
+		}
+	}
+	c.chokeToggles = append(toggles, now)
+	if len(c.chokeToggles) > MaxChokeToggles {
+		c.flapUntil = now.Add(ChokeFlapWindow)
+	}
+	return now.Before(c.flapUntil)
+}
+
+// believe the last unchoke once the peer stopped flapping
+func (c *PeerConn) settleChoke(now time.Time) {
+	c.access.Lock()
+	settled := c.peerChoke && !c.theirChoke && !now.Before(c.flapUntil)
+	if settled {
+		c.peerChoke = false
+	}
+	c.access.Unlock()
+	if settled {
+		log.Debugf("%s settled down, unchoked", c.id.String())
+	}
+}
+
 func (c *PeerConn) cancelPendingDownloads() {
 	c.access.Lock()
 	for _, r := range c.downloading {
@@ -328,35 +599,81 @@ func (c *PeerConn) cancelPendingDownloads() {
 }
 
 func (c *PeerConn) markInterested() {
+	c.access.Lock()
 	c.peerInterested = true
+	c.access.Unlock()
 	log.Debugf("%s is interested", c.id.String())
 }
 
 func (c *PeerConn) markNotInterested() {
+	c.access.Lock()
 	c.peerInterested = false
+	c.slotChoked = false
+	c.access.Unlock()
 	log.Debugf("%s is not interested", c.id.String())
+	c.t.releaseUploadSlot(c)
+}
+
+// true if the peer said it is interested in what we have
+func (c *PeerConn) isPeerInterested() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.peerInterested
+}
+
+// true while we keep the peer choked for lack of an upload slot
+func (c *PeerConn) isSlotChoked() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.slotChoked
 }
 
 func (c *PeerConn) Close() {
+	c.access.Lock()
 	if c.closing {
+		c.access.Unlock()
 		return
 	}
 	c.closing = true
+	c.access.Unlock()
 	c.close <- true
 }
 
+// true once the connection started closing
+func (c *PeerConn) isClosing() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.closing
+}
+
+// true once reading or writing the connection failed
+func (c *PeerConn) isBroken() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.broken
+}
+
+// the connection can't be written to anymore, close without saying goodbye
+func (c *PeerConn) writeFailed() {
+	c.access.Lock()
+	c.broken = true
+	c.closing = true
+	c.access.Unlock()
+	c.doClose()
+}
+
 func (c *PeerConn) doClose() {
 	c.send = nil
-	for _, r := range c.downloading {
-		c.t.pt.canceledRequest(r)
+	downloading := c.t.onPeerDisconnect(c)
+	if !c.isBroken() {
+		for _, r := range downloading {
+			// tell them we don't want it so they don't waste upload on us
+			c.processWrite(&c.writeBuff, r.Cancel())
+		}
+		c.c.SetWriteDeadline(time.Now().Add(CloseWriteTimeout))
+		c.flushSend()
 	}
-	c.downloading = nil
 	log.Debugf("%s closing connection", c.id.String())
-	if c.inbound {
-		c.t.removeIBConn(c)
-	} else {
-		c.t.removeOBConn(c)
-	}
 	c.ticker.Stop()
 	c.c.Close()
 }
@@ -366,10 +683,38 @@ func (c *PeerConn) runReader() {
 	err := common.ReadWireMessages(c.c, c.recv, c.readBuff[:])
 	if err != nil {
 		log.Debugf("PeerConn() reader failed: %s", err.Error())
+		c.access.Lock()
+		c.broken = true
+		c.access.Unlock()
 	}
 	c.Close()
 }
 
+// remote peer got a new piece
+func (c *PeerConn) gotHave(idx uint32) {
+	if !c.t.Ready() {
+		// default to interested if we have no bitfield yet
+		c.Send(common.NewNotInterested())
+		return
+	}
+	if idx >= c.t.MetaInfo().Info.NumPieces() {
+		log.Warnf("%s has piece %d which does not exist", c.id.String(), idx)
+		return
+	}
+	if c.bf == nil {
+		// peers with no pieces can skip sending a bitfield
+		c.bf = bittorrent.NewBitfield(c.t.MetaInfo().Info.NumPieces(), nil)
+	}
+	if !c.bf.Has(idx) {
+		c.bf.Set(idx)
+		c.t.availability.addHave(idx)
+	}
+	c.checkInterested()
+	if c.isUsInterested() {
+		c.runDownload = true
+	}
+}
+
 func (c *PeerConn) cancelPiece(idx uint32) {
 	c.access.Lock()
 	downloading := c.downloading
@@ -386,50 +731,43 @@ func (c *PeerConn) cancelPiece(idx uint32) {
 
 func (c *PeerConn) checkInterested() {
 	bf := c.t.Bitfield()
-	if bf != nil && c.bf != nil && c.bf.XOR(bf).CountSet() > 0 {
-		c.usInterested = true
-		m := common.NewInterested()
-		c.Send(m)
-		c.sentInterested = true
+	interested := bf != nil && c.bf != nil && c.bf.XOR(bf).CountSet() > 0
+	c.access.Lock()
+	c.usInterested = interested
+	c.access.Unlock()
+	if interested {
+		c.Send(common.NewInterested())
 	} else {
-		c.usInterested = false
-		m := common.NewNotInterested()
-		c.sentInterested = true
-		c.Send(m)
+		c.Send(common.NewNotInterested())
 	}
+	c.sentInterested = true
+}
+
+// return true if we want pieces from the remote peer
+func (c *PeerConn) isUsInterested() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.usInterested
 }
 
 func (c *PeerConn) metaInfoDownload() {
 	if !c.t.Ready() && c.theirOpts.MetaData() {
 		if c.theirOpts.MetainfoSize != nil {
 			l := *c.theirOpts.MetainfoSize
+			c.t.metaMtx.Lock()
 			if c.t.metaInfo == nil || len(c.t.metaInfo) == 0 {
 				// set meta info
 				c.t.metaInfo = make([]byte, l)
-				l = 1 + (l / (16 * 1024))
+				l = (l + extensions.MetadataSliceSize - 1) / extensions.MetadataSliceSize
 				log.Debugf("bitfield is %d bits", l)
 				c.t.pendingInfoBF = bittorrent.NewBitfield(l, nil)
 				c.t.requestingInfoBF = bittorrent.NewBitfield(l, nil)
 			} else {
 				log.Debugf("metainfo len=%d", len(c.t.metaInfo))
 			}
+			c.t.metaMtx.Unlock()
 		}
-		id, ok := c.theirOpts.Extensions[extensions.UTMetaData.String()]
-		if ok {
-			var md extensions.MetaData
-			md.Type = extensions.UTRequest
-			r := c.t.nextMetaInfoReq()
-			if r != nil {
-				md.Piece = *r
-				m := &extensions.Message{ID: uint8(id), PayloadRaw: md.Bytes()}
-				log.Debugf("asking for info piece %d", md.Piece)
-				c.Send(m.ToWireMessage())
-			} else {
-				log.Debugf("no more pieces desired")
-			}
-		} else {
-			log.Debug("ut_metadata not found?")
-		}
+		c.askNextMetadata()
 	}
 }
 
@@ -441,24 +779,43 @@ func (c *PeerConn) inboundMessage(msg common.WireMessage) (err error) {
 	}
 	msgid := msg.MessageID()
 	log.Debugf("%s from %s", msgid.String(), c.id.String())
+	err = msg.Validate()
+	if err == nil && msgid == common.BitField && c.t.Ready() {
+		np := c.t.MetaInfo().Info.NumPieces()
+		if len(msg.Payload()) != int((np+7)/8) {
+			err = common.ErrBadMessageLength
+		} else if bittorrent.NewBitfield(np, msg.Payload()).SpareBitsSet() {
+			// only a broken client sets these
+			err = bittorrent.ErrSpareBitsSet
+		}
+	}
+	if err != nil {
+		// returning the error closes the connection
+		log.Warnf("%s sent bad %s message of %d bytes: %s", c.id.String(), msgid.String(), msg.Len(), err.Error())
+		return
+	}
 	if msgid == common.BitField {
 		isnew := false
 		if c.bf == nil {
 			isnew = true
 		}
 		if c.t.Ready() {
+			if c.bf != nil {
+				c.t.availability.removeBitfield(c.bf)
+			}
 			c.bf = bittorrent.NewBitfield(c.t.MetaInfo().Info.NumPieces(), msg.Payload())
+			c.t.availability.addBitfield(c.bf)
 			log.Debugf("got bitfield from %s", c.id.String())
 			c.checkInterested()
 			if isnew {
 				c.Unchoke()
-				c.Send(c.ourOpts.ToWireMessage())
+				c.Send(c.ourOptions().ToWireMessage())
 			}
 		} else {
 			// empty bitfield
 			bits := make([]byte, len(msg.Payload()))
 			c.Send(common.NewWireMessage(common.BitField, bits))
-			c.Send(c.ourOpts.ToWireMessage())
+			c.Send(c.ourOptions().ToWireMessage())
 			c.metaInfoDownload()
 		}
 		if isnew {
@@ -479,7 +836,9 @@ func (c *PeerConn) inboundMessage(msg common.WireMessage) (err error) {
 		c.markInterested()
 		if !c.sentInterested {
 			c.checkInterested()
-			c.Unchoke()
+			if !c.isSlotChoked() {
+				c.Unchoke()
+			}
 		}
 	}
 	if msgid == common.NotInterested {
@@ -500,15 +859,7 @@ func (c *PeerConn) inboundMessage(msg common.WireMessage) (err error) {
 	}
 
 	if msgid == common.Have {
-		// update bitfield
-		idx := msg.GetHave()
-		if c.bf != nil {
-			c.bf.Set(idx)
-			c.checkInterested()
-		} else {
-			// default to interested if we have no bitfield yet
-			c.Send(common.NewNotInterested())
-		}
+		c.gotHave(msg.GetHave())
 	}
 	if msgid == common.Cancel {
 		// TODO: check validity
@@ -527,50 +878,9 @@ func (c *PeerConn) inboundMessage(msg common.WireMessage) (err error) {
 }
 
 func (c *PeerConn) handleLNPEX(m interface{}) {
-	var peers []common.Peer
 	pex, ok := m.(map[string]interface{})
 	if ok {
-		added, ok := pex["addedln"]
-		if ok {
-			l, ok := added.([]interface{})
-			if ok {
-				for idx := range l {
-					p, ok := l[idx].(map[string]interface{})
-					if ok {
-						var peer common.Peer
-						v, ok := p["ip"]
-						if !ok {
-							continue
-						}
-						peer.IP, ok = v.(string)
-						if !ok {
-							continue
-						}
-						v, ok = p["port"]
-						if !ok {
-							continue
-						}
-						port, ok := v.(int64)
-						if !ok {
-							continue
-						}
-						peer.Port = int(port)
-						v, ok = p["peer id"]
-						if !ok {
-							continue
-						}
-						pid, ok := v.(string)
-						if ok && len(pid) == 20 {
-							copy(peer.ID[:], pid[:])
-						} else {
-							continue
-						}
-						peers = append(peers, peer)
-					}
-				}
-			}
-		}
-		c.t.addPeers(peers)
+		c.t.addPeers(common.ParsePeers(common.PeersDict, pex["addedln"]))
 	} else {
 		log.Errorf("invalid pex message: %q", m)
 	}
@@ -597,17 +907,7 @@ func (c *PeerConn) handleI2PPEX(m interface{}) {
 
 // handle inbound PEX message payload
 func (c *PeerConn) handlePEXAdded(m interface{}) {
-	var peers []common.Peer
-	msg := m.(string)
-	l := len(msg) / 32
-	for l > 0 {
-		var p common.Peer
-		// TODO: bounds check
-		copy(p.Compact[:], msg[(l-1)*32:l*32])
-		l--
-		peers = append(peers, p)
-	}
-	c.t.addPeers(peers)
+	c.t.addPeers(common.ParsePeers(common.PeersI2P, m))
 }
 
 func (c *PeerConn) handlePEXAddedf(m interface{}) {
@@ -640,7 +940,7 @@ func (c *PeerConn) handleExtendedOpts(opts extensions.Message) {
 		c.theirOpts = opts.Copy()
 	} else {
 		// lookup the extension number
-		ext, ok := c.ourOpts.Lookup(opts.ID)
+		ext, ok := c.ourOptions().Lookup(opts.ID)
 		if ok {
 			if ext == extensions.I2PPeerExchange.String() {
 				c.handleI2PPEX(opts.Payload)
@@ -662,16 +962,25 @@ func (c *PeerConn) handleExtendedOpts(opts extensions.Message) {
 	}
 }
 
-func (c *PeerConn) askNextMetadata(id uint8) {
+// ask this peer for the next metadata slice we don't have and nobody was asked for
+func (c *PeerConn) askNextMetadata() {
+	id, ok := c.theirOpts.Extensions[extensions.UTMetaData.String()]
+	if !ok {
+		log.Debug("ut_metadata not found?")
+		return
+	}
 	r := c.t.nextMetaInfoReq()
 	if r != nil {
+		c.access.Lock()
+		c.metaRequests = append(c.metaRequests, *r)
+		c.access.Unlock()
 		var m extensions.Message
 		var msg extensions.MetaData
 		msg.Type = extensions.UTRequest
 		msg.Data = nil
 		msg.Size = 0
 		msg.Piece = *r
-		m.ID = id
+		m.ID = uint8(id)
 		m.PayloadRaw = msg.Bytes()
 		log.Debugf("asking for info piece %d", msg.Piece)
 		c.Send(m.ToWireMessage())
@@ -680,63 +989,140 @@ func (c *PeerConn) askNextMetadata(id uint8) {
 	}
 }
 
+// this peer answered our request for metadata slice idx one way or another
+func (c *PeerConn) metaRequestDone(idx uint32) {
+	c.access.Lock()
+	for i, r := range c.metaRequests {
+		if r == idx {
+			c.metaRequests = append(c.metaRequests[:i], c.metaRequests[i+1:]...)
+			break
+		}
+	}
+	c.access.Unlock()
+}
+
 func (c *PeerConn) handleMetadata(m extensions.Message) {
 	msg, err := extensions.ParseMetadata(m.PayloadRaw)
 	if err == nil {
 		if msg.Type == extensions.UTData {
 			log.Debugf("got UTData: piece %d", msg.Piece)
 			if !c.t.Ready() && msg.Size > 0 {
+				c.metaRequestDone(msg.Piece)
 				c.t.putInfoSlice(msg.Piece, msg.Data)
-				c.askNextMetadata(m.ID)
+				c.askNextMetadata()
 			}
 		} else if msg.Type == extensions.UTReject {
 			log.Debugf("ut_metadata rejected from %s", c.id.String())
-			c.t.requestingInfoBF.Unset(msg.Piece)
+			c.metaRequestDone(msg.Piece)
+			c.t.metaSliceRejected(msg.Piece)
 		} else if msg.Type == extensions.UTRequest {
-			if c.t.Ready() {
-				idx := msg.Piece * (16 * 1024)
-				pieces := c.t.getMetaInfo()
-				if pieces == nil || len(pieces) == 0 {
-					msg.Type = extensions.UTReject
-				} else if uint32(len(pieces)) >= idx+(32*1024) {
-					msg.Type = extensions.UTReject
-				} else if uint32(len(pieces)) >= idx+(16*1024) {
-					if idx < uint32(len(pieces)) {
-						msg.Type = extensions.UTData
-						msg.Data = pieces[idx:]
-						msg.Size = uint32(len(msg.Data))
-					} else {
-						msg.Type = extensions.UTReject
-					}
-				} else {
-					if idx+(16*1024) < uint32(len(pieces)) {
-						msg.Type = extensions.UTData
-						msg.Data = pieces[idx : idx+(16*1024)]
-						msg.Size = uint32(len(msg.Data))
-					} else {
-						msg.Type = extensions.UTReject
-					}
-				}
-			} else {
-				msg.Type = extensions.UTReject
-			}
-			m.Payload = nil
-			m.PayloadRaw = msg.Bytes()
-			c.Send(m.ToWireMessage())
+			c.sendMetadata(msg.Piece)
 		}
 	} else {
 		log.Errorf("failed to parse ut_metainfo message: %s", err.Error())
 	}
 }
 
+// get slice idx of the info dict, returns nil if there is no such slice
+func metadataSlice(info []byte, idx uint32) []byte {
+	begin := uint64(idx) * extensions.MetadataSliceSize
+	if begin >= uint64(len(info)) {
+		return nil
+	}
+	end := begin + extensions.MetadataSliceSize
+	if end > uint64(len(info)) {
+		end = uint64(len(info))
+	}
+	return info[begin:end]
+}
+
+// answer a ut_metadata request with a slice of the info dict or reject it if we don't have that slice
+func (c *PeerConn) sendMetadata(idx uint32) {
+	id, ok := c.theirOpts.Extensions[extensions.UTMetaData.String()]
+	if !ok {
+		log.Warnf("%s asked for metadata without telling us how to send it", c.id.String())
+		return
+	}
+	msg := extensions.MetaData{
+		Type:  extensions.UTReject,
+		Piece: idx,
+	}
+	if c.t.Ready() {
+		info := c.t.getMetaInfo()
+		if data := metadataSlice(info, idx); data != nil {
+			msg.Type = extensions.UTData
+			msg.Size = uint32(len(info))
+			msg.Data = data
+		}
+	}
+	if msg.Type == extensions.UTReject {
+		log.Debugf("reject metadata request for slice %d from %s", idx, c.id.String())
+	}
+	m := extensions.Message{ID: uint8(id), PayloadRaw: msg.Bytes()}
+	c.Send(m.ToWireMessage())
+}
+
 func (c *PeerConn) sendKeepAlive() {
-	tm := time.Now().Add(0 - (time.Minute * 2))
+	tm := c.t.clock.Now().Add(0 - (time.Minute * 2))
 	if c.lastSend.Before(tm) {
 		log.Debugf("send keepalive to %s", c.id.String())
 		c.Send(common.KeepAlive)
 	}
 }
 
+// get the pieces we are downloading from this peer
+func (c *PeerConn) downloadingPieces() (pieces []uint32) {
+	c.access.Lock()
+	for _, r := range c.downloading {
+		seen := false
+		for _, idx := range pieces {
+			seen = seen || idx == r.Index
+		}
+		if !seen {
+			pieces = append(pieces, r.Index)
+		}
+	}
+	c.access.Unlock()
+	return
+}
+
+// return true if we can ask this peer for a block of piece idx without going over MaxPiecesPerPeer
+func (c *PeerConn) canTakePiece(idx uint32) bool {
+	pieces := c.downloadingPieces()
+	if c.t.MaxPiecesPerPeer <= 0 || len(pieces) < c.t.MaxPiecesPerPeer {
+		return true
+	}
+	for _, p := range pieces {
+		if p == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// get the next block to ask this peer for
+// once it has MaxPiecesPerPeer pieces on the go it only helps finish those
+func (c *PeerConn) nextRequest() *common.PieceRequest {
+	pieces := c.downloadingPieces()
+	if c.t.MaxPiecesPerPeer > 0 && len(pieces) >= c.t.MaxPiecesPerPeer {
+		return c.t.pt.nextRequestIn(pieces, c.blockSize())
+	}
+	return c.t.pt.nextRequestOf(c.bf, c.lastRequest, c.blockSize())
+}
+
+// how many bytes to ask this peer for at once
+// fast peers get LargeBlockSize so they need fewer round trips, everyone else BlockSize
+func (c *PeerConn) blockSize() uint32 {
+	size := c.t.LargeBlockSize
+	if size <= BlockSize || c.rx.Rate() < float64(c.t.LargeBlockRate) {
+		return BlockSize
+	}
+	if size > MaxBlockSize {
+		size = MaxBlockSize
+	}
+	return size
+}
+
 // tick download stuff
 func (c *PeerConn) tickDownload() {
 	if !c.runDownload {
@@ -748,24 +1134,28 @@ func (c *PeerConn) tickDownload() {
 			c.Done()
 			c.Done = nil
 		}
-	} else if (c.usInterested || c.peerInterested) && !c.closing {
+	} else if (c.isUsInterested() || c.isPeerInterested()) && !c.isClosing() {
+		c.settleChoke(c.t.clock.Now())
 		if c.RemoteChoking() {
 			//log.Debugf("will not download this tick, %s is choking", c.id.String())
 			return
 		}
 		// pending request
 		p := c.numDownloading()
-		if p >= c.MaxParalellRequests {
+		if p >= c.maxRequests() {
 			//log.Debugf("max parallel reached for %s", c.id.String())
 			return
 		}
-		now := time.Now()
-		if now.After(c.nextPieceRequest) {
-			r := c.t.pt.NextRequest(c.bf, c.lastRequest)
+		if c.UploadOnly() && c.t.hasBetterSourceThan(c) {
+			return
+		}
+		now := c.t.clock.Now()
+		if c.mayRequestAt(now) {
+			r := c.nextRequest()
 			if r != nil {
 				c.queueDownload(r)
 			} else {
-				c.nextPieceRequest = now.Add(time.Second / 4)
+				c.holdRequestsUntil(now.Add(time.Second / 4))
 				log.Debugf("no next piece to download for %s", c.id.String())
 			}
 		}
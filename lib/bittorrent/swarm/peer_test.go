@@ -0,0 +1,842 @@
+package swarm
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/bittorrent/extensions"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/geoip"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// make a connected PeerConn with outstanding requests, returns the remote end of the connection
+func newTestPeerConn(t *Torrent, reqs []*common.PieceRequest) (*PeerConn, net.Conn) {
+	local, remote := net.Pipe()
+	c := makePeerConn(local, t, common.GeneratePeerID(), extensions.Message{})
+	t.addOBPeer(c)
+	for _, r := range reqs {
+		t.pt.visitCached(r.Index, func(cp *cachedPiece) {
+			cp.nextRequest()
+		})
+		c.downloading = append(c.downloading, r)
+	}
+	return c, remote
+}
+
+func TestCloseSendsCancel(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize*2))
+	defer closeTestTorrent(tr, n)
+	reqs := []*common.PieceRequest{
+		{Index: 0, Begin: 0, Length: BlockSize},
+		{Index: 1, Begin: 0, Length: BlockSize},
+	}
+	c, remote := newTestPeerConn(tr, reqs)
+	go c.run()
+
+	var cancels []*common.PieceRequest
+	done := make(chan error)
+	go func() {
+		var buff [common.MaxWireMessageSize + 4]byte
+		done <- common.ReadWireMessages(remote, func(msg common.WireMessage) error {
+			if msg.MessageID() == common.Cancel {
+				cancels = append(cancels, msg.GetPieceRequest())
+			}
+			return nil
+		}, buff[:])
+	}()
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("connection not closed")
+	}
+
+	if len(cancels) != len(reqs) {
+		t.Fatalf("got %d cancels, expected %d", len(cancels), len(reqs))
+	}
+	for idx := range reqs {
+		if cancels[idx] == nil || !cancels[idx].Equals(reqs[idx]) {
+			t.Errorf("cancel %d is %v, expected %v", idx, cancels[idx], reqs[idx])
+		}
+	}
+	if c.numDownloading() != 0 {
+		t.Errorf("%d requests still tracked after close", c.numDownloading())
+	}
+	// the blocks can be requested again
+	for _, r := range reqs {
+		tr.pt.visitCached(r.Index, func(cp *cachedPiece) {
+			if next := cp.nextRequest(); next == nil || next.Begin != r.Begin {
+				t.Errorf("block %d %d not requestable after close", r.Index, r.Begin)
+			}
+		})
+	}
+}
+
+func TestCloseBrokenConn(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	c, remote := newTestPeerConn(tr, []*common.PieceRequest{
+		{Index: 0, Begin: 0, Length: BlockSize},
+	})
+	// remote end goes away first
+	remote.Close()
+	c.start()
+	deadline := time.Now().Add(time.Second * 5)
+	for tr.NumPeers() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not closed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !c.broken {
+		t.Error("connection not marked broken")
+	}
+	if c.numDownloading() != 0 {
+		t.Errorf("%d requests still tracked after close", c.numDownloading())
+	}
+}
+
+func TestHaveUpdatesAvailability(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(8, BlockSize))
+	defer closeTestTorrent(tr, n)
+	a, _ := newTestPeerConn(tr, nil)
+	b, _ := newTestPeerConn(tr, nil)
+
+	bits := bittorrent.NewBitfield(8, nil)
+	bits.Set(1)
+	a.inboundMessage(bits.ToWireMessage())
+	a.inboundMessage(common.NewHave(3))
+	if !a.HasPiece(3) {
+		t.Error("have did not set the bit in the peer's bitfield")
+	}
+	if c := tr.availability.Count(3); c != 1 {
+		t.Errorf("piece 3 is on %d peers, expected 1", c)
+	}
+	// same have again does not count twice
+	a.inboundMessage(common.NewHave(3))
+	if c := tr.availability.Count(3); c != 1 {
+		t.Errorf("piece 3 is on %d peers after a repeated have, expected 1", c)
+	}
+	// have without a bitfield first
+	b.inboundMessage(common.NewHave(3))
+	if !b.HasPiece(3) {
+		t.Error("have without a bitfield did not set the bit")
+	}
+	if c := tr.availability.Count(3); c != 2 {
+		t.Errorf("piece 3 is on %d peers, expected 2", c)
+	}
+	if !b.usInterested {
+		t.Error("not interested in a peer that has a piece we need")
+	}
+	// out of range have is ignored
+	b.inboundMessage(common.NewHave(100))
+	if c := tr.availability.Count(100); c != 0 {
+		t.Errorf("piece that does not exist is on %d peers", c)
+	}
+
+	// piece 1 is rarer than piece 3
+	remote := bittorrent.NewBitfield(8, nil)
+	remote.Set(1)
+	remote.Set(3)
+	if idx, has := tr.getRarestPiece(remote, nil); !has || idx != 1 {
+		t.Errorf("rarest piece is %d, expected 1", idx)
+	}
+
+	a.doClose()
+	if c := tr.availability.Count(3); c != 1 {
+		t.Errorf("piece 3 is on %d peers after one left, expected 1", c)
+	}
+	if c := tr.availability.Count(1); c != 0 {
+		t.Errorf("piece 1 is on %d peers after the only one with it left", c)
+	}
+}
+
+func TestDisconnectCleansUp(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize*2))
+	defer closeTestTorrent(tr, n)
+	c, _ := newTestPeerConn(tr, []*common.PieceRequest{
+		{Index: 0, Begin: 0, Length: BlockSize},
+		{Index: 2, Begin: 0, Length: BlockSize},
+	})
+	bits := bittorrent.NewBitfield(4, nil)
+	bits.Set(0)
+	bits.Set(2)
+	c.inboundMessage(bits.ToWireMessage())
+	// some other peer has them too
+	tr.availability.addBitfield(bits)
+	if n := tr.availability.Count(2); n != 2 {
+		t.Fatalf("piece 2 is on %d peers, expected 2", n)
+	}
+
+	// nothing is reading the other end so don't try to say goodbye
+	c.broken = true
+	if got := tr.onPeerDisconnect(c); len(got) != 2 {
+		t.Errorf("got back %d requests, expected 2", len(got))
+	}
+	if tr.HasOBConn(c.c.RemoteAddr()) {
+		t.Error("peer still connected after disconnect")
+	}
+	if c.numDownloading() != 0 {
+		t.Errorf("%d requests still tracked after disconnect", c.numDownloading())
+	}
+	tr.pt.iterCached(func(cp *cachedPiece) {
+		if pending := cp.pendingRequests(); len(pending) != 0 {
+			t.Errorf("piece %d still has %d blocks asked for", cp.index, len(pending))
+		}
+	})
+	for _, idx := range []uint32{0, 2} {
+		if n := tr.availability.Count(idx); n != 1 {
+			t.Errorf("piece %d is on %d peers after disconnect, expected 1", idx, n)
+		}
+	}
+}
+
+func TestRequestFloodDoesNotBlock(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.SendQueueSize = 4
+	// nothing is sending so the queue fills up
+	c, _ := newTestPeerConn(tr, nil)
+	done := make(chan bool)
+	go func() {
+		for idx := 0; idx < 10; idx++ {
+			c.inboundMessage(common.PieceRequest{Index: uint32(idx % 4), Length: BlockSize}.ToWireMessage())
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("handling requests blocked on a full send queue")
+	}
+	if d := c.DroppedRequests(); d != 6 {
+		t.Errorf("dropped %d requests, expected 6", d)
+	}
+	if d := c.Stats().Dropped; d != 6 {
+		t.Errorf("stats say %d dropped requests, expected 6", d)
+	}
+}
+
+// ask c for a metadata slice and get what it sent back
+func requestMetadata(t *testing.T, c *PeerConn, idx uint32) extensions.MetaData {
+	req := extensions.MetaData{Type: extensions.UTRequest, Piece: idx}
+	c.handleMetadata(extensions.Message{ID: 1, PayloadRaw: req.Bytes()})
+	var reply common.WireMessage
+	select {
+	case reply = <-c.send:
+	default:
+		t.Fatalf("no reply to metadata request for slice %d", idx)
+	}
+	opts, err := extensions.FromWireMessage(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ID != 3 {
+		t.Errorf("reply sent with extension id %d, expected their id 3", opts.ID)
+	}
+	md, err := extensions.ParseMetadata(opts.PayloadRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return md
+}
+
+func TestServeMetadata(t *testing.T) {
+	// big enough for 2 slices
+	tr, n := newTestTorrent(testMetaInfo(1000, BlockSize))
+	defer closeTestTorrent(tr, n)
+	c, _ := newTestPeerConn(tr, nil)
+	c.theirOpts = extensions.New()
+	c.theirOpts.Extensions[extensions.UTMetaData.String()] = 3
+	info := tr.MetaInfo().Info.Bytes()
+	if len(info) <= extensions.MetadataSliceSize {
+		t.Fatalf("info is only %d bytes", len(info))
+	}
+
+	for idx, expected := range [][]byte{info[:extensions.MetadataSliceSize], info[extensions.MetadataSliceSize:]} {
+		md := requestMetadata(t, c, uint32(idx))
+		if md.Type != extensions.UTData {
+			t.Fatalf("slice %d was not sent", idx)
+		}
+		if md.Piece != uint32(idx) {
+			t.Errorf("got slice %d, expected %d", md.Piece, idx)
+		}
+		if md.Size != uint32(len(info)) {
+			t.Errorf("total size is %d, expected %d", md.Size, len(info))
+		}
+		if !bytes.Equal(md.Data, expected) {
+			t.Errorf("slice %d has the wrong data", idx)
+		}
+	}
+
+	if md := requestMetadata(t, c, 2); md.Type != extensions.UTReject {
+		t.Errorf("request past the last slice got msg_type %d, expected reject", md.Type)
+	}
+}
+
+// a peer with the metadata for a torrent of size bytes of info, asks go out on its send queue
+func metadataTestPeer(tr *Torrent, n byte, size uint32) *PeerConn {
+	c := testPeerFrom(tr, n)
+	tr.addOBPeer(c)
+	c.theirOpts = extensions.NewOur(size)
+	c.theirOpts.Extensions[extensions.UTMetaData.String()] = 3
+	return c
+}
+
+// the metadata slices c was asked for since last time
+func metadataAsked(t *testing.T, c *PeerConn) (slices []uint32) {
+	for {
+		select {
+		case msg := <-c.send:
+			opts, err := extensions.FromWireMessage(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			md, err := extensions.ParseMetadata(opts.PayloadRaw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.ID != 3 || md.Type != extensions.UTRequest {
+				t.Fatalf("sent extension %d msg_type %d, expected a request on their id 3", opts.ID, md.Type)
+			}
+			slices = append(slices, md.Piece)
+		default:
+			return
+		}
+	}
+}
+
+// send c metadata slice idx of info
+func sendMetadataSlice(c *PeerConn, info []byte, idx uint32) {
+	md := extensions.MetaData{
+		Type:  extensions.UTData,
+		Piece: idx,
+		Size:  uint32(len(info)),
+		Data:  metadataSlice(info, idx),
+	}
+	c.handleMetadata(extensions.Message{ID: 1, PayloadRaw: md.Bytes()})
+}
+
+func TestMetadataPeerFailover(t *testing.T) {
+	// 3 slices of info
+	info := testMetaInfo(2000, BlockSize).Info.Bytes()
+	if len(info) <= extensions.MetadataSliceSize*2 {
+		t.Fatalf("info is only %d bytes", len(info))
+	}
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	first := metadataTestPeer(tr, 1, uint32(len(info)))
+	first.metaInfoDownload()
+	if asked := metadataAsked(t, first); len(asked) != 1 || asked[0] != 0 {
+		t.Fatalf("first peer asked for %v, expected slice 0", asked)
+	}
+	sendMetadataSlice(first, info, 0)
+	if asked := metadataAsked(t, first); len(asked) != 1 || asked[0] != 1 {
+		t.Fatalf("first peer asked for %v after slice 0, expected slice 1", asked)
+	}
+	// someone else has it too but everything is asked for already
+	second := metadataTestPeer(tr, 2, uint32(len(info)))
+	second.metaInfoDownload()
+	if asked := metadataAsked(t, second); len(asked) != 1 || asked[0] != 2 {
+		t.Fatalf("second peer asked for %v, expected slice 2", asked)
+	}
+
+	// first goes away without sending slice 1
+	first.broken = true
+	tr.onPeerDisconnect(first)
+	if asked := metadataAsked(t, second); len(asked) != 1 || asked[0] != 1 {
+		t.Fatalf("second peer asked for %v after the first left, expected slice 1", asked)
+	}
+	sendMetadataSlice(second, info, 2)
+	sendMetadataSlice(second, info, 1)
+	if asked := metadataAsked(t, second); len(asked) != 0 {
+		t.Errorf("asked for %v again after getting every slice", asked)
+	}
+	if !tr.hasAllPendingInfo() || !bytes.Equal(tr.metaInfo, info) {
+		t.Error("metadata not put together from both peers")
+	}
+}
+
+func TestLazyBitfield(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(10, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.LazyBitfield = true
+	st := tr.st.(*testStorage)
+	for idx := uint32(0); idx < 10; idx++ {
+		st.bf.Set(idx)
+	}
+	c, _ := newTestPeerConn(tr, nil)
+	tr.sendBitfield(c)
+	if st.bf.CountSet() != 10 {
+		t.Fatal("sending a lazy bitfield changed our own bitfield")
+	}
+
+	msg := <-c.send
+	if msg.MessageID() != common.BitField {
+		t.Fatalf("first message is %s, expected a bitfield", msg.MessageID())
+	}
+	sent := bittorrent.NewBitfield(10, msg.Payload())
+	if sent.CountSet() != 10-LazyBitfieldHaves {
+		t.Errorf("bitfield has %d pieces, expected %d", sent.CountSet(), 10-LazyBitfieldHaves)
+	}
+	for idx := 0; idx < LazyBitfieldHaves; idx++ {
+		var msg common.WireMessage
+		select {
+		case msg = <-c.send:
+		default:
+			t.Fatalf("got %d haves, expected %d", idx, LazyBitfieldHaves)
+		}
+		if msg.MessageID() != common.Have {
+			t.Fatalf("sent %s after the bitfield, expected a have", msg.MessageID())
+		}
+		h := msg.GetHave()
+		if sent.Has(h) {
+			t.Errorf("have %d sent for a piece already in the bitfield", h)
+		}
+		sent.Set(h)
+	}
+	if !sent.Completed() {
+		t.Error("bitfield and haves together do not have every piece")
+	}
+}
+
+// a connection that says it is from some address
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// connection that keeps each write made to it
+type writesConn struct {
+	net.Conn
+	mtx    sync.Mutex
+	writes [][]byte
+}
+
+func (c *writesConn) Write(data []byte) (int, error) {
+	c.mtx.Lock()
+	c.writes = append(c.writes, append([]byte{}, data...))
+	c.mtx.Unlock()
+	return len(data), nil
+}
+
+func (c *writesConn) numWrites() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.writes)
+}
+
+func TestSendCoalescing(t *testing.T) {
+	for _, bufSize := range []int{DefaultSendBufferSize, 0} {
+		tr, n := newTestTorrent(testMetaInfo(8, BlockSize))
+		tr.SendBufferSize = bufSize
+		local, _ := net.Pipe()
+		conn := &writesConn{Conn: local}
+		c := makePeerConn(conn, tr, common.GeneratePeerID(), extensions.Message{})
+		// queued together before the connection gets to any of them
+		for idx := uint32(0); idx < 3; idx++ {
+			c.Send(common.NewHave(idx))
+		}
+		go c.run()
+		expected := 1
+		if bufSize == 0 {
+			expected = 3
+		}
+		deadline := time.Now().Add(time.Second * 5)
+		for conn.numWrites() < expected && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+		c.Close()
+		closeTestTorrent(tr, n)
+		conn.mtx.Lock()
+		writes := conn.writes
+		conn.mtx.Unlock()
+		if len(writes) == 0 || len(writes) > expected {
+			t.Errorf("%d haves went out in %d writes with a %d byte send buffer, expected %d", 3, len(writes), bufSize, expected)
+		} else if got := len(bytes.Join(writes, nil)); got != 3*9 {
+			t.Errorf("wrote %d bytes, expected %d", got, 3*9)
+		}
+	}
+}
+
+type testGeoIP map[string]string
+
+func (g testGeoIP) Lookup(ip net.IP) (geoip.Info, error) {
+	return geoip.Info{Country: g[ip.String()]}, nil
+}
+
+func TestPeerStatsGeoIP(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.GeoIP = geoip.NewCache(testGeoIP{"10.0.0.1": "NL", "10.0.0.2": "DE"}, 0)
+	expected := map[string]string{}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		local, _ := net.Pipe()
+		a := &net.TCPAddr{IP: net.ParseIP(ip), Port: 6881}
+		c := makePeerConn(addrConn{local, a}, tr, common.GeneratePeerID(), extensions.Message{})
+		tr.addOBPeer(c)
+		expected[a.String()] = map[string]string{"10.0.0.1": "NL", "10.0.0.2": "DE"}[ip]
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		found := 0
+		peers := tr.GetStatus().Peers
+		for _, st := range peers {
+			if st.Country == expected[st.Addr] {
+				found++
+			}
+		}
+		if found == len(expected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			for _, st := range peers {
+				t.Errorf("peer %s is from %q, expected %q", st.Addr, st.Country, expected[st.Addr])
+			}
+			t.FailNow()
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// no provider means no lookups
+	tr.GeoIP = nil
+	for _, st := range tr.GetStatus().Peers {
+		if st.Country != "" {
+			t.Errorf("peer %s has country %q with no geoip", st.Addr, st.Country)
+		}
+	}
+}
+
+func TestAdvertiseUploadOnly(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize))
+	defer closeTestTorrent(tr, n)
+	st := tr.st.(*testStorage)
+	st.bf.Set(0)
+	st.bf.Set(1)
+	local, _ := net.Pipe()
+	c := makePeerConn(local, tr, common.GeneratePeerID(), extensions.New())
+	tr.addOBPeer(c)
+	tr.advertiseUploadOnly(true)
+	select {
+	case msg := <-c.send:
+		opts, err := extensions.FromWireMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.ID != 0 || !opts.IsUploadOnly() {
+			t.Errorf("sent extended message %d without upload_only", opts.ID)
+		}
+	default:
+		t.Fatal("no extended handshake sent")
+	}
+	// only once
+	tr.advertiseUploadOnly(true)
+	if len(c.send) != 0 {
+		t.Error("upload_only sent again")
+	}
+	// a recheck found pieces missing, peers must hear we download again
+	st.data[BlockSize] ^= 0xff
+	if err := tr.Recheck(); err != nil {
+		t.Fatal(err)
+	}
+	cleared := false
+	for len(c.send) > 0 {
+		msg := <-c.send
+		if msg.MessageID() == common.Extended && bytes.Contains(msg.Payload(), []byte("11:upload_onlyi0e")) {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("upload_only not cleared after recheck")
+	}
+	// not there at all when we never said we only upload
+	opts := extensions.New()
+	if bytes.Contains(opts.ToWireMessage().Payload(), []byte("upload_only")) {
+		t.Error("upload_only sent while downloading")
+	}
+}
+
+// make a peer that has every piece and is not choking us
+func unchokedTestSeed(tr *Torrent, n byte) *PeerConn {
+	c := testPeerFrom(tr, n)
+	tr.addOBPeer(c)
+	c.bf = bittorrent.NewBitfield(tr.MetaInfo().Info.NumPieces(), nil)
+	for idx := uint32(0); idx < c.bf.Length; idx++ {
+		c.bf.Set(idx)
+	}
+	c.peerChoke = false
+	c.runDownload = true
+	return c
+}
+
+func TestPeerRequestQueueRespected(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(8, BlockSize*4))
+	defer closeTestTorrent(tr, n)
+	c := unchokedTestSeed(tr, 1)
+	c.MaxParalellRequests = 64
+	opts := extensions.New()
+	opts.RequestQueue = 10
+	if err := c.inboundMessage(opts.ToWireMessage()); err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 40; idx++ {
+		c.nextPieceRequest = time.Time{}
+		c.tickDownload()
+		if got := c.numDownloading(); got > 10 {
+			t.Fatalf("%d requests out to a peer that queues 10", got)
+		}
+	}
+	if got := c.numDownloading(); got != 10 {
+		t.Errorf("%d requests out, expected 10", got)
+	}
+}
+
+func TestUploadOnlyPeerNotAskedFirst(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(8, BlockSize))
+	defer closeTestTorrent(tr, n)
+	seed := unchokedTestSeed(tr, 1)
+	only := unchokedTestSeed(tr, 2)
+	only.theirOpts = extensions.New()
+	only.theirOpts.SetUploadOnly(true)
+
+	seed.tickDownload()
+	only.tickDownload()
+	if seed.numDownloading() == 0 {
+		t.Error("nothing asked from the normal peer")
+	}
+	if only.numDownloading() != 0 {
+		t.Errorf("upload only peer asked for %d blocks while another peer can give them", only.numDownloading())
+	}
+
+	// still used when it is all we have
+	seed.peerChoke = true
+	only.tickDownload()
+	if only.numDownloading() == 0 {
+		t.Error("upload only peer not asked when no one else can give us pieces")
+	}
+}
+
+func TestUnsolicitedPieceIgnored(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize*2))
+	defer closeTestTorrent(tr, n)
+	st := tr.st.(*testStorage)
+	c := unchokedTestSeed(tr, 1)
+	c.MaxParalellRequests = 1
+	c.tickDownload()
+	if c.numDownloading() != 1 {
+		t.Fatalf("asked for %d blocks, expected 1", c.numDownloading())
+	}
+	c.access.Lock()
+	asked := *c.downloading[0]
+	c.access.Unlock()
+	junk := func(idx, begin uint32) *common.PieceData {
+		return &common.PieceData{Index: idx, Begin: begin, Data: bytes.Repeat([]byte{0xff}, BlockSize)}
+	}
+
+	// the other block of the piece we are downloading and a piece we never started
+	c.gotDownload(junk(asked.Index, asked.Begin^BlockSize))
+	c.gotDownload(junk(asked.Index^1, 0))
+	if !bytes.Equal(st.data, make([]byte, len(st.data))) {
+		t.Error("unsolicited piece data was stored")
+	}
+	if p := tr.pt.PendingPieces(); len(p) != 1 || p[0] != asked.Index {
+		t.Errorf("pieces in progress are %v, expected only %d", p, asked.Index)
+	}
+	tr.pt.visitInProgress(asked.Index, func(cp *cachedPiece) {
+		if cp.obtained.CountSet() != 0 {
+			t.Error("unsolicited block marked as obtained")
+		}
+	})
+
+	// what we asked for still counts, once
+	good := &common.PieceData{Index: asked.Index, Begin: asked.Begin, Data: make([]byte, asked.Length)}
+	c.gotDownload(good)
+	tr.pt.handlePieceData(junk(asked.Index, asked.Begin))
+	if !bytes.Equal(st.data, make([]byte, len(st.data))) {
+		t.Error("duplicate block overwrote the one we got")
+	}
+	tr.pt.visitInProgress(asked.Index, func(cp *cachedPiece) {
+		if cp.obtained.CountSet() != 1 {
+			t.Errorf("%d blocks obtained, expected 1", cp.obtained.CountSet())
+		}
+	})
+	if tr.Bitfield().CountSet() != 0 {
+		t.Error("progress changed without a whole piece")
+	}
+}
+
+func TestMalformedMessageClosesPeer(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(10, BlockSize))
+	defer closeTestTorrent(tr, n)
+	for _, msg := range []common.WireMessage{
+		common.NewWireMessage(common.Have, []byte{0, 1}),
+		common.NewWireMessage(common.Request, make([]byte, 4)),
+		// 10 pieces need 2 bytes
+		common.NewWireMessage(common.BitField, []byte{0xff, 0xff, 0xff}),
+	} {
+		c := testPeerFrom(tr, 1)
+		if err := c.inboundMessage(msg); err != common.ErrBadMessageLength {
+			t.Errorf("bad %s message gave %v", msg.MessageID(), err)
+		}
+		if c.bf != nil {
+			t.Errorf("bad %s message changed the peer bitfield", msg.MessageID())
+		}
+	}
+	c := testPeerFrom(tr, 2)
+	if err := c.inboundMessage(common.NewWireMessage(common.BitField, []byte{0xff, 0xc0})); err != nil {
+		t.Errorf("good bitfield gave %s", err)
+	}
+	if c.bf == nil || c.bf.CountSet() != 10 {
+		t.Error("good bitfield not used")
+	}
+}
+
+func TestBitfieldSpareBitsRejected(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(10, BlockSize))
+	defer closeTestTorrent(tr, n)
+	c := testPeerFrom(tr, 1)
+	// 10 pieces leave the last 6 bits spare
+	if err := c.inboundMessage(common.NewWireMessage(common.BitField, []byte{0xff, 0xc1})); err != bittorrent.ErrSpareBitsSet {
+		t.Errorf("bitfield with spare bits set gave %v", err)
+	}
+	if c.bf != nil {
+		t.Error("bitfield with spare bits set was used")
+	}
+}
+
+func TestTraceMessages(t *testing.T) {
+	var buff bytes.Buffer
+	log.SetOutput(&buff)
+	defer log.SetOutput(os.Stdout)
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.TraceMessages = true
+	c := testPeerFrom(tr, 1)
+	c.recv(common.NewInterested())
+	c.recv(common.NewHave(2))
+	c.processWrite(io.Discard, common.NewNotInterested())
+	c.recv(common.KeepAlive)
+
+	var got []string
+	prefix := "trace " + c.id.String() + " "
+	for _, line := range strings.Split(buff.String(), "\n") {
+		if idx := strings.Index(line, prefix); idx >= 0 {
+			got = append(got, line[idx+len(prefix):])
+		}
+	}
+	expected := []string{
+		"<- Interested 1 bytes",
+		"<- Have 5 bytes",
+		"-> NotInterested 1 bytes",
+		"<- KeepAlive 0 bytes",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("traced %q, expected %q", got, expected)
+	}
+	for idx := range expected {
+		if !strings.HasPrefix(got[idx], expected[idx]) {
+			t.Errorf("traced %q, expected %q", got[idx], expected[idx])
+		}
+	}
+}
+
+func TestChokeFlappingCollapsed(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(8, BlockSize))
+	defer closeTestTorrent(tr, n)
+	c := unchokedTestSeed(tr, 1)
+	c.peerChoke = true
+	c.MaxParalellRequests = 4
+	c.nextPieceRequest = time.Time{}
+
+	cancels := 0
+	for round := 0; round < 10; round++ {
+		c.inboundMessage(common.NewWireMessage(common.UnChoke, nil))
+		for idx := 0; idx < 4; idx++ {
+			tr.tick()
+		}
+		c.inboundMessage(common.NewWireMessage(common.Choke, nil))
+		for len(c.send) > 0 {
+			if msg := <-c.send; msg.MessageID() == common.Cancel {
+				cancels++
+			}
+		}
+	}
+	if cancels == 0 {
+		t.Fatal("choking with requests out sent no cancels")
+	}
+	// only the toggles before it was seen flapping got to ask and cancel
+	if max := (MaxChokeToggles/2 + 1) * 4; cancels > max {
+		t.Errorf("sent %d cancels, expected no more than %d", cancels, max)
+	}
+	if !c.RemoteChoking() {
+		t.Fatal("not choked after the last choke")
+	}
+
+	// left unchoked long enough we believe it again
+	c.inboundMessage(common.NewWireMessage(common.UnChoke, nil))
+	if !c.RemoteChoking() {
+		t.Error("unchoke believed while flapping")
+	}
+	c.settleChoke(time.Now().Add(ChokeFlapWindow))
+	if c.RemoteChoking() {
+		t.Error("still choked after settling down")
+	}
+}
+
+func TestPeerStatusJSON(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	local, _ := net.Pipe()
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	c := makePeerConn(addrConn{local, a}, tr, common.PeerID{'-', 'q', 'B', '4', '2', '5', '0', '-'}, extensions.Message{})
+	c.theirOpts.Version = "qBittorrent v4.2.5"
+	c.peerChoke = false
+	c.peerInterested = true
+	tr.addOBPeer(c)
+
+	data, err := json.Marshal(tr.GetStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status struct {
+		Peers []map[string]interface{}
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Peers) != 1 {
+		t.Fatalf("status has %d peers", len(status.Peers))
+	}
+	peer := status.Peers[0]
+	for k, expected := range map[string]interface{}{
+		"Addr":           "10.0.0.1:6881",
+		"Port":           float64(6881),
+		"ClientVersion":  "qBittorrent v4.2.5",
+		"ThemChoking":    false,
+		"ThemInterested": true,
+		"UsChoking":      true,
+		"UsInterested":   true,
+		"Encrypted":      false,
+		"TX":             float64(0),
+		"RX":             float64(0),
+	} {
+		if got, ok := peer[k]; !ok || got != expected {
+			t.Errorf("peer %s is %v, expected %v", k, got, expected)
+		}
+	}
+	if client, _ := peer["Client"].(string); client == "" {
+		t.Error("peer has no client name from its id")
+	}
+}
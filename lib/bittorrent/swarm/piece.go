@@ -1,17 +1,29 @@
 package swarm
 
 import (
+	"errors"
 	"github.com/majestrate/XD/lib/bittorrent"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/log"
 	"github.com/majestrate/XD/lib/storage"
 	"github.com/majestrate/XD/lib/sync"
+	"math/rand"
+	"syscall"
 	"time"
 )
 
 // how big should we download pieces at a time (bytes)?
 const BlockSize = 1024 * 16
 
+// MaxBlockSize is the most we ask a fast peer for at once (bytes)
+const MaxBlockSize = 1024 * 64
+
+// DefaultLargeBlockRate is how fast a peer has to send to us (bytes per second) before we ask it for large blocks
+const DefaultLargeBlockRate = 1024 * 1024
+
+// MaxBackgroundVerifies is how many finished pieces a torrent hashes at once when verifying in the background
+const MaxBackgroundVerifies = 2
+
 // cached downloading piece
 type cachedPiece struct {
 	pending    *bittorrent.Bitfield
@@ -20,6 +32,12 @@ type cachedPiece struct {
 	index      uint32
 	length     uint32
 	mtx        sync.Mutex
+	// hand out blocks in random order instead of lowest offset first
+	random bool
+	// blocks we are trying to store again, they stay asked for
+	retrying int
+	// all blocks are in and the piece is being hashed
+	verifying bool
 }
 
 // should we accept a piece data with offset and length ?
@@ -29,6 +47,8 @@ func (p *cachedPiece) accept(offset, length uint32) bool {
 
 // is this piece done downloading ?
 func (p *cachedPiece) done() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
 	return p.obtained.Completed()
 }
 
@@ -37,61 +57,137 @@ func (p *cachedPiece) bitfieldIndex(offset uint32) uint32 {
 	return offset / BlockSize
 }
 
+// calculate the bitfield indexes a slice of length bytes at offset covers, at least one
+func (p *cachedPiece) bitfieldRange(offset, length uint32) (first, end uint32) {
+	first = p.bitfieldIndex(offset)
+	end = p.bitfieldIndex(offset + length + BlockSize - 1)
+	if end <= first {
+		end = first + 1
+	}
+	return
+}
+
 // mark slice of data at offset as obtained
-func (p *cachedPiece) put(offset uint32) {
+func (p *cachedPiece) put(offset, length uint32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
 	// set obtained
-	idx := p.bitfieldIndex(offset)
-	p.obtained.Set(idx)
-	p.pending.Unset(idx)
+	first, end := p.bitfieldRange(offset, length)
+	for idx := first; idx < end; idx++ {
+		p.obtained.Set(idx)
+		p.pending.Unset(idx)
+	}
 	p.lastActive = time.Now()
-	log.Debugf("put idx=%d offset=%d bit=%d", p.index, offset, idx)
+	log.Debugf("put idx=%d offset=%d bits=%d-%d", p.index, offset, first, end)
+}
+
+// return true if we already got all of the slice at offset
+func (p *cachedPiece) has(offset, length uint32) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	first, end := p.bitfieldRange(offset, length)
+	for idx := first; idx < end; idx++ {
+		if !p.obtained.Has(idx) {
+			return false
+		}
+	}
+	return true
 }
 
 // cancel a slice
-func (p *cachedPiece) cancel(offset uint32) {
-	idx := p.bitfieldIndex(offset)
-	p.pending.Unset(idx)
+func (p *cachedPiece) cancel(offset, length uint32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	first, end := p.bitfieldRange(offset, length)
+	for idx := first; idx < end; idx++ {
+		p.pending.Unset(idx)
+	}
 	p.lastActive = time.Now()
 }
 
+// find a block we did not get or ask for yet
+func (p *cachedPiece) nextBlock() (idx uint32, has bool) {
+	var free []uint32
+	for bit := uint32(0); bit < p.obtained.Length && bit*BlockSize < p.length; bit++ {
+		if p.pending.Has(bit) || p.obtained.Has(bit) {
+			continue
+		}
+		if !p.random {
+			return bit, true
+		}
+		free = append(free, bit)
+	}
+	if len(free) > 0 {
+		idx = free[rand.Intn(len(free))]
+		has = true
+	}
+	return
+}
+
 func (p *cachedPiece) nextRequest() (r *common.PieceRequest) {
+	return p.nextRequestOf(BlockSize)
+}
+
+// like nextRequest but asks for up to size bytes at once
+// the following blocks are added on as long as nobody was asked for them yet
+func (p *cachedPiece) nextRequestOf(size uint32) (r *common.PieceRequest) {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
-	l := p.length
+	idx, has := p.nextBlock()
+	if !has {
+		log.Debugf("no next piece request for idx=%d", p.index)
+		return
+	}
+	end := idx + 1
+	for end < p.obtained.Length && (end-idx+1)*BlockSize <= size && !p.pending.Has(end) && !p.obtained.Has(end) {
+		end++
+	}
 	r = new(common.PieceRequest)
 	r.Index = p.index
-	r.Length = BlockSize
-	for r.Begin < l {
-		idx := p.bitfieldIndex(r.Begin)
-		if p.pending.Has(idx) || p.obtained.Has(idx) {
-			r.Begin += BlockSize
-		} else {
-			break
-		}
+	r.Begin = idx * BlockSize
+	r.Length = (end - idx) * BlockSize
+	if r.Begin+r.Length > p.length {
+		// last block is short
+		r.Length = p.length - r.Begin
 	}
-
-	if r.Begin+r.Length > l {
-		// is this probably the last piece ?
-		if (r.Begin+r.Length)-l >= BlockSize {
-			// no, let's just say there are no more blocks left
-			log.Debugf("no next piece request for idx=%d", r.Index)
-			r = nil
-			return
-		} else {
-			// yes so let's correct the size
-			if p.pending.Has(p.bitfieldIndex(r.Begin)) {
-				log.Debugf("no next piece request for idx=%d", r.Index)
-				r = nil
-				return
-			}
-			r.Length = l - r.Begin
-		}
+	log.Debugf("next piece request made: idx=%d offset=%d len=%d total=%d", r.Index, r.Begin, r.Length, p.length)
+	for ; idx < end; idx++ {
+		p.pending.Set(idx)
 	}
-	log.Debugf("next piece request made: idx=%d offset=%d len=%d total=%d", r.Index, r.Begin, r.Length, l)
-	p.pending.Set(p.bitfieldIndex(r.Begin))
 	return
 }
 
+// how many times we try storing a chunk again before downloading it again
+const DefaultPutChunkTries = 5
+
+// how long we wait before the first try at storing a chunk again, it doubles every try after
+const DefaultPutChunkRetryDelay = time.Millisecond * 100
+
+// most we wait between tries at storing a chunk
+const MaxPutChunkRetryDelay = time.Second * 2
+
+// get how long to wait before storing a chunk again for the try'th time
+// disks come back quickly or not at all so this stays a lot shorter than retrying peers
+func putChunkRetryDelay(try int) time.Duration {
+	if try < 1 {
+		try = 1
+	}
+	if try > 16 {
+		return MaxPutChunkRetryDelay
+	}
+	d := DefaultPutChunkRetryDelay << uint(try-1)
+	if d > MaxPutChunkRetryDelay {
+		d = MaxPutChunkRetryDelay
+	}
+	return d
+}
+
+// how many different pieces we ask one peer for at the same time by default
+const DefaultMaxPiecesPerPeer = 4
+
+// how many pieces we download at the same time per torrent by default
+const DefaultMaxInProgressPieces = 16
+
 // picks the next good piece to download
 type PiecePicker func(*bittorrent.Bitfield, []uint32) (uint32, bool)
 
@@ -102,6 +198,23 @@ type pieceTracker struct {
 	st        storage.Torrent
 	have      func(uint32)
 	nextPiece PiecePicker
+	// max pieces in progress at once, 0 or less for no limit
+	maxInProgress int
+	// held while storing piece data, paused is set under it
+	storing sync.RWMutex
+	paused  bool
+	// last error we got storing piece data, nil once a store works again
+	storeErr   error
+	errMtx     sync.Mutex
+	retrySleep func(time.Duration)
+	// called when storing fails because the disk is full
+	diskFull func(error)
+	// shared with other torrents, nil for no limit
+	budget *PieceBudget
+	// new pieces hand out their blocks in random order
+	randomBlocks bool
+	// hash finished pieces off the caller, nil to hash them right away
+	verifies chan bool
 }
 
 // get number of pending pieces we are requesting
@@ -125,21 +238,56 @@ func (pt *pieceTracker) visitCached(idx uint32, v func(*cachedPiece)) {
 	v(pc)
 }
 
+// like visitCached but does not start a new piece if idx is not in progress
+func (pt *pieceTracker) visitInProgress(idx uint32, v func(*cachedPiece)) {
+	pt.mtx.Lock()
+	pc, has := pt.requests[idx]
+	pt.mtx.Unlock()
+	if has {
+		v(pc)
+	}
+}
+
+// return true if we can't start any more pieces
+func (pt *pieceTracker) atCapacity() bool {
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+	if pt.maxInProgress > 0 && len(pt.requests) >= pt.maxInProgress {
+		return true
+	}
+	if pt.budget.full() {
+		return true
+	}
+	info := pt.st.MetaInfo()
+	return len(pt.requests) > 0 && info != nil && !pt.budget.fits(uint64(info.Info.PieceLength))
+}
+
 func createPieceTracker(st storage.Torrent, picker PiecePicker) (pt *pieceTracker) {
 	pt = &pieceTracker{
-		requests:  make(map[uint32]*cachedPiece),
-		st:        st,
-		nextPiece: picker,
+		requests:      make(map[uint32]*cachedPiece),
+		st:            st,
+		nextPiece:     picker,
+		maxInProgress: DefaultMaxInProgressPieces,
+		retrySleep:    time.Sleep,
 	}
 	return
 }
 
 func (pt *pieceTracker) newPiece(piece uint32) bool {
+	if pt.maxInProgress > 0 && len(pt.requests) >= pt.maxInProgress {
+		log.Debugf("not starting piece %d, %d pieces in progress", piece, len(pt.requests))
+		return false
+	}
 
 	info := pt.st.MetaInfo()
 
 	sz := info.LengthOfPiece(piece)
-	bits := sz / BlockSize
+	if !pt.budget.take(uint64(sz), len(pt.requests) == 0) {
+		log.Debugf("not starting piece %d, piece budget used up", piece)
+		return false
+	}
+	// the last block is shorter when the piece length isn't a multiple of the block size
+	bits := (sz + BlockSize - 1) / BlockSize
 	if bits == 0 {
 		bits++
 	}
@@ -150,14 +298,86 @@ func (pt *pieceTracker) newPiece(piece uint32) bool {
 		length:     sz,
 		index:      piece,
 		lastActive: time.Now(),
+		random:     pt.randomBlocks,
 	}
 	return true
 }
 
 func (pt *pieceTracker) removePiece(piece uint32) {
 	pt.mtx.Lock()
+	pc, has := pt.requests[piece]
 	delete(pt.requests, piece)
 	pt.mtx.Unlock()
+	if has {
+		pt.budget.give(uint64(pc.length), 1)
+	}
+}
+
+// drop every piece in progress, their bytes go back to the budget
+func (pt *pieceTracker) removeAll() {
+	var n uint64
+	pt.mtx.Lock()
+	pieces := len(pt.requests)
+	for idx, pc := range pt.requests {
+		n += uint64(pc.length)
+		delete(pt.requests, idx)
+	}
+	pt.mtx.Unlock()
+	pt.budget.give(n, pieces)
+}
+
+// get a copy of which blocks we stored for each piece in progress
+func (pt *pieceTracker) obtainedBlocks() map[uint32]*bittorrent.Bitfield {
+	pt.mtx.Lock()
+	var pieces []*cachedPiece
+	for _, pc := range pt.requests {
+		pieces = append(pieces, pc)
+	}
+	pt.mtx.Unlock()
+	blocks := make(map[uint32]*bittorrent.Bitfield)
+	for _, pc := range pieces {
+		pc.mtx.Lock()
+		if pc.obtained.CountSet() > 0 {
+			blocks[pc.index] = pc.obtained.Copy()
+		}
+		pc.mtx.Unlock()
+	}
+	return blocks
+}
+
+// start pieces we had blocks of before again so only the missing blocks are asked for
+func (pt *pieceTracker) restorePartial(blocks map[uint32]*bittorrent.Bitfield) {
+	info := pt.st.MetaInfo()
+	if info == nil {
+		return
+	}
+	bf := pt.st.Bitfield()
+	var done []uint32
+	pt.mtx.Lock()
+	for idx, obtained := range blocks {
+		if obtained == nil || obtained.CountSet() == 0 || idx >= info.Info.NumPieces() || bf.Has(idx) {
+			continue
+		}
+		if _, has := pt.requests[idx]; has {
+			continue
+		}
+		if !pt.newPiece(idx) {
+			break
+		}
+		pc := pt.requests[idx]
+		if obtained.Length != pc.obtained.Length {
+			// saved with a different block size, download all of it
+			continue
+		}
+		pc.obtained.CopyFrom(obtained)
+		if pc.obtained.Completed() {
+			done = append(done, idx)
+		}
+	}
+	pt.mtx.Unlock()
+	for _, idx := range done {
+		pt.verifyPiece(idx)
+	}
 }
 
 func (pt *pieceTracker) pendingPiece(remote *bittorrent.Bitfield) (idx uint32, old bool) {
@@ -186,6 +406,12 @@ func (pt *pieceTracker) iterCached(v func(*cachedPiece)) {
 }
 
 func (cp *cachedPiece) isExpired() (expired bool) {
+	cp.mtx.Lock()
+	defer cp.mtx.Unlock()
+	if cp.verifying {
+		// nothing comes in while it is hashed, however long that takes
+		return
+	}
 	now := time.Now()
 	expired = now.Sub(cp.lastActive) > time.Second*30
 	return
@@ -201,14 +427,36 @@ func (pt *pieceTracker) PendingPieces() (exclude []uint32) {
 }
 
 func (pt *pieceTracker) NextRequest(remote *bittorrent.Bitfield, lastReq *common.PieceRequest) (r *common.PieceRequest) {
+	return pt.nextRequestOf(remote, lastReq, BlockSize)
+}
+
+// like NextRequest but asks for up to size bytes at once
+func (pt *pieceTracker) nextRequestOf(remote *bittorrent.Bitfield, lastReq *common.PieceRequest, size uint32) (r *common.PieceRequest) {
+	if pt.isPaused() {
+		return
+	}
 	if lastReq != nil {
-		pt.visitCached(lastReq.Index, func(cp *cachedPiece) {
-			r = cp.nextRequest()
+		pt.visitInProgress(lastReq.Index, func(cp *cachedPiece) {
+			r = cp.nextRequestOf(size)
 		})
 	}
 	if r != nil {
 		return
 	}
+	if pt.atCapacity() {
+		// too many pieces in progress, help with one of them instead
+		for _, idx := range pt.PendingPieces() {
+			if remote != nil && remote.Has(idx) {
+				pt.visitInProgress(idx, func(cp *cachedPiece) {
+					r = cp.nextRequestOf(size)
+				})
+				if r != nil {
+					return
+				}
+			}
+		}
+		return
+	}
 	// no last request or no more requests for last request
 	// pick new piece
 	exclude := pt.PendingPieces()
@@ -219,7 +467,7 @@ func (pt *pieceTracker) NextRequest(remote *bittorrent.Bitfield, lastReq *common
 	}
 	// get next requset for this newly created piece
 	pt.visitCached(idx, func(cp *cachedPiece) {
-		r = cp.nextRequest()
+		r = cp.nextRequestOf(size)
 	})
 	return
 }
@@ -255,40 +503,237 @@ func (pt *pieceTracker) nextRequestForDownload(remote *bittorrent.Bitfield, req
 	return true
 }
 
+// get the next request of up to size bytes for one of pieces, never starts a new piece
+func (pt *pieceTracker) nextRequestIn(pieces []uint32, size uint32) (r *common.PieceRequest) {
+	if pt.isPaused() {
+		return
+	}
+	for _, idx := range pieces {
+		pt.visitInProgress(idx, func(cp *cachedPiece) {
+			r = cp.nextRequestOf(size)
+		})
+		if r != nil {
+			return
+		}
+	}
+	return
+}
+
+// give back blocks we asked for that no peer has a request out for anymore so they get asked for again
+// owned tells if some peer has a request out for the block at begin in piece idx
+func (pt *pieceTracker) freeOrphanedBlocks(owned func(idx, begin uint32) bool) (freed int) {
+	pt.mtx.Lock()
+	var pieces []*cachedPiece
+	for _, pc := range pt.requests {
+		pieces = append(pieces, pc)
+	}
+	pt.mtx.Unlock()
+	for _, pc := range pieces {
+		pc.mtx.Lock()
+		if pc.retrying == 0 {
+			for bit := uint32(0); bit < pc.pending.Length; bit++ {
+				if pc.pending.Has(bit) && !pc.obtained.Has(bit) && !owned(pc.index, bit*BlockSize) {
+					pc.pending.Unset(bit)
+					freed++
+				}
+			}
+		}
+		pc.mtx.Unlock()
+	}
+	return
+}
+
 // cancel previously requested piece request
 func (pt *pieceTracker) canceledRequest(r *common.PieceRequest) {
 	if r.Length == 0 {
 		return
 	}
-	pt.visitCached(r.Index, func(pc *cachedPiece) {
-		pc.cancel(r.Begin)
+	pt.visitInProgress(r.Index, func(pc *cachedPiece) {
+		pc.cancel(r.Begin, r.Length)
 	})
 }
 
+// stop storing piece data and making requests, waits for stores in progress to finish
+func (pt *pieceTracker) pause() {
+	pt.storing.Lock()
+	pt.paused = true
+	pt.storing.Unlock()
+}
+
+func (pt *pieceTracker) resume() {
+	pt.storing.Lock()
+	pt.paused = false
+	pt.storing.Unlock()
+}
+
+func (pt *pieceTracker) isPaused() bool {
+	pt.storing.RLock()
+	defer pt.storing.RUnlock()
+	return pt.paused
+}
+
 func (pt *pieceTracker) handlePieceData(d *common.PieceData) {
+	pt.storing.RLock()
+	defer pt.storing.RUnlock()
+	if pt.paused {
+		log.Debugf("dropping piece data %d %d while paused", d.Index, d.Begin)
+		return
+	}
 	idx := d.Index
-	pt.visitCached(idx, func(pc *cachedPiece) {
+	if pt.st.Bitfield().Has(idx) {
+		log.Debugf("dropping piece data %d %d for a piece we have", d.Index, d.Begin)
+		return
+	}
+	// only pieces we asked for, never start a new one here
+	pt.visitInProgress(idx, func(pc *cachedPiece) {
 		if !pc.accept(d.Begin, uint32(len(d.Data))) {
 			log.Errorf("invalid piece data: index=%d offset=%d length=%d", d.Index, d.Begin, len(d.Data))
 			return
 		}
+		if pc.has(d.Begin, uint32(len(d.Data))) {
+			log.Debugf("dropping duplicate piece data %d %d", d.Index, d.Begin)
+			return
+		}
 		err := pt.st.PutChunk(d)
 		if err == nil {
-			pc.put(d.Begin)
+			pt.chunkStored(pc, d.Begin, uint32(len(d.Data)))
+		} else if isDiskFull(err) {
+			// trying again won't help until someone makes space
+			pt.setStoreError(err)
+			pc.cancel(d.Begin, uint32(len(d.Data)))
+			pt.fullDisk(err)
 		} else {
 			log.Errorf("failed to put chunk %d: %s", idx, err.Error())
-		}
-		if pc.done() {
-			err = pt.st.VerifyPiece(idx)
-			if err == nil {
-				pt.st.Flush()
-				if pt.have != nil {
-					pt.have(idx)
-				}
-			} else {
-				log.Warnf("put piece %d failed: %s", idx, err.Error())
+			pt.setStoreError(err)
+			// hold on to the data and try again instead of losing it
+			retry := &common.PieceData{
+				Index: d.Index,
+				Begin: d.Begin,
+				Data:  make([]byte, len(d.Data)),
 			}
-			pt.removePiece(idx)
+			copy(retry.Data, d.Data)
+			pc.mtx.Lock()
+			pc.retrying++
+			pc.mtx.Unlock()
+			go pt.retryPutChunk(pc, retry)
 		}
 	})
 }
+
+// mark a chunk as stored and finish the piece if it is complete
+func (pt *pieceTracker) chunkStored(pc *cachedPiece, offset, length uint32) {
+	pc.put(offset, length)
+	if !pc.done() {
+		return
+	}
+	pt.mtx.Lock()
+	verifies := pt.verifies
+	pt.mtx.Unlock()
+	if verifies == nil {
+		pt.verifyPiece(pc.index)
+		return
+	}
+	pc.mtx.Lock()
+	if pc.verifying {
+		pc.mtx.Unlock()
+		return
+	}
+	pc.verifying = true
+	pc.mtx.Unlock()
+	// hashing a big piece takes a while, don't hold up whoever gave us the last block
+	go func() {
+		verifies <- true
+		pt.storing.RLock()
+		if pt.paused {
+			// whoever paused us checks everything anyways
+			pt.removePiece(pc.index)
+		} else {
+			pt.verifyPiece(pc.index)
+		}
+		pt.storing.RUnlock()
+		<-verifies
+	}()
+}
+
+// check a piece we got all blocks of, we have it if it is good, if not it is downloaded again
+func (pt *pieceTracker) verifyPiece(idx uint32) {
+	err := pt.st.VerifyPiece(idx)
+	if err == nil {
+		err = pt.st.Flush()
+		if err != nil {
+			log.Errorf("failed to flush piece %d: %s", idx, err.Error())
+			pt.setStoreError(err)
+		}
+		if pt.have != nil {
+			pt.have(idx)
+		}
+	} else {
+		log.Warnf("put piece %d failed: %s", idx, err.Error())
+	}
+	pt.removePiece(idx)
+}
+
+// store a chunk that failed to store, backing off between tries
+// if it keeps failing the chunk is given back to be downloaded again
+func (pt *pieceTracker) retryPutChunk(pc *cachedPiece, d *common.PieceData) {
+	defer func() {
+		pc.mtx.Lock()
+		pc.retrying--
+		pc.mtx.Unlock()
+	}()
+	for try := 1; try <= DefaultPutChunkTries; try++ {
+		pt.retrySleep(putChunkRetryDelay(try))
+		pt.storing.RLock()
+		if pt.paused {
+			pt.storing.RUnlock()
+			break
+		}
+		// don't let the piece expire while we retry
+		pc.mtx.Lock()
+		pc.lastActive = time.Now()
+		pc.mtx.Unlock()
+		err := pt.st.PutChunk(d)
+		if err == nil {
+			pt.setStoreError(nil)
+			pt.chunkStored(pc, d.Begin, uint32(len(d.Data)))
+			pt.storing.RUnlock()
+			return
+		}
+		pt.storing.RUnlock()
+		log.Warnf("failed to put chunk %d %d again: %s", d.Index, d.Begin, err.Error())
+		pt.setStoreError(err)
+		if isDiskFull(err) {
+			pc.cancel(d.Begin, uint32(len(d.Data)))
+			pt.fullDisk(err)
+			return
+		}
+	}
+	log.Errorf("giving up on storing %d %d, will download it again", d.Index, d.Begin)
+	pc.cancel(d.Begin, uint32(len(d.Data)))
+}
+
+// is err from running out of disk space ?
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+func (pt *pieceTracker) fullDisk(err error) {
+	log.Errorf("no space left to store pieces: %s", err.Error())
+	if pt.diskFull != nil {
+		// piece data is handled with the peer locked, let it go first
+		go pt.diskFull(err)
+	}
+}
+
+func (pt *pieceTracker) setStoreError(err error) {
+	pt.errMtx.Lock()
+	pt.storeErr = err
+	pt.errMtx.Unlock()
+}
+
+// StoreError gets the last error storing piece data, nil if the last store worked
+func (pt *pieceTracker) StoreError() error {
+	pt.errMtx.Lock()
+	defer pt.errMtx.Unlock()
+	return pt.storeErr
+}
@@ -1,11 +1,511 @@
 package swarm
 
 import (
-	"github.com/majestrate/XD/lib/log"
+	"crypto/sha1"
+	"errors"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/metainfo"
+	"math/rand"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
-func TestPieceRequester(t *testing.T) {
-	log.SetLevel("debug")
+func TestMaxInProgressPieces(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(10, BlockSize*4))
+	defer closeTestTorrent(tr, n)
+	tr.SetMaxInProgressPieces(2)
+	remote := bittorrent.NewBitfield(10, nil)
+	for idx := uint32(0); idx < 10; idx++ {
+		remote.Set(idx)
+	}
 
+	// many peers asking for something new to download
+	got := 0
+	for idx := 0; idx < 20; idx++ {
+		if tr.pt.NextRequest(remote, nil) != nil {
+			got++
+		}
+		if p := tr.pt.NumPending(); p > 2 {
+			t.Fatalf("%d pieces in progress but max is 2", p)
+		}
+	}
+	// every block of the 2 in progress pieces is handed out before we stop
+	if got != 8 {
+		t.Errorf("got %d requests, expected 8", got)
+	}
+
+	// a piece finishing lets a new one start
+	pending := tr.pt.PendingPieces()
+	tr.st.(*testStorage).setPiece(pending[0])
+	tr.pt.removePiece(pending[0])
+	r := tr.pt.NextRequest(remote, nil)
+	if r == nil {
+		t.Fatal("no request after a piece finished")
+	}
+	if r.Index == pending[0] || r.Index == pending[1] {
+		t.Errorf("got request for piece %d which is not new", r.Index)
+	}
+	if p := tr.pt.NumPending(); p != 2 {
+		t.Errorf("%d pieces in progress, expected 2", p)
+	}
+}
+
+func TestPutChunkFailureRetried(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize))
+	defer closeTestTorrent(tr, n)
+	st := tr.st.(*testStorage)
+	st.putFails = 1
+	retry := make(chan bool)
+	tr.pt.retrySleep = func(time.Duration) {
+		<-retry
+	}
+	remote := bittorrent.NewBitfield(2, nil)
+	remote.Set(0)
+	r := tr.pt.NextRequest(remote, nil)
+	if r == nil {
+		t.Fatal("no request made")
+	}
+	tr.pt.handlePieceData(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: make([]byte, r.Length)})
+	if st.bf.Has(r.Index) {
+		t.Fatal("piece stored even though storing failed")
+	}
+	if status := tr.GetStatus(); status.Error != errTestPut.Error() {
+		t.Errorf("status error is %q after failing to store", status.Error)
+	}
+
+	// a good piece gets flushed right after it is marked as had
+	flushed := make(chan bool, 1)
+	st.onFlush = func() {
+		flushed <- true
+	}
+	retry <- true
+	select {
+	case <-flushed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("piece never stored")
+	}
+	if !st.bf.Has(r.Index) {
+		t.Fatal("piece not had after storing it")
+	}
+	if err := tr.pt.StoreError(); err != nil {
+		t.Errorf("store error %s still there after storing worked", err)
+	}
+}
+
+func TestPutChunkGivesUp(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize))
+	defer closeTestTorrent(tr, n)
+	st := tr.st.(*testStorage)
+	st.putFails = DefaultPutChunkTries + 1
+	tr.pt.retrySleep = func(time.Duration) {}
+	remote := bittorrent.NewBitfield(2, nil)
+	remote.Set(0)
+	r := tr.pt.NextRequest(remote, nil)
+	if r == nil {
+		t.Fatal("no request made")
+	}
+	tr.pt.handlePieceData(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: make([]byte, r.Length)})
+	// the block can be downloaded again once we give up storing it
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var next *common.PieceRequest
+		tr.pt.visitInProgress(r.Index, func(cp *cachedPiece) {
+			next = cp.nextRequest()
+		})
+		if next != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("block not requestable after giving up on storing it")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if st.bf.Has(r.Index) {
+		t.Error("piece marked as had without being stored")
+	}
+}
+
+// count the requests c queued to send, draining everything else
+func countRequests(c *PeerConn) (n int) {
+	for len(c.send) > 0 {
+		if msg := <-c.send; msg.MessageID() == common.Request {
+			n++
+		}
+	}
+	return
+}
+
+func TestDiskFullStopsDownload(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.setState(Downloading)
+	st := tr.st.(*testStorage)
+	st.putErr = &os.PathError{Op: "write", Path: "test", Err: syscall.ENOSPC}
+	c := unchokedTestSeed(tr, 1)
+
+	tr.tick()
+	if countRequests(c) == 0 {
+		t.Fatal("nothing requested")
+	}
+	r := c.downloading[0]
+	c.gotDownload(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: make([]byte, r.Length)})
+	waitForState(t, tr, Errored)
+	if !errors.Is(tr.Err(), ErrDiskFull) {
+		t.Errorf("torrent error is %v", tr.Err())
+	}
+	if status := tr.GetStatus(); !strings.HasPrefix(status.Error, ErrDiskFull.Error()) {
+		t.Errorf("status error is %q", status.Error)
+	}
+	if tr.pt.NumPending() != 0 {
+		t.Errorf("%d pieces still in progress", tr.pt.NumPending())
+	}
+	countRequests(c)
+	tr.tick()
+	if got := countRequests(c); got != 0 {
+		t.Errorf("requested %d blocks with a full disk", got)
+	}
+
+	// someone made space
+	st.putErr = nil
+	tr.retryDiskFull(time.Now().Add(DiskFullRetryInterval))
+	if s := tr.State(); s != Downloading {
+		t.Fatalf("torrent is %s after retrying", s)
+	}
+	tr.tick()
+	if countRequests(c) == 0 {
+		t.Error("nothing requested after retrying")
+	}
+}
+
+func TestDownloadQuotaStopsRequesting(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.setState(Downloading)
+	tr.DownloadQuota = BlockSize * 2
+	c := unchokedTestSeed(tr, 1)
+
+	tr.tick()
+	if countRequests(c) == 0 {
+		t.Fatal("nothing requested under the quota")
+	}
+	tr.rxRate.Add(BlockSize * 2)
+	tr.tick()
+	if !errors.Is(tr.Err(), ErrQuotaReached) {
+		t.Fatalf("torrent error is %v after reaching the quota", tr.Err())
+	}
+	if tr.pt.NumPending() != 0 {
+		t.Errorf("%d pieces still in progress", tr.pt.NumPending())
+	}
+	countRequests(c)
+	tr.tick()
+	if got := countRequests(c); got != 0 {
+		t.Errorf("requested %d blocks over the quota", got)
+	}
+
+	// raising the quota carries on
+	tr.DownloadQuota = BlockSize * 4
+	tr.tick()
+	if s := tr.State(); s != Downloading {
+		t.Fatalf("torrent is %s under the raised quota", s)
+	}
+	tr.tick()
+	if countRequests(c) == 0 {
+		t.Error("nothing requested under the raised quota")
+	}
+}
+
+func TestMaxPiecesPerPeer(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(8, BlockSize*2))
+	defer closeTestTorrent(tr, n)
+	tr.MaxPiecesPerPeer = 2
+	c := unchokedTestSeed(tr, 1)
+	c.MaxParalellRequests = 16
+	for idx := 0; idx < 8; idx++ {
+		c.nextPieceRequest = time.Time{}
+		c.tickDownload()
+	}
+	if pieces := c.downloadingPieces(); len(pieces) != 2 {
+		t.Fatalf("peer asked for blocks of %d pieces, cap is 2", len(pieces))
+	}
+	// both blocks of both pieces, nothing else
+	if n := c.numDownloading(); n != 4 {
+		t.Errorf("peer asked for %d blocks, expected 4", n)
+	}
+
+	// finishing a piece makes room for a new one
+	c.access.Lock()
+	var done []*common.PieceRequest
+	for _, r := range c.downloading {
+		if r.Index == c.downloading[0].Index {
+			done = append(done, r)
+		}
+	}
+	c.access.Unlock()
+	for _, r := range done {
+		c.gotDownload(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: make([]byte, r.Length)})
+	}
+	c.nextPieceRequest = time.Time{}
+	c.tickDownload()
+	if pieces := c.downloadingPieces(); len(pieces) != 2 {
+		t.Errorf("peer downloading %d pieces after finishing one, expected 2", len(pieces))
+	}
+}
+
+func TestHugePieceAssembles(t *testing.T) {
+	for _, pieceLen := range []uint32{64 * 1024 * 1024, 64*1024*1024 + 1000} {
+		data := make([]byte, pieceLen)
+		for idx := range data {
+			data[idx] = byte(idx / BlockSize)
+		}
+		h := sha1.Sum(data)
+		tr, n := newTestTorrent(&metainfo.TorrentFile{
+			Info: metainfo.Info{
+				Path:        "huge",
+				PieceLength: pieceLen,
+				Pieces:      h[:],
+				Length:      uint64(pieceLen),
+			},
+		})
+		remote := bittorrent.NewBitfield(1, nil)
+		remote.Set(0)
+		blocks := (pieceLen + BlockSize - 1) / BlockSize
+		var reqs []*common.PieceRequest
+		for r := tr.pt.NextRequest(remote, nil); r != nil && uint32(len(reqs)) <= blocks; r = tr.pt.NextRequest(remote, r) {
+			reqs = append(reqs, r)
+		}
+		if uint32(len(reqs)) != blocks {
+			t.Fatalf("got %d requests for a piece of %d bytes, expected %d", len(reqs), pieceLen, blocks)
+		}
+		if last := reqs[len(reqs)-1]; last.Begin+last.Length != pieceLen {
+			t.Fatalf("last request ends at %d, piece is %d bytes", last.Begin+last.Length, pieceLen)
+		}
+		// blocks come back in any order
+		for idx := len(reqs) - 1; idx >= 0; idx-- {
+			r := reqs[idx]
+			tr.pt.handlePieceData(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: data[r.Begin : r.Begin+r.Length]})
+		}
+		if !tr.st.Bitfield().Has(0) {
+			t.Errorf("piece of %d bytes did not verify once all blocks came in", pieceLen)
+		}
+		if p := tr.pt.NumPending(); p != 0 {
+			t.Errorf("%d pieces still in progress", p)
+		}
+		closeTestTorrent(tr, n)
+	}
+}
+
+func TestPieceSourceReproducible(t *testing.T) {
+	pick := func(seed int64) (picked []uint32) {
+		tr, n := newTestTorrent(testMetaInfo(64, BlockSize))
+		defer closeTestTorrent(tr, n)
+		tr.SetMaxInProgressPieces(0)
+		tr.SetPieceSource(rand.NewSource(seed))
+		remote := bittorrent.NewBitfield(64, nil)
+		for idx := uint32(0); idx < 64; idx++ {
+			remote.Set(idx)
+		}
+		// some pieces are less rare than others
+		popular := bittorrent.NewBitfield(64, nil)
+		for idx := uint32(0); idx < 64; idx += 3 {
+			popular.Set(idx)
+		}
+		tr.availability.addBitfield(remote)
+		tr.availability.addBitfield(popular)
+		for {
+			r := tr.pt.NextRequest(remote, nil)
+			if r == nil {
+				return
+			}
+			picked = append(picked, r.Index)
+		}
+	}
+	first := pick(42)
+	if len(first) != 64 {
+		t.Fatalf("picked %d pieces, expected 64", len(first))
+	}
+	second := pick(42)
+	for idx := range first {
+		if first[idx] != second[idx] {
+			t.Fatalf("same seed picked %v then %v", first, second)
+		}
+	}
+}
+
+// ask for every block of the only piece, in the order they are handed out
+func allBlockOffsets(t *testing.T, random bool) (offsets []uint32) {
+	const blocks = 64
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize*blocks))
+	defer closeTestTorrent(tr, n)
+	tr.SetRandomBlocks(random)
+	remote := bittorrent.NewBitfield(1, nil)
+	remote.Set(0)
+	for r := tr.pt.NextRequest(remote, nil); r != nil && len(offsets) <= blocks; r = tr.pt.NextRequest(remote, r) {
+		offsets = append(offsets, r.Begin)
+	}
+	if len(offsets) != blocks {
+		t.Fatalf("got %d requests for %d blocks", len(offsets), blocks)
+	}
+	return
+}
+
+func TestBlocksInOrder(t *testing.T) {
+	for idx, off := range allBlockOffsets(t, false) {
+		if off != uint32(idx)*BlockSize {
+			t.Fatalf("request %d was for offset %d", idx, off)
+		}
+	}
+}
+
+func TestBlocksRandomOrder(t *testing.T) {
+	offsets := allBlockOffsets(t, true)
+	seen := make(map[uint32]bool)
+	ascending := true
+	for idx, off := range offsets {
+		if off%BlockSize != 0 || seen[off] {
+			t.Fatalf("bad or repeated offset %d", off)
+		}
+		seen[off] = true
+		if off != uint32(idx)*BlockSize {
+			ascending = false
+		}
+	}
+	if ascending {
+		t.Error("random block order handed out blocks in order")
+	}
+}
+
+func TestGonePeerBlocksFreed(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize*4))
+	defer closeTestTorrent(tr, n)
+	// one piece at a time so whoever comes next has to help with it
+	tr.SetMaxInProgressPieces(1)
+	c := unchokedTestSeed(tr, 1)
+	c.MaxParalellRequests = 4
+	for idx := 0; idx < 4; idx++ {
+		c.nextPieceRequest = time.Time{}
+		c.tickDownload()
+	}
+	piece := c.lastRequest.Index
+	pending := func() (n int) {
+		tr.pt.iterCached(func(cp *cachedPiece) {
+			n += len(cp.pendingRequests())
+		})
+		return
+	}
+	if got := pending(); got != 4 {
+		t.Fatalf("%d blocks asked for, expected 4", got)
+	}
+	// still there, nothing changes
+	tr.freeOrphanedBlocks()
+	if got := pending(); got != 4 {
+		t.Fatalf("%d blocks asked for after freeing orphans with the peer still there, expected 4", got)
+	}
+	// gone without giving back what it was asked for
+	tr.removeOBConn(c)
+	tr.freeOrphanedBlocks()
+	if got := pending(); got != 0 {
+		t.Errorf("%d blocks still asked for after the peer went away", got)
+	}
+	other := unchokedTestSeed(tr, 2)
+	other.MaxParalellRequests = 4
+	other.tickDownload()
+	if r := other.lastRequest; r == nil || r.Index != piece || r.Begin != 0 {
+		t.Errorf("freed blocks of piece %d not asked for again, got %v", piece, r)
+	}
+}
+
+func TestLargeBlocksForFastPeers(t *testing.T) {
+	// pieces are smaller than the large block size so requests get clamped to them
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize*3))
+	defer closeTestTorrent(tr, n)
+	tr.LargeBlockSize = MaxBlockSize
+	tr.LargeBlockRate = 1024
+	fast := unchokedTestSeed(tr, 1)
+	fast.rx.Add(1024 * 1024 * 10)
+	slow := unchokedTestSeed(tr, 2)
+
+	fast.tickDownload()
+	r := fast.lastRequest
+	if r == nil || r.Begin != 0 || r.Length != BlockSize*3 {
+		t.Fatalf("fast peer asked for %v, expected all of a piece at once", r)
+	}
+	slow.tickDownload()
+	if r := slow.lastRequest; r == nil || r.Length != BlockSize {
+		t.Errorf("slow peer asked for %v, expected %d bytes", r, BlockSize)
+	}
+
+	// the large block answers every block it covers
+	fast.gotDownload(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: make([]byte, r.Length)})
+	if !tr.Bitfield().Has(r.Index) {
+		t.Errorf("piece %d not done after its large block came in", r.Index)
+	}
+}
+
+func TestBackgroundVerify(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.SetBackgroundVerify(true)
+	st := tr.st.(*testStorage)
+	hashing := make(chan uint32)
+	release := make(chan bool)
+	st.onVerifyPiece = func(idx uint32) {
+		hashing <- idx
+		<-release
+	}
+	remote := bittorrent.NewBitfield(2, nil)
+	remote.Set(0)
+	remote.Set(1)
+	waitHashed := func(idx uint32) {
+		deadline := time.Now().Add(time.Second * 5)
+		for tr.pt.NumPending() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("piece %d still being hashed", idx)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// storing the last block hands the piece off and returns right away
+	r := tr.pt.NextRequest(remote, nil)
+	tr.pt.handlePieceData(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: make([]byte, r.Length)})
+	select {
+	case idx := <-hashing:
+		if idx != r.Index {
+			t.Fatalf("hashing piece %d, expected %d", idx, r.Index)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("piece was never hashed")
+	}
+	if st.bf.Has(r.Index) {
+		t.Fatal("piece counted as had before it was hashed")
+	}
+	// the other piece can be asked for meanwhile
+	if other := tr.pt.NextRequest(remote, nil); other == nil || other.Index == r.Index {
+		t.Fatalf("asked for %v while hashing piece %d", other, r.Index)
+	}
+	tr.pt.removePiece(1 - r.Index)
+	release <- true
+	waitHashed(r.Index)
+	if !st.bf.Has(r.Index) {
+		t.Fatal("good piece not had after hashing")
+	}
+
+	// a bad piece is thrown away and asked for again
+	bad := tr.pt.NextRequest(remote, nil)
+	data := make([]byte, bad.Length)
+	data[0] = 1
+	tr.pt.handlePieceData(&common.PieceData{Index: bad.Index, Begin: bad.Begin, Data: data})
+	<-hashing
+	release <- true
+	waitHashed(bad.Index)
+	if st.bf.Has(bad.Index) {
+		t.Fatal("bad piece counted as had")
+	}
+	if again := tr.pt.NextRequest(remote, nil); again == nil || again.Index != bad.Index || again.Begin != bad.Begin {
+		t.Fatalf("bad piece %d not asked for again, got %v", bad.Index, again)
+	}
 }
@@ -0,0 +1,114 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
+)
+
+// DownloadQueue limits how many torrents sharing it download at once
+// the rest keep announcing and seeding what they have but ask for nothing until a slot frees up
+// slots go to the waiting torrent with the highest Priority, ties go to whichever started first
+type DownloadQueue struct {
+	mtx     sync.Mutex
+	slots   int
+	active  map[*Torrent]bool
+	waiting []*Torrent
+}
+
+// NewDownloadQueue makes a queue letting slots torrents download at once, 0 for no limit
+func NewDownloadQueue(slots int) *DownloadQueue {
+	return &DownloadQueue{
+		slots:  slots,
+		active: make(map[*Torrent]bool),
+	}
+}
+
+// Active counts torrents that are downloading
+func (q *DownloadQueue) Active() (n int) {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	n = len(q.active)
+	q.mtx.Unlock()
+	return
+}
+
+// Waiting counts torrents waiting for a slot
+func (q *DownloadQueue) Waiting() (n int) {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	n = len(q.waiting)
+	q.mtx.Unlock()
+	return
+}
+
+// t wants to download, it gets a slot if there is one free or waits for one
+func (q *DownloadQueue) join(t *Torrent) {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.active[t] || q.isWaiting(t) {
+		return
+	}
+	if q.slots <= 0 || len(q.active) < q.slots {
+		q.active[t] = true
+		return
+	}
+	log.Infof("%s is queued, %d torrents are downloading", t.Name(), len(q.active))
+	q.waiting = append(q.waiting, t)
+}
+
+// t is done downloading or stopped, its slot goes to the next one waiting
+func (q *DownloadQueue) leave(t *Torrent) {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for idx := range q.waiting {
+		if q.waiting[idx] == t {
+			q.waiting = append(q.waiting[:idx], q.waiting[idx+1:]...)
+			return
+		}
+	}
+	if !q.active[t] {
+		return
+	}
+	delete(q.active, t)
+	for len(q.waiting) > 0 && (q.slots <= 0 || len(q.active) < q.slots) {
+		next := 0
+		for idx := range q.waiting {
+			if q.waiting[idx].Priority > q.waiting[next].Priority {
+				next = idx
+			}
+		}
+		nt := q.waiting[next]
+		q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+		q.active[nt] = true
+		log.Infof("%s is done waiting, downloading", nt.Name())
+	}
+}
+
+// may t download ?
+func (q *DownloadQueue) canDownload(t *Torrent) bool {
+	if q == nil {
+		return true
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return !q.isWaiting(t)
+}
+
+func (q *DownloadQueue) isWaiting(t *Torrent) bool {
+	for _, w := range q.waiting {
+		if w == t {
+			return true
+		}
+	}
+	return false
+}
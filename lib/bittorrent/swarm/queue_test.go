@@ -0,0 +1,70 @@
+package swarm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDownloadQueueSlots(t *testing.T) {
+	q := NewDownloadQueue(2)
+	var torrents []*Torrent
+	for idx := 0; idx < 3; idx++ {
+		tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+		defer closeTestTorrent(tr, n)
+		tr.RemoveSelf = func() {}
+		tr.Queue = q
+		if err := tr.Start(); err != nil {
+			t.Fatal(err)
+		}
+		torrents = append(torrents, tr)
+	}
+	if torrents[0].Queued() || torrents[1].Queued() {
+		t.Error("one of the first two torrents is queued")
+	}
+	if !torrents[2].Queued() {
+		t.Fatal("third torrent is downloading with 2 slots")
+	}
+	// waiting makes no requests
+	c := unchokedTestSeed(torrents[2], 1)
+	torrents[2].tick()
+	if c.numDownloading() != 0 {
+		t.Errorf("queued torrent asked for %d blocks", c.numDownloading())
+	}
+
+	// the first one completes and seeds, its slot goes to the third
+	torrents[0].VerifyAll()
+	waitForState(t, torrents[0], Seeding)
+	deadline := time.Now().Add(time.Second * 5)
+	for torrents[2].Queued() {
+		if time.Now().After(deadline) {
+			t.Fatal("third torrent still queued after one completed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := q.Active(); n != 2 {
+		t.Errorf("%d torrents downloading, expected 2", n)
+	}
+	torrents[2].tick()
+	if c.numDownloading() == 0 {
+		t.Error("torrent made no requests after it got a slot")
+	}
+}
+
+func TestDownloadQueuePriority(t *testing.T) {
+	q := NewDownloadQueue(1)
+	var torrents []*Torrent
+	for idx := 0; idx < 3; idx++ {
+		tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+		defer closeTestTorrent(tr, n)
+		q.join(tr)
+		torrents = append(torrents, tr)
+	}
+	torrents[2].Priority = 1
+	q.leave(torrents[0])
+	if torrents[2].Queued() {
+		t.Error("higher priority torrent did not get the free slot")
+	}
+	if q.canDownload(torrents[1]) {
+		t.Error("lower priority torrent got a slot too")
+	}
+}
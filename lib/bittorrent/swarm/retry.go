@@ -0,0 +1,76 @@
+package swarm
+
+import (
+	"errors"
+	"github.com/majestrate/XD/lib/sync"
+	"math/rand"
+	"time"
+)
+
+// how long we wait before the first retry of a peer connection
+const DefaultPeerRetryDelay = time.Second
+
+// longest we wait between retries of a peer connection
+const MaxPeerRetryDelay = time.Minute
+
+// how many times we dial a peer before giving up on it
+const DefaultPeerDialTries = 10
+
+// how many peer connection retries all torrents together can make per minute
+const DefaultPeerRetryBudget = 256
+
+// limits how many retries we make over a period of time
+type retryBudget struct {
+	mtx    sync.Mutex
+	max    int
+	used   int
+	period time.Duration
+	reset  time.Time
+}
+
+func newRetryBudget(max int, period time.Duration) *retryBudget {
+	return &retryBudget{
+		max:    max,
+		period: period,
+	}
+}
+
+// take one retry from the budget, returns false if it is used up for now
+func (b *retryBudget) take() bool {
+	now := time.Now()
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if now.After(b.reset) {
+		b.used = 0
+		b.reset = now.Add(b.period)
+	}
+	if b.used >= b.max {
+		return false
+	}
+	b.used++
+	return true
+}
+
+// retry budget shared by every torrent
+var peerRetryBudget = newRetryBudget(DefaultPeerRetryBudget, time.Minute)
+
+// get how long to wait before retry number try, the delay doubles every try
+// and is randomized to somewhere between half and all of it so retries don't line up
+func retryDelay(try int) time.Duration {
+	d := MaxPeerRetryDelay
+	if try < 1 {
+		try = 1
+	}
+	if try < 32 {
+		if backoff := DefaultPeerRetryDelay << uint(try-1); backoff < d {
+			d = backoff
+		}
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// check if dialing a peer again could work after it failed with err
+func retriablePeerError(err error) bool {
+	return !errors.Is(err, ErrInfohashMismatch) && !errors.Is(err, ErrDuplicate)
+}
@@ -0,0 +1,68 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/common"
+	"net"
+	"testing"
+	"time"
+)
+
+// persist a peer that never answers, returns the delays between dials
+func persistDeadPeer(t *testing.T, budget *retryBudget) (delays []time.Duration, dials int) {
+	tr, n := newTestTorrent(nil)
+	defer closeTestTorrent(tr, n)
+	n.refuse = true
+	tr.retries = budget
+	tr.retrySleep = func(d time.Duration) {
+		delays = append(delays, d)
+	}
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	tr.PersistPeer(a, common.PeerID{})
+	dials = n.numDials(a.String())
+	return
+}
+
+func TestPersistPeerBackoff(t *testing.T) {
+	delays, dials := persistDeadPeer(t, newRetryBudget(100, time.Minute))
+	if dials != DefaultPeerDialTries {
+		t.Errorf("dialed %d times, expected %d", dials, DefaultPeerDialTries)
+	}
+	if len(delays) != DefaultPeerDialTries-1 {
+		t.Fatalf("waited %d times, expected %d", len(delays), DefaultPeerDialTries-1)
+	}
+	jittered := false
+	for idx, d := range delays {
+		full := DefaultPeerRetryDelay << uint(idx)
+		if full > MaxPeerRetryDelay {
+			full = MaxPeerRetryDelay
+		}
+		if d < full/2 || d > full {
+			t.Errorf("retry %d waited %s, expected between %s and %s", idx+1, d, full/2, full)
+		}
+		if d != full/2 && d != full {
+			jittered = true
+		}
+		if idx > 0 && full < MaxPeerRetryDelay && d < delays[idx-1] {
+			t.Errorf("retry %d waited %s which is less than the %s before it", idx+1, d, delays[idx-1])
+		}
+	}
+	if !jittered {
+		t.Error("retry delays are not jittered")
+	}
+}
+
+func TestPersistPeerRetryBudget(t *testing.T) {
+	budget := newRetryBudget(3, time.Minute)
+	delays, dials := persistDeadPeer(t, budget)
+	if len(delays) != 3 {
+		t.Errorf("waited %d times, expected 3", len(delays))
+	}
+	if dials != 4 {
+		t.Errorf("dialed %d times, expected 4", dials)
+	}
+	// budget is shared so the next peer gets no retries
+	delays, dials = persistDeadPeer(t, budget)
+	if len(delays) != 0 || dials != 1 {
+		t.Errorf("waited %d times and dialed %d times after budget was used up", len(delays), dials)
+	}
+}
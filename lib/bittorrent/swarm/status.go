@@ -24,6 +24,21 @@ func (i TorrentFileInfo) BytesCompleted() int64 {
 	return int64(float64(i.FileInfo.Length) * i.Progress)
 }
 
+// FileProgress is how much of one file in a torrent we have
+type FileProgress struct {
+	File      metainfo.FileInfo
+	Completed uint64
+	Total     uint64
+}
+
+// Progress gets how much of the file we have from 0 to 1
+func (p FileProgress) Progress() float64 {
+	if p.Total == 0 {
+		return 1
+	}
+	return float64(p.Completed) / float64(p.Total)
+}
+
 type TorrentPeers []*PeerConnStats
 
 func (p TorrentPeers) RX() (rx float64) {
@@ -70,7 +85,13 @@ type PeerConnStats struct {
 	Downloading    bool
 	Inbound        bool
 	Uploading      bool
+	Dropped        uint64
+	Country        string
+	ASN            uint32
 	Bitfield       bittorrent.Bitfield
+	Port           int
+	ClientVersion  string // from the extended handshake
+	Encrypted      bool   // always false until we support encryption
 }
 
 func (p *PeerConnStats) Less(o *PeerConnStats) bool {
@@ -83,6 +104,7 @@ const Seeding = TorrentState("seeding")
 const Checking = TorrentState("checking")
 const Stopped = TorrentState("stopped")
 const Downloading = TorrentState("downloading")
+const Errored = TorrentState("error")
 
 func (t TorrentState) String() string {
 	return string(t)
@@ -95,10 +117,13 @@ type TorrentStatus struct {
 	Us       PeerConnStats
 	Name     string
 	State    TorrentState
+	Error    string
 	Infohash string
 	Progress float64
 	TX       uint64
 	RX       uint64
+	Seeders  int
+	Leechers int
 }
 
 func (t TorrentStatus) Ratio() (r float64) {
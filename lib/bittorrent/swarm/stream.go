@@ -0,0 +1,204 @@
+package swarm
+
+import (
+	"errors"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/storage"
+	"io"
+)
+
+// ErrNoSuchFile is returned when opening a file index the torrent does not have
+var ErrNoSuchFile = errors.New("no such file in torrent")
+
+// ErrBadSeek is returned when seeking before the start of a file
+var ErrBadSeek = errors.New("seek before start of file")
+
+// FileReader reads one file of a torrent while it downloads
+// reads block until the pieces they need are downloaded
+type FileReader struct {
+	t *Torrent
+	// where the file starts in the torrent
+	start int64
+	// length of the file
+	length int64
+	// where we read next in the file
+	pos int64
+}
+
+// NewFileReader opens file at index for reading, blocking until data is downloaded
+// pieces a reader is waiting on are downloaded before any other piece
+func (t *Torrent) NewFileReader(index int) (io.ReadSeeker, error) {
+	info := t.MetaInfo()
+	if info == nil {
+		return nil, storage.ErrNoMetaInfo
+	}
+	files := info.Info.GetFiles()
+	if index < 0 || index >= len(files) {
+		return nil, ErrNoSuchFile
+	}
+	r := &FileReader{
+		t:      t,
+		length: int64(files[index].Length),
+	}
+	for idx := 0; idx < index; idx++ {
+		r.start += int64(files[idx].Length)
+	}
+	return r, nil
+}
+
+// Read implements io.Reader
+func (r *FileReader) Read(p []byte) (n int, err error) {
+	if r.pos >= r.length {
+		err = io.EOF
+		return
+	}
+	pl := int64(r.t.MetaInfo().Info.PieceLength)
+	offset := r.start + r.pos
+	idx := uint32(offset / pl)
+	err = r.t.waitForPiece(idx)
+	if err != nil {
+		return
+	}
+	// read at most to the end of the piece or file
+	begin := offset - int64(idx)*pl
+	l := int64(len(p))
+	if l > pl-begin {
+		l = pl - begin
+	}
+	if l > r.length-r.pos {
+		l = r.length - r.pos
+	}
+	var pc common.PieceData
+	err = r.t.st.GetPiece(common.PieceRequest{
+		Index:  idx,
+		Begin:  uint32(begin),
+		Length: uint32(l),
+	}, &pc)
+	if err == nil {
+		n = copy(p, pc.Data)
+		r.pos += int64(n)
+	}
+	return
+}
+
+// Seek implements io.Seeker
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	}
+	if offset < 0 {
+		return r.pos, ErrBadSeek
+	}
+	r.pos = offset
+	return r.pos, nil
+}
+
+// block until we have piece idx or the torrent is closed
+func (t *Torrent) waitForPiece(idx uint32) error {
+	for {
+		ch := t.pieceNotify()
+		if t.Bitfield().Has(idx) {
+			return nil
+		}
+		if t.isClosing() {
+			return ErrAlreadyStopped
+		}
+		t.wantPiece(idx, 1)
+		<-ch
+		t.wantPiece(idx, -1)
+	}
+}
+
+// get a channel that is closed the next time we get a piece
+func (t *Torrent) pieceNotify() <-chan struct{} {
+	t.streamMtx.Lock()
+	defer t.streamMtx.Unlock()
+	if t.haveNotify == nil {
+		t.haveNotify = make(chan struct{})
+	}
+	return t.haveNotify
+}
+
+// wake up everyone waiting for a piece
+func (t *Torrent) notifyHave() {
+	t.streamMtx.Lock()
+	if t.haveNotify != nil {
+		close(t.haveNotify)
+		t.haveNotify = nil
+	}
+	t.streamMtx.Unlock()
+}
+
+// add n readers waiting on piece idx
+func (t *Torrent) wantPiece(idx uint32, n int) {
+	t.streamMtx.Lock()
+	if t.streamWant == nil {
+		t.streamWant = make(map[uint32]int)
+	}
+	t.streamWant[idx] += n
+	if t.streamWant[idx] <= 0 {
+		delete(t.streamWant, idx)
+	}
+	t.streamMtx.Unlock()
+}
+
+// get the lowest piece a reader is waiting on that remote has
+func (t *Torrent) wantedPiece(remote *bittorrent.Bitfield, exclude func(uint32) bool) (idx uint32, has bool) {
+	t.streamMtx.Lock()
+	defer t.streamMtx.Unlock()
+	for want := range t.streamWant {
+		if remote.Has(want) && !exclude(want) && (!has || want < idx) {
+			idx = want
+			has = true
+		}
+	}
+	return
+}
+
+// get the first and last piece of every file, where media players look for headers and indexes
+func (t *Torrent) fileEdgePieces() []uint32 {
+	t.streamMtx.Lock()
+	defer t.streamMtx.Unlock()
+	if t.edgePieces != nil {
+		return t.edgePieces
+	}
+	info := t.MetaInfo()
+	if info == nil {
+		return nil
+	}
+	pl := uint64(info.Info.PieceLength)
+	seen := make(map[uint32]bool)
+	edges := []uint32{}
+	var offset uint64
+	for _, f := range info.Info.GetFiles() {
+		if f.Length == 0 {
+			continue
+		}
+		for _, idx := range []uint32{uint32(offset / pl), uint32((offset + f.Length - 1) / pl)} {
+			if !seen[idx] {
+				seen[idx] = true
+				edges = append(edges, idx)
+			}
+		}
+		offset += f.Length
+	}
+	t.edgePieces = edges
+	return edges
+}
+
+// get the first or last piece of a file that remote has if FirstLastPieces is set
+func (t *Torrent) edgePiece(remote *bittorrent.Bitfield, exclude func(uint32) bool) (idx uint32, has bool) {
+	if !t.FirstLastPieces || remote == nil {
+		return
+	}
+	for _, edge := range t.fileEdgePieces() {
+		if remote.Has(edge) && !exclude(edge) {
+			return edge, true
+		}
+	}
+	return
+}
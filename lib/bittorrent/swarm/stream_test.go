@@ -0,0 +1,140 @@
+package swarm
+
+import (
+	"bytes"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/metainfo"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFileReaderWaitsForPiece(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize))
+	defer closeTestTorrent(tr, n)
+	r, err := tr.NewFileReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// we have the first piece but not the second
+	tr.st.(*testStorage).bf.Set(0)
+	if _, err = r.Seek(BlockSize+10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	read := make(chan result, 1)
+	go func() {
+		buff := make([]byte, 100)
+		n, err := r.Read(buff)
+		read <- result{buff[:n], err}
+	}()
+	select {
+	case <-read:
+		t.Fatal("read returned before we had the piece")
+	case <-time.After(time.Millisecond * 100):
+	}
+	// the waiting reader makes the piece go first
+	remote := bittorrent.NewBitfield(2, nil)
+	remote.Set(0)
+	remote.Set(1)
+	req := tr.pt.NextRequest(remote, nil)
+	if req == nil || req.Index != 1 {
+		t.Fatalf("requested %v instead of the piece being read", req)
+	}
+	tr.pt.handlePieceData(&common.PieceData{Index: req.Index, Begin: req.Begin, Data: make([]byte, req.Length)})
+	select {
+	case res := <-read:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if !bytes.Equal(res.data, make([]byte, 100)) {
+			t.Errorf("read %d bytes of wrong data", len(res.data))
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("read never returned after getting the piece")
+	}
+}
+
+func TestFileReaderMultiFile(t *testing.T) {
+	meta := testMetaInfo(3, BlockSize)
+	meta.Info.Length = 0
+	meta.Info.Files = []metainfo.FileInfo{
+		{Length: BlockSize / 2, Path: metainfo.FilePath{"a"}},
+		{Length: BlockSize*2 + 10, Path: metainfo.FilePath{"b"}},
+		{Length: BlockSize/2 - 10, Path: metainfo.FilePath{"c"}},
+	}
+	tr, n := newTestTorrent(meta)
+	defer closeTestTorrent(tr, n)
+	st := tr.st.(*testStorage)
+	for idx := uint32(0); idx < 3; idx++ {
+		st.bf.Set(idx)
+	}
+	for idx := range st.data {
+		st.data[idx] = byte(idx)
+	}
+	if _, err := tr.NewFileReader(3); err != ErrNoSuchFile {
+		t.Errorf("opening missing file gave %v", err)
+	}
+	r, err := tr.NewFileReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, st.data[BlockSize/2:BlockSize/2+BlockSize*2+10]) {
+		t.Errorf("read %d bytes that don't match the file", len(data))
+	}
+	if pos, _ := r.Seek(-10, io.SeekEnd); pos != BlockSize*2 {
+		t.Errorf("seeked to %d", pos)
+	}
+}
+
+func TestFirstLastPiecesFirst(t *testing.T) {
+	meta := testMetaInfo(8, BlockSize)
+	meta.Info.Length = 0
+	meta.Info.Files = []metainfo.FileInfo{
+		{Length: BlockSize * 5, Path: metainfo.FilePath{"a"}},
+		{Length: BlockSize * 3, Path: metainfo.FilePath{"b"}},
+	}
+	tr, n := newTestTorrent(meta)
+	defer closeTestTorrent(tr, n)
+	tr.FirstLastPieces = true
+	remote := bittorrent.NewBitfield(8, nil)
+	for idx := uint32(0); idx < 8; idx++ {
+		remote.Set(idx)
+	}
+	// the middle pieces are rarer but the ends of files still go first
+	tr.availability.addBitfield(bittorrent.NewBitfield(8, []byte{0xff}))
+	tr.availability.addBitfield(bittorrent.NewBitfield(8, []byte{0xff}))
+	tr.availability.addBitfield(bittorrent.NewBitfield(8, []byte{0x00}))
+	for _, idx := range []uint32{0, 4, 5, 7} {
+		tr.availability.addHave(idx)
+	}
+	var exclude []uint32
+	picked := make(map[uint32]bool)
+	for round := 0; round < 4; round++ {
+		idx, has := tr.getRarestPiece(remote, exclude)
+		if !has {
+			t.Fatal("no piece picked")
+		}
+		picked[idx] = true
+		exclude = append(exclude, idx)
+	}
+	for _, edge := range []uint32{0, 4, 5, 7} {
+		if !picked[edge] {
+			t.Errorf("piece %d at the end of a file was not picked first, picked %v", edge, exclude)
+		}
+	}
+
+	// off by default
+	tr.FirstLastPieces = false
+	if idx, _ := tr.getRarestPiece(remote, nil); idx == 0 || idx == 4 || idx == 5 || idx == 7 {
+		t.Errorf("picked piece %d before rarer pieces without the option", idx)
+	}
+}
@@ -6,17 +6,21 @@ import (
 	"github.com/majestrate/XD/lib/bittorrent/extensions"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/dht"
+	"github.com/majestrate/XD/lib/geoip"
 	"github.com/majestrate/XD/lib/gnutella"
 	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/lsd"
 	"github.com/majestrate/XD/lib/metainfo"
 	"github.com/majestrate/XD/lib/network"
 	"github.com/majestrate/XD/lib/storage"
 	"github.com/majestrate/XD/lib/tracker"
 	"github.com/majestrate/XD/lib/util"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,6 +30,7 @@ type Swarm struct {
 	closing  bool
 	Torrents Holder
 	id       common.PeerID
+	key      string
 	trackers map[string]tracker.Announcer
 	xdht     dht.XDHT
 	gnutella *gnutella.Swarm
@@ -35,6 +40,25 @@ type Swarm struct {
 	newNet   chan network.Network
 	netError chan error
 	netDead  bool
+
+	// start of our peer id, the default one if empty
+	PeerIDPrefix string
+	// user agent for http tracker announces, the default one if empty
+	UserAgent string
+	// address others see us at from behind nat, empty if it is the one we listen on
+	ExternalAddr string
+	// where peers are from, nil to not look it up
+	GeoIP *geoip.Cache
+	// find peers on the lan with local service discovery
+	UseLSD bool
+	lsd    *lsd.Service
+	// announce public torrents we seed on the mainline dht
+	UseDHT bool
+	dht    *dht.DHT
+	// add torrents paused so they don't start until they are resumed
+	StartPaused bool
+	// only accept inbound connections for these infohashes, nil for any we have
+	AcceptInfohashes map[common.Infohash]bool
 }
 
 func (sw *Swarm) IsOnline() bool {
@@ -71,8 +95,16 @@ func (sw *Swarm) startTorrent(t *Torrent) {
 	// wait for network
 	sw.Network()
 	t.xdht = &sw.xdht
-	// give peerid
+	if sw.dht != nil {
+		t.DHT = sw.dht
+		t.addDHTNodes()
+	}
+	// give peerid and tracker key
 	t.id = sw.id
+	t.key = sw.key
+	t.UserAgent = sw.UserAgent
+	t.ExternalAddr = sw.ExternalAddr
+	t.GeoIP = sw.GeoIP
 	// add open trackers
 	for name := range sw.trackers {
 		t.Trackers[name] = sw.trackers[name]
@@ -81,16 +113,27 @@ func (sw *Swarm) startTorrent(t *Torrent) {
 	info := t.MetaInfo()
 	if info != nil {
 		for _, u := range info.GetAllAnnounceURLS() {
-			tr := tracker.FromURL(u)
-			if tr != nil {
-				name := tr.Name()
-				_, ok := t.Trackers[name]
-				if !ok {
-					t.Trackers[name] = tr
-				}
+			tr, err := tracker.NewAnnouncer(u)
+			if err != nil {
+				log.Debugf("not using tracker %s: %s", u, err)
+				continue
+			}
+			name := tr.Name()
+			_, ok := t.Trackers[name]
+			if !ok {
+				t.Trackers[name] = tr
 			}
 		}
 	}
+	if t.waitResume(func() { sw.runTorrent(t) }) {
+		log.Infof("%s added paused", t.Name())
+		return
+	}
+	sw.runTorrent(t)
+}
+
+// start a torrent once there is room in the queue
+func (sw *Swarm) runTorrent(t *Torrent) {
 	// handle messages
 	sw.waitForQueue()
 	sw.active++
@@ -99,9 +142,11 @@ func (sw *Swarm) startTorrent(t *Torrent) {
 
 // got inbound connection
 func (sw *Swarm) inboundConn(c net.Conn) {
+	// don't wait forever on a peer that never finishes its handshake
+	c.SetDeadline(time.Now().Add(HandshakeTimeout))
 	var firstBytes [20]byte
-	n, err := c.Read(firstBytes[:])
-	if err != nil || n != 20 {
+	_, err := io.ReadFull(c, firstBytes[:])
+	if err != nil {
 		log.Debug("failed to read first bytes")
 		c.Close()
 		return
@@ -110,9 +155,10 @@ func (sw *Swarm) inboundConn(c net.Conn) {
 		// bittorrent
 		var buff [68]byte
 		copy(buff[:], firstBytes[:])
-		n, err = c.Read(buff[20:])
-		if err != nil || n != 48 {
-			log.Debugf("failed to read bittorrent handshake: %d bytes", n)
+		// some peers wait for our reply before sending their peer id so only read up to the infohash for now
+		_, err = io.ReadFull(c, buff[20:48])
+		if err != nil {
+			log.Debugf("failed to read bittorrent handshake: %s", err)
 			c.Close()
 			return
 		}
@@ -123,6 +169,11 @@ func (sw *Swarm) inboundConn(c net.Conn) {
 			c.Close()
 			return
 		}
+		if sw.AcceptInfohashes != nil && !sw.AcceptInfohashes[h.Infohash] {
+			log.Debugf("not accepting connections for infohash %s, closing connection", h.Infohash.Hex())
+			c.Close()
+			return
+		}
 		t := sw.Torrents.GetTorrent(h.Infohash)
 		if t == nil {
 			log.Warnf("we don't have torrent with infohash %s, closing connection", h.Infohash.Hex())
@@ -136,17 +187,20 @@ func (sw *Swarm) inboundConn(c net.Conn) {
 			return
 		}
 		var opts extensions.Message
-		if h.Reserved.Has(bittorrent.Extension) {
+		if h.Reserved.Capabilities().Extended {
 			if t.Ready() {
 				opts = extensions.NewOur(uint32(len(t.metaInfo)))
 			} else {
 				opts = extensions.NewOur(0)
 			}
+			if t.Done() {
+				opts.SetUploadOnly(true)
+			}
 		}
 		// reply to handshake
-		var id common.PeerID
-		copy(id[:], h.PeerID[:])
 		copy(h.PeerID[:], sw.id[:])
+		// what we support, not what they asked for
+		h.Reserved = t.capabilities().Reserved()
 		err = h.Send(c)
 		if err != nil {
 			log.Warnf("didn't send bittorrent handshake reply: %s, closing connection", err)
@@ -154,6 +208,16 @@ func (sw *Swarm) inboundConn(c net.Conn) {
 			c.Close()
 			return
 		}
+		// now their peer id
+		_, err = io.ReadFull(c, buff[48:])
+		if err != nil {
+			log.Debugf("peer did not send its peer id: %s", err)
+			c.Close()
+			return
+		}
+		var id common.PeerID
+		copy(id[:], buff[48:])
+		c.SetDeadline(time.Time{})
 		// make peer conn
 		p := makePeerConn(c, t, id, opts)
 		p.inbound = true
@@ -164,6 +228,7 @@ func (sw *Swarm) inboundConn(c net.Conn) {
 		var delim [2]byte
 		// discard crlf
 		c.Read(delim[:])
+		c.SetDeadline(time.Time{})
 		// do the rest of the handshake
 		conn := gnutella.NewConn(c)
 		err = conn.Handshake(sw.gnutella == nil)
@@ -181,10 +246,22 @@ func (sw *Swarm) inboundConn(c net.Conn) {
 	}
 }
 
-// add a torrent to this swarm
+// add a torrent to this swarm, it is added paused if StartPaused is set
 func (sw *Swarm) AddTorrent(t storage.Torrent) (err error) {
+	return sw.AddTorrentPaused(t, sw.StartPaused)
+}
+
+// AddTorrentPaused adds a torrent to this swarm, with paused set it is not started until it is resumed
+func (sw *Swarm) AddTorrentPaused(t storage.Torrent, paused bool) (err error) {
 	sw.Torrents.addTorrent(t, sw.Network)
 	tr := sw.Torrents.GetTorrent(t.Infohash())
+	if tr == nil {
+		// closing
+		return
+	}
+	if paused {
+		tr.setPaused()
+	}
 	go sw.startTorrent(tr)
 	return
 }
@@ -265,6 +342,14 @@ func (sw *Swarm) acceptLoop() {
 	}
 }
 
+// make a peer id with our configured prefix
+func (sw *Swarm) generatePeerID() common.PeerID {
+	if sw.PeerIDPrefix == "" {
+		return common.GeneratePeerID()
+	}
+	return common.GeneratePeerIDWithPrefix(sw.PeerIDPrefix)
+}
+
 // inform that we lost the network context
 func (sw *Swarm) LostNetwork() {
 	sw.netDied <- true
@@ -272,20 +357,114 @@ func (sw *Swarm) LostNetwork() {
 
 // give this swarm a new network context
 func (sw *Swarm) ObtainedNetwork(n network.Network) {
-	sw.id = common.GeneratePeerID()
-	log.Infof("Generated new peer id: %s", sw.id.String())
+	// keep the same peer id for as long as we run so torrents all agree on it
+	if sw.id == (common.PeerID{}) {
+		sw.id = sw.generatePeerID()
+		log.Infof("Generated new peer id: %s", sw.id.String())
+	}
+	// before netLoop hands out the network so torrents started with it see the dht
+	sw.startDHT(n)
 	// give network to netLoop
 	sw.newNet <- n
 	log.Info("Swarm got network context")
+	sw.startLSD(n)
 	return
 }
 
+// start local service discovery once if we use it, i2p has no lan to find peers on
+func (sw *Swarm) startLSD(n network.Network) {
+	if !sw.UseLSD || sw.lsd != nil || n.Addr().Network() == "i2p" {
+		return
+	}
+	s, err := lsd.Listen()
+	if err != nil {
+		log.Warnf("local service discovery not started: %s", err)
+		return
+	}
+	s.OnPeer = sw.lsdPeer
+	sw.lsd = s
+	go s.Run()
+	go sw.lsdLoop()
+}
+
+// start our dht node once if we use it, its datagrams go over whatever network we have
+func (sw *Swarm) startDHT(n network.Network) {
+	if !sw.UseDHT || sw.dht != nil || n.Addr().Network() == "i2p" {
+		return
+	}
+	sw.dht = dht.New(dhtTransport{sw})
+	go sw.dht.Run()
+	go sw.dht.Bootstrap()
+}
+
+// the dht talks over the network the swarm has at the time
+type dhtTransport struct {
+	sw *Swarm
+}
+
+func (t dhtTransport) ReadFrom(d []byte) (int, net.Addr, error) {
+	return t.sw.Network().ReadFrom(d)
+}
+
+func (t dhtTransport) WriteTo(d []byte, to net.Addr) (int, error) {
+	return t.sw.Network().WriteTo(d, to)
+}
+
+func (t dhtTransport) Lookup(name, port string) (net.Addr, error) {
+	return t.sw.Network().Lookup(name, port)
+}
+
+// announce our torrents on the lan until we close
+func (sw *Swarm) lsdLoop() {
+	for sw.Running() {
+		sw.announceLSD()
+		time.Sleep(lsd.AnnounceInterval)
+	}
+}
+
+func (sw *Swarm) announceLSD() {
+	_, port, err := net.SplitHostPort(sw.Network().Addr().String())
+	if err != nil {
+		return
+	}
+	var p int
+	p, err = strconv.Atoi(port)
+	if err != nil {
+		return
+	}
+	var ihs []common.Infohash
+	sw.Torrents.ForEachTorrent(func(t *Torrent) {
+		// private torrents only get peers from their trackers
+		if t.ShouldAcceptNewPeer() && !t.Private() {
+			ihs = append(ihs, t.Infohash())
+		}
+	})
+	if len(ihs) == 0 {
+		return
+	}
+	err = sw.lsd.Announce(p, ihs)
+	if err != nil {
+		log.Warnf("local service discovery announce failed: %s", err)
+	}
+}
+
+// a peer on the lan announced it has ih
+func (sw *Swarm) lsdPeer(ih common.Infohash, a net.Addr) {
+	t := sw.Torrents.GetTorrent(ih)
+	if t != nil {
+		t.addLANPeer(a)
+	}
+}
+
 // create a new swarm using a storage backend for storing downloads and torrent metadata
 func NewSwarm(storage storage.Storage, gnutella *gnutella.Swarm) *Swarm {
 	sw := &Swarm{
 		Torrents: Holder{
-			st: storage,
+			st:         storage,
+			SendBuffer: DefaultSendBufferSize,
+			NoDelay:    DefaultNoDelay,
 		},
+		key:      tracker.GenerateKey(),
 		trackers: map[string]tracker.Announcer{},
 		gnutella: gnutella,
 		getNet:   make(chan network.Network),
@@ -316,28 +495,43 @@ func (sw *Swarm) Close() (err error) {
 	if !sw.closing {
 		sw.closing = true
 		log.Info("Swarm closing")
+		if sw.lsd != nil {
+			sw.lsd.Close()
+		}
+		if sw.dht != nil {
+			sw.dht.Close()
+		}
 		sw.Torrents.Close(!sw.netDead)
 	}
 	return
 }
 
 func (sw *Swarm) AddRemoteTorrent(remote string) (err error) {
+	return sw.AddRemoteTorrentPaused(remote, sw.StartPaused)
+}
+
+// AddRemoteTorrentPaused adds a torrent from a magnet, file or http url, with paused set it is not started until it is resumed
+func (sw *Swarm) AddRemoteTorrentPaused(remote string, paused bool) (err error) {
 	var u *url.URL
 	u, err = url.Parse(remote)
 	if err == nil {
 		scheme := strings.ToLower(u.Scheme)
 		if scheme == "magnet" {
-			err = sw.AddMagnet(remote)
+			err = sw.addMagnetURI(remote, paused)
 		} else if scheme == "file" || scheme == "" {
-			err = sw.addFileTorrent(u.Path)
+			err = sw.addFileTorrent(u.Path, paused)
 		} else {
-			err = sw.addHTTPTorrent(u.String())
+			err = sw.addHTTPTorrent(u.String(), paused)
 		}
 	}
 	return
 }
 
 func (sw *Swarm) AddMagnet(uri string) (err error) {
+	return sw.addMagnetURI(uri, sw.StartPaused)
+}
+
+func (sw *Swarm) addMagnetURI(uri string, paused bool) (err error) {
 	var u *url.URL
 	u, err = url.Parse(uri)
 	if err == nil {
@@ -349,7 +543,7 @@ func (sw *Swarm) AddMagnet(uri string) (err error) {
 				var ih common.Infohash
 				ih, err = common.DecodeInfohash(xt[9:])
 				if err == nil {
-					err = sw.addMagnet(ih)
+					err = sw.addMagnet(ih, paused)
 				}
 			} else {
 				err = common.ErrBadMagnetURI
@@ -361,12 +555,12 @@ func (sw *Swarm) AddMagnet(uri string) (err error) {
 	return
 }
 
-func (sw *Swarm) addMagnet(ih common.Infohash) (err error) {
-	sw.AddTorrent(sw.Torrents.st.EmptyTorrent(ih))
+func (sw *Swarm) addMagnet(ih common.Infohash, paused bool) (err error) {
+	sw.AddTorrentPaused(sw.Torrents.st.EmptyTorrent(ih), paused)
 	return
 }
 
-func (sw *Swarm) addFileTorrent(path string) (err error) {
+func (sw *Swarm) addFileTorrent(path string, paused bool) (err error) {
 	var info metainfo.TorrentFile
 	var f *os.File
 	f, err = os.Open(path)
@@ -379,7 +573,7 @@ func (sw *Swarm) addFileTorrent(path string) (err error) {
 			if err == nil {
 				err = t.VerifyAll()
 				if err == nil {
-					sw.AddTorrent(t)
+					sw.AddTorrentPaused(t, paused)
 				}
 			}
 		}
@@ -390,7 +584,7 @@ func (sw *Swarm) addFileTorrent(path string) (err error) {
 	return
 }
 
-func (sw *Swarm) addHTTPTorrent(remote string) (err error) {
+func (sw *Swarm) addHTTPTorrent(remote string, paused bool) (err error) {
 	n := sw.Network()
 	cl := &http.Client{
 		Transport: &http.Transport{
@@ -411,7 +605,7 @@ func (sw *Swarm) addHTTPTorrent(remote string) (err error) {
 				if err == nil {
 					err = t.VerifyAll()
 					if err == nil {
-						sw.AddTorrent(t)
+						sw.AddTorrentPaused(t, paused)
 					}
 				}
 			}
@@ -1,9 +1,578 @@
 package swarm
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/dht"
+	"github.com/majestrate/XD/lib/lsd"
+	"github.com/majestrate/XD/lib/metainfo"
+	"github.com/majestrate/XD/lib/network"
+	"github.com/majestrate/XD/lib/stats"
+	"github.com/majestrate/XD/lib/sync"
+	"github.com/majestrate/XD/lib/tracker"
+	"github.com/majestrate/XD/lib/util"
+	"io"
+	"io/ioutil"
+	"net"
 	"testing"
+	"time"
 )
 
+var errTestClosed = errors.New("test network closed")
+var errTestPut = errors.New("disk full")
+
+var errTestRefused = errors.New("test network refused connection")
+
+// in memory storage.Torrent for tests
+type testStorage struct {
+	ih   common.Infohash
+	meta *metainfo.TorrentFile
+	// guards the bits of bf once a torrent runs on this storage
+	bfMtx sync.Mutex
+	bf    *bittorrent.Bitfield
+	data  []byte
+	// called while checking all pieces
+	onVerify func()
+	// error to fail seeding with
+	seedErr error
+	// fail this many chunk stores before working
+	putFails int
+	// fail every chunk store with this while set
+	putErr error
+	// called before each piece read
+	onGetPiece func(common.PieceRequest)
+	// called on each flush
+	onFlush func()
+	// called before each piece is hashed
+	onVerifyPiece func(uint32)
+	// blocks of unfinished pieces we last saved
+	partialMtx sync.Mutex
+	partial    map[uint32]*bittorrent.Bitfield
+}
+
+func newTestStorage(meta *metainfo.TorrentFile) *testStorage {
+	st := &testStorage{
+		meta: meta,
+	}
+	if meta != nil {
+		st.ih = meta.Infohash()
+		st.bf = bittorrent.NewBitfield(meta.Info.NumPieces(), nil)
+		st.data = make([]byte, meta.TotalSize())
+	}
+	return st
+}
+
+func (st *testStorage) Allocate() error { return nil }
+func (st *testStorage) Checking() bool  { return false }
+
+func (st *testStorage) VerifyAll() error {
+	if st.meta == nil {
+		return nil
+	}
+	if st.onVerify != nil {
+		st.onVerify()
+	}
+	for idx := uint32(0); idx < st.meta.Info.NumPieces(); idx++ {
+		st.VerifyPiece(idx)
+	}
+	return nil
+}
+
+func (st *testStorage) PutChunk(pc *common.PieceData) error {
+	if st.putFails > 0 {
+		st.putFails--
+		return errTestPut
+	}
+	if st.putErr != nil {
+		return st.putErr
+	}
+	off := uint64(pc.Index)*uint64(st.meta.Info.PieceLength) + uint64(pc.Begin)
+	copy(st.data[off:], pc.Data)
+	return nil
+}
+
+func (st *testStorage) GetPiece(r common.PieceRequest, pc *common.PieceData) error {
+	if st.onGetPiece != nil {
+		st.onGetPiece(r)
+	}
+	off := uint64(r.Index)*uint64(st.meta.Info.PieceLength) + uint64(r.Begin)
+	pc.Index = r.Index
+	pc.Begin = r.Begin
+	pc.Data = make([]byte, r.Length)
+	copy(pc.Data, st.data[off:])
+	return nil
+}
+
+func (st *testStorage) VerifyPiece(idx uint32) error {
+	if st.onVerifyPiece != nil {
+		st.onVerifyPiece(idx)
+	}
+	var pc common.PieceData
+	st.GetPiece(common.PieceRequest{Index: idx, Length: st.meta.LengthOfPiece(idx)}, &pc)
+	st.bfMtx.Lock()
+	defer st.bfMtx.Unlock()
+	if st.meta.CheckPiece(&pc) {
+		st.bf.Set(idx)
+		return nil
+	}
+	st.bf.Unset(idx)
+	return common.ErrInvalidPiece
+}
+
+func (st *testStorage) DownloadedSize() (n uint64) {
+	if st.meta == nil {
+		return
+	}
+	st.bfMtx.Lock()
+	defer st.bfMtx.Unlock()
+	for idx := uint32(0); idx < st.bf.Length; idx++ {
+		if st.bf.Has(idx) {
+			n += uint64(st.meta.LengthOfPiece(idx))
+		}
+	}
+	return
+}
+
+func (st *testStorage) DownloadRemaining() uint64 {
+	if st.meta == nil {
+		return 0
+	}
+	return st.meta.TotalSize() - st.DownloadedSize()
+}
+
+func (st *testStorage) Seed() (bool, error) {
+	if st.seedErr != nil {
+		return false, st.seedErr
+	}
+	return st.Bitfield().Completed(), nil
+}
+
+func (st *testStorage) Flush() error {
+	if st.onFlush != nil {
+		st.onFlush()
+	}
+	return nil
+}
+
+// a copy of the pieces we have, so a running torrent never reads bits a test is setting
+func (st *testStorage) Bitfield() *bittorrent.Bitfield {
+	st.bfMtx.Lock()
+	defer st.bfMtx.Unlock()
+	if st.bf == nil {
+		return nil
+	}
+	return st.bf.Copy()
+}
+
+// we got piece idx, safe while a torrent runs on this storage
+func (st *testStorage) setPiece(idx uint32) {
+	st.bfMtx.Lock()
+	st.bf.Set(idx)
+	st.bfMtx.Unlock()
+}
+
+func (st *testStorage) SavePartial(blocks map[uint32]*bittorrent.Bitfield) error {
+	st.partialMtx.Lock()
+	st.partial = blocks
+	st.partialMtx.Unlock()
+	return nil
+}
+
+func (st *testStorage) LoadPartial() map[uint32]*bittorrent.Bitfield {
+	st.partialMtx.Lock()
+	defer st.partialMtx.Unlock()
+	return st.partial
+}
+
+func (st *testStorage) MetaInfo() *metainfo.TorrentFile  { return st.meta }
+func (st *testStorage) Infohash() common.Infohash        { return st.ih }
+func (st *testStorage) Name() string                     { return st.ih.Hex() }
+func (st *testStorage) Delete() error                    { return nil }
+func (st *testStorage) SaveStats(s *stats.Tracker) error { return nil }
+func (st *testStorage) FileList() []string               { return nil }
+func (st *testStorage) MoveTo(other string) error        { return nil }
+func (st *testStorage) PutInfo(info metainfo.Info) error { return nil }
+func (st *testStorage) DownloadDir() string              { return "" }
+
+// network for tests that records dials and blocks them until closed
+type testNetwork struct {
+	mtx    sync.Mutex
+	dials  map[string]int
+	sent   map[string]int
+	closed chan bool
+	// fail dials right away instead of blocking
+	refuse bool
+	// our address if not the default one
+	addr net.Addr
+	// answer dials with a pipe and hand the other end to this
+	serve func(net.Conn)
+}
+
+func newTestNetwork() *testNetwork {
+	return &testNetwork{
+		dials:  make(map[string]int),
+		sent:   make(map[string]int),
+		closed: make(chan bool),
+	}
+}
+
+func (n *testNetwork) Dial(network, addr string) (net.Conn, error) {
+	n.mtx.Lock()
+	n.dials[addr]++
+	refuse := n.refuse
+	serve := n.serve
+	n.mtx.Unlock()
+	if refuse {
+		return nil, errTestRefused
+	}
+	if serve != nil {
+		local, remote := net.Pipe()
+		go serve(remote)
+		return local, nil
+	}
+	<-n.closed
+	return nil, errTestClosed
+}
+
+func (n *testNetwork) numDials(addr string) int {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.dials[addr]
+}
+
+// datagrams are counted and dropped
+func (n *testNetwork) WriteTo(d []byte, to net.Addr) (int, error) {
+	n.mtx.Lock()
+	n.sent[to.String()]++
+	n.mtx.Unlock()
+	return len(d), nil
+}
+
+func (n *testNetwork) numSent(addr string) int {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.sent[addr]
+}
+
+func (n *testNetwork) Addr() net.Addr {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.addr != nil {
+		return n.addr
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+}
+
+func (n *testNetwork) setAddr(a net.Addr) {
+	n.mtx.Lock()
+	n.addr = a
+	n.mtx.Unlock()
+}
+
+func (n *testNetwork) Accept() (net.Conn, error)                  { return nil, errTestClosed }
+func (n *testNetwork) ReadFrom([]byte) (int, net.Addr, error)     { return 0, nil, errTestClosed }
+func (n *testNetwork) Open() error                                { return nil }
+func (n *testNetwork) Close() error                               { close(n.closed); return nil }
+func (n *testNetwork) Lookup(name, port string) (net.Addr, error) { return nil, errTestClosed }
+
+// tracker for tests that gives out a fixed set of peers
+type testTracker struct {
+	name  string
+	peers []common.Peer
+	delay time.Duration
+	// called on each announce
+	onAnnounce func(*tracker.Request)
+	// called after each announce
+	afterAnnounce func()
+	// clock to tell the next announce time with, nil for the real one
+	clock util.Clock
+	// min interval in seconds we give out
+	minInterval int
+	// swarm counts we give out
+	seeders  int
+	leechers int
+	// error to fail announces with
+	err error
+	// ip we say we see the announcer at
+	externalIP net.IP
+}
+
+func (tr *testTracker) Name() string {
+	return tr.name
+}
+
+func (tr *testTracker) Announce(req *tracker.Request) (*tracker.Response, error) {
+	if tr.onAnnounce != nil {
+		tr.onAnnounce(req)
+	}
+	time.Sleep(tr.delay)
+	if tr.afterAnnounce != nil {
+		tr.afterAnnounce()
+	}
+	clock := tr.clock
+	if clock == nil {
+		clock = util.RealClock
+	}
+	return &tracker.Response{
+		Peers:        tr.peers,
+		MinInterval:  tr.minInterval,
+		Complete:     tr.seeders,
+		Incomplete:   tr.leechers,
+		NextAnnounce: clock.Now().Add(time.Minute),
+		ExternalIP:   tr.externalIP,
+	}, tr.err
+}
+
+// metainfo for a single file torrent where every byte is zero
+func testMetaInfo(numPieces int, pieceLength uint32) *metainfo.TorrentFile {
+	h := sha1.Sum(make([]byte, pieceLength))
+	var pieces []byte
+	for idx := 0; idx < numPieces; idx++ {
+		pieces = append(pieces, h[:]...)
+	}
+	return &metainfo.TorrentFile{
+		Info: metainfo.Info{
+			Path:        "test",
+			PieceLength: pieceLength,
+			Pieces:      pieces,
+			Length:      uint64(numPieces) * uint64(pieceLength),
+		},
+	}
+}
+
+// make a torrent using test storage and network
+func newTestTorrent(meta *metainfo.TorrentFile) (*Torrent, *testNetwork) {
+	n := newTestNetwork()
+	t := newTorrent(newTestStorage(meta), func() network.Network { return n })
+	// tests look at the status right after changing things
+	t.StatusInterval = 0
+	// test peers are all on 10.0.0.0/8
+	t.AllowLANPeers = true
+	return t, n
+}
+
+// stop a test torrent and unblock everything it is waiting on
+func closeTestTorrent(t *Torrent, n *testNetwork) {
+	t.startClosing()
+	t.setStarted(false)
+	n.Close()
+}
+
 func TestSwarm(t *testing.T) {
 
 }
+
+func TestInboundNotAcceptedInfohash(t *testing.T) {
+	meta := testMetaInfo(1, BlockSize)
+	tr, n := newTestTorrent(meta)
+	defer closeTestTorrent(tr, n)
+	tr.setState(Downloading)
+	var other common.Infohash
+	other[0] = 1
+	sw := &Swarm{
+		id:               common.GeneratePeerID(),
+		AcceptInfohashes: map[common.Infohash]bool{other: true},
+	}
+	sw.Torrents.torrents.Store(meta.Infohash().Hex(), tr)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go sw.inboundConn(local)
+
+	h := bittorrent.Handshake{Infohash: meta.Infohash()}
+	var buff bytes.Buffer
+	h.Send(&buff)
+	if _, err := remote.Write(buff.Bytes()[:48]); err != nil {
+		t.Fatal(err)
+	}
+	// closed without a handshake reply
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	var reply [1]byte
+	if n, err := remote.Read(reply[:]); err != io.EOF {
+		t.Errorf("read %d bytes with error %v, expected the connection closed", n, err)
+	}
+	if tr.NumPeers() != 0 {
+		t.Error("peer added for an infohash we don't accept")
+	}
+}
+
+func TestStartPausedWaitsForResume(t *testing.T) {
+	meta := testMetaInfo(1, BlockSize)
+	n := newTestNetwork()
+	announced := make(chan tracker.Event, 4)
+	tt := &testTracker{
+		name: "test",
+		onAnnounce: func(req *tracker.Request) {
+			announced <- req.Event
+		},
+	}
+	sw := &Swarm{
+		getNet:      make(chan network.Network),
+		trackers:    map[string]tracker.Announcer{tt.name: tt},
+		StartPaused: true,
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sw.getNet <- n:
+			case <-done:
+				return
+			}
+		}
+	}()
+	sw.AddTorrent(newTestStorage(meta))
+	tr := sw.Torrents.GetTorrent(meta.Infohash())
+	defer closeTestTorrent(tr, n)
+	if !tr.Paused() {
+		t.Fatal("torrent not paused with StartPaused set")
+	}
+	select {
+	case ev := <-announced:
+		t.Fatalf("paused torrent announced %q", ev)
+	case <-time.After(time.Millisecond * 100):
+	}
+	if s := tr.State(); s != Stopped {
+		t.Errorf("paused torrent is %s", s)
+	}
+
+	if err := tr.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-announced:
+		if ev != tracker.Started {
+			t.Errorf("first announce after resume was %q", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no announce after resume")
+	}
+	if err := tr.Resume(); err != ErrNotPaused {
+		t.Errorf("resuming again gave %v", err)
+	}
+}
+
+func TestTorrentNodesSeedDHT(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	sw := &Swarm{
+		getNet:      make(chan network.Network),
+		StartPaused: true,
+	}
+	sw.dht = dht.New(n)
+	sw.dht.QueryTimeout = time.Millisecond * 100
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sw.getNet <- n:
+			case <-done:
+				return
+			}
+		}
+	}()
+	public := testMetaInfo(1, BlockSize)
+	public.Nodes = []byte("ll8:10.0.0.7i6881eel8:10.0.0.8i6882eee")
+	private := testMetaInfo(2, BlockSize)
+	p := uint64(1)
+	private.Info.Private = &p
+	private.Nodes = []byte("ll8:10.0.0.9i6883eee")
+	for _, meta := range []*metainfo.TorrentFile{public, private} {
+		sw.AddTorrent(newTestStorage(meta))
+		defer sw.Torrents.GetTorrent(meta.Infohash()).startClosing()
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for n.numSent("10.0.0.7:6881") == 0 || n.numSent("10.0.0.8:6882") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("nodes from the torrent were never asked to join the dht")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// give the private torrent time to use its nodes if it was going to
+	time.Sleep(time.Millisecond * 50)
+	if n.numSent("10.0.0.9:6883") != 0 {
+		t.Error("nodes from a private torrent were used")
+	}
+}
+
+func TestInboundDeferredPeerID(t *testing.T) {
+	meta := testMetaInfo(1, BlockSize)
+	tr, n := newTestTorrent(meta)
+	defer closeTestTorrent(tr, n)
+	tr.setState(Downloading)
+	sw := &Swarm{id: common.GeneratePeerID()}
+	sw.Torrents.torrents.Store(meta.Infohash().Hex(), tr)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go sw.inboundConn(local)
+
+	// handshake without the peer id at the end
+	h := bittorrent.Handshake{Infohash: meta.Infohash()}
+	var buff bytes.Buffer
+	h.Send(&buff)
+	if _, err := remote.Write(buff.Bytes()[:48]); err != nil {
+		t.Fatal(err)
+	}
+	var reply bittorrent.Handshake
+	if err := reply.Recv(remote); err != nil {
+		t.Fatalf("no handshake reply before sending our peer id: %s", err)
+	}
+	if reply.PeerID != sw.id {
+		t.Error("handshake reply has the wrong peer id")
+	}
+	if tr.NumPeers() != 0 {
+		t.Fatal("peer added before it sent its peer id")
+	}
+	id := common.GeneratePeerID()
+	remote.Write(id[:])
+	go io.Copy(ioutil.Discard, remote)
+	for idx := 0; idx < 100 && tr.NumPeers() == 0; idx++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	var got []common.PeerID
+	tr.VisitPeers(func(c *PeerConn) {
+		got = append(got, c.id)
+	})
+	if len(got) != 1 || got[0] != id {
+		t.Errorf("got peers %v, expected one with id %s", got, id.String())
+	}
+}
+
+func TestLSDAnnounceDialsPeer(t *testing.T) {
+	meta := testMetaInfo(1, BlockSize)
+	tr, n := newTestTorrent(meta)
+	defer closeTestTorrent(tr, n)
+	// lan peers get dialed even without AllowLANPeers
+	tr.AllowLANPeers = false
+	tr.setState(Downloading)
+	sw := &Swarm{}
+	sw.Torrents.torrents.Store(meta.Infohash().Hex(), tr)
+	s := &lsd.Service{OnPeer: sw.lsdPeer}
+	var other common.Infohash
+	other[0] = 1
+	a := lsd.Announce{Port: 6882, Infohashes: []common.Infohash{other, meta.Infohash()}, Cookie: "peer"}
+	s.Handle(a.Bytes(), &net.UDPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 6771})
+	time.Sleep(time.Millisecond * 100)
+	if n.numDials("192.168.1.5:6882") != 1 {
+		t.Fatal("did not dial the peer found on the lan")
+	}
+
+	// private torrents don't use lsd
+	pmeta := testMetaInfo(2, BlockSize)
+	private := uint64(1)
+	pmeta.Info.Private = &private
+	ptr, pn := newTestTorrent(pmeta)
+	defer closeTestTorrent(ptr, pn)
+	ptr.setState(Downloading)
+	sw.Torrents.torrents.Store(pmeta.Infohash().Hex(), ptr)
+	a.Infohashes = []common.Infohash{pmeta.Infohash()}
+	s.Handle(a.Bytes(), &net.UDPAddr{IP: net.IPv4(192, 168, 1, 6), Port: 6771})
+	time.Sleep(time.Millisecond * 100)
+	if pn.numDials("192.168.1.6:6882") != 0 {
+		t.Error("private torrent dialed a peer found on the lan")
+	}
+}
@@ -3,10 +3,12 @@ package swarm
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"github.com/majestrate/XD/lib/bittorrent"
 	"github.com/majestrate/XD/lib/bittorrent/extensions"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/dht"
+	"github.com/majestrate/XD/lib/geoip"
 	"github.com/majestrate/XD/lib/log"
 	"github.com/majestrate/XD/lib/metainfo"
 	"github.com/majestrate/XD/lib/network"
@@ -16,13 +18,25 @@ import (
 	"github.com/majestrate/XD/lib/tracker"
 	"github.com/majestrate/XD/lib/util"
 	"github.com/zeebo/bencode"
+	"math/rand"
 	"net"
+	"net/url"
+	"strconv"
 	"time"
 )
 
 // max peers peer swarm default
 const DefaultMaxSwarmPeers = 50
 
+// DefaultStatusInterval is how long a status snapshot is reused for
+const DefaultStatusInterval = time.Second
+
+// DefaultResumeFlushInterval is how often what we have is written out while running
+const DefaultResumeFlushInterval = time.Second * 30
+
+// MaxQueuedPeers is how many peers we keep around to dial later once we have room for them
+const MaxQueuedPeers = 500
+
 // rate name for upload
 const RateUpload = "upload"
 
@@ -33,51 +47,310 @@ var defaultRates = []string{RateDownload, RateUpload}
 
 // single torrent tracked in a swarm
 type Torrent struct {
-	TID              int64
-	addr             net.Addr
-	Completed        func()
-	Started          func()
-	Stopped          func()
-	RemoveSelf       func()
-	netacces         sync.Mutex
-	suspended        bool
-	Network          func() network.Network
-	Trackers         map[string]tracker.Announcer
-	announcers       map[string]*torrentAnnounce
-	announceMtx      sync.Mutex
-	announceTicker   *time.Ticker
-	id               common.PeerID
-	st               storage.Torrent
-	obconns          map[string]*PeerConn
-	ibconns          map[string]*PeerConn
-	connMtx          sync.Mutex
-	pt               *pieceTracker
-	defaultOpts      extensions.Message
-	closing          bool
-	started          bool
-	MaxRequests      int
-	MaxPeers         uint
-	pexState         PEXSwarmState
-	xdht             *dht.XDHT
-	statsTracker     *stats.Tracker
-	tx               uint64
-	rx               uint64
-	seeding          bool
-	metaInfo         []byte
-	pendingInfoBF    *bittorrent.Bitfield
-	requestingInfoBF *bittorrent.Bitfield
-	puttingMetaInfo  bool
-	addedAt          time.Time
-	peersPool        sync.Pool
-	lastPEX          time.Time
-	pexInterval      time.Duration
+	TID                  int64
+	addr                 net.Addr
+	Completed            func()
+	Started              func()
+	Stopped              func()
+	RemoveSelf           func()
+	netacces             sync.Mutex
+	suspended            bool
+	Network              func() network.Network
+	Trackers             map[string]tracker.Announcer
+	announcers           map[string]*torrentAnnounce
+	announceMtx          sync.Mutex
+	disabledTrackers     map[string]bool
+	announceTicker       util.Ticker
+	id                   common.PeerID
+	key                  string
+	UserAgent            string
+	ExternalAddr         string
+	externalIPs          map[bool]net.IP
+	externalMtx          sync.Mutex
+	NoPeerID             bool
+	st                   storage.Torrent
+	obconns              map[string]*PeerConn
+	ibconns              map[string]*PeerConn
+	connMtx              sync.Mutex
+	pendingPeers         map[string]bool
+	queuedPeers          []common.Peer
+	badPeers             map[string]bool
+	retries              *retryBudget
+	stateMtx             sync.Mutex
+	state                TorrentState
+	stateErr             error
+	checkMtx             sync.Mutex
+	retrySleep           func(time.Duration)
+	pt                   *pieceTracker
+	defaultOpts          extensions.Message
+	closing              bool
+	started              bool
+	MaxRequests          int
+	MaxPiecesPerPeer     int
+	MaxUploadSlots       int
+	UploadQueueSize      int
+	MaxPeers             uint
+	MaxParallelAnnounces int
+	SendQueueSize        int
+	SendBufferSize       int
+	NoDelay              bool
+	LazyBitfield         bool
+	LeechOnly            bool
+	FirstLastPieces      bool
+	DownloadQuota        uint64
+	AllowLANPeers        bool
+	PeerIdleTimeout      time.Duration
+	RequestTimeout       time.Duration
+	LargeBlockSize       uint32
+	LargeBlockRate       uint64
+	StopWhenDone         bool
+	TraceMessages        bool
+	pexState             PEXSwarmState
+	availability         pieceAvailability
+	xdht                 *dht.XDHT
+	DHT                  dht.Announcer
+	GeoIP                *geoip.Cache
+	NetPool              *NetPool
+	Queue                *DownloadQueue
+	Priority             int
+	statsTracker         *stats.Tracker
+	RateWindow           time.Duration
+	txRate               *util.RateMeter
+	rxRate               *util.RateMeter
+	seeding              bool
+	IdleSeedTimeout      time.Duration
+	AnnounceInterval     time.Duration
+	lastInterested       time.Time
+	metaInfo             []byte
+	metaMtx              sync.Mutex
+	pendingInfoBF        *bittorrent.Bitfield
+	requestingInfoBF     *bittorrent.Bitfield
+	puttingMetaInfo      bool
+	addedAt              time.Time
+	peersPool            sync.Pool
+	pieceReads           chan bool
+	lastPEX              time.Time
+	pexInterval          time.Duration
+	clock                util.Clock
+	streamMtx            sync.Mutex
+	haveNotify           chan struct{}
+	streamWant           map[uint32]int
+	edgePieces           []uint32
+	uploadMtx            sync.Mutex
+	uploaders            map[*PeerConn]time.Time
+	diskFullAt           time.Time
+	StatusInterval       time.Duration
+	ResumeFlushInterval  time.Duration
+	resumeTicker         util.Ticker
+	resumeDone           chan struct{}
+	statusMtx            sync.Mutex
+	status               TorrentStatus
+	statusAt             time.Time
+	statusBuilds         int
+	resolved             *common.ResolveCache
+	// changes tracker announce urls right before each announce, to put in a passkey, nil to announce to them as they are
+	RewriteAnnounce func(*url.URL) *url.URL
+	// added paused and waiting for a start, resume is set once it can be started
+	paused bool
+	resume func()
 }
 
 func (t *Torrent) ShouldAcceptNewPeer() bool {
-	state := t.GetStatus().State
+	state := t.State()
 	return state == Downloading || state == Seeding
 }
 
+// State gets what this torrent is doing right now
+func (t *Torrent) State() TorrentState {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	return t.state
+}
+
+// Err gets the error that put this torrent into the error state
+func (t *Torrent) Err() error {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	return t.stateErr
+}
+
+// mark the torrent as closing, returns false if it already was
+func (t *Torrent) startClosing() bool {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	if t.closing {
+		return false
+	}
+	t.closing = true
+	return true
+}
+
+// true while running, from when run starts until Close
+func (t *Torrent) isStarted() bool {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	return t.started
+}
+
+func (t *Torrent) setStarted(started bool) {
+	t.stateMtx.Lock()
+	t.started = started
+	t.stateMtx.Unlock()
+}
+
+// true once Close was called until we start again
+func (t *Torrent) isClosing() bool {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	return t.closing
+}
+
+func (t *Torrent) setState(state TorrentState) {
+	t.stateMtx.Lock()
+	old := t.state
+	t.state = state
+	if state != Errored {
+		t.stateErr = nil
+	}
+	t.stateMtx.Unlock()
+	t.invalidateStatus()
+	if old != state {
+		log.Infof("%s went from %s to %s", t.Name(), old, state)
+	}
+}
+
+// put this torrent into the error state
+func (t *Torrent) setError(err error) {
+	t.stateMtx.Lock()
+	t.stateErr = err
+	t.stateMtx.Unlock()
+	t.setState(Errored)
+	log.Errorf("%s: %s", t.Name(), err)
+}
+
+// stop downloading because there is no space to put what we get, uploading keeps going
+func (t *Torrent) diskFull(err error) {
+	if t.State() == Errored {
+		return
+	}
+	t.stateMtx.Lock()
+	t.diskFullAt = t.clock.Now()
+	t.stateMtx.Unlock()
+	t.setError(fmt.Errorf("%w: %s", ErrDiskFull, err))
+	// take back every request, what we get can't be stored
+	t.cancelAllPieces()
+}
+
+// cancel every piece in progress with every peer
+func (t *Torrent) cancelAllPieces() {
+	t.pt.iterCached(func(cp *cachedPiece) {
+		t.VisitPeers(func(conn *PeerConn) {
+			conn.cancelPiece(cp.index)
+		})
+		t.pt.removePiece(cp.index)
+	})
+}
+
+// stop downloading once DownloadQuota bytes came in this session, start again if the quota is raised
+func (t *Torrent) checkQuota() {
+	total := t.rxRate.Total()
+	over := t.DownloadQuota > 0 && total >= t.DownloadQuota
+	stopped := errors.Is(t.Err(), ErrQuotaReached)
+	if over && !stopped && t.State() != Errored && !t.Done() {
+		t.setError(fmt.Errorf("%w: got %d of %d bytes", ErrQuotaReached, total, t.DownloadQuota))
+		t.cancelAllPieces()
+	} else if !over && stopped {
+		log.Infof("%s is under its download quota again", t.Name())
+		t.setState(t.runningState())
+		t.VisitPeers(func(c *PeerConn) {
+			if c.isUsInterested() {
+				c.runDownload = true
+			}
+		})
+	}
+}
+
+// start downloading again once DiskFullRetryInterval has passed since the disk filled up
+// if there is still no space we go right back to the error state
+func (t *Torrent) retryDiskFull(now time.Time) {
+	if !errors.Is(t.Err(), ErrDiskFull) {
+		return
+	}
+	t.stateMtx.Lock()
+	since := now.Sub(t.diskFullAt)
+	t.stateMtx.Unlock()
+	if since < DiskFullRetryInterval {
+		return
+	}
+	log.Infof("%s trying to download again after the disk filled up", t.Name())
+	t.pt.setStoreError(nil)
+	t.setState(t.runningState())
+	t.VisitPeers(func(c *PeerConn) {
+		if c.isUsInterested() {
+			c.runDownload = true
+		}
+	})
+}
+
+// get the state a running torrent should be in from how much we have
+func (t *Torrent) runningState() TorrentState {
+	if t.seeding {
+		return Seeding
+	}
+	return Downloading
+}
+
+// VerifyAll checks all local data for this torrent
+func (t *Torrent) VerifyAll() (err error) {
+	t.setState(Checking)
+	err = t.st.VerifyAll()
+	if err == nil && !t.Done() {
+		// something went bad since we started seeding
+		t.seeding = false
+		t.advertiseUploadOnly(false)
+		if t.isStarted() {
+			t.Queue.join(t)
+		}
+	}
+	if err != nil {
+		t.setError(err)
+	} else if t.isStarted() {
+		t.setState(t.runningState())
+	} else {
+		t.setState(Stopped)
+	}
+	return
+}
+
+// Recheck checks all local data while we are running
+// transfers pause while checking and resume with whatever pieces we turned out to have
+func (t *Torrent) Recheck() (err error) {
+	if !t.Ready() {
+		return storage.ErrNoMetaInfo
+	}
+	t.checkMtx.Lock()
+	defer t.checkMtx.Unlock()
+	log.Infof("rechecking %s", t.Name())
+	t.pt.pause()
+	// take back every request, nothing we get until we are done will be stored
+	t.pt.iterCached(func(cp *cachedPiece) {
+		t.VisitPeers(func(conn *PeerConn) {
+			conn.cancelPiece(cp.index)
+		})
+		t.pt.removePiece(cp.index)
+	})
+	err = t.VerifyAll()
+	t.pt.resume()
+	t.notifyHave()
+	t.VisitPeers(func(c *PeerConn) {
+		c.checkInterested()
+		if c.isUsInterested() {
+			c.runDownload = true
+		}
+	})
+	return
+}
+
 func (t *Torrent) getNextPeer() *PeerConn {
 	p := t.peersPool.Get()
 	return p.(*PeerConn)
@@ -97,20 +370,42 @@ func (t *Torrent) Ready() bool {
 
 // implements io.Closer
 func (t *Torrent) Close() error {
-	if t.closing {
+	if !t.startClosing() {
 		return nil
 	}
-	t.closing = true
-	t.started = false
+	t.setStarted(false)
+	t.stopResumeFlush()
+	t.Queue.leave(t)
+	if t.State() != Errored {
+		t.setState(Stopped)
+	}
 	t.VisitPeers(func(c *PeerConn) {
 		c.Close()
 	})
+	// pieces we were getting are saved to pick up later, other torrents sharing the budget can have their room
+	partial := t.pt.obtainedBlocks()
+	t.pt.removeAll()
+	// let reads already going finish, any after this see we are closing
+	for idx := 0; idx < cap(t.pieceReads); idx++ {
+		t.pieceReads <- true
+	}
+	for idx := 0; idx < cap(t.pieceReads); idx++ {
+		<-t.pieceReads
+	}
+	// wake up readers so they see we closed
+	t.notifyHave()
 	t.saveStats()
+	if t.Ready() {
+		err := t.st.SavePartial(partial)
+		if err != nil {
+			log.Warnf("failed to save partial pieces for %s: %s", t.Name(), err)
+		}
+	}
 	return t.st.Flush()
 }
 
 func (t *Torrent) shouldAnnounce(name string) bool {
-	return time.Now().After(t.nextAnnounceFor(name))
+	return !t.clock.Now().Before(t.nextAnnounceFor(name))
 }
 
 func (t *Torrent) SetPieceWindow(n int) {
@@ -121,13 +416,51 @@ func (t *Torrent) SetPieceWindow(n int) {
 	// t.pt.maxPending = n
 }
 
+// SetPieceBudget makes this torrent share b with the other torrents using it, nil for no limit
+func (t *Torrent) SetPieceBudget(b *PieceBudget) {
+	t.pt.mtx.Lock()
+	t.pt.budget = b
+	t.pt.mtx.Unlock()
+}
+
+// SetPieceSource makes piece selection use src for its random choices so the same seed and peers pick the same pieces
+// nil goes back to the global source
+func (t *Torrent) SetPieceSource(src rand.Source) {
+	t.availability.setSource(src)
+}
+
+// SetRandomBlocks makes pieces started from now on hand out their blocks in random order instead of in order
+// this makes peers asking for the same piece less likely to ask for the same blocks
+func (t *Torrent) SetRandomBlocks(random bool) {
+	t.pt.mtx.Lock()
+	t.pt.randomBlocks = random
+	t.pt.mtx.Unlock()
+}
+
+// SetBackgroundVerify makes finished pieces get hashed in the background so downloading goes on meanwhile
+// at most MaxBackgroundVerifies pieces are hashed at once, a piece only counts as had once it checks out
+func (t *Torrent) SetBackgroundVerify(background bool) {
+	t.pt.mtx.Lock()
+	if !background {
+		t.pt.verifies = nil
+	} else if t.pt.verifies == nil {
+		t.pt.verifies = make(chan bool, MaxBackgroundVerifies)
+	}
+	t.pt.mtx.Unlock()
+}
+
+// SetMaxInProgressPieces sets how many pieces we download at once, 0 or less for no limit
+func (t *Torrent) SetMaxInProgressPieces(n int) {
+	t.pt.mtx.Lock()
+	t.pt.maxInProgress = n
+	t.pt.mtx.Unlock()
+}
+
 func (t *Torrent) nextAnnounceFor(name string) (tm time.Time) {
 	t.announceMtx.Lock()
 	a, ok := t.announcers[name]
-	if ok {
-		tm = a.next
-	} else {
-		tm = time.Now()
+	if !ok {
+		tm = t.clock.Now()
 		t.announcers[name] = &torrentAnnounce{
 			next:     tm,
 			t:        t,
@@ -135,6 +468,11 @@ func (t *Torrent) nextAnnounceFor(name string) (tm time.Time) {
 		}
 	}
 	t.announceMtx.Unlock()
+	if ok {
+		a.access.Lock()
+		tm = a.next
+		a.access.Unlock()
+	}
 	return tm
 }
 
@@ -142,19 +480,43 @@ var tIDCounter = int64(0)
 
 func newTorrent(st storage.Torrent, getNet func() network.Network) *Torrent {
 	t := &Torrent{
-		TID:          tIDCounter,
-		Trackers:     make(map[string]tracker.Announcer),
-		announcers:   make(map[string]*torrentAnnounce),
-		st:           st,
-		Network:      getNet,
-		ibconns:      make(map[string]*PeerConn),
-		obconns:      make(map[string]*PeerConn),
-		MaxRequests:  DefaultMaxParallelRequests,
-		MaxPeers:     DefaultMaxSwarmPeers,
-		statsTracker: stats.NewTracker(),
-		addedAt:      time.Now(),
-		lastPEX:      time.Now(),
-		pexInterval:  time.Minute * 2,
+		TID:                  tIDCounter,
+		Trackers:             make(map[string]tracker.Announcer),
+		announcers:           make(map[string]*torrentAnnounce),
+		st:                   st,
+		Network:              getNet,
+		ibconns:              make(map[string]*PeerConn),
+		obconns:              make(map[string]*PeerConn),
+		pendingPeers:         make(map[string]bool),
+		badPeers:             make(map[string]bool),
+		retries:              peerRetryBudget,
+		state:                Stopped,
+		retrySleep:           time.Sleep,
+		MaxRequests:          DefaultMaxParallelRequests,
+		MaxPiecesPerPeer:     DefaultMaxPiecesPerPeer,
+		MaxUploadSlots:       DefaultMaxUploadSlots,
+		UploadQueueSize:      DefaultUploadQueueSize,
+		MaxPeers:             DefaultMaxSwarmPeers,
+		MaxParallelAnnounces: DefaultMaxParallelAnnounces,
+		SendQueueSize:        DefaultSendQueueSize,
+		SendBufferSize:       DefaultSendBufferSize,
+		NoDelay:              DefaultNoDelay,
+		StatusInterval:       DefaultStatusInterval,
+		ResumeFlushInterval:  DefaultResumeFlushInterval,
+		AllowLANPeers:        DefaultAllowLANPeers,
+		PeerIdleTimeout:      DefaultPeerIdleTimeout,
+		RequestTimeout:       DefaultRequestTimeout,
+		LargeBlockRate:       DefaultLargeBlockRate,
+		pieceReads:           make(chan bool, MaxPieceReads),
+		resolved:             common.NewResolveCache(common.DefaultResolveTTL),
+		statsTracker:         stats.NewTracker(),
+		RateWindow:           util.DefaultRateWindow,
+		txRate:               util.NewRateMeter(util.DefaultRateWindow),
+		rxRate:               util.NewRateMeter(util.DefaultRateWindow),
+		addedAt:              time.Now(),
+		lastPEX:              time.Now(),
+		pexInterval:          time.Minute * 2,
+		clock:                util.RealClock,
 	}
 	t.peersPool.New = func() interface{} { return &PeerConn{} }
 	tIDCounter++
@@ -176,27 +538,58 @@ func newTorrent(st storage.Torrent, getNet func() network.Network) *Torrent {
 	t.defaultOpts.SetSupported(extensions.UTMetaData)
 	t.pt = createPieceTracker(st, t.getRarestPiece)
 	t.pt.have = t.broadcastHave
+	t.pt.diskFull = t.diskFull
 	return t
 }
 
 func (t *Torrent) getRarestPiece(remote *bittorrent.Bitfield, exclude []uint32) (idx uint32, has bool) {
-	var swarm []*bittorrent.Bitfield
-	t.VisitPeers(func(c *PeerConn) {
-		if c.bf != nil {
-			swarm = append(swarm, c.bf)
-		}
-	})
 	m := make(map[uint32]bool)
 	for idx := range exclude {
 		m[exclude[idx]] = true
 	}
 	bt := t.st.Bitfield()
-	idx, has = remote.FindRarest(swarm, func(idx uint32) bool {
+	// pieces someone is waiting to read go first
+	idx, has = t.wantedPiece(remote, func(idx uint32) bool {
+		return bt.Has(idx) || m[idx]
+	})
+	if has {
+		return
+	}
+	// then the ends of files so media can start playing
+	idx, has = t.edgePiece(remote, func(idx uint32) bool {
+		return bt.Has(idx) || m[idx]
+	})
+	if has {
+		return
+	}
+	idx, has = t.availability.rarest(remote, func(idx uint32) bool {
 		return bt.Has(idx) || m[idx]
 	})
 	return
 }
 
+// free blocks asked for from peers that went away without giving them back
+// requests are only made while ticking so none get made while we look
+func (t *Torrent) freeOrphanedBlocks() {
+	owned := make(map[common.PieceRequest]bool)
+	t.VisitPeers(func(c *PeerConn) {
+		c.access.Lock()
+		for _, r := range c.downloading {
+			// large requests own every block they cover
+			for begin := r.Begin; begin < r.Begin+r.Length; begin += BlockSize {
+				owned[common.PieceRequest{Index: r.Index, Begin: begin}] = true
+			}
+		}
+		c.access.Unlock()
+	})
+	freed := t.pt.freeOrphanedBlocks(func(idx, begin uint32) bool {
+		return owned[common.PieceRequest{Index: idx, Begin: begin}]
+	})
+	if freed > 0 {
+		log.Debugf("%s freed %d blocks nobody was downloading", t.Name(), freed)
+	}
+}
+
 // NumPeers counts how many peers we have on this torrent
 func (t *Torrent) NumPeers() (count uint) {
 	t.VisitPeers(func(_ *PeerConn) {
@@ -225,43 +618,86 @@ func (t *Torrent) VisitPeers(v func(*PeerConn)) {
 	}
 }
 
-func (t *Torrent) RX() (rx int64) {
-	t.VisitPeers(func(c *PeerConn) {
-		rx += int64(c.rx.Mean())
-	})
-	return
+// RX gets the download rate of this torrent in bytes per second
+func (t *Torrent) RX() int64 {
+	return int64(t.rxRate.Rate())
 }
 
-func (t *Torrent) TX() (tx int64) {
-	t.VisitPeers(func(c *PeerConn) {
-		tx += int64(c.tx.Mean())
-	})
-	return
+// TX gets the upload rate of this torrent in bytes per second
+func (t *Torrent) TX() int64 {
+	return int64(t.txRate.Rate())
+}
+
+// SetRateWindow sets the time window upload and download rates are averaged over
+func (t *Torrent) SetRateWindow(window time.Duration) {
+	t.RateWindow = window
+	t.txRate = util.NewRateMeter(window)
+	t.rxRate = util.NewRateMeter(window)
 }
 
+// GetStatus gets a snapshot of this torrent's status, rebuilt at most once per StatusInterval
+// the snapshot is shared so it must not be modified
 func (t *Torrent) GetStatus() TorrentStatus {
+	if t.StatusInterval <= 0 {
+		return t.buildStatus()
+	}
+	t.statusMtx.Lock()
+	defer t.statusMtx.Unlock()
+	now := t.clock.Now()
+	if t.statusAt.IsZero() || now.Sub(t.statusAt) >= t.StatusInterval {
+		t.status = t.buildStatus()
+		t.statusAt = now
+		t.statusBuilds++
+	}
+	return t.status
+}
+
+// rebuild the status snapshot on tick if it is due so callers find a fresh one
+func (t *Torrent) refreshStatus() {
+	if t.StatusInterval > 0 {
+		t.GetStatus()
+	}
+}
+
+// make the next GetStatus rebuild the snapshot
+func (t *Torrent) invalidateStatus() {
+	t.statusMtx.Lock()
+	t.statusAt = time.Time{}
+	t.statusMtx.Unlock()
+}
 
+func (t *Torrent) buildStatus() TorrentStatus {
 	var addr string
-	if t.addr != nil {
-		addr = t.addr.String()
+	if la := t.localAddr(); la != nil {
+		addr = la.String()
 	}
 	name := t.Name()
+	seeders, leechers := t.SwarmSize()
 	var peers []*PeerConnStats
 	t.VisitPeers(func(c *PeerConn) {
 		peers = append(peers, c.Stats())
 	})
-	state := Downloading
+	state := t.State()
 	if t.st.Checking() {
 		state = Checking
 	}
+	var errMsg string
+	if err := t.Err(); err != nil {
+		errMsg = err.Error()
+	} else if err := t.pt.StoreError(); err != nil {
+		errMsg = err.Error()
+	}
 	if !t.Ready() {
 		return TorrentStatus{
 			Peers:    peers,
 			Name:     name,
 			State:    state,
+			Error:    errMsg,
 			Infohash: t.st.Infohash().Hex(),
-			TX:       t.tx,
-			RX:       t.rx,
+			TX:       t.txRate.Total(),
+			RX:       t.rxRate.Total(),
+			Seeders:  seeders,
+			Leechers: leechers,
 			Us: PeerConnStats{
 				TX:     float64(t.TX()),
 				RX:     float64(t.RX()),
@@ -271,54 +707,13 @@ func (t *Torrent) GetStatus() TorrentStatus {
 			},
 		}
 	}
-	if t.Done() {
-		state = Seeding
-	} else if t.closing || !t.started {
-		state = Stopped
-	}
-	if t.st.Checking() {
-		state = Checking
-	}
-
 	bf := t.Bitfield()
 	var files []TorrentFileInfo
-	nfo := t.st.MetaInfo().Info
-	var idx uint64
-	f := nfo.GetFiles()
-	if len(f) == 1 {
-		b := bittorrent.Bitfield{
-			Data:   bf.Data,
-			Length: bf.Length,
-		}
+	for _, fp := range t.FileProgress() {
 		files = append(files, TorrentFileInfo{
-			FileInfo: f[0],
-			Progress: b.Progress(),
+			FileInfo: fp.File,
+			Progress: fp.Progress(),
 		})
-	} else {
-		for _, file := range f {
-			l := file.Length / uint64(nfo.PieceLength)
-			// XXX: this below here is wrong because how the bits are packed in the bitfield
-			l /= 8
-			plen := l
-			var data []byte
-			if l == 0 {
-				data = []byte{bf.Data[idx]}
-				plen = 1
-			} else if idx+l < uint64(len(bf.Data)) {
-				data = bf.Data[idx : idx+l]
-			} else {
-				data = bf.Data[idx:]
-			}
-			b := bittorrent.Bitfield{
-				Data:   data,
-				Length: uint32(plen),
-			}
-			files = append(files, TorrentFileInfo{
-				FileInfo: file,
-				Progress: b.Progress(),
-			})
-			idx += l
-		}
 	}
 	b := bittorrent.Bitfield{
 		Data:   bf.Data,
@@ -328,11 +723,14 @@ func (t *Torrent) GetStatus() TorrentStatus {
 		Peers:    peers,
 		Name:     name,
 		State:    state,
+		Error:    errMsg,
 		Infohash: t.MetaInfo().Infohash().Hex(),
 		Progress: b.Progress(),
 		Files:    files,
-		TX:       t.tx,
-		RX:       t.rx,
+		TX:       t.txRate.Total(),
+		RX:       t.rxRate.Total(),
+		Seeders:  seeders,
+		Leechers: leechers,
 		Us: PeerConnStats{
 			TX:     float64(t.TX()),
 			RX:     float64(t.RX()),
@@ -343,140 +741,651 @@ func (t *Torrent) GetStatus() TorrentStatus {
 	}
 }
 
+// FileProgress gets how many bytes of each file we have
+// a piece that spans files counts for each of them once we have all of it
+func (t *Torrent) FileProgress() (files []FileProgress) {
+	info := t.MetaInfo()
+	if info == nil {
+		return
+	}
+	bf := t.Bitfield()
+	pl := uint64(info.Info.PieceLength)
+	var offset uint64
+	for _, f := range info.Info.GetFiles() {
+		fp := FileProgress{
+			File:  f,
+			Total: f.Length,
+		}
+		end := offset + f.Length
+		for idx := offset / pl; idx*pl < end; idx++ {
+			if !bf.Has(uint32(idx)) {
+				continue
+			}
+			// only count the part of the piece in this file
+			start := idx * pl
+			if start < offset {
+				start = offset
+			}
+			stop := (idx + 1) * pl
+			if stop > end {
+				stop = end
+			}
+			fp.Completed += stop - start
+		}
+		files = append(files, fp)
+		offset = end
+	}
+	return
+}
+
 func (t *Torrent) Bitfield() *bittorrent.Bitfield {
 	return t.st.Bitfield()
 }
 
+// tell peers if we only upload now (BEP 21)
+func (t *Torrent) advertiseUploadOnly(only bool) {
+	t.VisitPeers(func(c *PeerConn) {
+		c.setUploadOnly(only)
+	})
+}
+
+// check if there is a peer besides c that we would rather download from
+// peers that only upload are only asked for pieces when no one else can give us any
+func (t *Torrent) hasBetterSourceThan(c *PeerConn) (has bool) {
+	t.VisitPeers(func(other *PeerConn) {
+		if other != c && !other.isClosing() && !other.UploadOnly() && other.isUsInterested() && !other.RemoteChoking() {
+			has = true
+		}
+	})
+	return
+}
+
 // manually announce as seed to all trackers
 // blocks until done
 func (t *Torrent) AnnounceSeed() {
-	var wg sync.WaitGroup
-	for name := range t.Trackers {
-		wg.Add(1)
-		go func() {
-			t.announce(name, tracker.Completed)
-			wg.Add(-1)
-		}()
+	t.announceAll(tracker.Completed, t.trackerNames())
+	t.announceDHT()
+}
+
+// give the dht the nodes the torrent file lists to bootstrap from
+func (t *Torrent) addDHTNodes() {
+	info := t.MetaInfo()
+	if t.DHT == nil || info == nil || info.IsPrivate() {
+		return
+	}
+	for _, node := range info.DHTNodes() {
+		t.DHT.AddNode(node)
+	}
+}
+
+// tell the dht we have this torrent, private torrents never go on the dht
+func (t *Torrent) announceDHT() {
+	if t.DHT == nil || t.Private() || t.StopWhenDone {
+		return
+	}
+	port, err := t.listenPort()
+	if err == nil {
+		err = t.DHT.AnnouncePeer(t.Infohash(), port)
+	}
+	if err != nil {
+		log.Warnf("dht announce for %s failed: %s", t.Name(), err)
 	}
-	wg.Wait()
 }
 
 // start annoucing on all trackers
+// started is only sent to trackers that don't know about us yet, such as when we sent them stopped
 func (t *Torrent) StartAnnouncing() {
 	// wait for network
-	t.addr = t.Network().Addr()
-	ev := tracker.Started
+	la := t.Network().Addr()
+	t.announceMtx.Lock()
+	t.addr = la
+	t.announceMtx.Unlock()
+	ev := tracker.Nop
 	if t.Done() {
 		ev = tracker.Completed
 	}
-	for name := range t.Trackers {
+	names := t.trackerNames()
+	for _, name := range names {
 		t.nextAnnounceFor(name)
-		go t.announce(name, ev)
 	}
+	go t.announceAll(ev, names)
+	t.announceMtx.Lock()
 	if t.announceTicker == nil {
-		t.announceTicker = time.NewTicker(time.Second)
+		t.announceTicker = t.clock.NewTicker(time.Second)
 	}
-	go t.pollAnnounce()
+	ticker := t.announceTicker
+	t.announceMtx.Unlock()
+	go t.pollAnnounce(ticker)
 }
 
 // stop annoucing on all trackers
 func (t *Torrent) StopAnnouncing(announce bool) {
+	t.announceMtx.Lock()
 	if t.announceTicker != nil {
 		t.announceTicker.Stop()
 		t.announceTicker = nil
 	}
+	t.announceMtx.Unlock()
 	if announce {
-		var wg sync.WaitGroup
-		for n := range t.Trackers {
-			wg.Add(1)
-			go func(name string) {
-				log.Debugf("%s stopping", name)
-				t.announce(name, tracker.Stopped)
-				log.Debugf("%s stopped", name)
-				wg.Add(-1)
-			}(n)
-		}
-		wg.Wait()
+		t.announceAll(tracker.Stopped, t.trackerNames())
+	}
+}
+
+// our network address as we last saw it
+func (t *Torrent) localAddr() net.Addr {
+	t.announceMtx.Lock()
+	defer t.announceMtx.Unlock()
+	return t.addr
+}
+
+// check if our network address changed since we last looked
+func (t *Torrent) addrChanged() bool {
+	la := t.Network().Addr()
+	t.announceMtx.Lock()
+	old := t.addr
+	if old != nil && la.String() == old.String() {
+		t.announceMtx.Unlock()
+		return false
+	}
+	t.addr = la
+	t.announceMtx.Unlock()
+	if old == nil {
+		return false
 	}
+	log.Infof("%s address changed from %s to %s", t.Name(), old, la)
+	return true
+}
+
+// announce to everyone again so they know our new address
+func (t *Torrent) reannounce() {
+	names := t.trackerNames()
+	for _, name := range names {
+		t.nextAnnounceFor(name)
+		t.announceMtx.Lock()
+		a := t.announcers[name]
+		t.announceMtx.Unlock()
+		a.reset()
+	}
+	ev := tracker.Started
+	if t.Done() {
+		ev = tracker.Completed
+	}
+	t.announceAll(ev, names)
 }
 
 // poll announce ticker channel and issue announces
-func (t *Torrent) pollAnnounce() {
-	for t.announceTicker != nil {
-		_, ok := <-t.announceTicker.C
+func (t *Torrent) pollAnnounce(ticker util.Ticker) {
+	for t.announcingWith(ticker) {
+		_, ok := <-ticker.Chan()
 		if !ok {
 			// done
 			return
 		}
+		if t.addrChanged() {
+			t.reannounce()
+			continue
+		}
 		ev := tracker.Nop
 		if t.Done() {
 			ev = tracker.Completed
 		}
-		for name := range t.Trackers {
+		var names []string
+		for _, name := range t.trackerNames() {
 			if t.shouldAnnounce(name) {
-				t.announce(name, ev)
+				names = append(names, name)
 			}
 		}
+		if len(names) > 0 {
+			t.announceAll(ev, names)
+		}
 	}
 }
 
-func (t *Torrent) announce(name string, ev tracker.Event) {
+// is ticker still the one we announce on ?
+func (t *Torrent) announcingWith(ticker util.Ticker) bool {
+	t.announceMtx.Lock()
+	defer t.announceMtx.Unlock()
+	return ticker != nil && t.announceTicker == ticker
+}
+
+// get the names of all enabled trackers for this torrent
+func (t *Torrent) trackerNames() (names []string) {
+	t.announceMtx.Lock()
+	for name := range t.Trackers {
+		if !t.disabledTrackers[name] {
+			names = append(names, name)
+		}
+	}
+	t.announceMtx.Unlock()
+	return
+}
+
+// SetTrackerEnabled turns announcing to the tracker with this name on or off, disabled trackers stay in the list
+func (t *Torrent) SetTrackerEnabled(name string, enabled bool) error {
+	if _, ok := t.Trackers[name]; !ok {
+		return ErrNoSuchTracker
+	}
+	t.announceMtx.Lock()
+	if enabled {
+		delete(t.disabledTrackers, name)
+	} else {
+		if t.disabledTrackers == nil {
+			t.disabledTrackers = make(map[string]bool)
+		}
+		t.disabledTrackers[name] = true
+	}
+	t.announceMtx.Unlock()
+	log.Infof("%s tracker %s enabled=%v", t.Name(), name, enabled)
+	return nil
+}
+
+// TrackerEnabled returns false if announcing to the tracker with this name was turned off
+func (t *Torrent) TrackerEnabled(name string) bool {
+	t.announceMtx.Lock()
+	defer t.announceMtx.Unlock()
+	return !t.disabledTrackers[name]
+}
+
+// announce to many trackers, at most MaxParallelAnnounces at a time
+// blocks until all are done then adds the peers they gave us without duplicates
+func (t *Torrent) announceAll(ev tracker.Event, names []string) {
+	max := t.MaxParallelAnnounces
+	if max <= 0 {
+		max = DefaultMaxParallelAnnounces
+	}
+	sem := make(chan struct{}, max)
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var peers []common.Peer
+	for _, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n string) {
+			log.Debugf("%s announce %s", n, ev)
+			got := t.announce(n, ev)
+			mtx.Lock()
+			peers = append(peers, got...)
+			mtx.Unlock()
+			<-sem
+			wg.Add(-1)
+		}(name)
+	}
+	wg.Wait()
+	if len(peers) > 0 {
+		t.addPeers(uniquePeers(peers))
+	}
+}
+
+// announce when it is time to, completed goes out right away so it is not lost if we stop before the next announce
+func (t *Torrent) announce(name string, ev tracker.Event) (peers []common.Peer) {
+	peers, _ = t.announceTracker(name, ev, ev == tracker.Completed)
+	return
+}
+
+// ReannounceTracker announces to the tracker with this name right away outside of the normal schedule
+// returns ErrAnnounceTooSoon if the tracker's min interval since the last announce is not up
+// or why the announce failed
+func (t *Torrent) ReannounceTracker(name string) error {
+	if _, ok := t.Trackers[name]; !ok {
+		return ErrNoSuchTracker
+	}
+	if !t.TrackerEnabled(name) {
+		return ErrTrackerDisabled
+	}
+	t.nextAnnounceFor(name)
+	log.Infof("%s reannouncing to %s", t.Name(), name)
+	// the tracker already heard completed when we finished
+	peers, err := t.announceTracker(name, tracker.Nop, true)
+	if err != nil {
+		return err
+	}
+	if len(peers) > 0 {
+		t.addPeers(uniquePeers(peers))
+	}
+	return nil
+}
+
+func (t *Torrent) announceTracker(name string, ev tracker.Event, force bool) (peers []common.Peer, err error) {
 	t.announceMtx.Lock()
 	a := t.announcers[name]
 	t.announceMtx.Unlock()
 	if a != nil {
-		err := a.tryAnnounce(ev)
-		if err == nil {
+		if force {
+			peers, err = a.forceAnnounce(ev)
+		} else {
+			peers, err = a.tryAnnounce(ev)
+		}
+		if err == ErrAnnounceTooSoon {
+			log.Debugf("not announcing to %s yet: %s", name, err)
+		} else if err == nil {
+			a.access.Lock()
 			a.fails = 0
+			a.access.Unlock()
 		} else {
 			log.Warnf("announce to %s failed: %s", name, err)
+			a.access.Lock()
 			a.fails++
+			a.access.Unlock()
+		}
+	}
+	return
+}
+
+// add peers to torrent, dials only as many as we have room for and queues the rest
+func (t *Torrent) addPeers(peers []common.Peer) {
+	culled := false
+	for idx, p := range peers {
+		if culled && !t.NeedsPeers() {
+			// no more peers needed
+			t.queuePeers(peers[idx:])
+			return
+		}
+		a, e := t.resolved.Resolve(&p, t.Network())
+		if e == nil {
+			if t.isSelf(a) {
+				// don't connect to self
+				continue
+			}
+			if t.HasOBConn(a) || t.isBadPeer(a) {
+				// already connected or known bad
+				continue
+			}
+			if !t.AllowLANPeers && !routableAddr(a) {
+				log.Debugf("skipping unroutable peer %s", a)
+				continue
+			}
+			if t.dialCapacity() <= 0 {
+				// dials in progress already fill the room we have
+				if t.NeedsPeers() {
+					t.queuePeers(peers[idx:])
+					return
+				}
+				// make room for at most one of these peers
+				if culled || !t.cullWorstPeer(NewPeerValue) {
+					t.queuePeers(peers[idx:])
+					return
+				}
+				culled = true
+			}
+			if !t.addPendingPeer(a) {
+				// another source gave us this peer
+				continue
+			}
+			// no error resolving
+			go t.persistPendingPeer(a, p.ID)
+		} else {
+			log.Warnf("failed to resolve peer %s", e.Error())
+		}
+	}
+}
+
+// dial a peer local service discovery found, it is on the lan so AllowLANPeers does not apply
+func (t *Torrent) addLANPeer(a net.Addr) {
+	if t.Private() || !t.ShouldAcceptNewPeer() || t.dialCapacity() <= 0 {
+		return
+	}
+	if t.HasOBConn(a) || t.HasIBConn(a) || t.isBadPeer(a) || !t.addPendingPeer(a) {
+		return
+	}
+	log.Debugf("found %s on the lan for %s", a, t.Name())
+	go t.persistPendingPeer(a, common.PeerID{})
+}
+
+// how many more peers we can dial without going over MaxPeers counting the dials in progress
+func (t *Torrent) dialCapacity() int {
+	peers := int(t.NumPeers())
+	t.connMtx.Lock()
+	pending := len(t.pendingPeers)
+	t.connMtx.Unlock()
+	return int(t.MaxPeers) - peers - pending
+}
+
+// keep peers we had no room for to dial later, the oldest are dropped past MaxQueuedPeers
+// peers already queued keep their place
+func (t *Torrent) queuePeers(peers []common.Peer) {
+	t.connMtx.Lock()
+	queued := make(map[string]bool, len(t.queuedPeers))
+	for idx := range t.queuedPeers {
+		queued[t.queuedPeers[idx].Key()] = true
+	}
+	for idx := range peers {
+		k := peers[idx].Key()
+		if !queued[k] {
+			queued[k] = true
+			t.queuedPeers = append(t.queuedPeers, peers[idx])
 		}
 	}
+	if over := len(t.queuedPeers) - MaxQueuedPeers; over > 0 {
+		t.queuedPeers = t.queuedPeers[over:]
+	}
+	t.connMtx.Unlock()
+}
+
+// QueuedPeers gets how many peers are waiting for room to be dialed
+func (t *Torrent) QueuedPeers() (n int) {
+	t.connMtx.Lock()
+	n = len(t.queuedPeers)
+	t.connMtx.Unlock()
+	return
+}
+
+// dial queued peers we have room for now
+func (t *Torrent) dialQueuedPeers() {
+	if t.isClosing() {
+		return
+	}
+	n := t.dialCapacity()
+	if n <= 0 {
+		return
+	}
+	t.connMtx.Lock()
+	if n > len(t.queuedPeers) {
+		n = len(t.queuedPeers)
+	}
+	peers := t.queuedPeers[:n]
+	t.queuedPeers = t.queuedPeers[n:]
+	t.connMtx.Unlock()
+	if len(peers) > 0 {
+		t.addPeers(peers)
+	}
+}
+
+// mark a peer address as about to be dialed
+// returns false if it was already marked
+func (t *Torrent) addPendingPeer(a net.Addr) (added bool) {
+	t.connMtx.Lock()
+	if !t.pendingPeers[a.String()] {
+		t.pendingPeers[a.String()] = true
+		added = true
+	}
+	t.connMtx.Unlock()
+	return
+}
+
+// never dial a peer address again while we are running
+func (t *Torrent) markBadPeer(a net.Addr) {
+	t.connMtx.Lock()
+	t.badPeers[a.String()] = true
+	t.connMtx.Unlock()
+}
+
+func (t *Torrent) isBadPeer(a net.Addr) (bad bool) {
+	t.connMtx.Lock()
+	bad = t.badPeers[a.String()]
+	t.connMtx.Unlock()
+	return
+}
+
+// is a where we listen or where others see us from behind nat ?
+func (t *Torrent) isSelf(a net.Addr) bool {
+	la := t.Network().Addr().String()
+	if sameAddr(a.String(), la) {
+		return true
+	}
+	if adv := t.advertisedAddr(t.Network().Addr()); sameAddr(a.String(), adv.String()) {
+		return true
+	}
+	if t.ExternalAddr == "" {
+		return false
+	}
+	ext := t.ExternalAddr
+	if _, _, err := net.SplitHostPort(ext); err != nil {
+		// no port given so it is forwarded to the same one
+		_, port, _ := net.SplitHostPort(la)
+		ext = net.JoinHostPort(ext, port)
+	}
+	return sameAddr(a.String(), ext)
+}
+
+// a tracker told us the ip it sees us at, we tell trackers others reach us there from now on
+// ExternalAddr wins if it is set
+func (t *Torrent) gotExternalIP(ip net.IP) {
+	if ip == nil || t.ExternalAddr != "" {
+		return
+	}
+	v4 := ip.To4() != nil
+	t.externalMtx.Lock()
+	defer t.externalMtx.Unlock()
+	if old := t.externalIPs[v4]; old.Equal(ip) {
+		return
+	}
+	if t.externalIPs == nil {
+		t.externalIPs = make(map[bool]net.IP)
+	}
+	t.externalIPs[v4] = ip
+	log.Infof("%s trackers see us at %s", t.Name(), ip)
+}
+
+// the address others reach us at when we listen on la, la with the ip trackers told us about on its ip family if we have one
+func (t *Torrent) advertisedAddr(la net.Addr) net.Addr {
+	if la == nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(la.String())
+	if err != nil {
+		return la
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// not on ip, i2p or some such
+		return la
+	}
+	t.externalMtx.Lock()
+	ext := t.externalIPs[ip.To4() != nil]
+	t.externalMtx.Unlock()
+	if ext == nil {
+		return la
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: ext, Port: p}
+}
+
+// the addresses trackers told us we are at on each ip family with the port of la, none if la is not on ip
+func (t *Torrent) externalAddrs(la net.Addr) (addrs []net.Addr) {
+	host, port, err := net.SplitHostPort(la.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return
+	}
+	p, _ := strconv.Atoi(port)
+	t.externalMtx.Lock()
+	defer t.externalMtx.Unlock()
+	for _, v4 := range []bool{true, false} {
+		if ip := t.externalIPs[v4]; ip != nil {
+			addrs = append(addrs, &net.TCPAddr{IP: ip, Port: p})
+		}
+	}
+	return
+}
+
+// are two host:port the same, ips are compared by value so different ways of writing one match
+func sameAddr(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ha, pa, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	hb, pb, err := net.SplitHostPort(b)
+	if err != nil || pa != pb {
+		return false
+	}
+	ipa, ipb := net.ParseIP(ha), net.ParseIP(hb)
+	return ipa != nil && ipa.Equal(ipb)
+}
+
+// ip ranges that are only reachable on a lan, rfc 1918 and ipv6 unique local
+var lanNets = []*net.IPNet{
+	{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(172, 16, 0, 0), Mask: net.CIDRMask(12, 32)},
+	{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(16, 32)},
+	{IP: net.IP{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(7, 128)},
 }
 
-// add peers to torrent
-func (t *Torrent) addPeers(peers []common.Peer) {
-	for _, p := range peers {
-		if !t.NeedsPeers() {
-			// no more peers needed
-			return
-		}
-		a, e := p.Resolve(t.Network())
-		if e == nil {
-			if a.String() == t.Network().Addr().String() {
-				// don't connect to self or a duplicate
-				continue
-			}
-			if t.HasOBConn(a) {
-				continue
-			}
-			// no error resolving
-			go t.PersistPeer(a, p.ID)
-		} else {
-			log.Warnf("failed to resolve peer %s", e.Error())
+// returns false if a is an ip we have no business dialing from the internet
+// loopback, link local, unspecified or private, anything not an ip is routable
+func routableAddr(a net.Addr) bool {
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		host = a.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range lanNets {
+		if n.Contains(ip) {
+			return false
 		}
 	}
+	return true
+}
+
+func (t *Torrent) removePendingPeer(a net.Addr) {
+	t.connMtx.Lock()
+	delete(t.pendingPeers, a.String())
+	t.connMtx.Unlock()
+}
+
+// persist a connection to a pending peer and unmark it when we are done
+func (t *Torrent) persistPendingPeer(a net.Addr, id common.PeerID) {
+	t.PersistPeer(a, id)
+	t.removePendingPeer(a)
 }
 
-// persit a connection to a peer
+// persit a connection to a peer, backing off between failed dials
 func (t *Torrent) PersistPeer(a net.Addr, id common.PeerID) {
 
-	triesLeft := 10
-	for !t.closing {
-		if t.HasIBConn(a) {
+	tries := 0
+	for !t.isClosing() {
+		if t.HasIBConn(a) || t.isBadPeer(a) {
 			return
 		}
 		if !t.HasOBConn(a) {
 			err := t.DialPeer(a, id)
 			if err == nil {
 				return
-			} else {
-				triesLeft--
 			}
-			if triesLeft <= 0 {
+			if !retriablePeerError(err) {
+				log.Debugf("not trying %s again: %s", a, err)
+				// a duplicate can be dialed again once that connection is gone
+				if errors.Is(err, ErrInfohashMismatch) {
+					t.markBadPeer(a)
+				}
+				return
+			}
+			tries++
+			if tries >= DefaultPeerDialTries {
 				return
 			}
+			if !t.retries.take() {
+				log.Debugf("out of retries, giving up on %s", a)
+				return
+			}
+			t.retrySleep(retryDelay(tries))
 		} else {
 			time.Sleep(time.Second)
 		}
@@ -497,12 +1406,25 @@ func (t *Torrent) HasOBConn(a net.Addr) (has bool) {
 	return
 }
 
-func (t *Torrent) addOBPeer(c *PeerConn) {
-	addr := c.c.RemoteAddr()
-	t.connMtx.Lock()
-	t.obconns[addr.String()] = c
-	t.connMtx.Unlock()
-	t.pexState.onNewPeer(addr)
+func directionName(inbound bool) string {
+	if inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// tell every peer but c that we no longer want a block we got from c
+func (t *Torrent) cancelBlock(c *PeerConn, d *common.PieceData) {
+	t.VisitPeers(func(conn *PeerConn) {
+		if conn != c {
+			conn.cancelBlock(d)
+		}
+	})
+}
+
+// add a connection we dialed, returns false if it should be dropped
+func (t *Torrent) addOBPeer(c *PeerConn) bool {
+	return t.addConn(c, false)
 }
 
 func (t *Torrent) removeOBConn(c *PeerConn) {
@@ -513,13 +1435,65 @@ func (t *Torrent) removeOBConn(c *PeerConn) {
 	t.pexState.onPeerDisconnected(addr)
 }
 
-func (t *Torrent) addIBPeer(c *PeerConn) {
+// add a connection the peer dialed, returns false if it should be dropped
+func (t *Torrent) addIBPeer(c *PeerConn) bool {
+	return t.addConn(c, true)
+}
+
+// add c unless we already have a connection from its address
+// both ends dialed each other and c might be the second connection between us
+// both ends keep the connection dialed by whoever has the higher peer id
+// returns false if c should be dropped, otherwise the connection going the other way is closed
+// looking and adding happen under one lock so two connections racing in can't both be kept
+func (t *Torrent) addConn(c *PeerConn, inbound bool) bool {
 	addr := c.c.RemoteAddr()
+	c.inbound = inbound
 	t.connMtx.Lock()
-	t.ibconns[addr.String()] = c
+	conns, others := t.obconns, t.ibconns
+	if inbound {
+		conns, others = t.ibconns, t.obconns
+	}
+	if _, has := conns[addr.String()]; has {
+		t.connMtx.Unlock()
+		return false
+	}
+	var other *PeerConn
+	for _, conn := range others {
+		if conn.id == c.id {
+			other = conn
+			break
+		}
+	}
+	if other != nil {
+		dialer, listener := t.id, c.id
+		if inbound {
+			dialer, listener = c.id, t.id
+		}
+		if bytes.Compare(dialer[:], listener[:]) <= 0 {
+			t.connMtx.Unlock()
+			return false
+		}
+	}
+	conns[addr.String()] = c
 	t.connMtx.Unlock()
-	c.inbound = true
+	if other != nil {
+		log.Debugf("%s connected both ways, keeping the %s connection", c.id.String(), directionName(inbound))
+		other.Close()
+	}
 	t.pexState.onNewPeer(addr)
+	t.peerGeoIP(addr)
+	return true
+}
+
+// get where a peer is from if we know yet, the first call for a peer starts looking it up
+func (t *Torrent) peerGeoIP(a net.Addr) (info geoip.Info, ok bool) {
+	if t.GeoIP == nil {
+		return
+	}
+	if tcp, isTCP := a.(*net.TCPAddr); isTCP {
+		info, ok = t.GeoIP.Get(tcp.IP)
+	}
+	return
 }
 
 func (t *Torrent) removeIBConn(c *PeerConn) {
@@ -530,6 +1504,32 @@ func (t *Torrent) removeIBConn(c *PeerConn) {
 	t.pexState.onPeerDisconnected(addr)
 }
 
+// callback called when a peer goes away, gives back everything it held
+// returns the requests it still had out so they can be canceled on the wire
+func (t *Torrent) onPeerDisconnect(c *PeerConn) (downloading []*common.PieceRequest) {
+	if c.inbound {
+		t.removeIBConn(c)
+	} else {
+		t.removeOBConn(c)
+	}
+	c.access.Lock()
+	downloading = c.downloading
+	c.downloading = nil
+	metaRequests := c.metaRequests
+	c.metaRequests = nil
+	c.access.Unlock()
+	for _, r := range downloading {
+		t.pt.canceledRequest(r)
+	}
+	t.dropMetaRequests(metaRequests)
+	if c.bf != nil {
+		t.availability.removeBitfield(c.bf)
+	}
+	t.releaseUploadSlot(c)
+	return
+}
+
+// call with metaMtx held
 func (t *Torrent) hasAllPendingInfo() bool {
 	return t.pendingInfoBF.Completed()
 }
@@ -545,58 +1545,107 @@ func (t *Torrent) getMetaInfo() []byte {
 }
 
 func (t *Torrent) resetPendingInfo() {
+	t.metaMtx.Lock()
 	t.requestingInfoBF = bittorrent.NewBitfield(t.requestingInfoBF.Length, nil)
 	t.pendingInfoBF = bittorrent.NewBitfield(t.pendingInfoBF.Length, nil)
 	t.metaInfo = make([]byte, len(t.metaInfo))
+	t.metaMtx.Unlock()
 	t.askAllMetadata()
 }
 
+// forget which metadata slices we asked for so they are asked for again
+// returns false if we are not fetching metadata
+func (t *Torrent) forgetMetaRequests() bool {
+	t.metaMtx.Lock()
+	defer t.metaMtx.Unlock()
+	if t.puttingMetaInfo || t.requestingInfoBF == nil {
+		return false
+	}
+	t.requestingInfoBF = bittorrent.NewBitfield(t.requestingInfoBF.Length, nil)
+	return true
+}
+
+// a peer won't give us metadata slice idx, let someone else have it
+func (t *Torrent) metaSliceRejected(idx uint32) {
+	t.metaMtx.Lock()
+	if t.requestingInfoBF != nil {
+		t.requestingInfoBF.Unset(idx)
+	}
+	t.metaMtx.Unlock()
+}
+
 func (t *Torrent) askAllMetadata() {
 	t.VisitPeers(func(c *PeerConn) {
 		if c.theirOpts.MetaData() {
-			id, ok := c.theirOpts.Extensions[extensions.UTMetaData.String()]
-			if ok {
-				c.askNextMetadata(uint8(id))
-			}
+			c.askNextMetadata()
 		}
 	})
 }
 
+// a peer went away before sending the metadata slices we asked it for, ask the peers we still have for them
+// the slices we already got are kept so only the missing ones are fetched
+func (t *Torrent) dropMetaRequests(slices []uint32) {
+	if len(slices) == 0 || t.Ready() {
+		return
+	}
+	t.metaMtx.Lock()
+	if t.requestingInfoBF == nil {
+		t.metaMtx.Unlock()
+		return
+	}
+	for _, idx := range slices {
+		if !t.pendingInfoBF.Has(idx) {
+			t.requestingInfoBF.Unset(idx)
+		}
+	}
+	t.metaMtx.Unlock()
+	log.Debugf("%s asking other peers for %d metadata slices", t.Name(), len(slices))
+	t.askAllMetadata()
+}
+
 func (t *Torrent) putInfoSlice(idx uint32, data []byte) {
+	t.metaMtx.Lock()
 	if t.puttingMetaInfo {
+		t.metaMtx.Unlock()
 		return
 	}
-	if t.metaInfo != nil && !t.Ready() {
-		log.Debugf("put info slice idx=%d len=%d", idx, len(data))
-		t.pendingInfoBF.Set(idx)
-		copy(t.metaInfo[idx*(16*1024):], data)
-		if t.hasAllPendingInfo() {
-			t.puttingMetaInfo = true
-			log.Debugf("got all info slices: %q", t.metaInfo)
-			r := bytes.NewReader(t.metaInfo)
-			var info metainfo.Info
-			err := bencode.NewDecoder(r).Decode(&info)
-			if err == nil {
-				log.Info("putting metainfo")
-				err = t.st.PutInfo(info)
-			}
-			if err == nil {
-				// reset
-				sz := uint32(len(t.metaInfo))
-				t.defaultOpts.MetainfoSize = &sz
-				t.VisitPeers(func(p *PeerConn) {
-					p.Close()
-				})
-			} else {
-				t.puttingMetaInfo = false
-				log.Errorf("failed to get meta info %s", err.Error())
-				t.resetPendingInfo()
-			}
-		} else {
-			log.Debug("need more info slices")
-		}
-	} else {
+	if t.metaInfo == nil || t.Ready() {
+		t.metaMtx.Unlock()
 		log.Debug("unwarrented metainfo slice")
+		return
+	}
+	log.Debugf("put info slice idx=%d len=%d", idx, len(data))
+	t.pendingInfoBF.Set(idx)
+	copy(t.metaInfo[idx*extensions.MetadataSliceSize:], data)
+	if !t.hasAllPendingInfo() {
+		t.metaMtx.Unlock()
+		log.Debug("need more info slices")
+		return
+	}
+	// no one touches the slices while we put them together
+	t.puttingMetaInfo = true
+	t.metaMtx.Unlock()
+	log.Debugf("got all info slices: %q", t.metaInfo)
+	r := bytes.NewReader(t.metaInfo)
+	var info metainfo.Info
+	err := bencode.NewDecoder(r).Decode(&info)
+	if err == nil {
+		log.Info("putting metainfo")
+		err = t.st.PutInfo(info)
+	}
+	if err == nil {
+		// reset
+		sz := uint32(len(t.metaInfo))
+		t.defaultOpts.MetainfoSize = &sz
+		t.VisitPeers(func(p *PeerConn) {
+			p.Close()
+		})
+	} else {
+		t.metaMtx.Lock()
+		t.puttingMetaInfo = false
+		t.metaMtx.Unlock()
+		log.Errorf("failed to get meta info %s", err.Error())
+		t.resetPendingInfo()
 	}
 }
 
@@ -604,12 +1653,14 @@ func (t *Torrent) nextMetaInfoReq() *uint32 {
 	if t.Ready() {
 		return nil
 	}
+	t.metaMtx.Lock()
+	defer t.metaMtx.Unlock()
 	if t.metaInfo == nil || t.pendingInfoBF == nil || t.requestingInfoBF == nil {
 		log.Debug("no bitfield or metainfo")
 		return nil
 	}
 	var i uint32
-	for i < uint32(len(t.metaInfo)/(1024*16))+1 {
+	for i < t.requestingInfoBF.Length {
 		if (!t.pendingInfoBF.Has(i)) && (!t.requestingInfoBF.Has(i)) {
 			t.requestingInfoBF.Set(i)
 			return &i
@@ -619,57 +1670,97 @@ func (t *Torrent) nextMetaInfoReq() *uint32 {
 	return nil
 }
 
+// the protocol features we advertise in handshakes, only what we speak
+func (t *Torrent) capabilities() bittorrent.Capabilities {
+	return bittorrent.Capabilities{Extended: true}
+}
+
+// capabilities to handshake with in order until a peer answers one
+// some old clients hang up on or never answer handshakes with reserved bits they don't know
+func (t *Torrent) handshakeStyles() []bittorrent.Capabilities {
+	return []bittorrent.Capabilities{t.capabilities(), {}}
+}
+
+// dial a and handshake advertising caps
+func (t *Torrent) dialHandshake(a net.Addr, caps bittorrent.Capabilities) (c net.Conn, h bittorrent.Handshake, err error) {
+	c, err = t.Network().Dial(a.Network(), a.String())
+	if err != nil {
+		log.Debugf("didn't connect to %s: %s", a, err)
+		err = fmt.Errorf("%w: %s", ErrDialFailed, err)
+		return
+	}
+	ih := t.st.Infohash()
+	h.Reserved = caps.Reserved()
+	copy(h.Infohash[:], ih[:])
+	copy(h.PeerID[:], t.id[:])
+	// don't wait forever on a peer that never answers
+	c.SetDeadline(time.Now().Add(HandshakeTimeout))
+	err = h.Send(c)
+	if err == nil {
+		err = h.Recv(c)
+	}
+	if err != nil {
+		log.Debugf("didn't complete handshake with %s: %s", a, err)
+		c.Close()
+		err = fmt.Errorf("%w: %s", ErrHandshakeFailed, err)
+		return
+	}
+	c.SetDeadline(time.Time{})
+	return
+}
+
 // connect to a new peer for this swarm, blocks
+// DialPeer connects to a peer and does the handshake, errors wrap one of ErrDialFailed, ErrHandshakeFailed, ErrInfohashMismatch or ErrDuplicate
+// a failed handshake is tried again with the next style in handshakeStyles before giving up
 func (t *Torrent) DialPeer(a net.Addr, id common.PeerID) error {
 	if t.HasOBConn(a) {
-		return nil
+		return ErrDuplicate
 	}
 	ih := t.st.Infohash()
 	log.Debugf("%s %s ", a.String(), a.Network())
-	c, err := t.Network().Dial(a.Network(), a.String())
-	if err == nil {
-		// connected
-		// build handshake
-		var h bittorrent.Handshake
-		// enable bittorrent extensions
-		h.Reserved.Set(bittorrent.Extension)
-		copy(h.Infohash[:], ih[:])
-		copy(h.PeerID[:], t.id[:])
-		// send handshake
-		err = h.Send(c)
-		if err == nil {
-			// get response to handshake
-			err = h.Recv(c)
-			if err == nil {
-				if bytes.Equal(ih[:], h.Infohash[:]) {
-					// infohashes match
-					var opts extensions.Message
-					if h.Reserved.Has(bittorrent.Extension) {
-						opts = t.defaultOpts.Copy()
-					}
-					pc := makePeerConn(c, t, h.PeerID, opts)
-					t.addOBPeer(pc)
-					pc.start()
-					if t.Ready() {
-						pc.Send(t.Bitfield().ToWireMessage())
-					}
-					return nil
-				} else {
-					log.Warn("Infohash missmatch")
-				}
+	var c net.Conn
+	var h bittorrent.Handshake
+	var err error
+	t.NetPool.Do(func() {
+		for _, caps := range t.handshakeStyles() {
+			c, h, err = t.dialHandshake(a, caps)
+			if !errors.Is(err, ErrHandshakeFailed) {
+				break
 			}
 		}
-		log.Debugf("didn't complete handshake with peer: %s", err)
-		// bad thing happened
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ih[:], h.Infohash[:]) {
+		log.Warnf("Infohash missmatch from %s", a)
 		c.Close()
+		return ErrInfohashMismatch
 	}
-	log.Debugf("didn't connect to %s: %s", a, err)
-	return err
+	// infohashes match
+	var opts extensions.Message
+	if h.Reserved.Capabilities().Extended {
+		opts = t.defaultOpts.Copy()
+		if t.Done() {
+			opts.SetUploadOnly(true)
+		}
+	}
+	pc := makePeerConn(c, t, h.PeerID, opts)
+	if !t.addOBPeer(pc) {
+		c.Close()
+		return ErrDuplicate
+	}
+	pc.start()
+	if t.Ready() {
+		t.sendBitfield(pc)
+	}
+	return nil
 }
 
 func (t *Torrent) broadcastHave(idx uint32) {
 	msg := common.NewHave(idx)
 	log.Debugf("%s got piece %d", t.Name(), idx)
+	t.notifyHave()
 	conns := make(map[string]*PeerConn)
 	t.VisitPeers(func(c *PeerConn) {
 		conns[c.c.RemoteAddr().String()] = c
@@ -704,13 +1795,48 @@ func (t *Torrent) onNewPeer(c *PeerConn) {
 		c.Close()
 		return
 	}
-	if t.NeedsPeers() && t.Ready() {
-		log.Debugf("New peer (%s) for %s", c.id.String(), t.st.Infohash().Hex())
-		t.addIBPeer(c)
-		c.start()
-		c.Send(t.Bitfield().ToWireMessage())
-	} else {
+	if !t.Ready() || !(t.NeedsPeers() || t.cullWorstPeer(NewPeerValue)) {
+		c.Close()
+		return
+	}
+	if !t.addIBPeer(c) {
+		log.Debugf("duplicate peer from %s", a)
 		c.Close()
+		return
+	}
+	log.Debugf("New peer (%s) for %s", c.id.String(), t.st.Infohash().Hex())
+	c.start()
+	t.sendBitfield(c)
+}
+
+// send our bitfield to a new peer
+// with LazyBitfield some pieces are left out of it and sent as haves right after
+func (t *Torrent) sendBitfield(c *PeerConn) {
+	bf := t.Bitfield()
+	if !t.LazyBitfield {
+		c.Send(bf.ToWireMessage())
+		return
+	}
+	// storage gives us the bitfield it uses
+	bf = bf.Copy()
+	var set []uint32
+	for idx := uint32(0); idx < bf.Length; idx++ {
+		if bf.Has(idx) {
+			set = append(set, idx)
+		}
+	}
+	rand.Shuffle(len(set), func(i, j int) {
+		set[i], set[j] = set[j], set[i]
+	})
+	if len(set) > LazyBitfieldHaves {
+		set = set[:LazyBitfieldHaves]
+	}
+	for _, idx := range set {
+		bf.Unset(idx)
+	}
+	c.Send(bf.ToWireMessage())
+	for _, idx := range set {
+		c.Send(common.NewHave(idx))
 	}
 }
 
@@ -722,34 +1848,43 @@ func (t *Torrent) run() {
 	if t.Started != nil {
 		go t.Started()
 	}
-	t.started = true
+	t.setStarted(true)
 	go t.runRateTicker()
 	counter := 0
-	for !t.closing {
+	for !t.isClosing() {
 		if !t.Ready() {
 			time.Sleep(time.Second)
 			// reset pending info if we can't fetch it fast enough
 			counter++
 			if t.Ready() {
 				continue
-			} else if counter%30 == 0 && !t.puttingMetaInfo && t.requestingInfoBF != nil {
+			} else if counter%30 == 0 && t.forgetMetaRequests() {
 				// reset requesting info if we can't fetch it fast enough
-				t.requestingInfoBF = bittorrent.NewBitfield(t.requestingInfoBF.Length, nil)
 				t.askAllMetadata()
 			}
 			continue
 		}
 		if t.Done() {
-			if t.seeding {
-				break
-			} else {
+			// keep going while seeding, a recheck can find pieces we need again
+			if !t.seeding {
 				var err error
 				t.seeding, err = t.st.Seed()
 				if t.seeding {
 					log.Infof("%s is seeding", t.Name())
+					t.Queue.leave(t)
+					t.setState(Seeding)
+					t.advertiseUploadOnly(true)
 					t.AnnounceSeed()
+					if t.StopWhenDone {
+						// trackers heard we completed, now tell them we are gone
+						log.Infof("%s is done, stopping without seeding", t.Name())
+						t.Close()
+						t.StopAnnouncing(true)
+						break
+					}
 				} else if err != nil {
-					log.Errorf("failed to begin seeding: %s", err.Error())
+					t.setError(err)
+					break
 				} else {
 					log.Infof("will need to redownload pieces for %s", t.Name())
 				}
@@ -767,6 +1902,30 @@ func (t *Torrent) Private() bool {
 	return info.IsPrivate()
 }
 
+// stop seeding if no peer has been interested in us for IdleSeedTimeout, keeps our data
+func (t *Torrent) checkIdleSeed(now time.Time) {
+	if t.IdleSeedTimeout <= 0 || !t.seeding || t.isClosing() {
+		return
+	}
+	interested := false
+	t.VisitPeers(func(c *PeerConn) {
+		if c.isPeerInterested() {
+			interested = true
+		}
+	})
+	if interested || t.lastInterested.IsZero() {
+		t.lastInterested = now
+		return
+	}
+	if now.Sub(t.lastInterested) < t.IdleSeedTimeout {
+		return
+	}
+	log.Infof("%s had no interested peers for %s, no longer seeding", t.Name(), t.IdleSeedTimeout)
+	t.lastInterested = time.Time{}
+	t.Close()
+	go t.StopAnnouncing(true)
+}
+
 func (t *Torrent) tick() {
 
 	if !t.Ready() {
@@ -774,7 +1933,7 @@ func (t *Torrent) tick() {
 	}
 
 	if !t.Private() {
-		now := time.Now()
+		now := t.clock.Now()
 		if now.Sub(t.lastPEX) > t.pexInterval {
 			la := t.Network().Addr()
 			if la.Network() == "i2p" {
@@ -801,7 +1960,21 @@ func (t *Torrent) tick() {
 		}
 	}
 
-	if t.Done() {
+	t.refreshStatus()
+	t.checkIdleSeed(t.clock.Now())
+	t.expireUploadSlots(t.clock.Now())
+	t.closeIdlePeers(t.clock.Now())
+	t.snubStalledPeers(t.clock.Now())
+	t.dialQueuedPeers()
+	t.checkQuota()
+
+	if t.State() == Errored {
+		// nothing gets requested until it is sorted out
+		t.retryDiskFull(t.clock.Now())
+		return
+	}
+
+	if t.Done() || t.Queued() {
 		return
 	}
 	// expire and cancel all timed out pieces
@@ -813,25 +1986,43 @@ func (t *Torrent) tick() {
 			t.pt.removePiece(cp.index)
 		}
 	})
-	t.VisitPeers(func(conn *PeerConn) {
+	t.freeOrphanedBlocks()
+	// fastest peers pick first so they get asked for the last blocks before anyone else
+	peers := t.peersByRate()
+	for _, conn := range peers {
 		conn.tickDownload()
-	})
+	}
+	t.tickEndgame(peers)
 }
 
 func (t *Torrent) handlePieceRequest(c *PeerConn, r *common.PieceRequest) {
 
+	if t.isClosing() {
+		// we are going away, so is this peer
+		log.Debugf("closing, not serving %s", c.id.String())
+		c.Close()
+		return
+	}
+	if t.pt.isPaused() {
+		log.Debugf("not serving %s while checking", c.id.String())
+		return
+	}
+	if t.LeechOnly {
+		// we never unchoke anyone so they should not be asking
+		c.dropRequest(r)
+		return
+	}
+	if !t.takeUploadSlot(c) {
+		t.chokeNoSlot(c)
+		return
+	}
 	if r.Length > 0 {
-		var pc common.PieceData
 		log.Debugf("%s asked for piece %d %d-%d", c.id.String(), r.Index, r.Begin, r.Begin+r.Length)
 		if r.Length <= uint32(cap(c.sendPieceBuff)) {
-			pc.Data = c.sendPieceBuff[:r.Length]
-			err := t.st.GetPiece(*r, &pc)
-			if err == nil {
-				// have the piece, send it
-				c.Send(pc.ToWireMessage())
-				log.Debugf("%s queued piece %d %d-%d", c.id.String(), r.Index, r.Begin, r.Begin+r.Length)
-			} else {
-				c.Close()
+			// read it off the disk without holding up reading from this peer
+			if !c.queueRead(r) {
+				log.Debugf("%s asked for more than its request queue", c.id.String())
+				c.dropRequest(r)
 			}
 		} else {
 			log.Infof("%s asked for oversized piece bytes=%d", c.id.String(), r.Length)
@@ -845,6 +2036,38 @@ func (t *Torrent) handlePieceRequest(c *PeerConn, r *common.PieceRequest) {
 
 }
 
+// read a piece c asked for and queue sending it, called from the goroutine reading pieces for c
+// r is already counted as queued to send
+func (t *Torrent) servePiece(c *PeerConn, r *common.PieceRequest) {
+	var pc common.PieceData
+	pc.Data = c.sendPieceBuff[:r.Length]
+	// a slow read for one peer only holds up one of these
+	t.pieceReads <- true
+	if t.isClosing() {
+		<-t.pieceReads
+		c.queuedUpload(-1)
+		c.Close()
+		return
+	}
+	err := t.st.GetPiece(*r, &pc)
+	<-t.pieceReads
+	if err != nil {
+		c.queuedUpload(-1)
+		c.Close()
+		return
+	}
+	// have the piece, wait for room in the send queue if other messages filled it
+	msg := pc.ToWireMessage()
+	for !c.trySend(msg) {
+		if c.isClosing() {
+			c.queuedUpload(-1)
+			return
+		}
+		c.waitUploadSent()
+	}
+	log.Debugf("%s queued piece %d %d-%d", c.id.String(), r.Index, r.Begin, r.Begin+r.Length)
+}
+
 func (t *Torrent) Done() bool {
 	bf := t.Bitfield()
 	if bf == nil {
@@ -854,19 +2077,53 @@ func (t *Torrent) Done() bool {
 }
 
 var ErrAlreadyStopped = errors.New("torrent already stopped")
+
+// ErrNoSuchTracker is returned when reannouncing to a tracker the torrent does not have
+var ErrNoSuchTracker = errors.New("no such tracker")
+
+// ErrTrackerDisabled is returned when reannouncing to a tracker that was disabled
+var ErrTrackerDisabled = errors.New("tracker is disabled")
+
+// LazyBitfieldHaves is how many pieces we leave out of a lazy bitfield
+const LazyBitfieldHaves = 4
+
+// ErrDialFailed is wrapped when we could not connect to a peer
+var ErrDialFailed = errors.New("failed to dial peer")
+
+// HandshakeTimeout is how long we wait on a peer to answer our handshake
+const HandshakeTimeout = time.Second * 30
+
+// ErrHandshakeFailed is wrapped when a peer did not finish the handshake
+var ErrHandshakeFailed = errors.New("peer handshake failed")
+
+// ErrInfohashMismatch is when a peer answered with some other torrent
+var ErrInfohashMismatch = errors.New("peer sent wrong infohash")
+
+// ErrDuplicate is when we are already connected to a peer
+var ErrDuplicate = errors.New("already connected to peer")
 var ErrAlreadyStarted = errors.New("torrent already started")
 
+// ErrNotPaused is returned when resuming a torrent that wasn't added paused
+var ErrNotPaused = errors.New("torrent not paused")
+
+// ErrDiskFull is the error a torrent stops downloading with when there is no space left to store pieces
+var ErrDiskFull = errors.New("disk is full, not downloading until there is space")
+
+// ErrQuotaReached is the error a torrent stops downloading with once it downloaded DownloadQuota bytes
+var ErrQuotaReached = errors.New("download quota reached")
+
+// DiskFullRetryInterval is how long we wait before trying to download again after the disk filled up
+const DiskFullRetryInterval = time.Minute * 5
+
 func (t *Torrent) runRateTicker() {
-	for t.started {
+	for t.isStarted() {
 		time.Sleep(time.Second)
-		t.tx += t.statsTracker.Rate(RateUpload).Current()
-		t.rx += t.statsTracker.Rate(RateDownload).Current()
 		t.statsTracker.Tick()
 	}
 }
 
 func (t *Torrent) Stop() error {
-	if t.closing {
+	if t.isClosing() {
 		return ErrAlreadyStopped
 	}
 	log.Info("stopping...")
@@ -902,15 +2159,129 @@ func (t *Torrent) Remove() error {
 }
 
 func (t *Torrent) Start() error {
-	if t.started {
+	if t.Paused() {
+		return t.Resume()
+	}
+	if t.isStarted() {
 		return ErrAlreadyStarted
 	}
+	t.stateMtx.Lock()
 	t.closing = false
+	t.stateMtx.Unlock()
+	t.setState(t.runningState())
+	if !t.Done() {
+		if t.Ready() {
+			// carry on with the blocks we got before we stopped
+			t.pt.restorePartial(t.st.LoadPartial())
+		}
+		t.Queue.join(t)
+	}
 	t.StartAnnouncing()
+	t.startResumeFlush()
 	go t.run()
 	return nil
 }
 
+// write out resume data every ResumeFlushInterval so a crash loses at most that much
+func (t *Torrent) startResumeFlush() {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	if t.resumeTicker != nil || t.ResumeFlushInterval <= 0 {
+		return
+	}
+	t.resumeTicker = t.clock.NewTicker(t.ResumeFlushInterval)
+	t.resumeDone = make(chan struct{})
+	go t.pollResumeFlush(t.resumeTicker, t.resumeDone)
+}
+
+func (t *Torrent) stopResumeFlush() {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	if t.resumeTicker != nil {
+		t.resumeTicker.Stop()
+		close(t.resumeDone)
+		t.resumeTicker = nil
+		t.resumeDone = nil
+	}
+}
+
+func (t *Torrent) pollResumeFlush(ticker util.Ticker, done chan struct{}) {
+	for {
+		select {
+		case <-ticker.Chan():
+			t.flushResume()
+		case <-done:
+			return
+		}
+	}
+}
+
+// save the bitfield, blocks of pieces in progress and stats
+func (t *Torrent) flushResume() {
+	if !t.Ready() {
+		// nothing to save until we have the metainfo
+		return
+	}
+	err := t.st.SavePartial(t.pt.obtainedBlocks())
+	if err != nil {
+		log.Warnf("failed to save partial pieces for %s: %s", t.Name(), err)
+	}
+	err = t.st.Flush()
+	if err != nil {
+		log.Warnf("failed to flush resume data for %s: %s", t.Name(), err)
+	}
+	t.saveStats()
+}
+
+// Queued returns true if the torrent is waiting for its turn to download
+func (t *Torrent) Queued() bool {
+	return !t.Queue.canDownload(t)
+}
+
+// Paused returns true if the torrent was added paused and was not started yet
+func (t *Torrent) Paused() bool {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	return t.paused
+}
+
+// hold the torrent until it is resumed
+func (t *Torrent) setPaused() {
+	t.stateMtx.Lock()
+	t.paused = true
+	t.stateMtx.Unlock()
+}
+
+// run start once the torrent is resumed, returns false and does nothing if it isn't paused anymore
+func (t *Torrent) waitResume(start func()) bool {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	if !t.paused {
+		return false
+	}
+	t.resume = start
+	return true
+}
+
+// Resume starts a torrent that was added paused
+func (t *Torrent) Resume() error {
+	t.stateMtx.Lock()
+	if !t.paused {
+		t.stateMtx.Unlock()
+		return ErrNotPaused
+	}
+	t.paused = false
+	start := t.resume
+	t.resume = nil
+	t.stateMtx.Unlock()
+	log.Infof("resuming %s", t.Name())
+	// nil if it was not set up yet, it will start once it is
+	if start != nil {
+		go start()
+	}
+	return nil
+}
+
 func (t *Torrent) saveStats() (err error) {
 	err = t.st.SaveStats(t.statsTracker)
 	return
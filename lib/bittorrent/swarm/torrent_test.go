@@ -0,0 +1,674 @@
+package swarm
+
+import (
+	"errors"
+	"github.com/majestrate/XD/lib/bittorrent"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/metainfo"
+	"github.com/majestrate/XD/lib/sync"
+	"github.com/majestrate/XD/lib/tracker"
+	"github.com/majestrate/XD/lib/util"
+	"net"
+	"testing"
+	"time"
+)
+
+// wait for a torrent to get into a state
+func waitForState(t *testing.T, tr *Torrent, state TorrentState) {
+	deadline := time.Now().Add(time.Second * 5)
+	for tr.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("torrent is %s but expected %s", tr.State(), state)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestTorrentStateTransitions(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.RemoveSelf = func() {}
+	st := tr.st.(*testStorage)
+	if s := tr.State(); s != Stopped {
+		t.Errorf("new torrent is %s", s)
+	}
+
+	// nothing checked yet so we start out downloading
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, tr, Downloading)
+	if s := tr.GetStatus().State; s != Downloading {
+		t.Errorf("status says %s", s)
+	}
+
+	// checking finds we have every piece so we go on to seed
+	var during TorrentState
+	st.onVerify = func() {
+		during = tr.State()
+	}
+	if err := tr.VerifyAll(); err != nil {
+		t.Fatal(err)
+	}
+	if during != Checking {
+		t.Errorf("torrent was %s while checking", during)
+	}
+	waitForState(t, tr, Seeding)
+
+	tr.Stop()
+	if s := tr.State(); s != Stopped {
+		t.Errorf("torrent is %s after stop", s)
+	}
+}
+
+func TestTorrentStateError(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	st := tr.st.(*testStorage)
+	st.seedErr = errors.New("disk full")
+	st.bf.Set(0)
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, tr, Errored)
+	if status := tr.GetStatus(); status.Error != "disk full" {
+		t.Errorf("status error is %q", status.Error)
+	}
+	// stopping keeps the error around for whoever looks next
+	tr.Close()
+	if s := tr.State(); s != Errored {
+		t.Errorf("torrent is %s after closing", s)
+	}
+}
+
+func TestIdleSeedStops(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.RemoveSelf = func() {}
+	tr.IdleSeedTimeout = time.Minute
+	st := tr.st.(*testStorage)
+	st.bf.Set(0)
+	var stopped bool
+	var mtx sync.Mutex
+	tr.Trackers["test"] = &testTracker{
+		name: "test",
+		onAnnounce: func(req *tracker.Request) {
+			if req.Event == tracker.Stopped {
+				mtx.Lock()
+				stopped = true
+				mtx.Unlock()
+			}
+		},
+	}
+	tr.nextAnnounceFor("test")
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, tr, Seeding)
+	c, _ := newTestPeerConn(tr, nil)
+	go c.run()
+
+	now := time.Now()
+	c.peerInterested = true
+	tr.checkIdleSeed(now)
+	tr.checkIdleSeed(now.Add(time.Minute * 2))
+	if s := tr.State(); s != Seeding {
+		t.Fatalf("torrent with an interested peer is %s", s)
+	}
+
+	// peer loses interest, idle since we last saw it interested
+	c.peerInterested = false
+	now = now.Add(time.Minute * 2)
+	tr.checkIdleSeed(now.Add(time.Second * 30))
+	if s := tr.State(); s != Seeding {
+		t.Fatalf("torrent idle for less than the timeout is %s", s)
+	}
+	tr.checkIdleSeed(now.Add(time.Minute + time.Second))
+	waitForState(t, tr, Stopped)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		mtx.Lock()
+		done := stopped
+		mtx.Unlock()
+		if done && tr.NumPeers() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stopped announce sent: %v, %d peers still connected", done, tr.NumPeers())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !st.bf.Has(0) {
+		t.Error("data gone after we stopped seeding")
+	}
+}
+
+// answer our handshake with one for infohash ih
+func testHandshakeServer(ih common.Infohash) func(net.Conn) {
+	return func(c net.Conn) {
+		var h bittorrent.Handshake
+		if h.Recv(c) != nil {
+			c.Close()
+			return
+		}
+		copy(h.Infohash[:], ih[:])
+		h.Send(c)
+	}
+}
+
+func TestDialPeerHandshakeFallback(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	ih := tr.Infohash()
+	// an old client that hangs up on reserved bits it does not know
+	n.serve = func(c net.Conn) {
+		var h bittorrent.Handshake
+		if h.Recv(c) != nil || h.Reserved.Capabilities().Extended {
+			c.Close()
+			return
+		}
+		copy(h.Infohash[:], ih[:])
+		h.Send(c)
+	}
+	if err := tr.DialPeer(a, common.PeerID{}); err != nil {
+		t.Fatalf("fallback handshake gave %v", err)
+	}
+	if d := n.numDials(a.String()); d != 2 {
+		t.Errorf("dialed %d times, expected 2", d)
+	}
+}
+
+func TestDialPeerErrors(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+
+	n.refuse = true
+	if err := tr.DialPeer(a, common.PeerID{}); !errors.Is(err, ErrDialFailed) {
+		t.Errorf("refused dial gave %v", err)
+	}
+	n.refuse = false
+
+	n.serve = func(c net.Conn) {
+		c.Close()
+	}
+	if err := tr.DialPeer(a, common.PeerID{}); !errors.Is(err, ErrHandshakeFailed) {
+		t.Errorf("peer hanging up gave %v", err)
+	}
+
+	var other common.Infohash
+	other[0] = 1
+	n.serve = testHandshakeServer(other)
+	if err := tr.DialPeer(a, common.PeerID{}); !errors.Is(err, ErrInfohashMismatch) {
+		t.Errorf("wrong infohash gave %v", err)
+	}
+
+	n.serve = testHandshakeServer(tr.Infohash())
+	if err := tr.DialPeer(a, common.PeerID{}); err != nil {
+		t.Errorf("good handshake gave %v", err)
+	}
+
+	c, _ := newTestPeerConn(tr, nil)
+	tr.connMtx.Lock()
+	tr.obconns[a.String()] = c
+	tr.connMtx.Unlock()
+	if err := tr.DialPeer(a, common.PeerID{}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("dialing a connected peer gave %v", err)
+	}
+}
+
+func TestPersistPeerSkipsMismatch(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.retrySleep = func(time.Duration) {}
+	var other common.Infohash
+	other[0] = 1
+	n.serve = testHandshakeServer(other)
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	tr.PersistPeer(a, common.PeerID{})
+	if d := n.numDials(a.String()); d != 1 {
+		t.Errorf("peer with the wrong infohash dialed %d times", d)
+	}
+	// avoided after that no matter where we hear about it
+	tr.PersistPeer(a, common.PeerID{})
+	tr.addPeers([]common.Peer{{IP: "10.0.0.1", Port: 6881}})
+	time.Sleep(time.Millisecond * 100)
+	if d := n.numDials(a.String()); d != 1 {
+		t.Errorf("bad peer dialed %d times", d)
+	}
+}
+
+func TestFileProgress(t *testing.T) {
+	// piece 1 has the end of a and the start of b
+	meta := &metainfo.TorrentFile{
+		Info: metainfo.Info{
+			Path:        "test",
+			PieceLength: 100,
+			Pieces:      make([]byte, 3*20),
+			Files: []metainfo.FileInfo{
+				{Length: 150, Path: metainfo.FilePath{"a"}},
+				{Length: 100, Path: metainfo.FilePath{"b"}},
+			},
+		},
+	}
+	tr, n := newTestTorrent(meta)
+	defer closeTestTorrent(tr, n)
+	st := tr.st.(*testStorage)
+
+	check := func(a, b uint64) {
+		t.Helper()
+		files := tr.FileProgress()
+		if len(files) != 2 {
+			t.Fatalf("got progress for %d files", len(files))
+		}
+		for idx, expected := range []uint64{a, b} {
+			if files[idx].Completed != expected {
+				t.Errorf("file %d has %d of %d bytes, expected %d", idx, files[idx].Completed, files[idx].Total, expected)
+			}
+		}
+	}
+	check(0, 0)
+	st.bf.Set(1)
+	check(50, 50)
+	st.bf.Set(2)
+	check(50, 100)
+	st.bf.Set(0)
+	check(150, 100)
+
+	if files := tr.GetStatus().Files; len(files) != 2 || files[0].Progress != 1 || files[1].Progress != 1 {
+		t.Errorf("status has file progress %v", files)
+	}
+}
+
+func TestRecheckWhileRunning(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.RemoveSelf = func() {}
+	st := tr.st.(*testStorage)
+	if err := tr.VerifyAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, tr, Seeding)
+
+	// piece 2 goes bad on disk
+	st.data[2*BlockSize] = 1
+	if err := tr.Recheck(); err != nil {
+		t.Fatal(err)
+	}
+	if st.bf.Has(2) {
+		t.Error("corrupt piece still in bitfield after recheck")
+	}
+	if st.bf.CountSet() != 3 {
+		t.Errorf("%d pieces in bitfield after recheck, expected 3", st.bf.CountSet())
+	}
+	if s := tr.State(); s != Downloading {
+		t.Errorf("torrent is %s after finding a bad piece", s)
+	}
+
+	// we go back to downloading the bad piece
+	remote := bittorrent.NewBitfield(4, nil)
+	for idx := uint32(0); idx < 4; idx++ {
+		remote.Set(idx)
+	}
+	r := tr.pt.NextRequest(remote, nil)
+	if r == nil || r.Index != 2 {
+		t.Fatalf("next request after recheck is %v, expected piece 2", r)
+	}
+	tr.pt.handlePieceData(&common.PieceData{Index: 2, Begin: 0, Data: make([]byte, BlockSize)})
+	if !st.bf.Has(2) {
+		t.Fatal("downloaded piece not stored after recheck")
+	}
+	waitForState(t, tr, Seeding)
+}
+
+func TestRecheckDropsDataWhilePaused(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize))
+	defer closeTestTorrent(tr, n)
+	st := tr.st.(*testStorage)
+	remote := bittorrent.NewBitfield(2, nil)
+	remote.Set(0)
+	if r := tr.pt.NextRequest(remote, nil); r == nil {
+		t.Fatal("no request made")
+	}
+	tr.pt.pause()
+	if r := tr.pt.NextRequest(remote, nil); r != nil {
+		t.Errorf("request %v made while paused", r)
+	}
+	tr.pt.handlePieceData(&common.PieceData{Index: 0, Begin: 0, Data: make([]byte, BlockSize)})
+	if st.bf.Has(0) {
+		t.Error("piece stored while paused")
+	}
+	tr.pt.resume()
+	tr.pt.handlePieceData(&common.PieceData{Index: 0, Begin: 0, Data: make([]byte, BlockSize)})
+	if !st.bf.Has(0) {
+		t.Error("piece not stored after resuming")
+	}
+}
+
+func TestStatusSnapshotReused(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize))
+	defer closeTestTorrent(tr, n)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	tr.StatusInterval = time.Second
+	first := tr.GetStatus()
+	// progress made after the snapshot was taken
+	tr.st.(*testStorage).bf.Set(0)
+	for idx := 0; idx < 5; idx++ {
+		clock.Advance(time.Millisecond * 100)
+		if s := tr.GetStatus(); s.Progress != first.Progress {
+			t.Fatalf("snapshot changed from %f to %f", first.Progress, s.Progress)
+		}
+	}
+	if tr.statusBuilds != 1 {
+		t.Errorf("status built %d times within the refresh interval", tr.statusBuilds)
+	}
+	clock.Advance(time.Second)
+	if s := tr.GetStatus(); s.Progress != 0.5 {
+		t.Errorf("progress is %f after the refresh interval", s.Progress)
+	}
+	if tr.statusBuilds != 2 {
+		t.Errorf("status built %d times, expected 2", tr.statusBuilds)
+	}
+	// state changes show up right away
+	tr.setState(Seeding)
+	if s := tr.GetStatus().State; s != Seeding {
+		t.Errorf("status says %s after a state change", s)
+	}
+	// totals are what the session's rate meters counted
+	tr.txRate.Add(1000)
+	tr.rxRate.Add(3000)
+	clock.Advance(time.Second)
+	if s := tr.GetStatus(); s.TX != 1000 || s.RX != 3000 {
+		t.Errorf("status says tx %d rx %d, expected 1000 and 3000", s.TX, s.RX)
+	}
+}
+
+func TestUnroutablePeersSkipped(t *testing.T) {
+	lan := []string{"127.0.0.1", "::1", "169.254.1.2", "fe80::1", "10.1.2.3", "172.16.5.5", "192.168.1.1", "fd00::1", "0.0.0.0"}
+	wan := []string{"1.2.3.4", "172.32.0.1", "2001:db8::1"}
+	for _, allow := range []bool{false, true} {
+		tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+		tr.AllowLANPeers = allow
+		var peers []common.Peer
+		for _, ip := range append(append([]string{}, lan...), wan...) {
+			peers = append(peers, common.Peer{IP: ip, Port: 6882})
+		}
+		tr.addPeers(peers)
+		time.Sleep(time.Millisecond * 100)
+		for _, p := range peers {
+			dialed := n.numDials(p.Key()) > 0
+			routable := routableAddr(&net.TCPAddr{IP: net.ParseIP(p.IP)})
+			if routable == contains(lan, p.IP) {
+				t.Errorf("%s routable: %v", p.IP, routable)
+			}
+			if dialed != (allow || routable) {
+				t.Errorf("allow lan %v: dialed %s: %v", allow, p.IP, dialed)
+			}
+		}
+		closeTestTorrent(tr, n)
+	}
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExternalAddrSkipped(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.ExternalAddr = "203.0.113.7"
+	peers := []common.Peer{
+		{IP: "203.0.113.7", Port: 6881},
+		{IP: "::ffff:203.0.113.7", Port: 6881},
+		{IP: "203.0.113.7", Port: 6882},
+		{IP: "203.0.113.8", Port: 6881},
+	}
+	tr.addPeers(peers)
+	time.Sleep(time.Millisecond * 100)
+	for idx, p := range peers {
+		dialed := n.numDials(p.Key()) > 0
+		if dialed != (idx >= 2) {
+			t.Errorf("dialed %s: %v", p.Key(), dialed)
+		}
+	}
+
+	tr.ExternalAddr = "203.0.113.7:7000"
+	if !tr.isSelf(&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 7000}) {
+		t.Error("external address with a port is not us")
+	}
+	if tr.isSelf(&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 6881}) {
+		t.Error("external ip on the wrong port is us")
+	}
+}
+
+func TestStopWhenDone(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(1, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.StopWhenDone = true
+	st := tr.st.(*testStorage)
+	var events []tracker.Event
+	var mtx sync.Mutex
+	tr.Trackers["test"] = &testTracker{
+		name: "test",
+		onAnnounce: func(req *tracker.Request) {
+			mtx.Lock()
+			events = append(events, req.Event)
+			mtx.Unlock()
+		},
+	}
+	tr.nextAnnounceFor("test")
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, tr, Downloading)
+	// the tracker heard we started and does not want us back for a while
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		mtx.Lock()
+		got := len(events)
+		mtx.Unlock()
+		if got > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("never announced started")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// the last piece comes in
+	st.setPiece(0)
+	waitForState(t, tr, Stopped)
+	deadline = time.Now().Add(time.Second * 5)
+	for {
+		mtx.Lock()
+		got := append([]tracker.Event{}, events...)
+		mtx.Unlock()
+		if len(got) > 0 && got[len(got)-1] == tracker.Stopped {
+			if len(got) < 2 || got[len(got)-2] != tracker.Completed {
+				t.Errorf("announced %q, expected completed right before stopped", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("announced %q, never stopped", got)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if s := tr.State(); s != Stopped {
+		t.Errorf("torrent is %s after it was done", s)
+	}
+	if !st.Bitfield().Has(0) {
+		t.Error("data gone after stopping")
+	}
+}
+
+func TestSimultaneousConnect(t *testing.T) {
+	for _, theyWin := range []bool{false, true} {
+		tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+		tr.MaxPeers = 10
+		copy(tr.id[:], "-XD0000-mmmmmmmmmmmm")
+		var id common.PeerID
+		if theyWin {
+			copy(id[:], "-XD0000-zzzzzzzzzzzz")
+		} else {
+			copy(id[:], "-XD0000-aaaaaaaaaaaa")
+		}
+		// we dialed them and they dialed us from another port
+		ob := testPeerFrom(tr, 1)
+		ob.id = id
+		tr.addOBPeer(ob)
+		ib := testPeerFrom(tr, 2)
+		ib.id = id
+		tr.onNewPeer(ib)
+
+		// whoever has the higher peer id dialed the connection both ends keep
+		if keptIB := !ib.closing && tr.HasIBConn(ib.c.RemoteAddr()); keptIB != theyWin {
+			t.Errorf("their id higher %v: kept inbound %v", theyWin, keptIB)
+		}
+		if ob.closing != theyWin {
+			t.Errorf("their id higher %v: outbound closing %v", theyWin, ob.closing)
+		}
+		if !ob.closing && !ib.closing {
+			t.Errorf("their id higher %v: both connections kept", theyWin)
+		}
+		closeTestTorrent(tr, n)
+	}
+}
+
+func TestSimultaneousConnectRace(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	for idx := byte(0); idx < 50; idx++ {
+		// both connections to the same peer come in at once
+		ob := testPeerFrom(tr, idx*2+1)
+		ib := testPeerFrom(tr, idx*2+2)
+		ib.id = ob.id
+		var wg sync.WaitGroup
+		var addedOB, addedIB bool
+		wg.Add(2)
+		go func() {
+			addedOB = tr.addOBPeer(ob)
+			wg.Done()
+		}()
+		go func() {
+			addedIB = tr.addIBPeer(ib)
+			wg.Done()
+		}()
+		wg.Wait()
+		kept := 0
+		if addedOB && !ob.isClosing() {
+			kept++
+		}
+		if addedIB && !ib.isClosing() {
+			kept++
+		}
+		if kept != 1 {
+			t.Fatalf("kept %d connections to one peer", kept)
+		}
+	}
+}
+
+func TestResumeFlushInterval(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize*4))
+	defer closeTestTorrent(tr, n)
+	tr.RemoveSelf = func() {}
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	tr.clock = clock
+	tr.ResumeFlushInterval = time.Second * 30
+	var mtx sync.Mutex
+	flushes := 0
+	tr.st.(*testStorage).onFlush = func() {
+		mtx.Lock()
+		flushes++
+		mtx.Unlock()
+	}
+	waitFor := func(expected int) {
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			mtx.Lock()
+			got := flushes
+			mtx.Unlock()
+			if got == expected {
+				return
+			}
+			if got > expected || time.Now().After(deadline) {
+				t.Fatalf("%d flushes but expected %d", got, expected)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// get one block of a piece
+	remote := bittorrent.NewBitfield(2, nil)
+	remote.Set(0)
+	r := tr.pt.NextRequest(remote, nil)
+	if r == nil {
+		t.Fatal("no request made")
+	}
+	tr.pt.handlePieceData(&common.PieceData{Index: r.Index, Begin: r.Begin, Data: make([]byte, r.Length)})
+	// not time yet
+	clock.Advance(time.Second * 29)
+	time.Sleep(time.Millisecond * 50)
+	waitFor(0)
+	clock.Advance(time.Second)
+	waitFor(1)
+	// the block we got is saved along with the bitfield
+	partial := tr.st.LoadPartial()
+	if blocks := partial[r.Index]; blocks == nil || !blocks.Has(0) || blocks.CountSet() != 1 {
+		t.Fatalf("saved partial pieces %v after getting block 0 of piece %d", partial, r.Index)
+	}
+	clock.Advance(time.Second * 30)
+	waitFor(2)
+	// closing flushes whatever is left
+	tr.Close()
+	waitFor(3)
+	if blocks := tr.st.LoadPartial()[r.Index]; blocks == nil || !blocks.Has(0) {
+		t.Error("partial piece not saved on close")
+	}
+}
+
+func TestPartialPiecesRestored(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(2, BlockSize*4))
+	defer closeTestTorrent(tr, n)
+	tr.RemoveSelf = func() {}
+	// all of piece 0 and the first 3 blocks of piece 1 were in before we stopped
+	whole := bittorrent.NewBitfield(4, nil)
+	some := bittorrent.NewBitfield(4, nil)
+	for idx := uint32(0); idx < 4; idx++ {
+		whole.Set(idx)
+		if idx < 3 {
+			some.Set(idx)
+		}
+	}
+	tr.st.SavePartial(map[uint32]*bittorrent.Bitfield{0: whole, 1: some})
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !tr.st.Bitfield().Has(0) {
+		t.Error("piece with all blocks saved not checked when starting")
+	}
+	// only the missing block is asked for
+	r := tr.pt.nextRequestIn([]uint32{1}, BlockSize)
+	if r == nil {
+		t.Fatal("piece 1 not in progress after starting")
+	}
+	if r.Begin != BlockSize*3 {
+		t.Errorf("asked for offset %d of piece 1, expected %d", r.Begin, BlockSize*3)
+	}
+	if r := tr.pt.nextRequestIn([]uint32{1}, BlockSize); r != nil {
+		t.Errorf("asked for offset %d of piece 1 after the missing block", r.Begin)
+	}
+}
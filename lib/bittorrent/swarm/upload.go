@@ -0,0 +1,223 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"time"
+)
+
+// DefaultMaxUploadSlots is how many peers can download from us at once by default, 0 is no limit
+const DefaultMaxUploadSlots = 0
+
+// UploadSlotTimeout is how long a peer keeps its upload slot without asking for anything
+const UploadSlotTimeout = time.Minute
+
+// DefaultUploadQueueSize is how many blocks we queue up to send to all peers of a torrent together
+// once that many are queued each peer gets an even share of it
+const DefaultUploadQueueSize = 256
+
+// MaxPieceReads is how many pieces a torrent reads from disk at once to send to peers
+// each peer has at most one read going so one slow read doesn't hold up the others
+const MaxPieceReads = 4
+
+// UploadWaitInterval is how often a peer waiting to send more pieces checks if it closed
+const UploadWaitInterval = time.Millisecond * 100
+
+// take an upload slot for c or keep the one it has, return false if they are all in use
+func (t *Torrent) takeUploadSlot(c *PeerConn) bool {
+	if t.MaxUploadSlots <= 0 {
+		return true
+	}
+	now := t.clock.Now()
+	t.uploadMtx.Lock()
+	defer t.uploadMtx.Unlock()
+	if t.uploaders == nil {
+		t.uploaders = make(map[*PeerConn]time.Time)
+	}
+	if _, ok := t.uploaders[c]; !ok {
+		if len(t.uploaders) >= t.MaxUploadSlots {
+			return false
+		}
+		log.Debugf("%s got an upload slot", c.id.String())
+	}
+	t.uploaders[c] = now
+	return true
+}
+
+// give up the upload slot c has if it has one and let a waiting peer have it
+func (t *Torrent) releaseUploadSlot(c *PeerConn) {
+	t.uploadMtx.Lock()
+	_, had := t.uploaders[c]
+	delete(t.uploaders, c)
+	t.uploadMtx.Unlock()
+	if had {
+		log.Debugf("%s gave up its upload slot", c.id.String())
+		t.unchokeWaiting(1)
+	}
+}
+
+// free the slots of peers that went away or stopped asking for a while
+func (t *Torrent) expireUploadSlots(now time.Time) {
+	freed := 0
+	t.uploadMtx.Lock()
+	for u, last := range t.uploaders {
+		if u.isClosing() || !u.isPeerInterested() || now.Sub(last) >= UploadSlotTimeout {
+			delete(t.uploaders, u)
+			freed++
+		}
+	}
+	t.uploadMtx.Unlock()
+	if freed > 0 {
+		t.unchokeWaiting(freed)
+	}
+}
+
+// unchoke up to n peers we choked for lack of an upload slot so they can ask again
+func (t *Torrent) unchokeWaiting(n int) {
+	t.VisitPeers(func(c *PeerConn) {
+		if n > 0 && c.takeSlotUnchoke() {
+			c.Unchoke()
+			n--
+		}
+	})
+}
+
+// choke c because there is no upload slot for it
+func (t *Torrent) chokeNoSlot(c *PeerConn) {
+	log.Debugf("no upload slot for %s", c.id.String())
+	c.access.Lock()
+	c.slotChoked = true
+	c.access.Unlock()
+	if !c.Chocking() {
+		c.Choke()
+	}
+}
+
+// stop waiting for an upload slot, returns false if c is not waiting for one or does not want it anymore
+func (c *PeerConn) takeSlotUnchoke() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if !c.slotChoked || !c.peerInterested || c.closing {
+		return false
+	}
+	c.slotChoked = false
+	return true
+}
+
+// return true if c has its whole share of blocks queued up to send
+func (t *Torrent) uploadShareFull(c *PeerConn) bool {
+	share := t.uploadShare(c)
+	return share > 0 && c.QueuedUploads() >= share
+}
+
+// how many blocks c can have queued up to send, 0 for no limit
+// every peer we are sending to gets the same share so a peer asking for a lot can't crowd out the rest
+func (t *Torrent) uploadShare(c *PeerConn) int {
+	if t.UploadQueueSize <= 0 {
+		return 0
+	}
+	uploading := 1
+	t.VisitPeers(func(p *PeerConn) {
+		if p != c && p.QueuedUploads() > 0 {
+			uploading++
+		}
+	})
+	share := t.UploadQueueSize / uploading
+	if share < 1 {
+		share = 1
+	}
+	return share
+}
+
+// QueuedUploads gets how many blocks we have queued up to send to this peer
+func (c *PeerConn) QueuedUploads() (n int) {
+	c.access.Lock()
+	n = c.queuedUploads
+	c.access.Unlock()
+	return
+}
+
+func (c *PeerConn) queuedUpload(n int) {
+	c.access.Lock()
+	c.queuedUploads += n
+	if c.queuedUploads < 0 {
+		c.queuedUploads = 0
+	}
+	c.access.Unlock()
+}
+
+// how many requests from c are waiting on or being read off the disk
+func (c *PeerConn) queuedReads() (n int) {
+	c.access.Lock()
+	n = len(c.reads)
+	if c.serving {
+		n++
+	}
+	c.access.Unlock()
+	return
+}
+
+// queue reading r to send it to c, returns false if c has as many requests waiting as we told it it can have
+func (c *PeerConn) queueRead(r *common.PieceRequest) bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.closing || len(c.reads)+c.queuedUploads >= cap(c.send) {
+		return false
+	}
+	c.reads = append(c.reads, r)
+	if !c.reading {
+		c.reading = true
+		go c.runReads()
+	}
+	return true
+}
+
+// read and send what c asked for in order until there is nothing left
+// once c has its share queued up it waits for some of it to go out so the other peers get their turn
+func (c *PeerConn) runReads() {
+	for {
+		c.access.Lock()
+		if len(c.reads) == 0 || c.closing {
+			c.reads = nil
+			c.reading = false
+			c.access.Unlock()
+			return
+		}
+		c.access.Unlock()
+		if c.t.uploadShareFull(c) {
+			c.waitUploadSent()
+			continue
+		}
+		c.access.Lock()
+		if len(c.reads) == 0 {
+			// choked while we waited
+			c.access.Unlock()
+			continue
+		}
+		r := c.reads[0]
+		c.reads = c.reads[1:]
+		// counts as queued to send from here on so it is never counted twice or not at all
+		c.queuedUploads++
+		c.serving = true
+		c.access.Unlock()
+		c.t.servePiece(c, r)
+		c.access.Lock()
+		c.serving = false
+		c.access.Unlock()
+	}
+}
+
+// wait until a piece queued for c was written out or a little while passed
+func (c *PeerConn) waitUploadSent() {
+	select {
+	case <-c.uploadSent:
+	case <-time.After(UploadWaitInterval):
+	}
+}
+
+// forget the requests from c we did not start reading yet
+func (c *PeerConn) dropReads() {
+	c.access.Lock()
+	c.reads = nil
+	c.access.Unlock()
+}
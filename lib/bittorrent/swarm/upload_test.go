@@ -0,0 +1,268 @@
+package swarm
+
+import (
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/sync"
+	"io"
+	"testing"
+	"time"
+)
+
+// wait for the pieces c asked for to be read and queued to send
+func waitForReads(c *PeerConn) {
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); {
+		// the rest waits for its turn
+		if c.queuedReads() == 0 || c.t.uploadShareFull(c) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// drain what c queued to send and count the messages with id
+func countSent(c *PeerConn, id common.WireMessageType) (n int) {
+	waitForReads(c)
+	for {
+		select {
+		case msg := <-c.send:
+			if msg.MessageID() == id {
+				n++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestMaxUploadSlots(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.MaxUploadSlots = 2
+
+	var peers []*PeerConn
+	for idx := byte(1); idx <= 3; idx++ {
+		c := addOldTestPeer(tr, idx)
+		c.inboundMessage(common.NewInterested())
+		peers = append(peers, c)
+	}
+	for _, c := range peers {
+		c.inboundMessage(common.PieceRequest{Index: 0, Length: BlockSize}.ToWireMessage())
+	}
+	for idx, c := range peers[:2] {
+		if got := countSent(c, common.Piece); got != 1 {
+			t.Errorf("peer %d got %d pieces, expected 1", idx+1, got)
+		}
+	}
+	waiting := peers[2]
+	if got := countSent(waiting, common.Piece); got != 0 {
+		t.Errorf("peer without a slot got %d pieces", got)
+	}
+	if !waiting.usChoke {
+		t.Error("peer without a slot was not choked")
+	}
+
+	// a slot frees up when a peer is done with us
+	peers[0].inboundMessage(common.NewNotInterested())
+	if waiting.usChoke {
+		t.Fatal("waiting peer was not unchoked when a slot freed up")
+	}
+	waiting.inboundMessage(common.PieceRequest{Index: 1, Length: BlockSize}.ToWireMessage())
+	if got := countSent(waiting, common.Piece); got != 1 {
+		t.Errorf("waiting peer got %d pieces after getting a slot, expected 1", got)
+	}
+	peers[0].inboundMessage(common.NewInterested())
+	peers[0].inboundMessage(common.PieceRequest{Index: 2, Length: BlockSize}.ToWireMessage())
+	if got := countSent(peers[0], common.Piece); got != 0 {
+		t.Errorf("peer that gave up its slot got %d pieces while slots are full", got)
+	}
+}
+
+func TestFairUploadShare(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.UploadQueueSize = 8
+
+	greedy := addOldTestPeer(tr, 1)
+	modest := addOldTestPeer(tr, 2)
+	sent := make(map[*PeerConn]int)
+	for round := 0; round < 20; round++ {
+		// one asks for a lot more than the other
+		for idx := 0; idx < 4; idx++ {
+			greedy.inboundMessage(common.PieceRequest{Index: uint32(idx), Length: BlockSize}.ToWireMessage())
+		}
+		modest.inboundMessage(common.PieceRequest{Index: 0, Length: BlockSize}.ToWireMessage())
+		waitForReads(greedy)
+		waitForReads(modest)
+		if q := greedy.QueuedUploads(); q > tr.UploadQueueSize {
+			t.Fatalf("%d blocks queued for one peer", q)
+		}
+		// both links send one block each round
+		for _, c := range []*PeerConn{greedy, modest} {
+			select {
+			case msg := <-c.send:
+				c.processWrite(io.Discard, msg)
+				sent[c]++
+			default:
+			}
+		}
+	}
+	if sent[modest] != 20 {
+		t.Errorf("sent %d blocks to the peer asking for less, expected 20", sent[modest])
+	}
+	// the rest of what the greedy one asked for waits its turn instead of being thrown away
+	for _, c := range []*PeerConn{greedy, modest} {
+		if d := c.DroppedRequests(); d != 0 {
+			t.Errorf("dropped %d requests from a peer within its request queue", d)
+		}
+	}
+	if q := greedy.queuedReads(); q == 0 {
+		t.Error("peer asking for more was never held to its share")
+	}
+	if diff := sent[greedy] - sent[modest]; diff < -1 || diff > 1 {
+		t.Errorf("sent %d and %d blocks, expected about the same", sent[greedy], sent[modest])
+	}
+}
+
+func TestFullSendQueueHoldsPiece(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.SendQueueSize = 4
+	c := addOldTestPeer(tr, 1)
+	// other messages fill the send queue before the piece is read
+	for idx := 0; idx < 4; idx++ {
+		c.Send(common.NewHave(uint32(idx)))
+	}
+	c.inboundMessage(common.PieceRequest{Index: 0, Length: BlockSize}.ToWireMessage())
+	for idx := 0; idx < 4; idx++ {
+		c.processWrite(io.Discard, <-c.send)
+	}
+	if got := countSent(c, common.Piece); got != 1 {
+		t.Errorf("sent %d pieces after the send queue had room again, expected 1", got)
+	}
+	if d := c.DroppedRequests(); d != 0 {
+		t.Errorf("dropped %d requests", d)
+	}
+}
+
+func TestChokeDropsQueuedRequests(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.UploadQueueSize = 1
+	c := addOldTestPeer(tr, 1)
+	c.inboundMessage(common.NewInterested())
+	for idx := 0; idx < 3; idx++ {
+		c.inboundMessage(common.PieceRequest{Index: uint32(idx), Length: BlockSize}.ToWireMessage())
+	}
+	waitForReads(c)
+	c.Choke()
+	// they ask again after we unchoke them
+	if got := countSent(c, common.Piece); got != 1 {
+		t.Errorf("sent %d pieces, expected only the one queued before choking", got)
+	}
+	if q := c.queuedReads(); q != 0 {
+		t.Errorf("%d requests still queued after choking", q)
+	}
+}
+
+func TestLeechOnlyServesNothing(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	tr.LeechOnly = true
+	c := addOldTestPeer(tr, 1)
+	c.inboundMessage(common.NewInterested())
+	if got := countSent(c, common.UnChoke); got != 0 || !c.usChoke {
+		t.Error("interested peer was unchoked in leech only mode")
+	}
+	c.inboundMessage(common.PieceRequest{Index: 0, Length: BlockSize}.ToWireMessage())
+	if got := countSent(c, common.Piece); got != 0 {
+		t.Errorf("peer got %d pieces in leech only mode", got)
+	}
+	if d := c.DroppedRequests(); d != 1 {
+		t.Errorf("%d requests dropped, expected 1", d)
+	}
+}
+
+func TestSlowReadDoesNotBlockOthers(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	unblock := make(chan bool)
+	defer close(unblock)
+	tr.st.(*testStorage).onGetPiece = func(r common.PieceRequest) {
+		if r.Index == 0 {
+			<-unblock
+		}
+	}
+	slow := addOldTestPeer(tr, 1)
+	fast := addOldTestPeer(tr, 2)
+	// more slow reads than we do at once
+	for idx := 0; idx < MaxPieceReads*2; idx++ {
+		slow.inboundMessage(common.PieceRequest{Index: 0, Length: BlockSize}.ToWireMessage())
+	}
+	start := time.Now()
+	fast.inboundMessage(common.PieceRequest{Index: 1, Length: BlockSize}.ToWireMessage())
+	select {
+	case msg := <-fast.send:
+		if msg.MessageID() != common.Piece {
+			t.Fatalf("sent %s instead of a piece", msg.MessageID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a slow read for one peer held up sending to another")
+	}
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Errorf("took %s to send to the fast peer", d)
+	}
+	if q := slow.queuedReads(); q != MaxPieceReads*2 {
+		t.Errorf("%d reads waiting for the slow peer, expected %d", q, MaxPieceReads*2)
+	}
+	unblock <- true
+	select {
+	case <-slow.send:
+	case <-time.After(time.Second):
+		t.Error("slow peer never got its piece")
+	}
+}
+
+func TestRequestsDuringClose(t *testing.T) {
+	tr, n := newTestTorrent(testMetaInfo(4, BlockSize))
+	defer closeTestTorrent(tr, n)
+	var mtx sync.Mutex
+	closed := false
+	late := 0
+	tr.st.(*testStorage).onGetPiece = func(common.PieceRequest) {
+		mtx.Lock()
+		if closed {
+			late++
+		}
+		mtx.Unlock()
+	}
+	var wg sync.WaitGroup
+	for idx := byte(1); idx <= 4; idx++ {
+		c := addOldTestPeer(tr, idx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := uint32(0); r < 50; r++ {
+				c.inboundMessage(common.PieceRequest{Index: r % 4, Length: BlockSize}.ToWireMessage())
+			}
+		}()
+	}
+	tr.Close()
+	mtx.Lock()
+	closed = true
+	mtx.Unlock()
+	wg.Wait()
+	// a request once closed closes the peer instead of being read
+	c := testPeerFrom(tr, 9)
+	c.inboundMessage(common.PieceRequest{Index: 0, Length: BlockSize}.ToWireMessage())
+	if !c.isClosing() {
+		t.Error("peer asking for a piece after close was not closed")
+	}
+	if q := c.queuedReads(); q != 0 {
+		t.Errorf("%d reads queued after close", q)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if late > 0 {
+		t.Errorf("read %d pieces after close", late)
+	}
+}
@@ -7,10 +7,13 @@ import (
 	"github.com/majestrate/XD/lib/network"
 	"github.com/majestrate/XD/lib/network/i2p"
 	"github.com/majestrate/XD/lib/network/inet"
+	"github.com/majestrate/XD/lib/sync"
 	"github.com/majestrate/XD/lib/version"
 	"io"
+	mrand "math/rand"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -22,12 +25,59 @@ func (id PeerID) Bytes() []byte {
 	return id[:]
 }
 
+// MaxPeerIDPrefixLen is the longest peer id prefix we use, the rest of the peer id is always random
+const MaxPeerIDPrefixLen = 12
+
+// DefaultPeerIDPrefix gets the azureus style prefix for XD peer ids
+func DefaultPeerIDPrefix() string {
+	return "-" + version.Name + version.Major + version.Minor + version.Patch + "0-"
+}
+
 // GeneratePeerID generates a new peer id for XD
 func GeneratePeerID() (id PeerID) {
-	io.ReadFull(rand.Reader, id[:])
-	id[0] = '-'
-	v := version.Name + version.Major + version.Minor + version.Patch + "0-"
-	copy(id[1:], []byte(v[:]))
+	return GeneratePeerIDWithPrefix(DefaultPeerIDPrefix())
+}
+
+// peer ids we generated so far, we never give out the same one twice
+var generatedIDs = make(map[PeerID]bool)
+var generatedMtx sync.Mutex
+
+// where the random part of peer ids comes from
+var peerIDRand io.Reader = rand.Reader
+
+// how many times we read peerIDRand for a new peer id before falling back to math/rand
+const maxPeerIDReads = 8
+
+// GeneratePeerIDWithPrefix generates a new random peer id starting with prefix
+// prefixes longer than MaxPeerIDPrefixLen are cut short
+func GeneratePeerIDWithPrefix(prefix string) (id PeerID) {
+	if len(prefix) > MaxPeerIDPrefixLen {
+		prefix = prefix[:MaxPeerIDPrefixLen]
+	}
+	generatedMtx.Lock()
+	defer generatedMtx.Unlock()
+	fallback := false
+	for reads := 0; ; reads++ {
+		if !fallback && reads >= maxPeerIDReads {
+			log.Errorf("random source keeps repeating peer ids, using math/rand")
+			fallback = true
+		}
+		if !fallback {
+			_, err := io.ReadFull(peerIDRand, id[:])
+			if err != nil {
+				log.Errorf("failed to read random peer id, using math/rand: %s", err.Error())
+				fallback = true
+			}
+		}
+		if fallback {
+			mrand.Read(id[:])
+		}
+		copy(id[:], []byte(prefix))
+		if !generatedIDs[id] {
+			break
+		}
+	}
+	generatedIDs[id] = true
 	return
 }
 
@@ -44,6 +94,14 @@ type Peer struct {
 	ID      PeerID         `bencode:"peer id"`
 }
 
+// Key returns a string that identifies the address of this peer
+func (p *Peer) Key() string {
+	if len(p.IP) > 0 {
+		return net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+	}
+	return p.Compact.String()
+}
+
 // Resolve resolves network address of peer
 func (p *Peer) Resolve(n network.Network) (a net.Addr, err error) {
 	la := n.Addr()
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestGeneratePeerIDPrefix(t *testing.T) {
+	a := GeneratePeerID()
+	b := GeneratePeerID()
+	prefix := DefaultPeerIDPrefix()
+	if prefix != "-XD0420-" {
+		t.Errorf("default prefix is %q", prefix)
+	}
+	if !bytes.HasPrefix(a[:], []byte(prefix)) {
+		t.Errorf("peer id %q does not start with %q", a[:], prefix)
+	}
+	if a == b {
+		t.Error("two generated peer ids are the same")
+	}
+
+	id := GeneratePeerIDWithPrefix("-TT1234-")
+	if !bytes.HasPrefix(id[:], []byte("-TT1234-")) {
+		t.Errorf("peer id %q does not start with the configured prefix", id[:])
+	}
+	// always leave room for the random part
+	id = GeneratePeerIDWithPrefix("-ABCDEFGHIJKLMNOPQRSTUVWXYZ-")
+	if !bytes.HasPrefix(id[:], []byte("-ABCDEFGHIJK")) {
+		t.Errorf("peer id %q does not start with the cut prefix", id[:])
+	}
+	if bytes.Contains(id[:], []byte("LMNOPQRST")) {
+		t.Errorf("peer id %q has more than %d bytes of prefix", id[:], MaxPeerIDPrefixLen)
+	}
+}
+
+func TestGeneratePeerIDUnique(t *testing.T) {
+	a := GeneratePeerIDWithPrefix("-TT0001-")
+	b := GeneratePeerIDWithPrefix("-TT0001-")
+	if !bytes.Equal(a[:8], b[:8]) {
+		t.Errorf("peer ids %q and %q do not share a prefix", a[:], b[:])
+	}
+	if bytes.Equal(a[8:], b[8:]) {
+		t.Errorf("peer ids %q and %q have the same suffix", a[:], b[:])
+	}
+
+	// a random source that repeats itself still gives unique ids
+	defer func(r io.Reader) { peerIDRand = r }(peerIDRand)
+	same := bytes.Repeat([]byte{'a'}, 20)
+	other := bytes.Repeat([]byte{'b'}, 20)
+	peerIDRand = bytes.NewReader(append(append(same, same...), other...))
+	c := GeneratePeerIDWithPrefix("-TT0002-")
+	d := GeneratePeerIDWithPrefix("-TT0002-")
+	if c == d {
+		t.Errorf("generated %q twice", c[:])
+	}
+	if !bytes.Equal(d[8:], other[8:]) {
+		t.Errorf("peer id %q did not skip the repeated random bytes", d[:])
+	}
+
+	// a broken random source still gives unique ids
+	peerIDRand = bytes.NewReader(nil)
+	e := GeneratePeerIDWithPrefix("-TT0002-")
+	f := GeneratePeerIDWithPrefix("-TT0002-")
+	if e == f || string(e[:8]) != "-TT0002-" {
+		t.Errorf("generated %q and %q without a random source", e[:], f[:])
+	}
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// PeerEncoding is how a list of peers we got is encoded
+type PeerEncoding int
+
+const (
+	// PeersI2P is compact 32 byte i2p destination hashes
+	PeersI2P = PeerEncoding(iota)
+	// PeersIPv4 is compact 4 byte ip and 2 byte port
+	PeersIPv4
+	// PeersIPv6 is compact 16 byte ip and 2 byte port
+	PeersIPv6
+	// PeersDict is a bencoded list of dicts with ip, port and an optional peer id
+	PeersDict
+)
+
+// size of each entry of a compact peer list, 0 if it isn't compact
+func (enc PeerEncoding) size() int {
+	switch enc {
+	case PeersI2P:
+		return 32
+	case PeersIPv4:
+		return net.IPv4len + 2
+	case PeersIPv6:
+		return net.IPv6len + 2
+	}
+	return 0
+}
+
+// ParsePeers turns a list of peers from a tracker, pex or the dht into Peers
+// compact lists are a string or byteslice, a dict list is what bencode decodes into an interface{}
+// entries that don't make sense are skipped
+func ParsePeers(enc PeerEncoding, v interface{}) (peers []Peer) {
+	if enc == PeersDict {
+		l, _ := v.([]interface{})
+		for idx := range l {
+			p, ok := parseDictPeer(l[idx])
+			if ok {
+				peers = append(peers, p)
+			}
+		}
+		return
+	}
+	var data []byte
+	switch d := v.(type) {
+	case string:
+		data = []byte(d)
+	case []byte:
+		data = d
+	}
+	sz := enc.size()
+	if sz == 0 {
+		return
+	}
+	for ; len(data) >= sz; data = data[sz:] {
+		var p Peer
+		if enc == PeersI2P {
+			copy(p.Compact[:], data[:sz])
+		} else {
+			p.IP = net.IP(data[:sz-2]).String()
+			p.Port = int(binary.BigEndian.Uint16(data[sz-2:]))
+		}
+		peers = append(peers, p)
+	}
+	return
+}
+
+func parseDictPeer(v interface{}) (p Peer, ok bool) {
+	var d map[string]interface{}
+	d, ok = v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	p.IP, ok = d["ip"].(string)
+	if !ok || p.IP == "" {
+		ok = false
+		return
+	}
+	var port int64
+	port, ok = d["port"].(int64)
+	if !ok || port <= 0 || port > 65535 {
+		ok = false
+		return
+	}
+	p.Port = int(port)
+	if id, has := d["peer id"].(string); has && len(id) == len(p.ID) {
+		copy(p.ID[:], id)
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"github.com/zeebo/bencode"
+	"testing"
+)
+
+func TestParsePeersSameEverywhere(t *testing.T) {
+	// the same two peers the way each source sends them
+	compact4 := string([]byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2})
+	compact6 := string([]byte{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1, 0x1a, 0xe1,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 2, 0x1a, 0xe2,
+	})
+	var dicts interface{}
+	err := bencode.DecodeString("ld2:ip8:10.0.0.14:porti6881eed2:ip8:10.0.0.24:porti6882e7:peer id20:-TT0000-000000000000ee", &dicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.1:6881", "10.0.0.2:6882"}
+	for _, test := range []struct {
+		name string
+		enc  PeerEncoding
+		v    interface{}
+	}{
+		{"ipv4", PeersIPv4, compact4},
+		{"ipv4 bytes", PeersIPv4, []byte(compact4)},
+		{"ipv4 with a partial entry", PeersIPv4, compact4 + "\x0a\x00"},
+		{"ipv6", PeersIPv6, compact6},
+		{"dict", PeersDict, dicts},
+	} {
+		peers := ParsePeers(test.enc, test.v)
+		if len(peers) != len(expected) {
+			t.Errorf("%s: got %d peers, expected %d", test.name, len(peers), len(expected))
+			continue
+		}
+		for idx := range peers {
+			if k := peers[idx].Key(); k != expected[idx] {
+				t.Errorf("%s: peer %d is %s, expected %s", test.name, idx, k, expected[idx])
+			}
+		}
+	}
+	peers := ParsePeers(PeersDict, dicts)
+	if string(peers[1].ID[:]) != "-TT0000-000000000000" {
+		t.Errorf("peer id is %q", peers[1].ID[:])
+	}
+	if peers[0].ID != (PeerID{}) {
+		t.Errorf("peer without an id got %q", peers[0].ID[:])
+	}
+}
+
+func TestParsePeersI2P(t *testing.T) {
+	var compact []byte
+	for idx := byte(1); idx <= 2; idx++ {
+		var h [32]byte
+		h[0] = idx
+		compact = append(compact, h[:]...)
+	}
+	peers := ParsePeers(PeersI2P, string(compact))
+	if len(peers) != 2 {
+		t.Fatalf("got %d peers, expected 2", len(peers))
+	}
+	for idx, p := range peers {
+		if p.Compact[0] != byte(idx+1) || p.IP != "" {
+			t.Errorf("peer %d is %q", idx, p.Key())
+		}
+	}
+}
+
+func TestParsePeersBad(t *testing.T) {
+	var dicts interface{}
+	// no port, a port that can't be and an ip that isn't a string
+	bencode.DecodeString("ld2:ip8:10.0.0.1ed2:ip8:10.0.0.14:porti70000eed2:ipi1e4:porti1eee", &dicts)
+	for _, test := range []struct {
+		name string
+		enc  PeerEncoding
+		v    interface{}
+	}{
+		{"bad dicts", PeersDict, dicts},
+		{"compact as dicts", PeersDict, "abcdef"},
+		{"dicts as compact", PeersIPv4, dicts},
+		{"nothing", PeersI2P, nil},
+	} {
+		if peers := ParsePeers(test.enc, test.v); len(peers) != 0 {
+			t.Errorf("%s: got %d peers", test.name, len(peers))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"github.com/majestrate/XD/lib/network"
+	"github.com/majestrate/XD/lib/sync"
+	"net"
+	"time"
+)
+
+// DefaultResolveTTL is how long we remember the address a peer resolved to
+const DefaultResolveTTL = time.Minute * 30
+
+// MaxResolveCacheSize is how many resolved peers we remember at most
+const MaxResolveCacheSize = 1024
+
+type resolvedPeer struct {
+	addr    net.Addr
+	expires time.Time
+}
+
+// ResolveCache remembers the addresses peers resolved to so peers trackers keep giving us are not resolved every announce
+type ResolveCache struct {
+	TTL     time.Duration
+	now     func() time.Time
+	mtx     sync.Mutex
+	entries map[string]resolvedPeer
+}
+
+// NewResolveCache makes a cache that remembers resolved peers for ttl
+func NewResolveCache(ttl time.Duration) *ResolveCache {
+	return &ResolveCache{
+		TTL:     ttl,
+		now:     time.Now,
+		entries: make(map[string]resolvedPeer),
+	}
+}
+
+// Resolve resolves the network address of p on n or gets it from the cache
+// failures are not cached
+func (rc *ResolveCache) Resolve(p *Peer, n network.Network) (a net.Addr, err error) {
+	// the same peer resolves to something else on another network
+	key := n.Addr().Network() + " " + p.Key()
+	now := rc.now()
+	rc.mtx.Lock()
+	r, ok := rc.entries[key]
+	rc.mtx.Unlock()
+	if ok && now.Before(r.expires) {
+		a = r.addr
+		return
+	}
+	a, err = p.Resolve(n)
+	if err != nil || a == nil {
+		return
+	}
+	rc.mtx.Lock()
+	if len(rc.entries) >= MaxResolveCacheSize {
+		rc.expire(now)
+	}
+	if len(rc.entries) >= MaxResolveCacheSize {
+		// all still good, start over instead of growing forever
+		rc.entries = make(map[string]resolvedPeer)
+	}
+	rc.entries[key] = resolvedPeer{
+		addr:    a,
+		expires: now.Add(rc.TTL),
+	}
+	rc.mtx.Unlock()
+	return
+}
+
+// forget expired entries, call with mtx held
+func (rc *ResolveCache) expire(now time.Time) {
+	for k, r := range rc.entries {
+		if !now.Before(r.expires) {
+			delete(rc.entries, k)
+		}
+	}
+}
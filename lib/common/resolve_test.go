@@ -0,0 +1,57 @@
+package common
+
+import (
+	"errors"
+	"github.com/majestrate/XD/lib/network/i2p"
+	"net"
+	"testing"
+	"time"
+)
+
+var errTestNetwork = errors.New("not supported by test network")
+
+// i2p network that counts lookups
+type lookupNetwork struct {
+	lookups int
+}
+
+func (n *lookupNetwork) Lookup(name, port string) (net.Addr, error) {
+	n.lookups++
+	return i2p.I2PAddr(name), nil
+}
+func (n *lookupNetwork) Dial(string, string) (net.Conn, error)  { return nil, errTestNetwork }
+func (n *lookupNetwork) Accept() (net.Conn, error)              { return nil, errTestNetwork }
+func (n *lookupNetwork) ReadFrom([]byte) (int, net.Addr, error) { return 0, nil, errTestNetwork }
+func (n *lookupNetwork) WriteTo([]byte, net.Addr) (int, error)  { return 0, errTestNetwork }
+func (n *lookupNetwork) Open() error                            { return nil }
+func (n *lookupNetwork) Close() error                           { return nil }
+func (n *lookupNetwork) Addr() net.Addr                         { return i2p.I2PAddr("us") }
+
+func TestResolveCache(t *testing.T) {
+	n := new(lookupNetwork)
+	rc := NewResolveCache(time.Minute)
+	now := time.Now()
+	rc.now = func() time.Time { return now }
+	var p Peer
+	p.Compact[0] = 1
+	for idx := 0; idx < 2; idx++ {
+		if _, err := rc.Resolve(&p, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n.lookups != 1 {
+		t.Errorf("resolved the same peer %d times, expected 1", n.lookups)
+	}
+	// another peer is its own entry
+	other := p
+	other.Compact[0] = 2
+	rc.Resolve(&other, n)
+	if n.lookups != 2 {
+		t.Errorf("%d lookups after a new peer, expected 2", n.lookups)
+	}
+	now = now.Add(time.Minute)
+	rc.Resolve(&p, n)
+	if n.lookups != 3 {
+		t.Errorf("%d lookups once the cached address expired, expected 3", n.lookups)
+	}
+}
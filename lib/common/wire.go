@@ -112,7 +112,8 @@ func NewWireMessage(id WireMessageType, bodyParts ...[]byte) (msg WireMessage) {
 	return
 }
 
-const MaxWireMessageSize = 32 * 1024
+// MaxWireMessageSize is the biggest message we read, big enough for a piece message carrying a 64KiB block
+const MaxWireMessageSize = 64*1024 + 16
 
 // read wire messages from reader and call a function on each it gets
 // reads until reader is done
@@ -167,6 +168,41 @@ func (msg WireMessage) MessageID() WireMessageType {
 
 var ErrToBig = errors.New("message too big")
 
+// ErrBadMessageLength is returned when a wire message has the wrong payload length for its type
+var ErrBadMessageLength = errors.New("bad wire message length")
+
+// Validate checks that the payload length is right for the message type
+// unknown message types are not checked
+func (msg WireMessage) Validate() error {
+	if len(msg) == 4 && msg.Len() == 0 {
+		// keepalive
+		return nil
+	}
+	if len(msg) < 5 || int(msg.Len()) != len(msg)-4 {
+		return ErrBadMessageLength
+	}
+	l := len(msg.Payload())
+	ok := true
+	switch msg.MessageID() {
+	case Choke, UnChoke, Interested, NotInterested:
+		ok = l == 0
+	case Have:
+		ok = l == 4
+	case Request, Cancel:
+		ok = l == 12
+	case Piece:
+		// index and offset then at least 1 byte of data
+		ok = l > 8
+	case Extended:
+		// extension id then the message
+		ok = l >= 1
+	}
+	if !ok {
+		return ErrBadMessageLength
+	}
+	return nil
+}
+
 // ToWireMessage serialize to BitTorrent wire message
 func (p PieceData) ToWireMessage() WireMessage {
 	var buff [8]byte
@@ -200,9 +236,9 @@ func (msg WireMessage) VisitPieceData(v func(*PieceData)) {
 	return
 }
 
-// GetPieceRequest gets piece request from wire message
+// GetPieceRequest gets piece request from a request or cancel wire message
 func (msg WireMessage) GetPieceRequest() (req *PieceRequest) {
-	if msg.MessageID() == Request {
+	if id := msg.MessageID(); id == Request || id == Cancel {
 		data := msg.Payload()
 		if len(data) == 12 {
 			req = new(PieceRequest)
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestWireMessageDecode(t *testing.T) {
+	for _, msg := range []WireMessage{
+		KeepAlive,
+		NewWireMessage(Choke),
+		NewWireMessage(UnChoke),
+		NewInterested(),
+		NewNotInterested(),
+		NewHave(7),
+		NewWireMessage(BitField, []byte{0xff, 0x80}),
+		PieceRequest{Index: 1, Begin: 16384, Length: 16384}.ToWireMessage(),
+		PieceData{Index: 1, Begin: 16384, Data: []byte{1, 2, 3}}.ToWireMessage(),
+		NewCancel(1, 16384, 16384),
+		NewWireMessage(Extended, []byte{0}, []byte("de")),
+	} {
+		if err := msg.Validate(); err != nil {
+			t.Errorf("good %s message rejected: %s", msg.MessageID(), err)
+		}
+	}
+	if h := NewHave(7).GetHave(); h != 7 {
+		t.Errorf("have is for %d", h)
+	}
+	r := NewCancel(1, 16384, 100).GetPieceRequest()
+	if r == nil || r.Index != 1 || r.Begin != 16384 || r.Length != 100 {
+		t.Errorf("cancel decoded as %v", r)
+	}
+	var got *PieceData
+	PieceData{Index: 2, Begin: 5, Data: []byte{9}}.ToWireMessage().VisitPieceData(func(p *PieceData) {
+		got = p
+	})
+	if got == nil || got.Index != 2 || got.Begin != 5 || len(got.Data) != 1 || got.Data[0] != 9 {
+		t.Errorf("piece decoded as %v", got)
+	}
+}
+
+func TestWireMessageBadLength(t *testing.T) {
+	for _, msg := range []WireMessage{
+		NewWireMessage(Choke, []byte{0}),
+		NewWireMessage(UnChoke, []byte{0}),
+		NewWireMessage(Interested, []byte{0}),
+		NewWireMessage(NotInterested, []byte{0, 0}),
+		NewWireMessage(Have, []byte{0, 0, 1}),
+		NewWireMessage(Have, []byte{0, 0, 0, 0, 1}),
+		NewWireMessage(Request, make([]byte, 11)),
+		NewWireMessage(Request, make([]byte, 13)),
+		NewWireMessage(Cancel, make([]byte, 8)),
+		NewWireMessage(Piece, make([]byte, 8)),
+		NewWireMessage(Piece, make([]byte, 3)),
+		NewWireMessage(Extended),
+		// length header does not match
+		WireMessage{0, 0, 0, 6, byte(Have), 0, 0, 0, 1},
+		WireMessage{0, 0, 0, 1},
+	} {
+		if err := msg.Validate(); err != ErrBadMessageLength {
+			t.Errorf("bad %s message % x gave %v", msg.MessageID(), []byte(msg), err)
+		}
+	}
+}
@@ -3,12 +3,18 @@ package config
 import (
 	"fmt"
 	"github.com/majestrate/XD/lib/bittorrent/swarm"
+	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/configparser"
+	"github.com/majestrate/XD/lib/geoip"
 	"github.com/majestrate/XD/lib/gnutella"
+	"github.com/majestrate/XD/lib/log"
 	"github.com/majestrate/XD/lib/storage"
 	"github.com/majestrate/XD/lib/util"
+	"github.com/majestrate/XD/lib/version"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const DefaultTorrentQueueSize = 0
@@ -71,6 +77,72 @@ type BittorrentConfig struct {
 	PieceWindowSize  int
 	Swarms           int
 	TorrentQueueSize int
+	// seconds to average transfer rates over
+	RateWindow int
+	// ask trackers to leave out peer ids
+	NoPeerID bool
+	// max pieces downloading at once across all torrents, -1 for no limit
+	MaxPieces int
+	// how many messages we queue up to send to each peer
+	SendQueueSize int
+	// bytes of small messages held to go out to a peer in one write, 0 to write each as it is sent
+	SendBufferSize int
+	// turn off nagle on peer connections
+	NoDelay bool
+	// seconds without interested peers before we stop seeding, 0 to seed forever
+	IdleSeed int
+	// stop torrents as soon as they are done instead of seeding them
+	StopWhenDone bool
+	// log every message sent to and gotten from peers, for debugging
+	TraceMessages bool
+	// ask for the blocks of a piece in random order instead of in order
+	RandomBlocks bool
+	// hash finished pieces in the background so downloading does not wait on it
+	BackgroundVerify bool
+	// KiB to ask fast peers for at once, at most 64, 0 to always ask for 16
+	// only turn on if peers accept requests that big, some clients drop peers asking for more than 16
+	LargeBlockSize int
+	// KiB per second a peer has to send to us before it gets asked for large blocks
+	LargeBlockRate int
+	// seconds a peer can send nothing but keepalives before we close it, 0 for the default
+	PeerIdleTimeout int
+	// seconds a peer can leave all our requests unanswered before we ask others, 0 for the default
+	RequestTimeout int
+	// seconds between writing out what we have while downloading, 0 for the default
+	ResumeFlushInterval int
+	// how many peers can download from us at once, 0 for no limit
+	MaxUploadSlots int
+	// megabytes of pieces downloading at once across all torrents, 0 for no limit
+	PieceMemory int
+	// announces and dials done at once across all torrents, 0 for no limit
+	NetWorkers int
+	// megabytes each torrent may download per session before it stops, 0 for no limit
+	DownloadQuota int
+	// torrents downloading at once, the rest wait their turn while seeding what they have, 0 for no limit
+	ActiveDownloads int
+	// leave some pieces out of bitfields and send them as haves
+	LazyBitfield bool
+	// never upload to anyone, bad for the swarm so only if you really have to
+	LeechOnly bool
+	// download the first and last piece of each file before the rest
+	FirstLastPieces bool
+	// dial peers on loopback, link local and private addresses
+	AllowLANPeers bool
+	// find peers on the lan with local service discovery
+	LSD bool
+	// add torrents paused, they wait for a start before doing anything
+	StartPaused bool
+	// start of our peer id
+	PeerIDPrefix string
+	// user agent for http tracker announces
+	UserAgent string
+	// ip or ip:port others reach us at from behind nat, empty if we don't know
+	ExternalAddr string
+	// maxmind db files for peer country and asn, empty to not look them up
+	GeoIPCountry string
+	GeoIPASN     string
+	// comma separated hex infohashes we accept inbound connections for, empty for any we have
+	AcceptInfohashes string
 }
 
 func (c *BittorrentConfig) Load(s *configparser.Section) error {
@@ -79,10 +151,45 @@ func (c *BittorrentConfig) Load(s *configparser.Section) error {
 	c.TorrentQueueSize = DefaultTorrentQueueSize
 	c.PEX = true
 	c.Swarms = 1
+	c.RateWindow = int(util.DefaultRateWindow / time.Second)
+	c.MaxPieces = swarm.DefaultMaxInProgressPieces
+	c.SendQueueSize = swarm.DefaultSendQueueSize
+	c.SendBufferSize = swarm.DefaultSendBufferSize
+	c.NetWorkers = swarm.DefaultNetWorkers
+	c.NoDelay = swarm.DefaultNoDelay
+	c.PeerIdleTimeout = int(swarm.DefaultPeerIdleTimeout / time.Second)
+	c.RequestTimeout = int(swarm.DefaultRequestTimeout / time.Second)
+	c.ResumeFlushInterval = int(swarm.DefaultResumeFlushInterval / time.Second)
+	c.PeerIDPrefix = common.DefaultPeerIDPrefix()
+	c.UserAgent = version.UserAgent()
+	c.AllowLANPeers = swarm.DefaultAllowLANPeers
+	c.LargeBlockRate = swarm.DefaultLargeBlockRate / 1024
 	if s != nil {
 		c.DHT = s.Get("dht", "0") == "1"
+		c.LSD = s.Get("lsd", "0") == "1"
+		c.StartPaused = s.Get("start-paused", "0") == "1"
 		c.PEX = s.Get("pex", "1") == "1"
+		c.NoPeerID = s.Get("no-peer-id", "0") == "1"
+		c.LazyBitfield = s.Get("lazy-bitfield", "0") == "1"
+		c.LeechOnly = s.Get("leech-only", "0") == "1"
+		c.FirstLastPieces = s.Get("first-last-pieces", "0") == "1"
+		c.StopWhenDone = s.Get("stop-when-done", "0") == "1"
+		c.TraceMessages = s.Get("trace-messages", "0") == "1"
+		c.RandomBlocks = s.Get("random-blocks", "0") == "1"
+		c.BackgroundVerify = s.Get("background-verify", "0") == "1"
+		c.NoDelay = s.Get("tcp-nodelay", "1") == "1"
+		lan := "0"
+		if c.AllowLANPeers {
+			lan = "1"
+		}
+		c.AllowLANPeers = s.Get("allow-lan-peers", lan) == "1"
 		c.OpenTrackers.FileName = s.Get("tracker-config", c.OpenTrackers.FileName)
+		c.PeerIDPrefix = s.Get("peer-id-prefix", c.PeerIDPrefix)
+		c.UserAgent = s.Get("user-agent", c.UserAgent)
+		c.ExternalAddr = s.Get("external-addr", "")
+		c.GeoIPCountry = s.Get("geoip-country", "")
+		c.GeoIPASN = s.Get("geoip-asn", "")
+		c.AcceptInfohashes = s.Get("accept-infohashes", "")
 		var e error
 		c.PieceWindowSize, e = strconv.Atoi(s.Get("piece-window", fmt.Sprintf("%d", swarm.DefaultMaxParallelRequests)))
 		if e != nil {
@@ -96,6 +203,70 @@ func (c *BittorrentConfig) Load(s *configparser.Section) error {
 		if e != nil {
 			return e
 		}
+		c.RateWindow, e = strconv.Atoi(s.Get("rate-window", fmt.Sprintf("%d", c.RateWindow)))
+		if e != nil {
+			return e
+		}
+		c.MaxPieces, e = strconv.Atoi(s.Get("max-pieces", fmt.Sprintf("%d", c.MaxPieces)))
+		if e != nil {
+			return e
+		}
+		c.SendQueueSize, e = strconv.Atoi(s.Get("send-queue", fmt.Sprintf("%d", c.SendQueueSize)))
+		if e != nil {
+			return e
+		}
+		c.SendBufferSize, e = strconv.Atoi(s.Get("send-buffer", fmt.Sprintf("%d", c.SendBufferSize)))
+		if e != nil {
+			return e
+		}
+		c.IdleSeed, e = strconv.Atoi(s.Get("idle-seed", "0"))
+		if e != nil {
+			return e
+		}
+		c.PeerIdleTimeout, e = strconv.Atoi(s.Get("peer-idle-timeout", fmt.Sprintf("%d", c.PeerIdleTimeout)))
+		if e != nil {
+			return e
+		}
+		c.RequestTimeout, e = strconv.Atoi(s.Get("request-timeout", fmt.Sprintf("%d", c.RequestTimeout)))
+		if e != nil {
+			return e
+		}
+		c.ResumeFlushInterval, e = strconv.Atoi(s.Get("resume-flush-interval", fmt.Sprintf("%d", c.ResumeFlushInterval)))
+		if e != nil {
+			return e
+		}
+		c.MaxUploadSlots, e = strconv.Atoi(s.Get("max-upload-slots", "0"))
+		if e != nil {
+			return e
+		}
+		c.PieceMemory, e = strconv.Atoi(s.Get("piece-memory", "0"))
+		if e != nil {
+			return e
+		}
+		c.NetWorkers, e = strconv.Atoi(s.Get("net-workers", fmt.Sprintf("%d", c.NetWorkers)))
+		if e != nil {
+			return e
+		}
+		c.DownloadQuota, e = strconv.Atoi(s.Get("download-quota", "0"))
+		if e != nil {
+			return e
+		}
+		c.ActiveDownloads, e = strconv.Atoi(s.Get("active-downloads", "0"))
+		if e != nil {
+			return e
+		}
+		c.LargeBlockSize, e = strconv.Atoi(s.Get("large-block-size", "0"))
+		if e != nil {
+			return e
+		}
+		c.LargeBlockRate, e = strconv.Atoi(s.Get("large-block-rate", fmt.Sprintf("%d", c.LargeBlockRate)))
+		if e != nil {
+			return e
+		}
+		_, e = c.acceptInfohashes()
+		if e != nil {
+			return e
+		}
 	}
 	return c.OpenTrackers.Load()
 }
@@ -113,15 +284,169 @@ func (c *BittorrentConfig) Save(s *configparser.Section) error {
 		s.Add("dht", "0")
 	}
 
+	if c.LSD {
+		s.Add("lsd", "1")
+	} else {
+		s.Add("lsd", "0")
+	}
+
+	if c.StartPaused {
+		s.Add("start-paused", "1")
+	} else {
+		s.Add("start-paused", "0")
+	}
+
+	if c.NoPeerID {
+		s.Add("no-peer-id", "1")
+	} else {
+		s.Add("no-peer-id", "0")
+	}
+
+	if c.LazyBitfield {
+		s.Add("lazy-bitfield", "1")
+	} else {
+		s.Add("lazy-bitfield", "0")
+	}
+
+	if c.LeechOnly {
+		s.Add("leech-only", "1")
+	} else {
+		s.Add("leech-only", "0")
+	}
+
+	if c.FirstLastPieces {
+		s.Add("first-last-pieces", "1")
+	} else {
+		s.Add("first-last-pieces", "0")
+	}
+
+	if c.StopWhenDone {
+		s.Add("stop-when-done", "1")
+	} else {
+		s.Add("stop-when-done", "0")
+	}
+
+	if c.TraceMessages {
+		s.Add("trace-messages", "1")
+	} else {
+		s.Add("trace-messages", "0")
+	}
+
+	if c.RandomBlocks {
+		s.Add("random-blocks", "1")
+	} else {
+		s.Add("random-blocks", "0")
+	}
+
+	if c.BackgroundVerify {
+		s.Add("background-verify", "1")
+	} else {
+		s.Add("background-verify", "0")
+	}
+
+	if c.AllowLANPeers {
+		s.Add("allow-lan-peers", "1")
+	} else {
+		s.Add("allow-lan-peers", "0")
+	}
+
 	s.Add("swarms", fmt.Sprintf("%d", c.Swarms))
 
 	s.Add("tracker-config", c.OpenTrackers.FileName)
 
 	s.Add("max-torrents", fmt.Sprintf("%d", c.TorrentQueueSize))
 
+	s.Add("rate-window", fmt.Sprintf("%d", c.RateWindow))
+
+	s.Add("max-pieces", fmt.Sprintf("%d", c.MaxPieces))
+
+	s.Add("send-queue", fmt.Sprintf("%d", c.SendQueueSize))
+
+	s.Add("send-buffer", fmt.Sprintf("%d", c.SendBufferSize))
+
+	if c.NoDelay {
+		s.Add("tcp-nodelay", "1")
+	} else {
+		s.Add("tcp-nodelay", "0")
+	}
+
+	s.Add("idle-seed", fmt.Sprintf("%d", c.IdleSeed))
+
+	s.Add("peer-idle-timeout", fmt.Sprintf("%d", c.PeerIdleTimeout))
+
+	s.Add("request-timeout", fmt.Sprintf("%d", c.RequestTimeout))
+	s.Add("resume-flush-interval", fmt.Sprintf("%d", c.ResumeFlushInterval))
+
+	s.Add("max-upload-slots", fmt.Sprintf("%d", c.MaxUploadSlots))
+
+	s.Add("piece-memory", fmt.Sprintf("%d", c.PieceMemory))
+
+	s.Add("net-workers", fmt.Sprintf("%d", c.NetWorkers))
+
+	s.Add("download-quota", fmt.Sprintf("%d", c.DownloadQuota))
+
+	s.Add("active-downloads", fmt.Sprintf("%d", c.ActiveDownloads))
+
+	s.Add("large-block-size", fmt.Sprintf("%d", c.LargeBlockSize))
+
+	s.Add("large-block-rate", fmt.Sprintf("%d", c.LargeBlockRate))
+
+	s.Add("peer-id-prefix", c.PeerIDPrefix)
+
+	s.Add("user-agent", c.UserAgent)
+
+	s.Add("external-addr", c.ExternalAddr)
+
+	s.Add("geoip-country", c.GeoIPCountry)
+
+	s.Add("geoip-asn", c.GeoIPASN)
+
+	s.Add("accept-infohashes", c.AcceptInfohashes)
+
 	return c.OpenTrackers.Save()
 }
 
+// parse the infohashes we accept inbound connections for, nil to accept any
+func (c *BittorrentConfig) acceptInfohashes() (accept map[common.Infohash]bool, err error) {
+	for _, str := range strings.Split(c.AcceptInfohashes, ",") {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		var ih common.Infohash
+		ih, err = common.DecodeInfohash(str)
+		if err != nil {
+			err = fmt.Errorf("bad infohash %q in accept-infohashes: %s", str, err)
+			return
+		}
+		if accept == nil {
+			accept = make(map[common.Infohash]bool)
+		}
+		accept[ih] = true
+	}
+	return
+}
+
+// open the configured geoip databases, nil if there are none
+func (c *BittorrentConfig) loadGeoIP() *geoip.Cache {
+	var providers geoip.Providers
+	for _, fname := range []string{c.GeoIPCountry, c.GeoIPASN} {
+		if fname == "" {
+			continue
+		}
+		db, err := geoip.Open(fname)
+		if err != nil {
+			log.Warnf("failed to load geoip database %s: %s", fname, err)
+			continue
+		}
+		providers = append(providers, db)
+	}
+	if len(providers) == 0 {
+		return nil
+	}
+	return geoip.NewCache(providers, geoip.DefaultCacheSize)
+}
+
 const EnvOpenTracker = "XD_OPENTRACKER_URL"
 
 func (cfg *BittorrentConfig) LoadEnv() {
@@ -138,7 +463,62 @@ func (c *BittorrentConfig) CreateSwarm(st storage.Storage, gnutella *gnutella.Sw
 	for name := range c.OpenTrackers.Trackers {
 		sw.AddOpenTracker(c.OpenTrackers.Trackers[name])
 	}
+	sw.UseLSD = c.LSD
+	sw.UseDHT = c.DHT
+	sw.StartPaused = c.StartPaused
+	sw.PeerIDPrefix = c.PeerIDPrefix
+	sw.UserAgent = c.UserAgent
+	sw.ExternalAddr = c.ExternalAddr
+	sw.GeoIP = c.loadGeoIP()
+	accept, err := c.acceptInfohashes()
+	if err != nil {
+		// a broken allowlist accepts nothing rather than everything
+		log.Errorf("not accepting inbound connections: %s", err)
+		accept = make(map[common.Infohash]bool)
+	}
+	sw.AcceptInfohashes = accept
 	sw.Torrents.MaxReq = c.PieceWindowSize
 	sw.Torrents.QueueSize = c.TorrentQueueSize
+	sw.Torrents.RateWindow = time.Duration(c.RateWindow) * time.Second
+	sw.Torrents.NoPeerID = c.NoPeerID
+	sw.Torrents.MaxPieces = c.MaxPieces
+	sw.Torrents.SendQueue = c.SendQueueSize
+	sw.Torrents.SendBuffer = c.SendBufferSize
+	sw.Torrents.NoDelay = c.NoDelay
+	sw.Torrents.LazyBitfield = c.LazyBitfield
+	sw.Torrents.LeechOnly = c.LeechOnly
+	sw.Torrents.FirstLast = c.FirstLastPieces
+	sw.Torrents.LANPeers = c.AllowLANPeers
+	sw.Torrents.StopWhenDone = c.StopWhenDone
+	sw.Torrents.TraceMsgs = c.TraceMessages
+	sw.Torrents.RandBlocks = c.RandomBlocks
+	sw.Torrents.BgVerify = c.BackgroundVerify
+	if c.LargeBlockSize > 0 {
+		sw.Torrents.LargeBlock = uint32(c.LargeBlockSize) * 1024
+	}
+	if c.LargeBlockRate > 0 {
+		sw.Torrents.LargeRate = uint64(c.LargeBlockRate) * 1024
+	}
+	sw.Torrents.IdleSeed = time.Duration(c.IdleSeed) * time.Second
+	sw.Torrents.PeerIdle = time.Duration(c.PeerIdleTimeout) * time.Second
+	sw.Torrents.RequestWait = time.Duration(c.RequestTimeout) * time.Second
+	sw.Torrents.ResumeFlush = time.Duration(c.ResumeFlushInterval) * time.Second
+	sw.Torrents.UploadSlots = c.MaxUploadSlots
+	if c.DownloadQuota > 0 {
+		sw.Torrents.Quota = uint64(c.DownloadQuota) * 1024 * 1024
+	}
+	if c.PieceMemory > 0 || c.MaxPieces > 0 {
+		maxPieces := c.MaxPieces
+		if maxPieces < 0 {
+			maxPieces = 0
+		}
+		sw.Torrents.PieceBudget = swarm.NewPieceBudget(uint64(c.PieceMemory)*1024*1024, maxPieces)
+	}
+	if c.NetWorkers > 0 {
+		sw.Torrents.NetPool = swarm.NewNetPool(c.NetWorkers)
+	}
+	if c.ActiveDownloads > 0 {
+		sw.Torrents.Queue = swarm.NewDownloadQueue(c.ActiveDownloads)
+	}
 	return sw
 }
@@ -11,6 +11,8 @@ type LokiNetConfig struct {
 	DNSAddr  string
 	Port     string
 	Disabled bool
+	// local ip to make outbound connections from, empty for our lokinet address
+	Bind string
 }
 
 func (cfg *LokiNetConfig) Load(section *configparser.Section) error {
@@ -22,6 +24,7 @@ func (cfg *LokiNetConfig) Load(section *configparser.Section) error {
 		cfg.Disabled = section.Get("disabled", "") == "1"
 		cfg.DNSAddr = section.Get("dns", inet.DefaultDNSAddr)
 		cfg.Port = section.Get("port", inet.DefaultPort)
+		cfg.Bind = section.Get("bind", "")
 	}
 	return nil
 }
@@ -32,6 +35,9 @@ func (cfg *LokiNetConfig) Save(s *configparser.Section) error {
 	if cfg.Disabled {
 		opts["disabled"] = "1"
 	}
+	if cfg.Bind != "" {
+		opts["bind"] = cfg.Bind
+	}
 	for k := range opts {
 		s.Add(k, opts[k])
 	}
@@ -41,7 +47,7 @@ func (cfg *LokiNetConfig) Save(s *configparser.Section) error {
 // create a network session from this config
 func (cfg *LokiNetConfig) CreateSession() (*inet.Session, error) {
 	log.Infof("create new session on lokinet")
-	return inet.NewSession(cfg.Port, cfg.DNSAddr)
+	return inet.NewSessionBind(cfg.Port, cfg.DNSAddr, cfg.Bind)
 }
 
 func (cfg *LokiNetConfig) LoadEnv() {
@@ -51,6 +51,10 @@ type StorageConfig struct {
 	Meta string
 	// root directory
 	Root string
+	// put files of multi-file torrents right in the downloads directory
+	NoRootDir bool
+	// directory watched for new .torrent files, downloads if empty
+	Watch string
 	// number of io threads
 	Workers int
 	// number of buffered iops when using pooled io
@@ -71,6 +75,8 @@ func (cfg *StorageConfig) Load(s *configparser.Section) error {
 	if s != nil {
 		cfg.Workers = s.GetInt("workers", 0)
 		cfg.IOPBufferSize = s.GetInt("iop_buffer_size", 256)
+		cfg.NoRootDir = s.Get("multifile_folder", "1") == "0"
+		cfg.Watch = s.Get("watch", "")
 	}
 
 	cfg.setSubpaths(s)
@@ -105,6 +111,12 @@ func (cfg *StorageConfig) Save(s *configparser.Section) error {
 	s.Add("completed", cfg.Completed)
 	s.Add("workers", fmt.Sprintf("%d", cfg.Workers))
 	s.Add("iop_buffer_size", fmt.Sprintf("%d", cfg.IOPBufferSize))
+	s.Add("watch", cfg.Watch)
+	if cfg.NoRootDir {
+		s.Add("multifile_folder", "0")
+	} else {
+		s.Add("multifile_folder", "1")
+	}
 	return nil
 }
 
@@ -122,9 +134,11 @@ func (cfg *StorageConfig) CreateStorage() storage.Storage {
 		SeedingDir:    cfg.Completed,
 		DataDir:       cfg.Downloads,
 		MetaDir:       cfg.Meta,
+		NoRootDir:     cfg.NoRootDir,
 		FS:            fs.STD,
 		IOPBufferSize: cfg.IOPBufferSize,
 		Workers:       cfg.Workers,
+		WatchDir:      cfg.Watch,
 	}
 	if cfg.SFTP.Enabled {
 		st.FS = cfg.SFTP.ToFS()
@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"net"
+	"strconv"
+)
+
+// get the ip and port of an address, nil ip if it is not on ip
+func splitAddr(a net.Addr) (ip net.IP, port int) {
+	host, p, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return
+	}
+	port, err = strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, 0
+	}
+	ip = net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return
+}
+
+// compact form of an address, 4 or 16 bytes of ip and 2 of port
+func compactAddr(ip net.IP, port int) string {
+	return string(append(append([]byte{}, ip...), byte(port>>8), byte(port)))
+}
+
+// parse a compact address, nil if it is not 6 or 18 bytes
+func parseCompactAddr(s string) *net.UDPAddr {
+	if len(s) != 6 && len(s) != 18 {
+		return nil
+	}
+	ip := make(net.IP, len(s)-2)
+	copy(ip, s)
+	return &net.UDPAddr{
+		IP:   ip,
+		Port: int(s[len(s)-2])<<8 | int(s[len(s)-1]),
+	}
+}
+
+// compact node info of every node on one ip family
+func compactNodes(nodes []remote, v6 bool) string {
+	var buf []byte
+	for _, n := range nodes {
+		ip, port := splitAddr(n.addr)
+		if ip == nil || (len(ip) == net.IPv6len) != v6 {
+			continue
+		}
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, compactAddr(ip, port)...)
+	}
+	return string(buf)
+}
+
+// parse compact node info, size is the length of one entry
+func parseNodes(s string, size int) (nodes []remote) {
+	for len(s) >= size {
+		var r remote
+		copy(r.id[:], s)
+		if a := parseCompactAddr(s[len(r.id):size]); a != nil && a.Port > 0 {
+			r.addr = a
+			nodes = append(nodes, r)
+		}
+		s = s[size:]
+	}
+	return
+}
@@ -0,0 +1,551 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
+	"github.com/zeebo/bencode"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultRouters are well known nodes we bootstrap from
+var DefaultRouters = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+// DefaultQueryTimeout is how long we wait for a node to answer a query
+const DefaultQueryTimeout = time.Second * 5
+
+// Alpha is how many nodes a lookup asks at once
+const Alpha = 3
+
+// TokenLifetime is how often the secret announce tokens are made from changes, tokens stay good for one change
+const TokenLifetime = time.Minute * 5
+
+// PeerLifetime is how long we remember a peer that announced to us
+const PeerLifetime = time.Minute * 30
+
+// MaxPeersPerInfohash is how many peers we remember for one infohash
+const MaxPeersPerInfohash = 100
+
+// MaxInfohashes is how many infohashes we remember peers for
+const MaxInfohashes = 1000
+
+// ErrNoNodes is returned when no node could be reached
+var ErrNoNodes = errors.New("no dht nodes reachable")
+
+// ErrTimeout is returned when a node does not answer a query in time
+var ErrTimeout = errors.New("dht query timed out")
+
+// ErrBadMessage is returned when a node answers with something we can't use
+var ErrBadMessage = errors.New("bad dht message")
+
+// ErrClosed is returned for queries after the dht is closed
+var ErrClosed = errors.New("dht closed")
+
+// Transport sends and receives the datagrams of the dht, network.Network is one
+type Transport interface {
+	ReadFrom([]byte) (int, net.Addr, error)
+	WriteTo([]byte, net.Addr) (int, error)
+	Lookup(name, port string) (net.Addr, error)
+}
+
+// Announcer is what torrents use the dht for
+type Announcer interface {
+	// AnnouncePeer tells the nodes closest to ih that we have it and take peers on port
+	AnnouncePeer(ih common.Infohash, port int) error
+	// AddNode asks the node at host:port to join our routing table
+	AddNode(hostport string)
+}
+
+// a peer that announced an infohash to us
+type storedPeer struct {
+	addr string
+	at   time.Time
+}
+
+// DHT is a node on the mainline dht
+type DHT struct {
+	id      ID
+	tr      Transport
+	mtx     sync.Mutex
+	table   table
+	pending map[string]chan *Message
+	tid     uint16
+	peers   map[common.Infohash][]storedPeer
+	// announce tokens are made from secret, tokens made from oldSecret are still good
+	secret    []byte
+	oldSecret []byte
+	rotated   time.Time
+	closed    bool
+	// nodes we bootstrap from as host:port
+	Routers []string
+	// how long we wait for a node to answer, DefaultQueryTimeout if zero
+	QueryTimeout time.Duration
+}
+
+// New makes a dht node with a random id that talks over tr
+func New(tr Transport) *DHT {
+	d := &DHT{
+		tr:      tr,
+		pending: make(map[string]chan *Message),
+		peers:   make(map[common.Infohash][]storedPeer),
+		Routers: DefaultRouters,
+	}
+	rand.Read(d.id[:])
+	d.table.self = d.id
+	d.secret = newSecret()
+	d.oldSecret = d.secret
+	d.rotated = time.Now()
+	return d
+}
+
+func newSecret() []byte {
+	s := make([]byte, 8)
+	rand.Read(s)
+	return s
+}
+
+func (d *DHT) isClosed() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.closed
+}
+
+// Close stops answering and querying, the transport is left open
+func (d *DHT) Close() error {
+	d.mtx.Lock()
+	d.closed = true
+	d.mtx.Unlock()
+	return nil
+}
+
+// Run reads datagrams until closed
+func (d *DHT) Run() {
+	var buff [2048]byte
+	for !d.isClosed() {
+		n, from, err := d.tr.ReadFrom(buff[:])
+		if err != nil {
+			if !d.isClosed() {
+				log.Debugf("dht read failed: %s", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		d.Handle(buff[:n], from)
+	}
+}
+
+// Handle handles one datagram sent to us from a
+func (d *DHT) Handle(data []byte, from net.Addr) {
+	msg := new(Message)
+	err := bencode.DecodeBytes(data, msg)
+	if err != nil || from == nil {
+		log.Debugf("bad dht message from %s", from)
+		return
+	}
+	switch msg.Reply {
+	case kQuery:
+		d.handleQuery(msg, from)
+	case kResponse, kError:
+		d.mtx.Lock()
+		ch, ok := d.pending[msg.TID]
+		delete(d.pending, msg.TID)
+		d.mtx.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+func (d *DHT) send(msg *Message, to net.Addr) (err error) {
+	var data []byte
+	data, err = bencode.EncodeBytes(msg)
+	if err == nil {
+		_, err = d.tr.WriteTo(data, to)
+	}
+	return
+}
+
+func (d *DHT) queryTimeout() time.Duration {
+	if d.QueryTimeout > 0 {
+		return d.QueryTimeout
+	}
+	return DefaultQueryTimeout
+}
+
+// send a query to the node at a and wait for its answer, nodes that answer go in the routing table
+func (d *DHT) query(a net.Addr, method string, args map[string]interface{}) (resp map[string]interface{}, err error) {
+	args[vID] = string(d.id[:])
+	ch := make(chan *Message, 1)
+	d.mtx.Lock()
+	if d.closed {
+		d.mtx.Unlock()
+		err = ErrClosed
+		return
+	}
+	d.tid++
+	tid := string([]byte{byte(d.tid >> 8), byte(d.tid)})
+	d.pending[tid] = ch
+	d.mtx.Unlock()
+	err = d.send(NewQuery(tid, method, args), a)
+	if err == nil {
+		timer := time.NewTimer(d.queryTimeout())
+		select {
+		case msg := <-ch:
+			if msg.IsError() {
+				err = ErrBadMessage
+				if msg.Err != nil {
+					err = msg.Err
+				}
+			}
+			resp = msg.Resp
+		case <-timer.C:
+			err = ErrTimeout
+		}
+		timer.Stop()
+	}
+	d.mtx.Lock()
+	delete(d.pending, tid)
+	d.mtx.Unlock()
+	if err == nil {
+		id, ok := getID(resp, vID)
+		if ok {
+			d.addNode(id, a)
+		} else {
+			err = ErrBadMessage
+		}
+	}
+	return
+}
+
+func (d *DHT) addNode(id ID, a net.Addr) {
+	d.mtx.Lock()
+	d.table.add(id, a, time.Now())
+	d.mtx.Unlock()
+}
+
+func (d *DHT) closest(target ID, n int) []remote {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.table.closest(target, n)
+}
+
+// how many nodes are in our routing table
+func (d *DHT) size() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.table.size()
+}
+
+// answer a query from a node
+func (d *DHT) handleQuery(msg *Message, from net.Addr) {
+	resp, e := d.answer(msg, from)
+	if e != nil {
+		log.Debugf("dht %s query from %s failed: %s", msg.Query, from, e.Message)
+		d.send(NewError(msg.TID, int(e.Code), e.Message), from)
+		return
+	}
+	d.send(NewResponse(msg.TID, resp), from)
+}
+
+func (d *DHT) answer(msg *Message, from net.Addr) (resp map[string]interface{}, e *Error) {
+	if d.isClosed() {
+		return nil, &Error{Code: ErrCodeServer, Message: "closing"}
+	}
+	id, ok := getID(msg.Args, vID)
+	if !ok {
+		return nil, &Error{Code: ErrCodeProtocol, Message: "bad id"}
+	}
+	resp = map[string]interface{}{
+		vID: string(d.id[:]),
+	}
+	switch msg.Query {
+	case mPing:
+	case mFindNode:
+		target, ok := getID(msg.Args, vTarget)
+		if !ok {
+			return nil, &Error{Code: ErrCodeProtocol, Message: "bad target"}
+		}
+		d.putNodes(resp, target)
+	case mGetPeers:
+		ih, ok := getID(msg.Args, vInfohash)
+		if !ok {
+			return nil, &Error{Code: ErrCodeProtocol, Message: "bad info_hash"}
+		}
+		resp[vToken] = d.token(from, false)
+		if values := d.peersFor(common.Infohash(ih)); len(values) > 0 {
+			resp[vValues] = values
+		} else {
+			d.putNodes(resp, ih)
+		}
+	case mAnnouncePeer:
+		ih, ok := getID(msg.Args, vInfohash)
+		if !ok {
+			return nil, &Error{Code: ErrCodeProtocol, Message: "bad info_hash"}
+		}
+		token := getString(msg.Args, vToken)
+		if token == "" || (token != d.token(from, false) && token != d.token(from, true)) {
+			return nil, &Error{Code: ErrCodeProtocol, Message: "bad token"}
+		}
+		ip, port := splitAddr(from)
+		if implied, _ := getInt(msg.Args, vImpliedPort); implied == 0 {
+			p, _ := getInt(msg.Args, vPort)
+			port = int(p)
+		}
+		if ip == nil || port <= 0 || port > 65535 {
+			return nil, &Error{Code: ErrCodeProtocol, Message: "bad port"}
+		}
+		d.storePeer(common.Infohash(ih), compactAddr(ip, port))
+	default:
+		return nil, &Error{Code: ErrCodeMethod, Message: "method unknown"}
+	}
+	d.addNode(id, from)
+	return
+}
+
+// put the nodes closest to target we know in a response
+func (d *DHT) putNodes(resp map[string]interface{}, target ID) {
+	nodes := d.closest(target, K)
+	resp[vNodes] = compactNodes(nodes, false)
+	if v6 := compactNodes(nodes, true); v6 != "" {
+		resp[vNodes6] = v6
+	}
+}
+
+// make the token a node at a announces with, from our old secret if old is set
+func (d *DHT) token(a net.Addr, old bool) string {
+	ip, _ := splitAddr(a)
+	now := time.Now()
+	d.mtx.Lock()
+	if now.Sub(d.rotated) >= TokenLifetime {
+		d.oldSecret = d.secret
+		d.secret = newSecret()
+		d.rotated = now
+	}
+	secret := d.secret
+	if old {
+		secret = d.oldSecret
+	}
+	d.mtx.Unlock()
+	h := sha1.Sum(append(append([]byte{}, secret...), ip...))
+	return string(h[:8])
+}
+
+// remember a peer that announced ih, the oldest goes when we have too many
+func (d *DHT) storePeer(ih common.Infohash, addr string) {
+	now := time.Now()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	old, has := d.peers[ih]
+	if !has && len(d.peers) >= MaxInfohashes {
+		return
+	}
+	peers := []storedPeer{}
+	for _, p := range old {
+		if p.addr != addr && now.Sub(p.at) < PeerLifetime {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) >= MaxPeersPerInfohash {
+		peers = peers[1:]
+	}
+	d.peers[ih] = append(peers, storedPeer{addr: addr, at: now})
+}
+
+// get the compact addresses of peers that announced ih to us
+func (d *DHT) peersFor(ih common.Infohash) (values []string) {
+	now := time.Now()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, p := range d.peers[ih] {
+		if now.Sub(p.at) < PeerLifetime {
+			values = append(values, p.addr)
+		}
+	}
+	return
+}
+
+// resolve host:port to the address we send datagrams to
+func (d *DHT) resolve(hostport string) (a net.Addr, err error) {
+	var host, port string
+	host, port, err = net.SplitHostPort(hostport)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		var p int
+		p, err = strconv.Atoi(port)
+		if err == nil {
+			a = &net.UDPAddr{IP: ip, Port: p}
+		}
+		return
+	}
+	a, err = d.tr.Lookup(host, port)
+	if t, ok := a.(*net.TCPAddr); ok {
+		// names resolve to stream addresses, we want the same host and port over datagrams
+		a = &net.UDPAddr{IP: t.IP, Port: t.Port, Zone: t.Zone}
+	}
+	return
+}
+
+// ping a node so it goes in our routing table if it answers
+func (d *DHT) ping(hostport string) (err error) {
+	var a net.Addr
+	a, err = d.resolve(hostport)
+	if err == nil {
+		_, err = d.query(a, mPing, map[string]interface{}{})
+	}
+	return
+}
+
+// AddNode implements Announcer
+func (d *DHT) AddNode(hostport string) {
+	go func() {
+		err := d.ping(hostport)
+		if err != nil {
+			log.Debugf("dht node %s not added: %s", hostport, err)
+		}
+	}()
+}
+
+// Bootstrap fills the routing table with the nodes closest to us, starting from Routers
+func (d *DHT) Bootstrap() {
+	var wg sync.WaitGroup
+	for _, hostport := range d.Routers {
+		wg.Add(1)
+		go func(hostport string) {
+			defer wg.Done()
+			a, err := d.resolve(hostport)
+			if err == nil {
+				_, err = d.query(a, mFindNode, map[string]interface{}{vTarget: string(d.id[:])})
+			}
+			if err != nil {
+				log.Debugf("dht router %s did not answer: %s", hostport, err)
+			}
+		}(hostport)
+	}
+	wg.Wait()
+	d.lookup(d.id, mFindNode, map[string]interface{}{vTarget: string(d.id[:])})
+	log.Debugf("dht bootstrapped with %d nodes", d.size())
+}
+
+// a node that answered a lookup
+type answer struct {
+	remote
+	token string
+}
+
+// ask the nodes closest to target for closer ones until we asked the K closest we heard of
+// returns the nodes that answered, closest first
+func (d *DHT) lookup(target ID, method string, args map[string]interface{}) (answered []answer) {
+	candidates := d.closest(target, K)
+	known := make(map[string]bool)
+	asked := make(map[string]bool)
+	for _, c := range candidates {
+		known[c.addr.String()] = true
+	}
+	var mtx sync.Mutex
+	for {
+		sortRemotes(target, candidates)
+		var batch []remote
+		for idx := 0; idx < len(candidates) && idx < K && len(batch) < Alpha; idx++ {
+			c := candidates[idx]
+			if !asked[c.addr.String()] {
+				asked[c.addr.String()] = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		failed := make(map[string]bool)
+		var wg sync.WaitGroup
+		for _, r := range batch {
+			a := make(map[string]interface{})
+			for k, v := range args {
+				a[k] = v
+			}
+			wg.Add(1)
+			go func(r remote, a map[string]interface{}) {
+				defer wg.Done()
+				resp, err := d.query(r.addr, method, a)
+				mtx.Lock()
+				defer mtx.Unlock()
+				if err != nil {
+					failed[r.addr.String()] = true
+					return
+				}
+				answered = append(answered, answer{remote: r, token: getString(resp, vToken)})
+				found := append(parseNodes(getString(resp, vNodes), 26), parseNodes(getString(resp, vNodes6), 38)...)
+				for _, n := range found {
+					if n.id != d.id && !known[n.addr.String()] {
+						known[n.addr.String()] = true
+						candidates = append(candidates, n)
+					}
+				}
+			}(r, a)
+		}
+		wg.Wait()
+		left := candidates[:0]
+		for _, c := range candidates {
+			if !failed[c.addr.String()] {
+				left = append(left, c)
+			}
+		}
+		candidates = left
+	}
+	sort.SliceStable(answered, func(i, j int) bool {
+		return closer(target, answered[i].id, answered[j].id)
+	})
+	if len(answered) > K {
+		answered = answered[:K]
+	}
+	return
+}
+
+// AnnouncePeer implements Announcer
+func (d *DHT) AnnouncePeer(ih common.Infohash, port int) error {
+	if d.size() == 0 {
+		d.Bootstrap()
+	}
+	nodes := d.lookup(ID(ih), mGetPeers, map[string]interface{}{vInfohash: string(ih[:])})
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	announced := 0
+	for _, n := range nodes {
+		if n.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(n answer) {
+			defer wg.Done()
+			_, err := d.query(n.addr, mAnnouncePeer, map[string]interface{}{
+				vInfohash: string(ih[:]),
+				vPort:     int64(port),
+				vToken:    n.token,
+			})
+			if err != nil {
+				log.Debugf("dht node %s did not take our announce: %s", n.addr, err)
+				return
+			}
+			mtx.Lock()
+			announced++
+			mtx.Unlock()
+		}(n)
+	}
+	wg.Wait()
+	if announced == 0 {
+		return ErrNoNodes
+	}
+	log.Debugf("announced %s to %d dht nodes", ih.Hex(), announced)
+	return nil
+}
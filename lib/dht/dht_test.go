@@ -0,0 +1,191 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/sync"
+	"net"
+	"testing"
+	"time"
+)
+
+var errTestClosed = errors.New("test transport closed")
+
+type testPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// datagrams between test transports in memory
+type testNet struct {
+	mtx   sync.Mutex
+	nodes map[string]*testTransport
+}
+
+type testTransport struct {
+	n      *testNet
+	addr   *net.UDPAddr
+	in     chan testPacket
+	closed chan bool
+}
+
+func (n *testNet) transport(addr string) *testTransport {
+	a, _ := net.ResolveUDPAddr("udp", addr)
+	t := &testTransport{
+		n:      n,
+		addr:   a,
+		in:     make(chan testPacket, 64),
+		closed: make(chan bool),
+	}
+	n.mtx.Lock()
+	if n.nodes == nil {
+		n.nodes = make(map[string]*testTransport)
+	}
+	n.nodes[a.String()] = t
+	n.mtx.Unlock()
+	return t
+}
+
+func (t *testTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-t.in:
+		return copy(b, p.data), p.from, nil
+	case <-t.closed:
+		return 0, nil, errTestClosed
+	}
+}
+
+func (t *testTransport) WriteTo(b []byte, to net.Addr) (int, error) {
+	t.n.mtx.Lock()
+	other := t.n.nodes[to.String()]
+	t.n.mtx.Unlock()
+	if other != nil {
+		select {
+		case other.in <- testPacket{data: append([]byte{}, b...), from: t.addr}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (t *testTransport) Lookup(name, port string) (net.Addr, error) {
+	return net.ResolveTCPAddr("tcp", net.JoinHostPort(name, port))
+}
+
+// start count dht nodes on n at 10.0.0.1:6881 and on, each bootstraps from the first one
+func startTestDHTs(n *testNet, count int) ([]*DHT, func()) {
+	var ds []*DHT
+	var trs []*testTransport
+	for idx := 0; idx < count; idx++ {
+		tr := n.transport(fmt.Sprintf("10.0.0.%d:6881", idx+1))
+		d := New(tr)
+		d.Routers = []string{"10.0.0.1:6881"}
+		d.QueryTimeout = time.Second
+		go d.Run()
+		ds = append(ds, d)
+		trs = append(trs, tr)
+	}
+	for _, d := range ds[1:] {
+		d.Bootstrap()
+	}
+	return ds, func() {
+		for idx := range ds {
+			ds[idx].Close()
+			close(trs[idx].closed)
+		}
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	d := New(new(testNet).transport("10.0.0.1:6881"))
+	d.Handle([]byte("garbage"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881})
+	resp, e := d.answer(NewQuery("aa", "vote", map[string]interface{}{vID: string(make([]byte, 20))}), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881})
+	if resp != nil || e == nil || e.Code != ErrCodeMethod {
+		t.Errorf("unknown method gave %v %v", resp, e)
+	}
+}
+
+func TestAnnouncePeer(t *testing.T) {
+	ds, done := startTestDHTs(new(testNet), 12)
+	defer done()
+	var ih common.Infohash
+	ih[0] = 0xaa
+	if err := ds[5].AnnouncePeer(ih, 7000); err != nil {
+		t.Fatal(err)
+	}
+	expected := compactAddr(net.IPv4(10, 0, 0, 6).To4(), 7000)
+	stored := 0
+	for _, d := range ds {
+		for _, v := range d.peersFor(ih) {
+			if v != expected {
+				t.Errorf("stored %q, expected %q", v, expected)
+			}
+			stored++
+		}
+	}
+	if stored == 0 {
+		t.Error("no node stored our announce")
+	}
+}
+
+func TestAnnounceNeedsToken(t *testing.T) {
+	d := New(new(testNet).transport("10.0.0.1:6881"))
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	var ih common.Infohash
+	args := map[string]interface{}{
+		vID:       string(make([]byte, 20)),
+		vInfohash: string(ih[:]),
+		vPort:     int64(7000),
+		vToken:    "nope",
+	}
+	if _, e := d.answer(NewQuery("aa", mAnnouncePeer, args), from); e == nil || e.Code != ErrCodeProtocol {
+		t.Errorf("announce with a bad token gave %v", e)
+	}
+	args[vToken] = d.token(from, false)
+	if _, e := d.answer(NewQuery("ab", mAnnouncePeer, args), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 6881}); e == nil {
+		t.Error("announce with a token for another address was taken")
+	}
+	if _, e := d.answer(NewQuery("ac", mAnnouncePeer, args), from); e != nil {
+		t.Fatal(e)
+	}
+	if values := d.peersFor(ih); len(values) != 1 || values[0] != compactAddr(from.IP.To4(), 7000) {
+		t.Errorf("stored %q", values)
+	}
+}
+
+func TestAnnounceWithoutNodes(t *testing.T) {
+	tr := new(testNet).transport("10.0.0.1:6881")
+	d := New(tr)
+	d.Routers = []string{"10.0.0.9:6881"}
+	d.QueryTimeout = time.Millisecond * 10
+	go d.Run()
+	defer close(tr.closed)
+	defer d.Close()
+	if err := d.AnnouncePeer(common.Infohash{}, 7000); err != ErrNoNodes {
+		t.Errorf("announce with no nodes gave %v", err)
+	}
+}
+
+func TestAddNode(t *testing.T) {
+	n := new(testNet)
+	ds, done := startTestDHTs(n, 2)
+	defer done()
+	tr := n.transport("10.0.0.9:6881")
+	d := New(tr)
+	go d.Run()
+	defer close(tr.closed)
+	defer d.Close()
+	d.AddNode("10.0.0.2:6881")
+	d.AddNode("not a node")
+	deadline := time.Now().Add(time.Second * 5)
+	for d.size() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("node was never added to the routing table")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if nodes := d.closest(ds[1].id, K); len(nodes) != 1 || nodes[0].id != ds[1].id {
+		t.Errorf("routing table has %v", nodes)
+	}
+}
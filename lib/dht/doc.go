@@ -1 +1,2 @@
+// Package dht finds peers without trackers on the mainline dht (BEP 5)
 package dht
@@ -10,6 +10,10 @@ type Error struct {
 	Message string
 }
 
+func (e *Error) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
 func (e *Error) MarshalBencode() ([]byte, error) {
 	return bencode.EncodeBytes([]interface{}{
 		e.Code,
@@ -1,5 +1,6 @@
 package dht
 
+const mPing = "ping"
 const mFindNode = "find_node"
 const mGetPeers = "get_peers"
 const mAnnouncePeer = "announce_peer"
@@ -11,13 +12,20 @@ const kError = "e"
 const vID = "id"
 const vTarget = "target"
 const vNodes = "nodes"
+const vNodes6 = "nodes6"
+const vInfohash = "info_hash"
+const vPort = "port"
+const vImpliedPort = "implied_port"
+const vToken = "token"
+const vValues = "values"
 
 type Message struct {
-	Query string                 `bencode:"q",omitempty`
+	Query string                 `bencode:"q,omitempty"`
 	TID   string                 `bencode:"t"`
 	Reply string                 `bencode:"y"`
-	Err   *Error                 `bencode:"e",omitempty`
-	Args  map[string]interface{} `bencode:"a",omitempty`
+	Err   *Error                 `bencode:"e,omitempty"`
+	Args  map[string]interface{} `bencode:"a,omitempty"`
+	Resp  map[string]interface{} `bencode:"r,omitempty"`
 }
 
 func (m *Message) IsError() bool {
@@ -36,14 +44,50 @@ func NewError(txid string, code int, errMsg string) *Message {
 	}
 }
 
-func NewFindNodeRequest(txid, id, target string) *Message {
+// NewQuery generates a new query message calling method with args
+func NewQuery(txid, method string, args map[string]interface{}) *Message {
 	return &Message{
 		TID:   txid,
 		Reply: kQuery,
-		Query: mFindNode,
-		Args: map[string]interface{}{
-			vID:     id,
-			vTarget: target,
-		},
+		Query: method,
+		Args:  args,
 	}
 }
+
+// NewResponse generates a new reply message to the query with txid
+func NewResponse(txid string, vals map[string]interface{}) *Message {
+	return &Message{
+		TID:   txid,
+		Reply: kResponse,
+		Resp:  vals,
+	}
+}
+
+func NewFindNodeRequest(txid, id, target string) *Message {
+	return NewQuery(txid, mFindNode, map[string]interface{}{
+		vID:     id,
+		vTarget: target,
+	})
+}
+
+// get a string from query arguments or a response, empty if it is not there
+func getString(vals map[string]interface{}, k string) string {
+	s, _ := vals[k].(string)
+	return s
+}
+
+// get a node id or infohash from query arguments or a response
+func getID(vals map[string]interface{}, k string) (id ID, ok bool) {
+	s := getString(vals, k)
+	if len(s) == len(id) {
+		copy(id[:], s)
+		ok = true
+	}
+	return
+}
+
+// get an integer from query arguments or a response
+func getInt(vals map[string]interface{}, k string) (i int64, ok bool) {
+	i, ok = vals[k].(int64)
+	return
+}
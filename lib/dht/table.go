@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// K is how many nodes we keep in each bucket and announce to
+const K = 8
+
+// NodeStaleAfter is how long a node in a full bucket can go quiet before a new node takes its place
+const NodeStaleAfter = time.Minute * 15
+
+// ID identifies a node, infohashes live in the same space
+type ID [20]byte
+
+// how many leading bits a and b have in common
+func commonBits(a, b ID) int {
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			continue
+		}
+		n := i * 8
+		for x&0x80 == 0 {
+			x <<= 1
+			n++
+		}
+		return n
+	}
+	return len(a) * 8
+}
+
+// is a closer to target than b
+func closer(target, a, b ID) bool {
+	for i := range target {
+		da := a[i] ^ target[i]
+		db := b[i] ^ target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// a node we know about
+type remote struct {
+	id   ID
+	addr net.Addr
+	seen time.Time
+}
+
+// sort nodes so the closest to target comes first
+func sortRemotes(target ID, nodes []remote) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].id, nodes[j].id)
+	})
+}
+
+// the routing table, nodes are put in a bucket by how many leading bits they share with us
+type table struct {
+	self    ID
+	buckets [160][]*remote
+}
+
+// remember a node that talked to us
+func (t *table) add(id ID, a net.Addr, now time.Time) {
+	if id == t.self {
+		return
+	}
+	idx := commonBits(t.self, id)
+	b := t.buckets[idx]
+	for i, r := range b {
+		if r.id == id {
+			r.addr = a
+			r.seen = now
+			// most recently seen last
+			copy(b[i:], b[i+1:])
+			b[len(b)-1] = r
+			return
+		}
+	}
+	r := &remote{id: id, addr: a, seen: now}
+	if len(b) < K {
+		t.buckets[idx] = append(b, r)
+	} else if now.Sub(b[0].seen) >= NodeStaleAfter {
+		copy(b, b[1:])
+		b[len(b)-1] = r
+	}
+}
+
+// get the n nodes closest to target
+func (t *table) closest(target ID, n int) (nodes []remote) {
+	for _, b := range t.buckets {
+		for _, r := range b {
+			nodes = append(nodes, *r)
+		}
+	}
+	sortRemotes(target, nodes)
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return
+}
+
+// how many nodes we know
+func (t *table) size() (n int) {
+	for _, b := range t.buckets {
+		n += len(b)
+	}
+	return
+}
@@ -0,0 +1,2 @@
+// Package geoip looks up where peers are from
+package geoip
@@ -0,0 +1,111 @@
+package geoip
+
+import (
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
+	"net"
+)
+
+// DefaultCacheSize is how many addresses we remember lookups for
+const DefaultCacheSize = 4096
+
+// Info is what we know about where an address is
+type Info struct {
+	// iso country code
+	Country string
+	// autonomous system number
+	ASN uint32
+	// who owns the autonomous system
+	Org string
+}
+
+// Provider looks up where addresses are
+type Provider interface {
+	Lookup(ip net.IP) (Info, error)
+}
+
+// Providers looks up an address in all providers, the first one to know something wins
+// a provider that fails is skipped, the lookup only fails if all of them do
+type Providers []Provider
+
+// Lookup implements Provider
+func (ps Providers) Lookup(ip net.IP) (info Info, err error) {
+	found := false
+	for _, p := range ps {
+		i, e := p.Lookup(ip)
+		if e != nil {
+			log.Debugf("geoip provider failed to look up %s: %s", ip, e)
+			err = e
+			continue
+		}
+		found = true
+		if info.Country == "" {
+			info.Country = i.Country
+		}
+		if info.ASN == 0 {
+			info.ASN = i.ASN
+			info.Org = i.Org
+		}
+	}
+	if found {
+		err = nil
+	}
+	return
+}
+
+type cacheEntry struct {
+	info Info
+	done bool
+}
+
+// Cache remembers lookups from a Provider
+// lookups happen in the background so getting from the cache never blocks on the provider
+type Cache struct {
+	p       Provider
+	max     int
+	mtx     sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// NewCache makes a Cache for p that remembers at most max addresses
+func NewCache(p Provider, max int) *Cache {
+	if max <= 0 {
+		max = DefaultCacheSize
+	}
+	return &Cache{
+		p:       p,
+		max:     max,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// Get gets what we know about ip, ok is false if we don't know yet
+// if we never looked up ip before a lookup is started
+func (c *Cache) Get(ip net.IP) (info Info, ok bool) {
+	k := ip.String()
+	c.mtx.Lock()
+	e, has := c.entries[k]
+	if !has {
+		if len(c.entries) >= c.max {
+			// start over instead of tracking what is oldest
+			c.entries = make(map[string]*cacheEntry)
+		}
+		e = new(cacheEntry)
+		c.entries[k] = e
+		go c.lookup(ip, e)
+	}
+	info, ok = e.info, e.done
+	c.mtx.Unlock()
+	return
+}
+
+func (c *Cache) lookup(ip net.IP, e *cacheEntry) {
+	info, err := c.p.Lookup(ip)
+	if err != nil {
+		log.Debugf("geoip lookup of %s failed: %s", ip, err)
+	}
+	c.mtx.Lock()
+	e.info = info
+	e.done = true
+	c.mtx.Unlock()
+}
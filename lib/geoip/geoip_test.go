@@ -0,0 +1,161 @@
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type stubProvider struct {
+	lookups int
+	block   chan bool
+}
+
+func (p *stubProvider) Lookup(ip net.IP) (Info, error) {
+	if p.block != nil {
+		<-p.block
+	}
+	p.lookups++
+	return Info{Country: "NL", ASN: 1234}, nil
+}
+
+// wait for a lookup to be done
+func waitForInfo(t *testing.T, c *Cache, ip net.IP) Info {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		info, ok := c.Get(ip)
+		if ok {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lookup of %s never finished", ip)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestCacheDoesNotBlock(t *testing.T) {
+	p := &stubProvider{block: make(chan bool)}
+	c := NewCache(p, 0)
+	ip := net.IPv4(10, 0, 0, 1)
+	if _, ok := c.Get(ip); ok {
+		t.Error("info for an address before looking it up")
+	}
+	close(p.block)
+	if info := waitForInfo(t, c, ip); info.Country != "NL" || info.ASN != 1234 {
+		t.Errorf("got %v", info)
+	}
+	c.Get(ip)
+	if p.lookups != 1 {
+		t.Errorf("%d lookups for the one address", p.lookups)
+	}
+}
+
+type failingProvider struct{}
+
+func (failingProvider) Lookup(ip net.IP) (Info, error) {
+	return Info{}, errors.New("provider down")
+}
+
+func TestProvidersSkipFailing(t *testing.T) {
+	ps := Providers{failingProvider{}, &stubProvider{}}
+	info, err := ps.Lookup(net.IPv4(10, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Country != "NL" || info.ASN != 1234 {
+		t.Errorf("got %v", info)
+	}
+	if _, err = (Providers{failingProvider{}}).Lookup(net.IPv4(10, 0, 0, 1)); err == nil {
+		t.Error("no error when every provider failed")
+	}
+}
+
+// write a control byte for a value of some type and size, sizes up to 284
+func encodeControl(buf *bytes.Buffer, typ byte, size int) {
+	if size < 29 {
+		buf.WriteByte(typ<<5 | byte(size))
+	} else {
+		buf.WriteByte(typ<<5 | 29)
+		buf.WriteByte(byte(size - 29))
+	}
+}
+
+// encode values in the maxmind db data format for tests
+func encodeValue(buf *bytes.Buffer, v interface{}) {
+	switch val := v.(type) {
+	case string:
+		encodeControl(buf, 2, len(val))
+		buf.WriteString(val)
+	case uint16:
+		buf.WriteByte(5<<5 | 2)
+		buf.Write([]byte{byte(val >> 8), byte(val)})
+	case uint32:
+		buf.WriteByte(6<<5 | 4)
+		buf.Write([]byte{byte(val >> 24), byte(val >> 16), byte(val >> 8), byte(val)})
+	case map[string]interface{}:
+		encodeControl(buf, 7, len(val))
+		for k, e := range val {
+			encodeValue(buf, k)
+			encodeValue(buf, e)
+		}
+	}
+}
+
+// a database with one ipv4 node, 0.0.0.0/1 has data and 128.0.0.0/1 has none
+func testDB() []byte {
+	var buf bytes.Buffer
+	// left record points at offset 0 in the data section
+	left := uint32(1 + 16)
+	right := uint32(1)
+	buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+	buf.Write(make([]byte, 16))
+	encodeValue(&buf, map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": "NL",
+		},
+		"autonomous_system_number":       uint32(1234),
+		"autonomous_system_organization": "Test Org",
+	})
+	buf.Write(metadataMarker)
+	encodeValue(&buf, map[string]interface{}{
+		"node_count":  uint32(1),
+		"record_size": uint16(24),
+		"ip_version":  uint16(4),
+	})
+	return buf.Bytes()
+}
+
+func TestDBLookup(t *testing.T) {
+	db, err := Load(testDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.Lookup(net.IPv4(10, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Country != "NL" || info.ASN != 1234 || info.Org != "Test Org" {
+		t.Errorf("got %v", info)
+	}
+	info, err = db.Lookup(net.IPv4(192, 168, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != (Info{}) {
+		t.Errorf("got %v for an address not in the db", info)
+	}
+	if _, err = Load([]byte("not a db")); err != ErrBadDB {
+		t.Errorf("loading garbage gave %v", err)
+	}
+}
+
+func TestDecodePointerToPointer(t *testing.T) {
+	// a pointer at offset 0 pointing at itself
+	d := &decoder{buf: []byte{1 << 5, 0}}
+	if _, _, err := d.decode(0); err != ErrBadDB {
+		t.Errorf("decoding a pointer loop gave %v", err)
+	}
+}
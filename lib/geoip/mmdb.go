@@ -0,0 +1,315 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// ErrBadDB is returned when a database file is not a MaxMind DB we can read
+var ErrBadDB = errors.New("invalid maxmind database")
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// how far from the end of the file the metadata can start
+const maxMetadataSize = 128 * 1024
+
+// DB is a MaxMind DB file loaded in memory, it has country or asn data or both
+type DB struct {
+	data       []byte
+	tree       []byte
+	nodeCount  uint32
+	recordSize uint32
+	ipVersion  uint32
+	// node we start at for ipv4 addresses
+	ipv4Start uint32
+}
+
+// Open loads a MaxMind DB file
+func Open(fname string) (db *DB, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err == nil {
+		db, err = Load(data)
+	}
+	return
+}
+
+// Load reads a MaxMind DB from its raw bytes
+func Load(data []byte) (db *DB, err error) {
+	start := 0
+	if len(data) > maxMetadataSize {
+		start = len(data) - maxMetadataSize
+	}
+	idx := bytes.LastIndex(data[start:], metadataMarker)
+	if idx < 0 {
+		err = ErrBadDB
+		return
+	}
+	meta := data[start+idx+len(metadataMarker):]
+	d := decoder{buf: meta}
+	var v interface{}
+	v, _, err = d.decode(0)
+	if err != nil {
+		return
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		err = ErrBadDB
+		return
+	}
+	db = &DB{
+		nodeCount:  uint32(toUint(m["node_count"])),
+		recordSize: uint32(toUint(m["record_size"])),
+		ipVersion:  uint32(toUint(m["ip_version"])),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		db, err = nil, ErrBadDB
+		return
+	}
+	treeSize := int(db.recordSize) * 2 / 8 * int(db.nodeCount)
+	// 16 zero bytes between the tree and the data
+	if treeSize+16 > start+idx {
+		db, err = nil, ErrBadDB
+		return
+	}
+	db.tree = data[:treeSize]
+	db.data = data[treeSize+16 : start+idx]
+	if db.ipVersion == 6 {
+		// ipv4 addresses are under ::/96
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return
+}
+
+// get the left (0) or right (1) record of a node
+func (db *DB) record(node uint32, bit uint) uint32 {
+	b := db.tree[int(node)*int(db.recordSize)*2/8:]
+	switch db.recordSize {
+	case 24:
+		off := bit * 3
+		return uint32(b[off])<<16 | uint32(b[off+1])<<8 | uint32(b[off+2])
+	case 28:
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(b[bit*4:])
+	}
+}
+
+// find the data for an address, nil if there is none
+func (db *DB) find(ip net.IP) (v interface{}, err error) {
+	node := uint32(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		// no ipv6 in this db
+		return
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		// not found
+		return
+	}
+	off := int(node-db.nodeCount) - 16
+	if off < 0 || off >= len(db.data) {
+		err = ErrBadDB
+		return
+	}
+	d := decoder{buf: db.data}
+	v, _, err = d.decode(off)
+	return
+}
+
+// Lookup implements Provider
+func (db *DB) Lookup(ip net.IP) (info Info, err error) {
+	var v interface{}
+	v, err = db.find(ip)
+	m, _ := v.(map[string]interface{})
+	if err != nil || m == nil {
+		return
+	}
+	for _, k := range []string{"country", "registered_country"} {
+		c, _ := m[k].(map[string]interface{})
+		if iso, ok := c["iso_code"].(string); ok {
+			info.Country = iso
+			break
+		}
+	}
+	info.ASN = uint32(toUint(m["autonomous_system_number"]))
+	info.Org, _ = m["autonomous_system_organization"].(string)
+	return
+}
+
+func toUint(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
+
+// decodes the maxmind db data section format
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) bytes(off, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > len(d.buf) {
+		return nil, ErrBadDB
+	}
+	return d.buf[off : off+n], nil
+}
+
+// decode the value at off, returns it with the offset after it
+func (d *decoder) decode(off int) (v interface{}, next int, err error) {
+	var b []byte
+	b, err = d.bytes(off, 1)
+	if err != nil {
+		return
+	}
+	ctrl := b[0]
+	off++
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		// pointer, the value is somewhere else and we continue after the pointer
+		var ptr int
+		ptr, next, err = d.pointer(ctrl, off)
+		if err != nil {
+			return
+		}
+		// a pointer may not point to another pointer, a loop of them would never end
+		b, err = d.bytes(ptr, 1)
+		if err == nil && b[0]>>5 == 1 {
+			err = ErrBadDB
+		}
+		if err == nil {
+			v, _, err = d.decode(ptr)
+		}
+		return
+	}
+	if typ == 0 {
+		// extended type
+		b, err = d.bytes(off, 1)
+		if err != nil {
+			return
+		}
+		typ = 7 + int(b[0])
+		off++
+	}
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err = d.bytes(off, n)
+		if err != nil {
+			return
+		}
+		off += n
+		extra := 0
+		for _, c := range b {
+			extra = extra<<8 | int(c)
+		}
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+	switch typ {
+	case 2:
+		b, err = d.bytes(off, size)
+		v, next = string(b), off+size
+	case 3:
+		b, err = d.bytes(off, 8)
+		if err == nil {
+			v = math.Float64frombits(binary.BigEndian.Uint64(b))
+		}
+		next = off + 8
+	case 4:
+		b, err = d.bytes(off, size)
+		v, next = b, off+size
+	case 5, 6, 9, 10:
+		// uint128 that does not fit is cut short, we never need those
+		b, err = d.bytes(off, size)
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		v, next = n, off+size
+	case 7:
+		m := make(map[string]interface{}, size)
+		next = off
+		for i := 0; i < size && err == nil; i++ {
+			var k, val interface{}
+			k, next, err = d.decode(next)
+			if err == nil {
+				val, next, err = d.decode(next)
+			}
+			if s, ok := k.(string); ok {
+				m[s] = val
+			}
+		}
+		v = m
+	case 8:
+		b, err = d.bytes(off, size)
+		var n int32
+		for _, c := range b {
+			n = n<<8 | int32(c)
+		}
+		v, next = int64(n), off+size
+	case 11:
+		a := make([]interface{}, 0, size)
+		next = off
+		for i := 0; i < size && err == nil; i++ {
+			var val interface{}
+			val, next, err = d.decode(next)
+			a = append(a, val)
+		}
+		v = a
+	case 14:
+		v, next = size != 0, off
+	case 15:
+		b, err = d.bytes(off, 4)
+		if err == nil {
+			v = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		}
+		next = off + 4
+	default:
+		err = ErrBadDB
+	}
+	return
+}
+
+func (d *decoder) pointer(ctrl byte, off int) (ptr, next int, err error) {
+	n := int((ctrl>>3)&3) + 1
+	var b []byte
+	b, err = d.bytes(off, n)
+	if err != nil {
+		return
+	}
+	next = off + n
+	if n < 4 {
+		ptr = int(ctrl & 7)
+	}
+	for _, c := range b {
+		ptr = ptr<<8 | int(c)
+	}
+	switch n {
+	case 2:
+		ptr += 2048
+	case 3:
+		ptr += 526336
+	}
+	return
+}
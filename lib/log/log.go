@@ -69,7 +69,9 @@ var out io.Writer = os.Stdout
 
 // SetOutput sets logging to output to a writer
 func SetOutput(w io.Writer) {
+	mtx.Lock()
 	out = w
+	mtx.Unlock()
 }
 
 func accept(lvl logLevel) bool {
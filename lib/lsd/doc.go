@@ -0,0 +1,2 @@
+// Package lsd finds peers on the lan with local service discovery (BEP 14)
+package lsd
@@ -0,0 +1,164 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/util"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Addr is the multicast group announces are sent to
+const Addr = "239.192.152.143:6771"
+
+// AnnounceInterval is how often we announce our torrents on the lan
+const AnnounceInterval = time.Minute * 5
+
+// MaxInfohashes is how many infohashes we put in one announce so it fits in a packet
+const MaxInfohashes = 16
+
+// ErrBadAnnounce is returned when parsing something that is not an lsd announce
+var ErrBadAnnounce = errors.New("bad lsd announce")
+
+// Announce is an lsd BT-SEARCH message
+type Announce struct {
+	// port peers listen on for bittorrent
+	Port       int
+	Infohashes []common.Infohash
+	// set by each client so it can ignore its own announces
+	Cookie string
+}
+
+// Bytes encodes the announce as sent on the wire
+func (a *Announce) Bytes() []byte {
+	var buff bytes.Buffer
+	fmt.Fprintf(&buff, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", Addr, a.Port)
+	for _, ih := range a.Infohashes {
+		fmt.Fprintf(&buff, "Infohash: %s\r\n", ih.Hex())
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&buff, "cookie: %s\r\n", a.Cookie)
+	}
+	buff.WriteString("\r\n")
+	return buff.Bytes()
+}
+
+// ParseAnnounce decodes an announce, infohashes that can't be decoded are left out
+func ParseAnnounce(data []byte) (a Announce, err error) {
+	var req *http.Request
+	req, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || req.Method != "BT-SEARCH" {
+		err = ErrBadAnnounce
+		return
+	}
+	a.Port, err = strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || a.Port <= 0 || a.Port > 65535 {
+		err = ErrBadAnnounce
+		return
+	}
+	for _, h := range req.Header.Values("Infohash") {
+		ih, e := common.DecodeInfohash(strings.TrimSpace(h))
+		if e == nil {
+			a.Infohashes = append(a.Infohashes, ih)
+		}
+	}
+	a.Cookie = req.Header.Get("Cookie")
+	return
+}
+
+// Service announces our torrents to the lan and listens for other peers doing the same
+type Service struct {
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+	cookie string
+	// called for each infohash a peer on the lan announced
+	OnPeer func(ih common.Infohash, a net.Addr)
+}
+
+// Listen joins the lsd multicast group
+func Listen() (s *Service, err error) {
+	var group *net.UDPAddr
+	group, err = net.ResolveUDPAddr("udp4", Addr)
+	if err != nil {
+		return
+	}
+	var conn *net.UDPConn
+	conn, err = net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return
+	}
+	s = &Service{
+		conn:   conn,
+		group:  group,
+		cookie: util.RandStr(8),
+	}
+	return
+}
+
+// Announce tells the lan we have these infohashes and listen on port
+func (s *Service) Announce(port int, infohashes []common.Infohash) (err error) {
+	for len(infohashes) > 0 && err == nil {
+		n := len(infohashes)
+		if n > MaxInfohashes {
+			n = MaxInfohashes
+		}
+		a := Announce{
+			Port:       port,
+			Infohashes: infohashes[:n],
+			Cookie:     s.cookie,
+		}
+		_, err = s.conn.WriteToUDP(a.Bytes(), s.group)
+		infohashes = infohashes[n:]
+	}
+	return
+}
+
+// Handle handles one announce sent to us from a
+func (s *Service) Handle(data []byte, from net.Addr) {
+	a, err := ParseAnnounce(data)
+	if err != nil {
+		log.Debugf("bad lsd announce from %s: %s", from, err)
+		return
+	}
+	if s.cookie != "" && a.Cookie == s.cookie {
+		// our own
+		return
+	}
+	host, _, err := net.SplitHostPort(from.String())
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || s.OnPeer == nil {
+		return
+	}
+	peer := &net.TCPAddr{IP: ip, Port: a.Port}
+	for _, ih := range a.Infohashes {
+		s.OnPeer(ih, peer)
+	}
+}
+
+// Run reads announces until closed
+func (s *Service) Run() {
+	var buff [1500]byte
+	for {
+		n, from, err := s.conn.ReadFromUDP(buff[:])
+		if err != nil {
+			log.Debugf("lsd stopped: %s", err)
+			return
+		}
+		s.Handle(buff[:n], from)
+	}
+}
+
+// Close leaves the multicast group
+func (s *Service) Close() error {
+	return s.conn.Close()
+}
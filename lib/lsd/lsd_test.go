@@ -0,0 +1,64 @@
+package lsd
+
+import (
+	"bytes"
+	"github.com/majestrate/XD/lib/common"
+	"net"
+	"testing"
+)
+
+func TestAnnounceRoundTrip(t *testing.T) {
+	var ih1, ih2 common.Infohash
+	ih1[0] = 1
+	ih2[0] = 2
+	a := Announce{
+		Port:       6881,
+		Infohashes: []common.Infohash{ih1, ih2},
+		Cookie:     "abc",
+	}
+	if data := a.Bytes(); !bytes.HasSuffix(data, []byte("\r\n\r\n")) || bytes.HasSuffix(data, []byte("\r\n\r\n\r\n")) {
+		t.Errorf("announce does not end with exactly one empty line: %q", data)
+	}
+	got, err := ParseAnnounce(a.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Port != a.Port || got.Cookie != a.Cookie || len(got.Infohashes) != 2 || got.Infohashes[0] != ih1 || got.Infohashes[1] != ih2 {
+		t.Errorf("got %+v, expected %+v", got, a)
+	}
+}
+
+func TestParseAnnounceBad(t *testing.T) {
+	for _, msg := range []string{
+		"",
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nInfohash: 0000000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 70000\r\n\r\n",
+	} {
+		if _, err := ParseAnnounce([]byte(msg)); err != ErrBadAnnounce {
+			t.Errorf("%q: got error %v", msg, err)
+		}
+	}
+}
+
+func TestHandleIgnoresOwnAnnounce(t *testing.T) {
+	var ih common.Infohash
+	var found []net.Addr
+	s := &Service{
+		cookie: "ours",
+		OnPeer: func(_ common.Infohash, a net.Addr) {
+			found = append(found, a)
+		},
+	}
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 6771}
+	ours := Announce{Port: 6881, Infohashes: []common.Infohash{ih}, Cookie: "ours"}
+	s.Handle(ours.Bytes(), from)
+	if len(found) != 0 {
+		t.Fatalf("found ourselves at %s", found[0])
+	}
+	theirs := Announce{Port: 6882, Infohashes: []common.Infohash{ih}, Cookie: "theirs"}
+	s.Handle(theirs.Bytes(), from)
+	if len(found) != 1 || found[0].String() != "192.168.1.5:6882" {
+		t.Errorf("found %v", found)
+	}
+}
@@ -4,14 +4,31 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/sync"
 	"github.com/majestrate/XD/lib/util"
 	"github.com/zeebo/bencode"
 	"io"
+	"net"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+// ErrUnsafePath is returned when a file path in a torrent could escape the download directory
+var ErrUnsafePath = errors.New("unsafe file path in torrent")
+
+// ErrNoPieces is returned for a torrent with no pieces or nothing in it
+var ErrNoPieces = errors.New("torrent has no pieces")
+
+// ErrBadPieceCount is returned when a torrent's length does not match how many pieces it has
+var ErrBadPieceCount = errors.New("torrent length does not match its piece count")
+
+// ErrV2Only is returned for a v2 torrent without v1 pieces, we lay out files on disk using the v1 metadata
+var ErrV2Only = errors.New("v2 only torrents are not supported, only v1 and hybrid")
+
 type FilePath []string
 
 // get filepath
@@ -24,6 +41,27 @@ func (f FilePath) FilePath(base string) string {
 	return filepath.Join(f...)
 }
 
+// returns true if a single path component can be used as a file or directory name
+func safePathComponent(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\\x00") && !filepath.IsAbs(name) && filepath.VolumeName(name) == ""
+}
+
+// Safe returns true if every component of this path is a plain file or directory name
+func (f FilePath) Safe() bool {
+	if len(f) == 0 {
+		return false
+	}
+	for _, name := range f {
+		if !safePathComponent(name) {
+			return false
+		}
+	}
+	return true
+}
+
 type FileInfo struct {
 	// length of file
 	Length uint64 `bencode:"length"`
@@ -49,6 +87,13 @@ type Info struct {
 	Length uint64 `bencode:"length,omitempty"`
 	// md5sum
 	Sum []byte `bencode:"md5sum,omitempty"`
+	// tracker or site the torrent is for, part of the infohash so the same files
+	// made for different trackers can be seeded as different torrents
+	Source string `bencode:"source,omitempty"`
+	// v2 meta version
+	MetaVersion uint64 `bencode:"meta version,omitempty"`
+	// v2 file tree, kept raw so the infohash stays the same
+	FileTree bencode.RawMessage `bencode:"file tree,omitempty"`
 }
 
 func (i Info) Bytes() []byte {
@@ -71,16 +116,56 @@ func (i Info) GetFiles() (infos []FileInfo) {
 	return
 }
 
+// CheckPaths returns ErrUnsafePath if the name or any file path could escape the download directory
+func (i Info) CheckPaths() error {
+	if !safePathComponent(i.Path) {
+		return ErrUnsafePath
+	}
+	for _, f := range i.Files {
+		if !f.Path.Safe() {
+			return ErrUnsafePath
+		}
+	}
+	return nil
+}
+
+// CheckPieces returns ErrNoPieces for an empty torrent and ErrBadPieceCount if the piece count and length don't add up
+// v2 torrents without v1 metadata get ErrV2Only
+func (i Info) CheckPieces() error {
+	if i.IsV2() && len(i.Pieces) == 0 && len(i.Files) == 0 && i.Length == 0 {
+		return ErrV2Only
+	}
+	var total uint64
+	for _, f := range i.GetFiles() {
+		total += f.Length
+	}
+	if i.NumPieces() == 0 || total == 0 {
+		return ErrNoPieces
+	}
+	if i.PieceLength == 0 || len(i.Pieces)%20 != 0 {
+		return ErrBadPieceCount
+	}
+	pl := uint64(i.PieceLength)
+	if (total+pl-1)/pl != uint64(i.NumPieces()) {
+		return ErrBadPieceCount
+	}
+	return nil
+}
+
 // check if a piece is valid against the pieces in this info section
 func (i Info) CheckPiece(p *common.PieceData) bool {
-	idx := p.Index * 20
-	if i.NumPieces() > p.Index {
-		h := sha1.Sum(p.Data)
-		expected := i.Pieces[idx : idx+20]
-		if bytes.Equal(h[:], expected) {
+	h := sha1.Sum(p.Data)
+	return i.CheckPieceHash(p.Index, h[:])
+}
+
+// check if the sha1 sum h of piece idx matches the pieces in this info section
+func (i Info) CheckPieceHash(idx uint32, h []byte) bool {
+	if i.NumPieces() > idx {
+		expected := i.Pieces[idx*20 : idx*20+20]
+		if bytes.Equal(h, expected) {
 			return true
 		}
-		log.Warnf("piece missmatch: %s != %s", hex.EncodeToString(h[:]), hex.EncodeToString(expected))
+		log.Warnf("piece missmatch: %s != %s", hex.EncodeToString(h), hex.EncodeToString(expected))
 		return false
 	}
 	log.Error("piece index out of bounds")
@@ -100,6 +185,44 @@ type TorrentFile struct {
 	Comment      []byte     `bencode:"comment"`
 	CreatedBy    []byte     `bencode:"created by"`
 	Encoding     []byte     `bencode:"encoding"`
+	// v2 piece layers, pieces root -> concatenated piece hashes
+	PieceLayers map[string][]byte `bencode:"piece layers,omitempty"`
+	// dht nodes to bootstrap from for trackerless torrents, each a [host, port] pair
+	// kept raw so a badly formed nodes key doesn't stop the torrent from loading
+	Nodes bencode.RawMessage `bencode:"nodes,omitempty"`
+	// files from the v2 file tree, parsed the first time they are needed
+	v2    *v2FileTree
+	v2Mtx sync.Mutex
+}
+
+// DHTNodes gets the dht nodes from the nodes key as host:port, bad entries are skipped
+func (tf *TorrentFile) DHTNodes() (nodes []string) {
+	if len(tf.Nodes) == 0 {
+		return
+	}
+	var list []interface{}
+	if bencode.DecodeBytes(tf.Nodes, &list) != nil {
+		return
+	}
+	for _, l := range list {
+		n, ok := l.([]interface{})
+		if !ok {
+			continue
+		}
+		if len(n) != 2 {
+			continue
+		}
+		host, ok := n[0].(string)
+		if !ok || host == "" {
+			continue
+		}
+		port, ok := n[1].(int64)
+		if !ok || port <= 0 || port > 65535 {
+			continue
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+	return
 }
 
 func (tf *TorrentFile) LengthOfPiece(idx uint32) (l uint32) {
@@ -1,6 +1,10 @@
 package metainfo
 
 import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"github.com/majestrate/XD/lib/common"
 	"github.com/zeebo/bencode"
 	"os"
 	"strings"
@@ -25,3 +29,254 @@ func TestLoadTorrent(t *testing.T) {
 	}
 	// TODO: check members
 }
+
+func sha256Pair(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+func sha256Block(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// make a v2 torrent with a 3 piece file and a single piece file
+func makeV2Torrent(t *testing.T) (tf *TorrentFile, a, b []byte) {
+	const blk = MerkleBlockSize
+	a = make([]byte, blk*5)
+	b = make([]byte, blk+4096)
+	rand.Read(a)
+	rand.Read(b)
+	zero := make([]byte, 32)
+	p0 := sha256Pair(sha256Block(a[:blk]), sha256Block(a[blk:blk*2]))
+	p1 := sha256Pair(sha256Block(a[blk*2:blk*3]), sha256Block(a[blk*3:blk*4]))
+	p2 := sha256Pair(sha256Block(a[blk*4:]), zero)
+	aroot := sha256Pair(sha256Pair(p0, p1), sha256Pair(p2, sha256Pair(zero, zero)))
+	broot := sha256Pair(sha256Block(b[:blk]), sha256Block(b[blk:]))
+	tree, err := bencode.EncodeBytes(map[string]interface{}{
+		"a.bin": map[string]interface{}{
+			"": map[string]interface{}{"length": len(a), "pieces root": string(aroot)},
+		},
+		"b.bin": map[string]interface{}{
+			"": map[string]interface{}{"length": len(b), "pieces root": string(broot)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layer []byte
+	layer = append(layer, p0...)
+	layer = append(layer, p1...)
+	layer = append(layer, p2...)
+	tf = &TorrentFile{
+		Info: Info{
+			PieceLength: blk * 2,
+			Path:        "test",
+			MetaVersion: 2,
+			FileTree:    tree,
+		},
+		PieceLayers: map[string][]byte{
+			string(aroot): layer,
+		},
+	}
+	return
+}
+
+func TestCheckPieceV2(t *testing.T) {
+	const blk = MerkleBlockSize
+	tf, a, b := makeV2Torrent(t)
+	if err := tf.ValidatePieceLayers(); err != nil {
+		t.Fatal(err)
+	}
+	if !tf.CanCheckV2() {
+		t.Fatal("cannot check v2 pieces")
+	}
+	pieces := [][]byte{a[:blk*2], a[blk*2 : blk*4], a[blk*4:], b}
+	for idx, data := range pieces {
+		if !tf.CheckPiece(&common.PieceData{Index: uint32(idx), Data: data}) {
+			t.Errorf("piece %d did not validate", idx)
+		}
+	}
+	tampered := make([]byte, len(pieces[1]))
+	copy(tampered, pieces[1])
+	tampered[blk+1] ^= 0xff
+	if tf.CheckPiece(&common.PieceData{Index: 1, Data: tampered}) {
+		t.Error("tampered block validated")
+	}
+	if tf.CheckPiece(&common.PieceData{Index: 4, Data: b}) {
+		t.Error("out of bounds piece validated")
+	}
+}
+
+func TestFileTreeParsedOnce(t *testing.T) {
+	tf, a, _ := makeV2Torrent(t)
+	if !tf.CheckPiece(&common.PieceData{Index: 0, Data: a[:MerkleBlockSize*2]}) {
+		t.Fatal("piece 0 did not validate")
+	}
+	// checking more pieces uses what was parsed the first time
+	tf.Info.FileTree = []byte("not a file tree")
+	if !tf.CheckPiece(&common.PieceData{Index: 1, Data: a[MerkleBlockSize*2 : MerkleBlockSize*4]}) {
+		t.Error("piece 1 did not validate after the file tree was parsed")
+	}
+}
+
+// pieces read in a few odd sized chunks check the same as all at once
+func TestPieceHasherChunks(t *testing.T) {
+	tf, a, b := makeV2Torrent(t)
+	v1 := &TorrentFile{Info: Info{Path: "test", PieceLength: uint32(len(a)), Length: uint64(len(a))}}
+	h := sha1.Sum(a)
+	v1.Info.Pieces = h[:]
+	write := func(h PieceHasher, data []byte) {
+		for len(data) > 0 {
+			n := 1000
+			if n > len(data) {
+				n = len(data)
+			}
+			h.Write(data[:n])
+			data = data[n:]
+		}
+	}
+	const blk = MerkleBlockSize
+	for idx, data := range [][]byte{a[:blk*2], a[blk*2 : blk*4], a[blk*4:], b} {
+		h := tf.NewPieceHasher(uint32(idx))
+		write(h, data)
+		if !h.Check() {
+			t.Errorf("v2 piece %d did not validate in chunks", idx)
+		}
+	}
+	// the last piece gets padded out to the piece length, that is not part of the file
+	h2 := tf.NewPieceHasher(2)
+	write(h2, append(append([]byte{}, a[blk*4:]...), make([]byte, blk)...))
+	if !h2.Check() {
+		t.Error("padded v2 piece did not validate")
+	}
+	h1 := v1.NewPieceHasher(0)
+	write(h1, a)
+	if !h1.Check() {
+		t.Error("v1 piece did not validate in chunks")
+	}
+	bad := tf.NewPieceHasher(0)
+	write(bad, a[blk:blk*3])
+	if bad.Check() {
+		t.Error("wrong data validated")
+	}
+}
+
+func TestValidatePieceLayersTampered(t *testing.T) {
+	tf, _, _ := makeV2Torrent(t)
+	for root := range tf.PieceLayers {
+		tf.PieceLayers[root][0] ^= 0xff
+	}
+	if tf.ValidatePieceLayers() != ErrBadPieceLayer {
+		t.Error("tampered piece layer validated")
+	}
+}
+
+func TestCheckPaths(t *testing.T) {
+	bad := []FilePath{
+		{"..", "evil"},
+		{"a", "..", "..", "etc", "passwd"},
+		{"/etc/passwd"},
+		{"a/../../b"},
+		{""},
+		{},
+	}
+	for _, p := range bad {
+		info := Info{Path: "test", Files: []FileInfo{{Length: 1, Path: p}}}
+		if info.CheckPaths() != ErrUnsafePath {
+			t.Errorf("path %q was not rejected", p)
+		}
+	}
+	for _, name := range []string{"..", ".", "", "/tmp", "a/b"} {
+		info := Info{Path: name, Length: 1}
+		if info.CheckPaths() != ErrUnsafePath {
+			t.Errorf("name %q was not rejected", name)
+		}
+	}
+	info := Info{Path: "test", Files: []FileInfo{{Length: 1, Path: FilePath{"dir", "file.txt"}}}}
+	if err := info.CheckPaths(); err != nil {
+		t.Errorf("good path rejected: %s", err)
+	}
+}
+
+func TestCheckPieces(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		info     Info
+		expected error
+	}{
+		{"no pieces", Info{Path: "test", PieceLength: 16, Length: 10}, ErrNoPieces},
+		{"empty files", Info{Path: "test", PieceLength: 16, Pieces: make([]byte, 20), Files: []FileInfo{{Path: FilePath{"a"}}}}, ErrNoPieces},
+		{"too few pieces", Info{Path: "test", PieceLength: 16, Pieces: make([]byte, 20), Length: 17}, ErrBadPieceCount},
+		{"too many pieces", Info{Path: "test", PieceLength: 16, Pieces: make([]byte, 60), Length: 32}, ErrBadPieceCount},
+		{"partial piece hash", Info{Path: "test", PieceLength: 16, Pieces: make([]byte, 30), Length: 16}, ErrBadPieceCount},
+		{"no piece length", Info{Path: "test", Pieces: make([]byte, 20), Length: 16}, ErrBadPieceCount},
+		{"short last piece", Info{Path: "test", PieceLength: 16, Pieces: make([]byte, 40), Length: 17}, nil},
+		{"files", Info{Path: "test", PieceLength: 16, Pieces: make([]byte, 40), Files: []FileInfo{{Length: 16, Path: FilePath{"a"}}, {Length: 1, Path: FilePath{"b"}}}}, nil},
+		{"v2 only", Info{Path: "test", PieceLength: 16, MetaVersion: 2, FileTree: []byte("d1:ad0:d6:lengthi1eeee")}, ErrV2Only},
+		{"hybrid", Info{Path: "test", PieceLength: 16, Pieces: make([]byte, 20), Length: 1, MetaVersion: 2, FileTree: []byte("d4:testd0:d6:lengthi1eeee")}, nil},
+	} {
+		if err := test.info.CheckPieces(); err != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.expected)
+		}
+	}
+}
+
+func TestDHTNodes(t *testing.T) {
+	raw := "d4:infod6:lengthi1e4:name4:test12:piece lengthi1e6:pieces0:e5:nodesll9:127.0.0.1i6881eel7:dht.lani1234eel3:badeli1ei2eel3:::1i6882eeee"
+	tf := new(TorrentFile)
+	if err := bencode.DecodeString(raw, tf); err != nil {
+		t.Fatal(err)
+	}
+	nodes := tf.DHTNodes()
+	expected := []string{"127.0.0.1:6881", "dht.lan:1234", "[::1]:6882"}
+	if len(nodes) != len(expected) {
+		t.Fatalf("got nodes %q, expected %q", nodes, expected)
+	}
+	for idx := range expected {
+		if nodes[idx] != expected[idx] {
+			t.Errorf("node %d is %q, expected %q", idx, nodes[idx], expected[idx])
+		}
+	}
+}
+
+func TestBadDHTNodes(t *testing.T) {
+	// some torrent makers write the nodes as strings
+	raw := "d4:infod6:lengthi1e4:name4:test12:piece lengthi1e6:pieces0:e5:nodesl14:127.0.0.1:6881ee"
+	tf := new(TorrentFile)
+	if err := bencode.DecodeString(raw, tf); err != nil {
+		t.Fatalf("torrent with bad nodes failed to load: %s", err)
+	}
+	if nodes := tf.DHTNodes(); len(nodes) != 0 {
+		t.Errorf("got nodes %q from bad nodes key", nodes)
+	}
+	if tf.Info.Path != "test" {
+		t.Errorf("name is %q after loading", tf.Info.Path)
+	}
+}
+
+func TestSourceInInfohash(t *testing.T) {
+	info := "6:lengthi1e4:name4:test12:piece lengthi1e6:pieces20:aaaaaaaaaaaaaaaaaaaa"
+	var hashes []common.Infohash
+	for _, source := range []string{"", "6:source3:one", "6:source3:two"} {
+		raw := "d4:infod" + info + source + "ee"
+		tf := new(TorrentFile)
+		if err := bencode.DecodeString(raw, tf); err != nil {
+			t.Fatal(err)
+		}
+		if source != "" && tf.Info.Source != source[len(source)-3:] {
+			t.Errorf("source is %q", tf.Info.Source)
+		}
+		// the infohash is of the info dict exactly as it came
+		inner := raw[len("d4:info") : len(raw)-1]
+		if ih := tf.Infohash(); ih != common.Infohash(sha1.Sum([]byte(inner))) {
+			t.Errorf("infohash %s is not of the info dict %q", ih.Hex(), inner)
+		}
+		hashes = append(hashes, tf.Infohash())
+	}
+	if hashes[0] == hashes[1] || hashes[1] == hashes[2] || hashes[0] == hashes[2] {
+		t.Error("source tags did not change the infohash")
+	}
+}
@@ -0,0 +1,360 @@
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/zeebo/bencode"
+	"hash"
+	"io"
+	"sort"
+)
+
+// size of a leaf block in a v2 merkle tree
+const MerkleBlockSize = 16 * 1024
+
+// ErrBadPieceLayer is returned when the piece layers do not hash to the pieces root
+var ErrBadPieceLayer = errors.New("piece layer does not match pieces root")
+
+// ErrBadFileTree is returned when the v2 file tree could not be parsed
+var ErrBadFileTree = errors.New("invalid v2 file tree")
+
+// a file from a v2 file tree
+type V2File struct {
+	// relative path of file
+	Path FilePath
+	// length of file
+	Length uint64
+	// merkle root of this file's blocks
+	PiecesRoot []byte
+}
+
+// IsV2 returns true if this info section has v2 metadata
+func (i Info) IsV2() bool {
+	return i.MetaVersion == 2 && len(i.FileTree) > 0
+}
+
+// IsHybrid returns true if this info section has both v1 and v2 metadata
+func (i Info) IsHybrid() bool {
+	return i.IsV2() && len(i.Pieces) > 0
+}
+
+// V2Files gets all files from the v2 file tree in tree order
+func (i Info) V2Files() (files []V2File, err error) {
+	var tree map[string]interface{}
+	err = bencode.DecodeBytes(i.FileTree, &tree)
+	if err == nil {
+		files, err = walkFileTree(tree, nil)
+	}
+	return
+}
+
+func walkFileTree(tree map[string]interface{}, parent FilePath) (files []V2File, err error) {
+	var names []string
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, ErrBadFileTree
+		}
+		if name == "" {
+			// leaf node
+			var f V2File
+			length, _ := node["length"].(int64)
+			if length < 0 {
+				return nil, ErrBadFileTree
+			}
+			f.Length = uint64(length)
+			root, _ := node["pieces root"].(string)
+			if f.Length > 0 && len(root) != sha256.Size {
+				return nil, ErrBadFileTree
+			}
+			f.PiecesRoot = []byte(root)
+			f.Path = append(f.Path, parent...)
+			files = append(files, f)
+			continue
+		}
+		path := append(append(FilePath{}, parent...), name)
+		var sub []V2File
+		sub, err = walkFileTree(node, path)
+		if err != nil {
+			return
+		}
+		files = append(files, sub...)
+	}
+	return
+}
+
+// a parsed v2 file tree
+type v2FileTree struct {
+	files []V2File
+	err   error
+}
+
+// get the files from the v2 file tree, it is only parsed once
+func (tf *TorrentFile) v2Files() ([]V2File, error) {
+	tf.v2Mtx.Lock()
+	defer tf.v2Mtx.Unlock()
+	if tf.v2 == nil {
+		if !tf.Info.IsV2() {
+			// the info section may not be here yet
+			return nil, ErrBadFileTree
+		}
+		tree := new(v2FileTree)
+		tree.files, tree.err = tf.Info.V2Files()
+		tf.v2 = tree
+	}
+	return tf.v2.files, tf.v2.err
+}
+
+// hash 2 merkle nodes together
+func merkleHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// compute merkle root of leaves, padding with pad up to width leaves
+func merkleRoot(leaves [][]byte, width int, pad []byte) []byte {
+	layer := make([][]byte, width)
+	for idx := range layer {
+		if idx < len(leaves) {
+			layer[idx] = leaves[idx]
+		} else {
+			layer[idx] = pad
+		}
+	}
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for idx := range next {
+			next[idx] = merkleHash(layer[idx*2], layer[(idx*2)+1])
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// root hash of a subtree with width leaves that are all zero
+func zeroRoot(width int) []byte {
+	root := make([]byte, sha256.Size)
+	for width > 1 {
+		root = merkleHash(root, root)
+		width /= 2
+	}
+	return root
+}
+
+// get smallest power of 2 that is at least n
+func nextPow2(n int) (p int) {
+	p = 1
+	for p < n {
+		p *= 2
+	}
+	return
+}
+
+// number of pieces a v2 file spans
+func (i Info) v2PiecesIn(f V2File) uint32 {
+	pl := uint64(i.PieceLength)
+	return uint32((f.Length + pl - 1) / pl)
+}
+
+// find which v2 file and file relative piece a global piece index is in
+func (i Info) v2FileForPiece(files []V2File, idx uint32) (f V2File, local uint32, ok bool) {
+	for _, file := range files {
+		n := i.v2PiecesIn(file)
+		if idx < n {
+			return file, idx, true
+		}
+		idx -= n
+	}
+	return
+}
+
+// ValidatePieceLayers checks that every piece layer hashes up to its file's pieces root
+func (tf *TorrentFile) ValidatePieceLayers() error {
+	if !tf.Info.IsV2() {
+		return nil
+	}
+	files, err := tf.v2Files()
+	if err != nil {
+		return err
+	}
+	leavesPerPiece := int(tf.Info.PieceLength / MerkleBlockSize)
+	pad := zeroRoot(leavesPerPiece)
+	for _, f := range files {
+		if f.Length <= uint64(tf.Info.PieceLength) {
+			// small files have no piece layer
+			continue
+		}
+		layer, ok := tf.PieceLayers[string(f.PiecesRoot)]
+		if !ok {
+			// we may get it later
+			continue
+		}
+		n := int(tf.Info.v2PiecesIn(f))
+		if len(layer) != n*sha256.Size {
+			return ErrBadPieceLayer
+		}
+		var hashes [][]byte
+		for idx := 0; idx < n; idx++ {
+			hashes = append(hashes, layer[idx*sha256.Size:(idx+1)*sha256.Size])
+		}
+		if !bytes.Equal(merkleRoot(hashes, nextPow2(n), pad), f.PiecesRoot) {
+			return ErrBadPieceLayer
+		}
+	}
+	return nil
+}
+
+// hashes a piece into 16KiB merkle leaves as it is written and checks it against the v2 merkle tree
+type v2Hasher struct {
+	idx uint32
+	// file the piece is in, false if the piece index is out of bounds
+	ok bool
+	// bytes of file data left in the piece, anything past that is padding
+	left     uint64
+	expected []byte
+	// leaves the root is taken over, 0 for as many as there are
+	width  int
+	leaves [][]byte
+	block  []byte
+}
+
+func (tf *TorrentFile) newV2Hasher(idx uint32) *v2Hasher {
+	i := tf.Info
+	h := &v2Hasher{idx: idx}
+	files, err := tf.v2Files()
+	if err != nil {
+		log.Errorf("cannot check piece %d: %s", idx, err.Error())
+		return h
+	}
+	f, local, ok := i.v2FileForPiece(files, idx)
+	if !ok {
+		log.Error("piece index out of bounds")
+		return h
+	}
+	h.left = f.Length - (uint64(local) * uint64(i.PieceLength))
+	if f.Length <= uint64(i.PieceLength) {
+		// the whole file is one piece so the pieces root is the piece hash
+		h.expected = f.PiecesRoot
+	} else {
+		layer, has := tf.PieceLayers[string(f.PiecesRoot)]
+		if !has || len(layer) < int(local+1)*sha256.Size {
+			log.Errorf("no piece layer for piece %d", idx)
+			return h
+		}
+		h.expected = layer[local*sha256.Size : (local+1)*sha256.Size]
+		h.width = int(i.PieceLength / MerkleBlockSize)
+	}
+	h.ok = true
+	return h
+}
+
+func (h *v2Hasher) Write(data []byte) (int, error) {
+	n := len(data)
+	// strip padding past the end of the file
+	if uint64(len(data)) > h.left {
+		data = data[:h.left]
+	}
+	h.left -= uint64(len(data))
+	for len(data) > 0 {
+		take := MerkleBlockSize - len(h.block)
+		if take > len(data) {
+			take = len(data)
+		}
+		h.block = append(h.block, data[:take]...)
+		data = data[take:]
+		if len(h.block) == MerkleBlockSize {
+			h.leaf()
+		}
+	}
+	return n, nil
+}
+
+func (h *v2Hasher) leaf() {
+	sum := sha256.Sum256(h.block)
+	h.leaves = append(h.leaves, sum[:])
+	h.block = h.block[:0]
+}
+
+func (h *v2Hasher) Check() bool {
+	if !h.ok {
+		return false
+	}
+	if len(h.block) > 0 {
+		h.leaf()
+	}
+	width := h.width
+	if width == 0 {
+		width = nextPow2(len(h.leaves))
+	}
+	if bytes.Equal(merkleRoot(h.leaves, width, make([]byte, sha256.Size)), h.expected) {
+		return true
+	}
+	log.Warnf("v2 piece missmatch for piece %d", h.idx)
+	return false
+}
+
+// CanCheckV2 returns true if we can verify pieces against the v2 merkle tree
+func (tf *TorrentFile) CanCheckV2() bool {
+	if !tf.Info.IsV2() {
+		return false
+	}
+	files, err := tf.v2Files()
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		if f.Length > uint64(tf.Info.PieceLength) {
+			if _, ok := tf.PieceLayers[string(f.PiecesRoot)]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CheckPiece checks if a piece is valid, uses the v2 merkle tree when we can and sha1 otherwise
+func (tf *TorrentFile) CheckPiece(p *common.PieceData) bool {
+	h := tf.NewPieceHasher(p.Index)
+	h.Write(p.Data)
+	return h.Check()
+}
+
+// PieceHasher hashes a piece as it is read so big pieces don't have to be held in memory to check them
+type PieceHasher interface {
+	io.Writer
+	// Check returns true if everything written is the piece we expect
+	Check() bool
+}
+
+// NewPieceHasher makes a hasher for piece idx, it checks the same way CheckPiece does
+func (tf *TorrentFile) NewPieceHasher(idx uint32) PieceHasher {
+	if tf.CanCheckV2() {
+		return tf.newV2Hasher(idx)
+	}
+	return &v1Hasher{info: tf.Info, idx: idx, h: sha1.New()}
+}
+
+// sha1 of a piece checked against the v1 pieces
+type v1Hasher struct {
+	info Info
+	idx  uint32
+	h    hash.Hash
+}
+
+func (h *v1Hasher) Write(data []byte) (int, error) {
+	return h.h.Write(data)
+}
+
+func (h *v1Hasher) Check() bool {
+	return h.info.CheckPieceHash(h.idx, h.h.Sum(nil))
+}
@@ -2,6 +2,7 @@ package inet
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -19,9 +20,31 @@ type Session struct {
 	serv      net.Listener
 	packet    net.PacketConn
 	resolver  net.Resolver
+	// local address outbound connections are made from, nil for localIP
+	bindIP net.IP
 }
 
+// ErrBadBindAddr is returned when the bind address is not an ip address
+var ErrBadBindAddr = errors.New("bind address is not an ip address")
+
+// ErrNotOpen is returned when sending or receiving datagrams before the session is open
+var ErrNotOpen = errors.New("session is not open")
+
 func NewSession(port, dns string) (s *Session, err error) {
+	return NewSessionBind(port, dns, "")
+}
+
+// NewSessionBind makes a session that makes all outbound connections from the local ip bind
+// this covers peers and trackers, empty bind uses our lokinet address
+func NewSessionBind(port, dns, bind string) (s *Session, err error) {
+	var bindIP net.IP
+	if bind != "" {
+		bindIP = net.ParseIP(bind)
+		if bindIP == nil {
+			err = ErrBadBindAddr
+			return
+		}
+	}
 	var found []net.IP
 	found, err = net.LookupIP(DefaultHostname)
 	if err != nil {
@@ -32,6 +55,7 @@ func NewSession(port, dns string) (s *Session, err error) {
 		port:      port,
 		localIP:   localIP,
 		localAddr: net.JoinHostPort(localIP.String(), port),
+		bindIP:    bindIP,
 		resolver: net.Resolver{
 			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
 				var d net.Dialer
@@ -59,7 +83,7 @@ func (s *Session) LocalName() string {
 	return s.name
 }
 
-func (s *Session) Dial(_, a string) (net.Conn, error) {
+func (s *Session) Dial(n, a string) (net.Conn, error) {
 	h, p, err := net.SplitHostPort(a)
 	if err != nil {
 		return nil, err
@@ -68,18 +92,43 @@ func (s *Session) Dial(_, a string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	localAddr := net.JoinHostPort(s.localIP.String(), "0")
-	laddr, err := net.ResolveTCPAddr("tcp4", localAddr)
-	if err != nil {
-		return nil, err
+	if strings.HasPrefix(n, "udp") {
+		// for udp trackers, nothing needs the rdns name
+		return s.dialUDP(&net.UDPAddr{IP: raddr.IP, Port: raddr.Port})
 	}
-	c, err := net.DialTCP("tcp4", laddr, raddr)
+	c, err := s.dialTCP(raddr)
 	if err != nil {
 		return nil, err
 	}
 	return s.wrapConn(c)
 }
 
+// connect to raddr from our bind address
+func (s *Session) dialTCP(raddr *net.TCPAddr) (*net.TCPConn, error) {
+	ip := s.bindIP
+	if ip == nil {
+		ip = s.localIP
+	}
+	network := "tcp4"
+	if ip.To4() == nil {
+		network = "tcp6"
+	}
+	return net.DialTCP(network, &net.TCPAddr{IP: ip}, raddr)
+}
+
+// send datagrams to raddr from our bind address
+func (s *Session) dialUDP(raddr *net.UDPAddr) (*net.UDPConn, error) {
+	ip := s.bindIP
+	if ip == nil {
+		ip = s.localIP
+	}
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+	return net.DialUDP(network, &net.UDPAddr{IP: ip}, raddr)
+}
+
 func (s *Session) wrapConn(c net.Conn) (*Conn, error) {
 	raddr := c.RemoteAddr()
 	h, port, err := net.SplitHostPort(raddr.String())
@@ -209,6 +258,13 @@ func (s *Session) Open() error {
 	if err != nil {
 		return err
 	}
+	// datagrams go on the same port as streams
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(s.localIP.String(), port))
+	if err != nil {
+		l.Close()
+		return err
+	}
+	s.packet = pc
 	s.serv = &Listener{
 		l: l,
 		laddr: &Addr{
@@ -220,14 +276,25 @@ func (s *Session) Open() error {
 }
 
 func (s *Session) ReadFrom(d []byte) (n int, from net.Addr, err error) {
-	return
+	if s.packet == nil {
+		err = ErrNotOpen
+		return
+	}
+	return s.packet.ReadFrom(d)
 }
 
 func (s *Session) WriteTo(d []byte, to net.Addr) (n int, err error) {
-	return
+	if s.packet == nil {
+		err = ErrNotOpen
+		return
+	}
+	return s.packet.WriteTo(d, to)
 }
 
 func (s *Session) Close() error {
+	if s.packet != nil {
+		s.packet.Close()
+	}
 	return s.serv.Close()
 }
 
@@ -242,6 +309,26 @@ func (s *Session) Lookup(name, port string) (addr net.Addr, err error) {
 	return s.lookupTCP(name, port)
 }
 
+// LookupAll gets every tcp address name resolves to
+func (s *Session) LookupAll(name, port string) (addrs []net.Addr, err error) {
+	var ips []net.IPAddr
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	ips, err = s.resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return
+	}
+	var p int
+	p, err = net.LookupPort("tcp", port)
+	if err != nil {
+		return
+	}
+	for _, ip := range ips {
+		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: p})
+	}
+	return
+}
+
 func (s *Session) lookupTCP(name, port string) (addr *net.TCPAddr, err error) {
 	var ips []net.IPAddr
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
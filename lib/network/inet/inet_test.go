@@ -0,0 +1,78 @@
+package inet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDialFromBindAddr(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- c.RemoteAddr()
+		c.Close()
+	}()
+	s := &Session{
+		localIP: net.IPv4(127, 0, 0, 1),
+		bindIP:  net.IPv4(127, 0, 0, 2),
+	}
+	c, err := s.dialTCP(l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	from := <-accepted
+	if from == nil {
+		t.Fatal("no connection accepted")
+	}
+	if ip := from.(*net.TCPAddr).IP; !ip.Equal(s.bindIP) {
+		t.Errorf("dial came from %s, expected %s", ip, s.bindIP)
+	}
+}
+
+func TestBadBindAddr(t *testing.T) {
+	_, err := NewSessionBind(DefaultPort, DefaultDNSAddr, "not an ip")
+	if err != ErrBadBindAddr {
+		t.Errorf("bad bind address gave %v", err)
+	}
+}
+
+func TestDatagrams(t *testing.T) {
+	s := &Session{
+		localIP:   net.IPv4(127, 0, 0, 1),
+		localAddr: "127.0.0.1:0",
+		name:      "localhost",
+	}
+	if _, _, err := s.ReadFrom(make([]byte, 8)); err != ErrNotOpen {
+		t.Errorf("read before open gave %v", err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Addr().String())
+	to, err := net.ResolveUDPAddr("udp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.WriteTo([]byte("ping"), to); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	n, from, err := s.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || from.String() != to.String() {
+		t.Errorf("read %q from %s", buf[:n], from)
+	}
+}
@@ -15,3 +15,22 @@ type Network interface {
 	Addr() net.Addr
 	Lookup(name, port string) (net.Addr, error)
 }
+
+// MultiLookup is a network session that can resolve a name to every address it has
+type MultiLookup interface {
+	// LookupAll gets every address name resolves to in the order to try them
+	LookupAll(name, port string) ([]net.Addr, error)
+}
+
+// LookupAll resolves name to every address n has for it, just the one Lookup gives if that is all n can do
+func LookupAll(n Network, name, port string) (addrs []net.Addr, err error) {
+	if m, ok := n.(MultiLookup); ok {
+		return m.LookupAll(name, port)
+	}
+	var a net.Addr
+	a, err = n.Lookup(name, port)
+	if err == nil {
+		addrs = []net.Addr{a}
+	}
+	return
+}
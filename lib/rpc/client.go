@@ -86,6 +86,10 @@ func (cl *Client) DeleteTorrent(ih string) error {
 	return cl.torrentAction(ih, TorrentChangeDelete)
 }
 
+func (cl *Client) RecheckTorrent(ih string) error {
+	return cl.torrentAction(ih, TorrentChangeRecheck)
+}
+
 func (cl *Client) ListTorrents() (torrents swarm.TorrentsList, err error) {
 	err = cl.doRPC(&ListTorrentsRequest{BaseRequest{cl.swarmno}}, func(r io.Reader) error {
 		return json.NewDecoder(r).Decode(&torrents)
@@ -109,7 +113,16 @@ func (cl *Client) SetPieceWindow(n int) (err error) {
 }
 
 func (cl *Client) AddTorrent(url string) (err error) {
-	err = cl.doRPC(&AddTorrentRequest{BaseRequest{cl.swarmno}, url}, func(r io.Reader) error {
+	err = cl.doRPC(&AddTorrentRequest{BaseRequest: BaseRequest{cl.swarmno}, URL: url}, func(r io.Reader) error {
+		var response interface{}
+		return json.NewDecoder(r).Decode(&response)
+	})
+	return
+}
+
+// AddTorrentPaused adds a torrent that is paused or not no matter what the daemon does by default
+func (cl *Client) AddTorrentPaused(url string, paused bool) (err error) {
+	err = cl.doRPC(&AddTorrentRequest{BaseRequest: BaseRequest{cl.swarmno}, URL: url, Paused: &paused}, func(r io.Reader) error {
 		var response interface{}
 		return json.NewDecoder(r).Decode(&response)
 	})
@@ -2,6 +2,7 @@ package rpc
 
 const ParamInfohash = "infohash"
 const ParamURL = "url"
+const ParamPaused = "paused"
 const ParamN = "n"
 const ParamAction = "action"
 const ParamSwarms = "swarms"
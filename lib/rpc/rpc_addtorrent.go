@@ -8,10 +8,16 @@ import (
 type AddTorrentRequest struct {
 	BaseRequest
 	URL string `json:"url"`
+	// add it paused or not, nil to do what the swarm does by default
+	Paused *bool `json:"paused,omitempty"`
 }
 
 func (atr *AddTorrentRequest) ProcessRequest(sw *swarm.Swarm, w *ResponseWriter) {
-	err := sw.AddRemoteTorrent(atr.URL)
+	paused := sw.StartPaused
+	if atr.Paused != nil {
+		paused = *atr.Paused
+	}
+	err := sw.AddRemoteTorrentPaused(atr.URL, paused)
 	if err == nil {
 		w.Return(map[string]interface{}{"error": nil})
 	} else {
@@ -20,10 +26,14 @@ func (atr *AddTorrentRequest) ProcessRequest(sw *swarm.Swarm, w *ResponseWriter)
 }
 
 func (atr *AddTorrentRequest) MarshalJSON() (data []byte, err error) {
-	data, err = json.Marshal(map[string]interface{}{
+	params := map[string]interface{}{
 		ParamSwarm:  atr.Swarm,
 		ParamURL:    atr.URL,
 		ParamMethod: RPCAddTorrent,
-	})
+	}
+	if atr.Paused != nil {
+		params[ParamPaused] = *atr.Paused
+	}
+	data, err = json.Marshal(params)
 	return
 }
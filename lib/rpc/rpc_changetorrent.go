@@ -11,6 +11,7 @@ const TorrentChangeStart = "start"
 const TorrentChangeStop = "stop"
 const TorrentChangeRemove = "remove"
 const TorrentChangeDelete = "delete"
+const TorrentChangeRecheck = "recheck"
 
 var ErrInvalidAction = errors.New("invalid torrent action")
 
@@ -38,6 +39,8 @@ func (r *ChangeTorrentRequest) ProcessRequest(sw *swarm.Swarm, w *ResponseWriter
 					err = t.Remove()
 				case TorrentChangeDelete:
 					err = t.Delete()
+				case TorrentChangeRecheck:
+					err = t.Recheck()
 				default:
 					err = ErrInvalidAction
 				}
@@ -100,9 +100,13 @@ func (r *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 							Infohash: fmt.Sprintf("%s", body[ParamInfohash]),
 						}
 					case RPCAddTorrent:
-						rr = &AddTorrentRequest{
+						req := &AddTorrentRequest{
 							URL: fmt.Sprintf("%s", body[ParamURL]),
 						}
+						if paused, ok := body[ParamPaused].(bool); ok {
+							req.Paused = &paused
+						}
+						rr = req
 					case RPCSetPieceWindow:
 						n, ok := body[ParamN].(float64)
 						if ok {
@@ -188,6 +188,8 @@ func tgPeers(f string, t *swarm.Torrent, resp *tgResp) (err error) {
 		peers[idx] = &tgPeer{
 			Addr:            stats.Peers[idx].Addr,
 			ClientName:      stats.Peers[idx].Client,
+			Port:            stats.Peers[idx].Port,
+			Encrypted:       stats.Peers[idx].Encrypted,
 			UsChoked:        stats.Peers[idx].ThemChoking,
 			UsInterested:    stats.Peers[idx].UsInterested,
 			Flag:            "i2p",
@@ -201,6 +203,7 @@ func tgPeers(f string, t *swarm.Torrent, resp *tgResp) (err error) {
 			TX:              int64(stats.Peers[idx].TX),
 		}
 	}
+	resp.Set(f, peers)
 	return
 }
 
@@ -9,7 +9,10 @@ import (
 	"github.com/majestrate/XD/lib/metainfo"
 	"github.com/majestrate/XD/lib/stats"
 	"github.com/majestrate/XD/lib/sync"
+	"github.com/zeebo/bencode"
 	"io"
+	"os"
+	"sort"
 )
 
 /* Mutex used in fsTorrent.VerifyAll to ensure that the integrity of each
@@ -32,6 +35,8 @@ type fsTorrent struct {
 	bfmtx sync.RWMutex
 	// base directory
 	dir string
+	// put multi-file torrent files right in dir instead of a directory named after the torrent
+	noRootDir bool
 	// storage access mutex
 	access sync.Mutex
 	// set to true when we are doing a deep check
@@ -51,25 +56,99 @@ func (t *fsTorrent) Delete() (err error) {
 	if err == nil {
 		err = t.st.FS.RemoveAll(t.st.bitfieldFilename(t.ih))
 		if err == nil {
-			err = t.st.FS.RemoveAll(t.FilePath())
+			err = t.st.FS.RemoveAll(t.st.partialFilename(t.ih))
+		}
+		if err == nil && t.meta != nil {
+			if t.meta.IsSingleFile() || !t.noRootDir {
+				err = t.st.FS.RemoveAll(t.FilePath())
+			} else {
+				// files are not in their own directory so only remove them
+				for _, f := range t.meta.Info.GetFiles() {
+					var fname string
+					fname, err = t.fileName(t.dir, f)
+					if err == nil {
+						err = t.st.FS.RemoveAll(fname)
+					}
+					if err != nil {
+						break
+					}
+				}
+				if err == nil {
+					t.removeEmptyDirs()
+				}
+			}
 		}
 	}
 	return
 }
 
+// remove the subdirectories of dir our files were in, deepest first
+// directories that still have something else in them fail to be removed and stay
+func (t *fsTorrent) removeEmptyDirs() {
+	seen := make(map[string]bool)
+	var dirs []metainfo.FilePath
+	for _, f := range t.meta.Info.GetFiles() {
+		if !f.Path.Safe() {
+			continue
+		}
+		for n := len(f.Path) - 1; n > 0; n-- {
+			p := f.Path[:n]
+			k := t.st.FS.Join(p...)
+			if !seen[k] {
+				seen[k] = true
+				dirs = append(dirs, p)
+			}
+		}
+	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	for _, p := range dirs {
+		t.st.FS.Remove(t.st.FS.Join(append([]string{t.dir}, p...)...))
+	}
+}
+
+// get the directory the files of this torrent are put in when its base directory is dir
+func (t *fsTorrent) rootDir(dir string) string {
+	if t.meta.IsSingleFile() || t.noRootDir {
+		return dir
+	}
+	return t.st.FS.Join(dir, t.meta.Info.Path)
+}
+
+// get the full path of a file in this torrent when its base directory is dir
+// every path component is checked so that a file can never end up outside of dir
+func (t *fsTorrent) fileName(dir string, f metainfo.FileInfo) (fname string, err error) {
+	name := metainfo.FilePath{t.meta.Info.Path}
+	if !name.Safe() {
+		err = metainfo.ErrUnsafePath
+	} else if t.meta.IsSingleFile() {
+		fname = t.st.FS.Join(dir, t.meta.Info.Path)
+	} else if f.Path.Safe() {
+		fname = t.st.FS.Join(append([]string{t.rootDir(dir)}, f.Path...)...)
+	} else {
+		err = metainfo.ErrUnsafePath
+	}
+	if err != nil {
+		log.Errorf("refusing to use unsafe file path %q in %s", f.Path, dir)
+	}
+	return
+}
+
 func (t *fsTorrent) MoveTo(other string) (err error) {
 	t.access.Lock()
 	err = t.st.FS.EnsureDir(other)
 	if err == nil {
-		multifile := !t.MetaInfo().IsSingleFile()
 		files := t.MetaInfo().Info.GetFiles()
 		for _, file := range files {
-			root := ""
-			if multifile {
-				root = t.MetaInfo().Info.Path
+			var oldpath, newpath string
+			oldpath, err = t.fileName(t.dir, file)
+			if err == nil {
+				newpath, err = t.fileName(other, file)
+			}
+			if err != nil {
+				break
 			}
-			oldpath := file.Path.FilePath(t.st.FS.Join(t.dir, root))
-			newpath := file.Path.FilePath(t.st.FS.Join(other, root))
 			log.Debugf("move %s -> %s", oldpath, newpath)
 			err = t.st.FS.Move(oldpath, newpath)
 			if err != nil {
@@ -86,21 +165,22 @@ func (t *fsTorrent) MoveTo(other string) (err error) {
 }
 
 func (t *fsTorrent) AllocateFile(f metainfo.FileInfo) (err error) {
-	fname := t.st.FS.Join(t.FilePath(), f.Path.FilePath(""))
-	err = t.st.FS.EnsureFile(fname, f.Length)
+	var fname string
+	fname, err = t.fileName(t.dir, f)
+	if err == nil {
+		err = t.st.FS.EnsureFile(fname, f.Length)
+	}
 	return
 }
 
 func (t *fsTorrent) Allocate() (err error) {
 	if t.meta.IsSingleFile() {
 		log.Debugf("file is %d bytes", t.meta.Info.Length)
-		err = t.st.FS.EnsureFile(t.FilePath(), t.meta.Info.Length)
-	} else {
-		for _, f := range t.meta.Info.Files {
-			err = t.AllocateFile(f)
-			if err != nil {
-				break
-			}
+	}
+	for _, f := range t.meta.Info.GetFiles() {
+		err = t.AllocateFile(f)
+		if err != nil {
+			break
 		}
 	}
 	return
@@ -108,23 +188,19 @@ func (t *fsTorrent) Allocate() (err error) {
 
 func (t *fsTorrent) openfileRead(i metainfo.FileInfo) (f fs.ReadFile, err error) {
 	var fname string
-	if t.meta.IsSingleFile() {
-		fname = t.FilePath()
-	} else {
-		fname = t.st.FS.Join(t.FilePath(), i.Path.FilePath(""))
+	fname, err = t.fileName(t.dir, i)
+	if err == nil {
+		f, err = t.st.FS.OpenFileReadOnly(fname)
 	}
-	f, err = t.st.FS.OpenFileReadOnly(fname)
 	return
 }
 
 func (t *fsTorrent) openfileWrite(i metainfo.FileInfo) (f fs.WriteFile, err error) {
 	var fname string
-	if t.meta.IsSingleFile() {
-		fname = t.FilePath()
-	} else {
-		fname = t.st.FS.Join(t.FilePath(), i.Path.FilePath(""))
+	fname, err = t.fileName(t.dir, i)
+	if err == nil {
+		f, err = t.st.FS.OpenFileWriteOnly(fname)
 	}
-	f, err = t.st.FS.OpenFileWriteOnly(fname)
 	return
 }
 
@@ -133,6 +209,9 @@ func (t *fsTorrent) readFileAt(fi metainfo.FileInfo, b []byte, off int64) (n int
 	// from github.com/anacrolix/torrent
 	var f fs.ReadFile
 	f, err = t.openfileRead(fi)
+	if err != nil {
+		return
+	}
 	fil := int64(fi.Length)
 	// Limit the read to within the expected bounds of this file.
 	if int64(len(b)) > fil-off {
@@ -293,6 +372,13 @@ func (t *fsTorrent) FilePath() string {
 
 func (t *fsTorrent) PutInfo(info metainfo.Info) (err error) {
 	if t.meta == nil {
+		err = info.CheckPaths()
+		if err == nil {
+			err = info.CheckPieces()
+		}
+		if err != nil {
+			return
+		}
 		meta := &metainfo.TorrentFile{
 			Info: info,
 		}
@@ -310,6 +396,7 @@ func (t *fsTorrent) PutInfo(info metainfo.Info) (err error) {
 			err = t.meta.BEncode(f)
 			f.Close()
 			if err == nil {
+				t.st.putLayout(ih, Layout{Dir: t.dir, NoRootDir: t.noRootDir})
 				log.Debugf("allocate room for %s", t.Name())
 				err = t.Allocate()
 			}
@@ -325,14 +412,14 @@ func (t *fsTorrent) GetPiece(r common.PieceRequest, pc *common.PieceData) (err e
 	offset := int64(r.Begin) + (int64(sz) * int64(r.Index))
 	pc.Data = make([]byte, r.Length)
 	log.Debugf("get piece %d offset=%d len=%d", r.Index, r.Begin, r.Length)
-	if t.st.pooledIO() {
+	if iops := t.st.iops(); iops != nil {
 		iop := readIOP{
 			offset:    offset,
 			r:         t,
 			data:      pc.Data,
 			replyChnl: make(chan iopResult),
 		}
-		t.st.ioChan <- &iop
+		iops <- &iop
 		res := <-iop.replyChnl
 		err = res.err
 	} else {
@@ -346,18 +433,32 @@ func (t *fsTorrent) GetPiece(r common.PieceRequest, pc *common.PieceData) (err e
 	return
 }
 
+// VerifyChunkSize is how many bytes of a piece we read at a time when checking it
+// so big pieces don't have to be held in memory all at once
+const VerifyChunkSize = 1024 * 1024
+
 func (t *fsTorrent) VerifyPiece(idx uint32) (err error) {
 	l := t.meta.LengthOfPiece(idx)
+	h := t.meta.NewPieceHasher(idx)
 	r := common.PieceRequest{
-		Index:  idx,
-		Length: l,
+		Index: idx,
 	}
 	var pc common.PieceData
-	pc.Data = make([]byte, l)
-	pc.Index = idx
-	err = t.GetPiece(r, &pc)
-	if err == nil {
-		if t.meta.Info.CheckPiece(&pc) {
+	for r.Begin < l && err == nil {
+		r.Length = l - r.Begin
+		if r.Length > VerifyChunkSize {
+			r.Length = VerifyChunkSize
+		}
+		err = t.GetPiece(r, &pc)
+		h.Write(pc.Data)
+		r.Begin += r.Length
+	}
+	if missingData(err) {
+		// files copied over partly or not at all, we don't have the piece yet
+		t.bf.Unset(idx)
+		err = common.ErrInvalidPiece
+	} else if err == nil {
+		if h.Check() {
 			t.bf.Set(idx)
 		} else {
 			t.bf.Unset(idx)
@@ -367,6 +468,11 @@ func (t *fsTorrent) VerifyPiece(idx uint32) (err error) {
 	return
 }
 
+// is err from reading data that isn't on disk yet ?
+func missingData(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, os.ErrNotExist)
+}
+
 func (t *fsTorrent) VerifyAll() (err error) {
 	seqck.Lock() // Ensures sequential check
 	defer seqck.Unlock()
@@ -412,14 +518,14 @@ func (t *fsTorrent) putChunk(idx, offset uint32, data []byte) (err error) {
 	sz := int64(t.meta.Info.PieceLength)
 	off := (sz * int64(idx)) + int64(offset)
 	log.Debugf("put chunk idx=%d off=%d globaloff=%d len=%d", idx, offset, off, len(data))
-	if t.st.pooledIO() {
+	if iops := t.st.iops(); iops != nil {
 		iop := writeIOP{
 			data:      data,
 			offset:    off,
 			w:         t,
 			replyChnl: make(chan iopResult),
 		}
-		t.st.ioChan <- &iop
+		iops <- &iop
 		res := <-iop.replyChnl
 		err = res.err
 	} else {
@@ -447,6 +553,14 @@ func (t *fsTorrent) SaveStats(s *stats.Tracker) (err error) {
 	return
 }
 
+func (t *fsTorrent) SavePartial(blocks map[uint32]*bittorrent.Bitfield) error {
+	return t.st.savePartial(t.ih, blocks)
+}
+
+func (t *fsTorrent) LoadPartial() map[uint32]*bittorrent.Bitfield {
+	return t.st.loadPartial(t.ih)
+}
+
 func (t *fsTorrent) Checking() bool {
 	return t.checking
 }
@@ -454,9 +568,11 @@ func (t *fsTorrent) Checking() bool {
 func (t *fsTorrent) FileList() (flist []string) {
 	if t.meta != nil {
 		files := t.meta.Info.GetFiles()
-		flist = make([]string, len(files))
-		for idx, f := range files {
-			flist[idx] = f.Path.FilePath(t.dir)
+		for _, f := range files {
+			fname, err := t.fileName(t.dir, f)
+			if err == nil {
+				flist = append(flist, fname)
+			}
 		}
 	}
 	return
@@ -530,20 +646,29 @@ type FsStorage struct {
 	DataDir string
 	// directory for torrent seed data
 	MetaDir string
+	// put files of multi-file torrents right in the download directory
+	// instead of a directory named after the torrent
+	NoRootDir bool
 	// filesystem driver
 	FS fs.Driver
 	// number of io worker threads
 	Workers int
 	// IOP channel buffer size
 	IOPBufferSize int
-	// buffered io channel
+	// buffered io channel, set while Run is running
 	ioChan chan IOP
+	ioMtx  sync.RWMutex
+	// directory watched for new .torrent files, DataDir if empty
+	WatchDir string
+	// .torrent files found there that we are waiting on
+	watching map[string]watchedFile
+	watchMtx sync.Mutex
 }
 
 func (st *FsStorage) Run() {
 	n := st.Workers
 	if n <= 0 {
-		st.ioChan = nil
+		st.setIOPs(nil)
 	} else {
 		workers := n
 		buff := st.IOPBufferSize
@@ -551,14 +676,14 @@ func (st *FsStorage) Run() {
 			buff = 128
 		}
 		var wg sync.WaitGroup
-		st.ioChan = make(chan IOP, buff)
+		iops := make(chan IOP, buff)
 		for workers > 0 {
+			wg.Add(1)
 			go func() {
-				wg.Add(1)
 				for {
-					iop := <-st.ioChan
+					iop := <-iops
 					if iop == nil {
-						wg.Add(-1)
+						wg.Done()
 						return
 					}
 					iop.RunIOP()
@@ -566,15 +691,18 @@ func (st *FsStorage) Run() {
 			}()
 			workers--
 		}
+		st.setIOPs(iops)
 		wg.Wait()
 	}
 }
 
 func (st *FsStorage) Close() (err error) {
-	if st.pooledIO() {
+	if iops := st.iops(); iops != nil {
+		// io after this is done right away
+		st.setIOPs(nil)
 		workers := st.Workers
 		for workers > 0 {
-			st.ioChan <- nil
+			iops <- nil
 			workers--
 		}
 	}
@@ -657,6 +785,47 @@ func (st *FsStorage) settingsFilename(ih common.Infohash) string {
 	return st.FS.Join(st.MetaDir, ih.Hex()+".settings")
 }
 
+func (st *FsStorage) partialFilename(ih common.Infohash) string {
+	return st.FS.Join(st.MetaDir, ih.Hex()+".partial")
+}
+
+// blocks of one piece we don't have yet that are stored
+type fsPartialPiece struct {
+	Index  uint32              `bencode:"piece"`
+	Blocks bittorrent.Bitfield `bencode:"blocks"`
+}
+
+func (st *FsStorage) savePartial(ih common.Infohash, blocks map[uint32]*bittorrent.Bitfield) (err error) {
+	pieces := []fsPartialPiece{}
+	for idx, bf := range blocks {
+		pieces = append(pieces, fsPartialPiece{Index: idx, Blocks: *bf})
+	}
+	var f fs.WriteFile
+	f, err = st.FS.OpenFileWriteOnly(st.partialFilename(ih))
+	if err == nil {
+		err = bencode.NewEncoder(f).Encode(pieces)
+		f.Close()
+	}
+	return
+}
+
+func (st *FsStorage) loadPartial(ih common.Infohash) (blocks map[uint32]*bittorrent.Bitfield) {
+	f, err := st.FS.OpenFileReadOnly(st.partialFilename(ih))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var pieces []fsPartialPiece
+	if bencode.NewDecoder(f).Decode(&pieces) != nil || len(pieces) == 0 {
+		return
+	}
+	blocks = make(map[uint32]*bittorrent.Bitfield)
+	for idx := range pieces {
+		blocks[pieces[idx].Index] = &pieces[idx].Blocks
+	}
+	return
+}
+
 func (st *FsStorage) saveStatsForTorrent(ih common.Infohash, s *stats.Tracker) (err error) {
 	var f fs.WriteFile
 	f, err = st.FS.OpenFileWriteOnly(st.statsFilename(ih))
@@ -669,23 +838,54 @@ func (st *FsStorage) saveStatsForTorrent(ih common.Infohash, s *stats.Tracker) (
 
 func (st *FsStorage) EmptyTorrent(ih common.Infohash) (t Torrent) {
 	t = &fsTorrent{
-		dir: st.DataDir,
-		st:  st,
-		ih:  ih,
+		dir:       st.DataDir,
+		noRootDir: st.NoRootDir,
+		st:        st,
+		ih:        ih,
 	}
 	return
 }
 
+// DefaultLayout gets the layout new torrents get when none is given
+func (st *FsStorage) DefaultLayout() Layout {
+	return Layout{
+		Dir:       st.DataDir,
+		NoRootDir: st.NoRootDir,
+	}
+}
+
 func (st *FsStorage) OpenTorrent(info *metainfo.TorrentFile) (t Torrent, err error) {
-	t, err = st.openTorrent(info, st.DataDir)
+	t, err = st.OpenTorrentWithLayout(info, st.DefaultLayout())
+	return
+}
+
+func (st *FsStorage) OpenTorrentWithLayout(info *metainfo.TorrentFile, layout Layout) (t Torrent, err error) {
+	if layout.Dir == "" {
+		layout.Dir = st.DataDir
+	}
+	t, err = st.openTorrent(info, layout)
+	if err == nil {
+		st.putLayout(info.Infohash(), layout)
+	}
 	return
 }
 
-func (st *FsStorage) openTorrent(info *metainfo.TorrentFile, rootpath string) (t Torrent, err error) {
-	basepath := st.FS.Join(rootpath, info.TorrentName())
-	if !info.IsSingleFile() {
+func (st *FsStorage) openTorrent(info *metainfo.TorrentFile, layout Layout) (t Torrent, err error) {
+	err = info.Info.CheckPaths()
+	if err != nil {
+		return
+	}
+	err = info.Info.CheckPieces()
+	if err != nil {
+		return
+	}
+	err = info.ValidatePieceLayers()
+	if err != nil {
+		return
+	}
+	if !info.IsSingleFile() && !layout.NoRootDir {
 		// create directory
-		st.FS.EnsureDir(basepath)
+		st.FS.EnsureDir(st.FS.Join(layout.Dir, info.TorrentName()))
 	}
 
 	ih := info.Infohash()
@@ -702,10 +902,11 @@ func (st *FsStorage) openTorrent(info *metainfo.TorrentFile, rootpath string) (t
 
 	if err == nil {
 		ft := &fsTorrent{
-			dir:  rootpath,
-			st:   st,
-			meta: info,
-			ih:   ih,
+			dir:       layout.Dir,
+			noRootDir: layout.NoRootDir,
+			st:        st,
+			meta:      info,
+			ih:        ih,
 		}
 		log.Debugf("allocate space for %s", ft.Name())
 		err = ft.Allocate()
@@ -721,12 +922,43 @@ func (st *FsStorage) openTorrent(info *metainfo.TorrentFile, rootpath string) (t
 
 // return true if we are using pooled io
 func (st *FsStorage) pooledIO() bool {
-	return st.ioChan != nil
+	return st.iops() != nil
+}
+
+// get the channel the io workers take io from, nil when not using pooled io
+func (st *FsStorage) iops() chan IOP {
+	st.ioMtx.RLock()
+	defer st.ioMtx.RUnlock()
+	return st.ioChan
+}
+
+func (st *FsStorage) setIOPs(iops chan IOP) {
+	st.ioMtx.Lock()
+	st.ioChan = iops
+	st.ioMtx.Unlock()
 }
 
 func (st *FsStorage) initSettings(i common.Infohash) {
 	s := createSettings()
 	s.Put("dir", st.DataDir)
+	s.Put("noroot", settingsBool(st.NoRootDir))
+	st.putSettings(i, s)
+}
+
+// get the saved layout of a torrent
+func (st *FsStorage) getLayout(i common.Infohash) Layout {
+	s := st.getSettings(i)
+	return Layout{
+		Dir:       s.Get("dir", st.DataDir),
+		NoRootDir: s.Get("noroot", settingsBool(st.NoRootDir)) == "1",
+	}
+}
+
+// save the layout of a torrent
+func (st *FsStorage) putLayout(i common.Infohash, layout Layout) {
+	s := st.getSettings(i)
+	s.Put("dir", layout.Dir)
+	s.Put("noroot", settingsBool(layout.NoRootDir))
 	st.putSettings(i, s)
 }
 
@@ -764,36 +996,7 @@ func (st *FsStorage) OpenAllTorrents() (torrents []Torrent, err error) {
 			f.Close()
 		}
 		if err == nil {
-			s := st.getSettings(tf.Infohash())
-			path := s.Get("dir", st.DataDir)
-			t, err = st.openTorrent(tf, path)
-		}
-		if t != nil {
-			torrents = append(torrents, t)
-		}
-	}
-	return
-}
-
-func (st *FsStorage) PollNewTorrents() (torrents []Torrent) {
-	matches, _ := st.FS.Glob(st.FS.Join(st.DataDir, "*.torrent"))
-	for _, m := range matches {
-		var t Torrent
-		tf := new(metainfo.TorrentFile)
-		f, err := st.FS.OpenFileReadOnly(m)
-		if err == nil {
-			err = tf.BDecode(f)
-			f.Close()
-		}
-		if err != nil {
-			log.Warnf("error checking torrent file %s: %s", m, err)
-		}
-		if st.HasBitfield(tf.Infohash()) {
-			// we already have this torrent
-			continue
-		}
-		if err == nil {
-			t, err = st.OpenTorrent(tf)
+			t, err = st.openTorrent(tf, st.getLayout(tf.Infohash()))
 		}
 		if t != nil {
 			torrents = append(torrents, t)
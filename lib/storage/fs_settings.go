@@ -39,3 +39,10 @@ func (s *fsSettings) BEncode(w io.Writer) (err error) {
 	err = enc.Encode(s)
 	return
 }
+
+func settingsBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -23,7 +23,7 @@ type Torrent interface {
 	// return true if we are currently doing a deep check
 	Checking() bool
 
-	// put a chunk of data
+	// put a chunk of data, once this returns without error GetPiece sees the data even before Flush
 	PutChunk(pc *common.PieceData) error
 
 	// visit a piece from storage
@@ -59,6 +59,12 @@ type Torrent interface {
 	// save torrent stats
 	SaveStats(s *stats.Tracker) error
 
+	// save which blocks of pieces we don't have yet are stored, by piece index
+	SavePartial(blocks map[uint32]*bittorrent.Bitfield) error
+
+	// get the blocks last saved with SavePartial, nil if there are none
+	LoadPartial() map[uint32]*bittorrent.Bitfield
+
 	// get a list of files for this torrent
 	// returns absolute path of all downloaded files
 	FileList() []string
@@ -76,6 +82,14 @@ type Torrent interface {
 	DownloadDir() string
 }
 
+// Layout controls where and how the files of a torrent are put on disk
+type Layout struct {
+	// base download directory, empty means use the storage default
+	Dir string
+	// put files of multi-file torrents right in Dir instead of a directory named after the torrent
+	NoRootDir bool
+}
+
 // torrent storage driver
 type Storage interface {
 
@@ -89,6 +103,10 @@ type Storage interface {
 	// does not verify any piece data
 	OpenTorrent(info *metainfo.TorrentFile) (Torrent, error)
 
+	// open a storage session for a torrent with its files laid out as given
+	// does not verify any piece data
+	OpenTorrentWithLayout(info *metainfo.TorrentFile, layout Layout) (Torrent, error)
+
 	// open all torrents tracked by this storage
 	// does not verify any piece data
 	OpenAllTorrents() ([]Torrent, error)
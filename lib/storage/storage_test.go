@@ -1,14 +1,18 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/rand"
+	"github.com/majestrate/XD/lib/bittorrent"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/fs"
 	"github.com/majestrate/XD/lib/log"
 	"github.com/majestrate/XD/lib/metainfo"
 	"github.com/majestrate/XD/lib/mktorrent"
 	"io"
+	"os"
 	"testing"
+	"time"
 )
 
 const testPieceLen = 65536
@@ -29,19 +33,7 @@ func TestStorage(t *testing.T) {
 
 	log.SetLevel("debug")
 
-	st := &FsStorage{
-		MetaDir:    "storage",
-		DataDir:    "data",
-		SeedingDir: "seeding",
-		FS:         fs.STD,
-	}
-
-	err := st.Init()
-	if err != nil {
-		t.Log("failed to init storage")
-		t.Fail()
-		return
-	}
+	st := newTestStorage(t)
 	fname := st.FS.Join(st.DataDir, "test.bin")
 	meta, err := createRandomTorrent(fname)
 	if err != nil {
@@ -93,3 +85,330 @@ func TestStorage(t *testing.T) {
 	}
 
 }
+
+func newTestStorage(t *testing.T) *FsStorage {
+	dir := t.TempDir()
+	st := &FsStorage{
+		MetaDir:    fs.STD.Join(dir, "metadata"),
+		DataDir:    fs.STD.Join(dir, "downloads"),
+		SeedingDir: fs.STD.Join(dir, "seeding"),
+		FS:         fs.STD,
+	}
+	if err := st.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func multiFileTorrent(paths ...metainfo.FilePath) *metainfo.TorrentFile {
+	info := metainfo.Info{
+		PieceLength: testPieceLen,
+		Path:        "multi",
+		Pieces:      make([]byte, 20),
+	}
+	for _, p := range paths {
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length: 128,
+			Path:   p,
+		})
+	}
+	return &metainfo.TorrentFile{Info: info}
+}
+
+func TestOpenTorrentRejectsUnsafePath(t *testing.T) {
+	st := newTestStorage(t)
+	_, err := st.OpenTorrent(multiFileTorrent(metainfo.FilePath{"..", "evil"}))
+	if err != metainfo.ErrUnsafePath {
+		t.Errorf("torrent with ../ file was not rejected: %v", err)
+	}
+	tf := multiFileTorrent(metainfo.FilePath{"ok"})
+	tf.Info.Path = ".."
+	_, err = st.OpenTorrent(tf)
+	if err != metainfo.ErrUnsafePath {
+		t.Errorf("torrent named .. was not rejected: %v", err)
+	}
+	if st.FS.FileExists(st.FS.Join(st.DataDir, "..", "evil")) {
+		t.Error("file was made outside of the download directory")
+	}
+}
+
+func TestOpenTorrentRejectsEmpty(t *testing.T) {
+	st := newTestStorage(t)
+	tf := multiFileTorrent(metainfo.FilePath{"a"})
+	tf.Info.Pieces = nil
+	if _, err := st.OpenTorrent(tf); err != metainfo.ErrNoPieces {
+		t.Errorf("torrent with no pieces was not rejected: %v", err)
+	}
+	tf = multiFileTorrent(metainfo.FilePath{"a"})
+	tf.Info.Files[0].Length = testPieceLen * 2
+	if _, err := st.OpenTorrent(tf); err != metainfo.ErrBadPieceCount {
+		t.Errorf("torrent longer than its pieces was not rejected: %v", err)
+	}
+}
+
+func TestLayoutNoRootDir(t *testing.T) {
+	st := newTestStorage(t)
+	tf := multiFileTorrent(metainfo.FilePath{"a.txt"}, metainfo.FilePath{"sub", "b.txt"})
+	torrent, err := st.OpenTorrentWithLayout(tf, Layout{NoRootDir: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		st.FS.Join(st.DataDir, "a.txt"),
+		st.FS.Join(st.DataDir, "sub", "b.txt"),
+	}
+	for idx, f := range torrent.FileList() {
+		if f != expected[idx] {
+			t.Errorf("file at %s but expected %s", f, expected[idx])
+		}
+		if !st.FS.FileExists(f) {
+			t.Errorf("%s was not allocated", f)
+		}
+	}
+	// layout is kept when we open it again
+	torrents, err := st.OpenAllTorrents()
+	if err != nil || len(torrents) != 1 {
+		t.Fatalf("failed to reopen torrent: %v", err)
+	}
+	if f := torrents[0].FileList()[0]; f != expected[0] {
+		t.Errorf("reopened file at %s but expected %s", f, expected[0])
+	}
+}
+
+func TestDeleteNoRootDir(t *testing.T) {
+	st := newTestStorage(t)
+	keep := st.FS.Join(st.DataDir, "other", "keep.txt")
+	if err := st.FS.EnsureFile(keep, 1); err != nil {
+		t.Fatal(err)
+	}
+	tf := multiFileTorrent(metainfo.FilePath{"a.txt"}, metainfo.FilePath{"sub", "deep", "b.txt"}, metainfo.FilePath{"other", "c.txt"})
+	torrent, err := st.OpenTorrentWithLayout(tf, Layout{NoRootDir: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = torrent.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range torrent.FileList() {
+		if st.FS.FileExists(f) {
+			t.Errorf("%s was not deleted", f)
+		}
+	}
+	if st.FS.FileExists(st.FS.Join(st.DataDir, "sub")) {
+		t.Error("empty directories were left behind")
+	}
+	if !st.FS.FileExists(keep) {
+		t.Error("deleted a file that is not part of the torrent")
+	}
+}
+
+func TestLayoutRootDir(t *testing.T) {
+	st := newTestStorage(t)
+	tf := multiFileTorrent(metainfo.FilePath{"a.txt"})
+	torrent, err := st.OpenTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := st.FS.Join(st.DataDir, "multi", "a.txt")
+	if f := torrent.FileList()[0]; f != expected {
+		t.Errorf("file at %s but expected %s", f, expected)
+	}
+}
+
+func TestUnsafePathsStayInDownloadDir(t *testing.T) {
+	st := newTestStorage(t)
+	evil := []metainfo.FilePath{
+		{"..", "..", "etc", "passwd"},
+		{"/etc/passwd"},
+		{"a", "..", "..", "..", "escaped"},
+	}
+	for _, p := range evil {
+		// skip the checks done when opening so we test the storage mapping itself
+		ft := &fsTorrent{
+			dir:  st.DataDir,
+			st:   st,
+			meta: multiFileTorrent(p),
+		}
+		if err := ft.Allocate(); err != metainfo.ErrUnsafePath {
+			t.Errorf("allocated unsafe path %q: %v", p, err)
+		}
+		if _, err := ft.WriteAt([]byte("owned"), 0); err != metainfo.ErrUnsafePath {
+			t.Errorf("wrote to unsafe path %q: %v", p, err)
+		}
+		if _, err := ft.ReadAt(make([]byte, 8), 0); err != metainfo.ErrUnsafePath {
+			t.Errorf("read from unsafe path %q: %v", p, err)
+		}
+		if l := ft.FileList(); len(l) != 0 {
+			t.Errorf("unsafe path %q listed as %q", p, l)
+		}
+	}
+	for _, name := range []string{"../../etc/passwd", "/etc/passwd", ".."} {
+		ft := &fsTorrent{
+			dir: st.DataDir,
+			st:  st,
+			meta: &metainfo.TorrentFile{
+				Info: metainfo.Info{Path: name, Length: 128, PieceLength: testPieceLen},
+			},
+		}
+		if err := ft.Allocate(); err != metainfo.ErrUnsafePath {
+			t.Errorf("allocated unsafe name %q: %v", name, err)
+		}
+	}
+	for _, f := range []string{"etc", "escaped"} {
+		if st.FS.FileExists(st.FS.Join(st.DataDir, "..", f)) || st.FS.FileExists(st.FS.Join(st.DataDir, "..", "..", f)) {
+			t.Errorf("%s was made outside of the download directory", f)
+		}
+	}
+}
+
+func testGetPieceAfterPutChunk(t *testing.T, st *FsStorage) {
+	torrent, err := st.OpenTorrent(multiFileTorrent(metainfo.FilePath{"a"}, metainfo.FilePath{"b"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// chunk goes over the end of the first file into the second one
+	for round := 0; round < 8; round++ {
+		data := make([]byte, 150)
+		rand.Read(data)
+		err = torrent.PutChunk(&common.PieceData{Index: 0, Begin: 64, Data: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pc common.PieceData
+		err = torrent.GetPiece(common.PieceRequest{Index: 0, Begin: 64, Length: 150}, &pc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pc.Data, data) {
+			t.Fatalf("round %d: got back different data than was just put", round)
+		}
+	}
+}
+
+func TestGetPieceAfterPutChunk(t *testing.T) {
+	testGetPieceAfterPutChunk(t, newTestStorage(t))
+}
+
+func TestGetPieceAfterPutChunkPooled(t *testing.T) {
+	st := newTestStorage(t)
+	st.Workers = 4
+	go st.Run()
+	for !st.pooledIO() {
+		time.Sleep(time.Millisecond)
+	}
+	defer st.Close()
+	testGetPieceAfterPutChunk(t, st)
+}
+
+func TestVerifyPartialData(t *testing.T) {
+	st := newTestStorage(t)
+	fname := st.FS.Join(st.DataDir, "partial.bin")
+	meta, err := createRandomTorrent(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the whole file is there but two pieces got damaged
+	for _, idx := range []int{2, 5} {
+		data[idx*testPieceLen+1] ^= 0xff
+	}
+	if err := os.WriteFile(fname, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := st.OpenTorrent(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.VerifyAll(); err != nil {
+		t.Fatal(err)
+	}
+	bf := torrent.Bitfield()
+	for idx := uint32(0); idx < meta.Info.NumPieces(); idx++ {
+		if bf.Has(idx) == (idx == 2 || idx == 5) {
+			t.Errorf("piece %d: have %v", idx, bf.Has(idx))
+		}
+	}
+
+	// only the start of the file was copied over
+	if err := os.WriteFile(fname, data[:testPieceLen*3+100], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.VerifyAll(); err != nil {
+		t.Fatal(err)
+	}
+	for idx := uint32(0); idx < meta.Info.NumPieces(); idx++ {
+		if bf.Has(idx) != (idx < 2) {
+			t.Errorf("short file, piece %d: have %v", idx, bf.Has(idx))
+		}
+	}
+	// what is missing can still be downloaded
+	for idx := uint32(2); idx < meta.Info.NumPieces(); idx++ {
+		orig := data[idx*testPieceLen:]
+		if idx == 2 || idx == 5 {
+			orig = append([]byte{}, orig...)
+			orig[1] ^= 0xff
+		}
+		l := meta.LengthOfPiece(idx)
+		if err := torrent.PutChunk(&common.PieceData{Index: idx, Data: orig[:l]}); err != nil {
+			t.Fatal(err)
+		}
+		if err := torrent.VerifyPiece(idx); err != nil {
+			t.Errorf("piece %d: %s", idx, err)
+		}
+	}
+	if !bf.Completed() {
+		t.Error("not complete after downloading the rest")
+	}
+
+	// nothing there at all
+	if err := os.Remove(fname); err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.VerifyAll(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bf.CountSet(); n != 0 {
+		t.Errorf("have %d pieces of a file that is gone", n)
+	}
+}
+
+func TestPartialBlocks(t *testing.T) {
+	st := newTestStorage(t)
+	fname := st.FS.Join(st.DataDir, "partial.bin")
+	meta, err := createRandomTorrent(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := st.OpenTorrent(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := torrent.LoadPartial(); blocks != nil {
+		t.Fatalf("got %d partial pieces before saving any", len(blocks))
+	}
+	bf := bittorrent.NewBitfield(4, nil)
+	bf.Set(0)
+	bf.Set(2)
+	if err := torrent.SavePartial(map[uint32]*bittorrent.Bitfield{3: bf}); err != nil {
+		t.Fatal(err)
+	}
+	// a fresh session sees what the last one saved
+	torrent, err = st.OpenTorrent(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := torrent.LoadPartial()
+	if len(blocks) != 1 || blocks[3] == nil || !blocks[3].Equals(bf) {
+		t.Fatalf("loaded %v, expected piece 3 with blocks 0 and 2", blocks)
+	}
+	// nothing left in progress
+	if err := torrent.SavePartial(nil); err != nil {
+		t.Fatal(err)
+	}
+	if blocks := torrent.LoadPartial(); blocks != nil {
+		t.Errorf("got %d partial pieces after saving none", len(blocks))
+	}
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/metainfo"
+	"time"
+)
+
+// MaxWatchTries is how many polls in a row we fail to read a .torrent file that stopped changing before giving up on it
+const MaxWatchTries = 5
+
+// suffix added to .torrent files in the watch directory once they are added
+const watchAddedSuffix = ".added"
+
+// suffix added to .torrent files in the watch directory we could not read
+const watchInvalidSuffix = ".invalid"
+
+// a .torrent file in the watch directory as it was on the last poll
+type watchedFile struct {
+	size  int64
+	mod   time.Time
+	tries int
+}
+
+func (st *FsStorage) watchDir() string {
+	if st.WatchDir == "" {
+		return st.DataDir
+	}
+	return st.WatchDir
+}
+
+// PollNewTorrents opens .torrent files dropped into the watch directory
+// a file is only read once it did not change since the last poll so we don't read one still being written
+// files are renamed to end in .added once added so each is added once
+func (st *FsStorage) PollNewTorrents() (torrents []Torrent) {
+	matches, _ := st.FS.Glob(st.FS.Join(st.watchDir(), "*.torrent"))
+	st.watchMtx.Lock()
+	defer st.watchMtx.Unlock()
+	// anything not found this time is forgotten
+	watching := make(map[string]watchedFile)
+	for _, m := range matches {
+		fi, err := st.FS.Stat(m)
+		if err != nil {
+			continue
+		}
+		w := watchedFile{
+			size: fi.Size(),
+			mod:  fi.ModTime(),
+		}
+		last, had := st.watching[m]
+		if !had || last.size != w.size || !last.mod.Equal(w.mod) {
+			// new or still being written, look again next time
+			watching[m] = w
+			continue
+		}
+		w.tries = last.tries
+		tf := new(metainfo.TorrentFile)
+		f, err := st.FS.OpenFileReadOnly(m)
+		if err == nil {
+			err = tf.BDecode(f)
+			f.Close()
+		}
+		var t Torrent
+		if err == nil && !st.HasBitfield(tf.Infohash()) {
+			t, err = st.OpenTorrent(tf)
+		}
+		if err != nil {
+			w.tries++
+			if w.tries < MaxWatchTries {
+				log.Debugf("could not read torrent file %s yet: %s", m, err)
+				watching[m] = w
+			} else {
+				log.Warnf("giving up on torrent file %s: %s", m, err)
+				st.FS.Move(m, m+watchInvalidSuffix)
+			}
+			continue
+		}
+		if t != nil {
+			torrents = append(torrents, t)
+		}
+		err = st.FS.Move(m, m+watchAddedSuffix)
+		if err != nil {
+			log.Warnf("could not rename torrent file %s: %s", m, err)
+		}
+	}
+	st.watching = watching
+	return
+}
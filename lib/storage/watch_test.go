@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/majestrate/XD/lib/metainfo"
+	"os"
+	"testing"
+)
+
+func encodeTorrent(t *testing.T, tf *metainfo.TorrentFile) []byte {
+	var buff bytes.Buffer
+	if err := tf.BEncode(&buff); err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+func TestWatchDirAddsOnce(t *testing.T) {
+	st := newTestStorage(t)
+	st.WatchDir = t.TempDir()
+	fname := st.FS.Join(st.WatchDir, "test.torrent")
+	if err := os.WriteFile(fname, encodeTorrent(t, multiFileTorrent(metainfo.FilePath{"a"})), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// first time it is seen it might still be getting written
+	if got := st.PollNewTorrents(); len(got) != 0 {
+		t.Fatalf("added %d torrents on first sight", len(got))
+	}
+	if got := st.PollNewTorrents(); len(got) != 1 {
+		t.Fatalf("added %d torrents, expected 1", len(got))
+	}
+	if st.FS.FileExists(fname) || !st.FS.FileExists(fname+watchAddedSuffix) {
+		t.Error("added torrent file was not renamed")
+	}
+	for idx := 0; idx < 3; idx++ {
+		if got := st.PollNewTorrents(); len(got) != 0 {
+			t.Fatalf("added the torrent again")
+		}
+	}
+}
+
+func TestWatchDirRetriesPartialFile(t *testing.T) {
+	st := newTestStorage(t)
+	st.WatchDir = t.TempDir()
+	fname := st.FS.Join(st.WatchDir, "partial.torrent")
+	data := encodeTorrent(t, multiFileTorrent(metainfo.FilePath{"b"}))
+	if err := os.WriteFile(fname, data[:len(data)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < MaxWatchTries; idx++ {
+		if got := st.PollNewTorrents(); len(got) != 0 {
+			t.Fatalf("added a partly written torrent")
+		}
+	}
+	if !st.FS.FileExists(fname) {
+		t.Fatal("gave up on the partly written torrent too soon")
+	}
+	// the rest gets written
+	if err := os.WriteFile(fname, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	added := 0
+	for idx := 0; idx < 2; idx++ {
+		added += len(st.PollNewTorrents())
+	}
+	if added != 1 {
+		t.Errorf("added %d torrents once it was written, expected 1", added)
+	}
+}
+
+func TestWatchDirGivesUp(t *testing.T) {
+	st := newTestStorage(t)
+	st.WatchDir = t.TempDir()
+	fname := st.FS.Join(st.WatchDir, "bad.torrent")
+	if err := os.WriteFile(fname, []byte("not a torrent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx <= MaxWatchTries; idx++ {
+		st.PollNewTorrents()
+	}
+	if st.FS.FileExists(fname) || !st.FS.FileExists(fname+watchInvalidSuffix) {
+		t.Error("unreadable torrent file was not set aside")
+	}
+}
@@ -1,9 +1,17 @@
 package tracker
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/network"
+	"github.com/majestrate/XD/lib/sync"
+	"io"
+	"net"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -28,14 +36,56 @@ type Request struct {
 	Event      Event
 	NumWant    int
 	Compact    bool
+	Key        string
+	NoPeerID   bool
+	Addr       net.Addr
+	// our addresses on each ip family, trackers are told the one on the family we reach them over
+	Addrs      []net.Addr
+	UserAgent  string
 	GetNetwork func() network.Network
+	// changes the tracker's announce url right before announcing, nil to announce to it as it is
+	// it gets a copy it may change and returns the url to use, nil to use it unchanged
+	RewriteURL func(*url.URL) *url.URL
+}
+
+// the url to announce to for the tracker at u
+func (req *Request) announceURL(u *url.URL) *url.URL {
+	if req.RewriteURL == nil {
+		return u
+	}
+	c := *u
+	if rewritten := req.RewriteURL(&c); rewritten != nil {
+		return rewritten
+	}
+	return u
+}
+
+// GenerateKey makes a random key for identifying ourselves to trackers
+func GenerateKey() string {
+	var k [4]byte
+	io.ReadFull(rand.Reader, k[:])
+	return hex.EncodeToString(k[:])
 }
 
 type Response struct {
 	Interval     int           `bencode:"interval"`
+	MinInterval  int           `bencode:"min interval"`
+	Complete     int           `bencode:"complete"`
+	Incomplete   int           `bencode:"incomplete"`
 	Peers        []common.Peer `bencode:"peers"`
 	Error        string        `bencode:"failure reason"`
+	TrackerID    string        `bencode:"tracker id"`
 	NextAnnounce time.Time     `bencode:"-"`
+	// the ip the tracker sees us at, nil if it did not say
+	ExternalIP net.IP `bencode:"-"`
+}
+
+// parse the 4 or 16 byte external ip trackers send back (BEP 24), nil if it is neither
+func parseExternalIP(raw string) net.IP {
+	if len(raw) != net.IPv4len && len(raw) != net.IPv6len {
+		return nil
+	}
+	return net.IP([]byte(raw))
 }
 
 // bittorrent announcer, gets peers and announces presence in swarm
@@ -46,14 +96,56 @@ type Announcer interface {
 	Name() string
 }
 
+// ErrUnknownScheme is returned for tracker urls with a scheme we have no announcer for
+var ErrUnknownScheme = errors.New("unknown tracker url scheme")
+
+// ErrNoAddrs is returned when a tracker's host resolves to no addresses
+var ErrNoAddrs = errors.New("tracker host has no addresses")
+
+// makes an announcer for a tracker url
+type AnnouncerFactory func(u *url.URL) Announcer
+
+func newHttpAnnouncer(u *url.URL) Announcer { return NewHttpTracker(u) }
+func newUDPAnnouncer(u *url.URL) Announcer  { return NewUDPTracker(u) }
+
+// guards schemes
+var schemesMtx sync.RWMutex
+
+// announcer factories by url scheme
+var schemes = map[string]AnnouncerFactory{
+	"http":  newHttpAnnouncer,
+	"https": newHttpAnnouncer,
+	"udp":   newUDPAnnouncer,
+}
+
+// RegisterScheme makes tracker urls with scheme use f
+func RegisterScheme(scheme string, f AnnouncerFactory) {
+	schemesMtx.Lock()
+	schemes[strings.ToLower(scheme)] = f
+	schemesMtx.Unlock()
+}
+
+// NewAnnouncer makes the announcer for a tracker url by its scheme
+func NewAnnouncer(str string) (a Announcer, err error) {
+	var u *url.URL
+	u, err = url.Parse(str)
+	if err != nil {
+		return
+	}
+	schemesMtx.RLock()
+	f, ok := schemes[u.Scheme]
+	schemesMtx.RUnlock()
+	if !ok {
+		err = fmt.Errorf("%w: %q", ErrUnknownScheme, u.Scheme)
+		return
+	}
+	a = f(u)
+	return
+}
+
 // get announcer from url
 // returns nil if invalid url
 func FromURL(str string) Announcer {
-	u, err := url.Parse(str)
-	if err == nil {
-		if u.Scheme == "http" {
-			return NewHttpTracker(u)
-		}
-	}
-	return nil
+	a, _ := NewAnnouncer(str)
+	return a
 }
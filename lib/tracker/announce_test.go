@@ -0,0 +1,83 @@
+package tracker
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestNewAnnouncerByScheme(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		http bool
+	}{
+		{"http://tracker.i2p/a", true},
+		{"https://tracker.example/announce", true},
+		{"HTTP://tracker.i2p/a", true},
+		{"udp://tracker.example:6969", false},
+	} {
+		a, err := NewAnnouncer(test.url)
+		if err != nil {
+			t.Errorf("%s: %s", test.url, err)
+			continue
+		}
+		_, isHttp := a.(*HttpTracker)
+		_, isUDP := a.(*UDPTracker)
+		if isHttp != test.http || isUDP == test.http {
+			t.Errorf("%s: got %T", test.url, a)
+		}
+	}
+	for _, u := range []string{"wss://tracker.example/announce", "tracker.example", "://"} {
+		if a, err := NewAnnouncer(u); err == nil {
+			t.Errorf("%s: got announcer %T", u, a)
+		}
+		if FromURL(u) != nil {
+			t.Errorf("%s: FromURL gave an announcer", u)
+		}
+	}
+	if _, err := NewAnnouncer("wss://tracker.example/announce"); !errors.Is(err, ErrUnknownScheme) {
+		t.Errorf("unknown scheme gave error %v", err)
+	}
+}
+
+type testAnnouncer struct {
+	u *url.URL
+}
+
+func (a *testAnnouncer) Announce(req *Request) (*Response, error) { return new(Response), nil }
+func (a *testAnnouncer) Name() string                             { return a.u.String() }
+
+func TestRegisterScheme(t *testing.T) {
+	RegisterScheme("test", func(u *url.URL) Announcer { return &testAnnouncer{u: u} })
+	defer func() {
+		schemesMtx.Lock()
+		delete(schemes, "test")
+		schemesMtx.Unlock()
+	}()
+	a, err := NewAnnouncer("test://tracker/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.(*testAnnouncer); !ok || a.Name() != "test://tracker/announce" {
+		t.Errorf("got %T named %s", a, a.Name())
+	}
+}
+
+func TestRegisterSchemeWhileAnnouncing(t *testing.T) {
+	defer func() {
+		schemesMtx.Lock()
+		delete(schemes, "test2")
+		schemesMtx.Unlock()
+	}()
+	done := make(chan struct{})
+	go func() {
+		for idx := 0; idx < 100; idx++ {
+			NewAnnouncer("udp://tracker:6969/announce")
+		}
+		close(done)
+	}()
+	for idx := 0; idx < 100; idx++ {
+		RegisterScheme("test2", func(u *url.URL) Announcer { return &testAnnouncer{u: u} })
+	}
+	<-done
+}
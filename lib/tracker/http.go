@@ -5,26 +5,47 @@ import (
 	"fmt"
 	"github.com/majestrate/XD/lib/common"
 	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/network"
 	"github.com/majestrate/XD/lib/sync"
+	"github.com/majestrate/XD/lib/version"
 	"github.com/zeebo/bencode"
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 )
 
+// escape every byte of b as %XX
+// url.QueryEscape leaves printable bytes as they are and turns spaces into +, some trackers get the wrong infohash from that
+func escapeBytes(b []byte) string {
+	const hex = "0123456789ABCDEF"
+	buf := make([]byte, 0, len(b)*3)
+	for _, c := range b {
+		buf = append(buf, '%', hex[c>>4], hex[c&15])
+	}
+	return string(buf)
+}
+
+// MaxHttpRedirects is how many redirects we follow for one announce
+const MaxHttpRedirects = 5
+
+// ErrTooManyRedirects is returned when a tracker redirects us more than MaxHttpRedirects times
+var ErrTooManyRedirects = errors.New("too many tracker redirects")
+
 // http tracker
 type HttpTracker struct {
 	u *url.URL
 	// last time we resolved the remote address
 	lastResolved time.Time
-	// cached network address of tracker
-	addr net.Addr
+	// cached network addresses of tracker, the one that last worked first
+	addrs []net.Addr
 	// how often to resolve network address
 	resolveInterval time.Duration
 	// currently resolving the address ?
 	resolving sync.Mutex
+	// tracker id the tracker gave us for each torrent, sent back on later announces
+	trackerIDs map[common.Infohash]string
+	idMtx      sync.Mutex
 }
 
 // create new http tracker from url
@@ -33,6 +54,7 @@ func NewHttpTracker(u *url.URL) *HttpTracker {
 		u:               u,
 		resolveInterval: time.Hour,
 		lastResolved:    time.Unix(0, 0),
+		trackerIDs:      make(map[common.Infohash]string),
 	}
 
 	return t
@@ -42,11 +64,146 @@ func (t *HttpTracker) shouldResolve() bool {
 	return t.lastResolved.Add(t.resolveInterval).Before(time.Now())
 }
 
+// get the ip of an address, nil if it is not an ip address
+func addrIP(a net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// pick the address we announce, the one on the ip family we reach the tracker over if Addr is on the other one
+func (t *HttpTracker) localAddr(req *Request) net.Addr {
+	a := req.Addr
+	if a == nil {
+		a = req.GetNetwork().Addr()
+	}
+	ip := addrIP(a)
+	if ip == nil || len(req.Addrs) == 0 {
+		return a
+	}
+	addrs, err := t.resolve(req.GetNetwork(), t.hostPort())
+	if err != nil {
+		return a
+	}
+	// the first one is the one that worked last
+	tip := addrIP(addrs[0])
+	if tip == nil {
+		return a
+	}
+	v4 := tip.To4() != nil
+	if (ip.To4() != nil) == v4 {
+		return a
+	}
+	for _, la := range req.Addrs {
+		if ip = addrIP(la); ip != nil && (ip.To4() != nil) == v4 {
+			return la
+		}
+	}
+	log.Debugf("%s: we have no address on its ip family, announcing %s", t.Name(), a)
+	return a
+}
+
+func (t *HttpTracker) trackerID(ih common.Infohash) string {
+	t.idMtx.Lock()
+	defer t.idMtx.Unlock()
+	return t.trackerIDs[ih]
+}
+
+func (t *HttpTracker) setTrackerID(ih common.Infohash, id string) {
+	t.idMtx.Lock()
+	t.trackerIDs[ih] = id
+	t.idMtx.Unlock()
+}
+
+// host and port of the tracker as the http client dials it
+func (t *HttpTracker) hostPort() string {
+	port := t.u.Port()
+	if port == "" {
+		port = "80"
+		if t.u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(t.u.Hostname(), port)
+}
+
+// resolve every address to try dialing, only the tracker itself is cached
+// anything else is a host we were redirected to
+func (t *HttpTracker) resolve(n network.Network, addr string) (addrs []net.Addr, err error) {
+	t.resolving.Lock()
+	defer t.resolving.Unlock()
+	ours := addr == t.hostPort()
+	if ours && !t.shouldResolve() {
+		addrs = append(addrs, t.addrs...)
+		return
+	}
+	var h, p string
+	h, p, err = net.SplitHostPort(addr)
+	if err == nil {
+		addrs, err = network.LookupAll(n, h, p)
+	}
+	if err == nil && len(addrs) == 0 {
+		err = ErrNoAddrs
+	}
+	if err == nil && ours {
+		t.addrs = append([]net.Addr{}, addrs...)
+		t.lastResolved = time.Now()
+	}
+	return
+}
+
+// remember the tracker address that worked so it is tried first next time
+func (t *HttpTracker) prefer(a net.Addr) {
+	t.resolving.Lock()
+	defer t.resolving.Unlock()
+	for idx, addr := range t.addrs {
+		if addr.String() == a.String() {
+			copy(t.addrs[1:idx+1], t.addrs[:idx])
+			t.addrs[0] = addr
+			return
+		}
+	}
+}
+
+// dial each address addr resolves to in order until one connects
+func (t *HttpTracker) dial(n network.Network, addr string) (c net.Conn, err error) {
+	var addrs []net.Addr
+	addrs, err = t.resolve(n, addr)
+	if err != nil {
+		return
+	}
+	for _, a := range addrs {
+		c, err = n.Dial(a.Network(), a.String())
+		if err == nil {
+			if addr == t.hostPort() {
+				t.prefer(a)
+			}
+			return
+		}
+		log.Debugf("%s: could not connect to %s: %s", t.Name(), a, err)
+	}
+	return
+}
+
 // http compact response
 type compactHttpAnnounceResponse struct {
-	Peers    interface{} `bencode:"peers"`
-	Interval int         `bencode:"interval"`
-	Error    string      `bencode:"failure reason"`
+	Peers       interface{} `bencode:"peers"`
+	Peers6      string      `bencode:"peers6"`
+	Interval    int         `bencode:"interval"`
+	MinInterval int         `bencode:"min interval"`
+	Complete    int         `bencode:"complete"`
+	Incomplete  int         `bencode:"incomplete"`
+	Error       string      `bencode:"failure reason"`
+	TrackerID   string      `bencode:"tracker id"`
+	ExternalIP  string      `bencode:"external ip"`
+}
+
+// http non compact response
+type httpAnnounceResponse struct {
+	Response
+	ExternalIP string `bencode:"external ip"`
 }
 
 func (t *HttpTracker) Name() string {
@@ -62,69 +219,75 @@ func (t *HttpTracker) Announce(req *Request) (resp *Response, err error) {
 	var client http.Client
 
 	client.Transport = &http.Transport{
-		Dial: func(_, _ string) (c net.Conn, e error) {
-			var a net.Addr
-			t.resolving.Lock()
-			if t.shouldResolve() {
-				var h, p string
-				// XXX: hack
-				if strings.Index(t.u.Host, ":") == -1 {
-					t.u.Host += ":80"
-				}
-				h, p, e = net.SplitHostPort(t.u.Host)
-				if e == nil {
-					a, e = req.GetNetwork().Lookup(h, p)
-					if e == nil {
-						t.addr = a
-						t.lastResolved = time.Now()
-					}
-				}
-			} else {
-				a = t.addr
-			}
-			t.resolving.Unlock()
-			if e == nil {
-				c, e = req.GetNetwork().Dial(a.Network(), a.String())
-			}
-			return
+		Dial: func(_, addr string) (net.Conn, error) {
+			return t.dial(req.GetNetwork(), addr)
 		},
 	}
+	client.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		if len(via) > MaxHttpRedirects {
+			return ErrTooManyRedirects
+		}
+		log.Debugf("%s redirected to %s", t.Name(), r.URL.Host)
+		return nil
+	}
 
 	resp = new(Response)
 	interval := 30
 	// build query
 	var u *url.URL
-	u, err = url.Parse(t.u.String())
+	u, err = url.Parse(req.announceURL(t.u).String())
 	if err == nil {
+		// keep params already in the announce url, ours replace any with the same name
 		v := u.Query()
-		n := req.GetNetwork()
-		a := n.Addr()
+		a := t.localAddr(req)
 		host, _, _ := net.SplitHostPort(a.String())
 		if a.Network() == "i2p" {
 			host += ".i2p"
 			req.Compact = true
 		}
-		v.Add("ip", host)
-		v.Add("info_hash", string(req.Infohash.Bytes()))
-		v.Add("peer_id", string(req.PeerID.Bytes()))
-		v.Add("port", fmt.Sprintf("%d", req.Port))
-		v.Add("numwant", fmt.Sprintf("%d", req.NumWant))
-		v.Add("left", fmt.Sprintf("%d", req.Left))
+		v.Set("ip", host)
+		// sent escaped by hand below
+		v.Del("info_hash")
+		v.Del("peer_id")
+		v.Set("port", fmt.Sprintf("%d", req.Port))
+		v.Set("numwant", fmt.Sprintf("%d", req.NumWant))
+		v.Set("left", fmt.Sprintf("%d", req.Left))
 		if req.Event != Nop {
-			v.Add("event", req.Event.String())
+			v.Set("event", req.Event.String())
+		}
+		v.Set("downloaded", fmt.Sprintf("%d", req.Downloaded))
+		v.Set("uploaded", fmt.Sprintf("%d", req.Uploaded))
+		if req.Key != "" {
+			v.Set("key", req.Key)
+		}
+		if req.NoPeerID {
+			v.Set("no_peer_id", "1")
+		}
+		if id := t.trackerID(req.Infohash); id != "" {
+			v.Set("trackerid", id)
 		}
-		v.Add("downloaded", fmt.Sprintf("%d", req.Downloaded))
-		v.Add("uploaded", fmt.Sprintf("%d", req.Uploaded))
 
 		// compact response
 		if req.Compact || u.Path != "/a" {
 			req.Compact = true
-			v.Add("compact", "1")
+			v.Set("compact", "1")
 		}
-		u.RawQuery = v.Encode()
+		ih := escapeBytes(req.Infohash.Bytes())
+		id := escapeBytes(req.PeerID.Bytes())
+		u.RawQuery = "info_hash=" + ih + "&peer_id=" + id + "&" + v.Encode()
 		var r *http.Response
 		log.Debugf("%s announcing", t.Name())
-		r, err = client.Get(u.String())
+		var hreq *http.Request
+		hreq, err = http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return
+		}
+		ua := req.UserAgent
+		if ua == "" {
+			ua = version.UserAgent()
+		}
+		hreq.Header.Set("User-Agent", ua)
+		r, err = client.Do(hreq)
 		if err == nil {
 			defer r.Body.Close()
 			dec := bencode.NewDecoder(r.Body)
@@ -133,38 +296,22 @@ func (t *HttpTracker) Announce(req *Request) (resp *Response, err error) {
 				err = dec.Decode(cresp)
 				if err == nil {
 					interval = cresp.Interval
-					var cpeers string
-
-					_, ok := cresp.Peers.(string)
-					if ok {
-						cpeers = cresp.Peers.(string)
-						l := len(cpeers) / 32
-						for l > 0 {
-							var p common.Peer
-							// TODO: bounds check
-							copy(p.Compact[:], cpeers[(l-1)*32:l*32])
-							resp.Peers = append(resp.Peers, p)
-							l--
+					resp.MinInterval = cresp.MinInterval
+					resp.Complete = cresp.Complete
+					resp.Incomplete = cresp.Incomplete
+					resp.TrackerID = cresp.TrackerID
+					resp.ExternalIP = parseExternalIP(cresp.ExternalIP)
+					if _, ok := cresp.Peers.(string); ok {
+						// i2p destination hashes on i2p, ip and port anywhere else
+						enc := common.PeersIPv4
+						if a.Network() == "i2p" {
+							enc = common.PeersI2P
 						}
+						resp.Peers = common.ParsePeers(enc, cresp.Peers)
 					} else {
-						fullpeers, ok := cresp.Peers.([]interface{})
-						if ok {
-							for idx := range fullpeers {
-								// XXX: this is horribad :DDDDDDDDD
-								var peer map[string]interface{}
-								peer, ok = fullpeers[idx].(map[string]interface{})
-								if ok {
-									var p common.Peer
-									p.IP = fmt.Sprintf("%s", peer["ip"])
-									port, ok := peer["port"].(int64)
-									if ok {
-										p.Port = int(port)
-									}
-									resp.Peers = append(resp.Peers, p)
-								}
-							}
-						}
+						resp.Peers = common.ParsePeers(common.PeersDict, cresp.Peers)
 					}
+					resp.Peers = append(resp.Peers, common.ParsePeers(common.PeersIPv6, cresp.Peers6)...)
 
 					if len(cresp.Error) > 0 {
 						err = errors.New(cresp.Error)
@@ -172,7 +319,10 @@ func (t *HttpTracker) Announce(req *Request) (resp *Response, err error) {
 				}
 			} else {
 				// decode non compact response
-				err = dec.Decode(resp)
+				full := new(httpAnnounceResponse)
+				err = dec.Decode(full)
+				*resp = full.Response
+				resp.ExternalIP = parseExternalIP(full.ExternalIP)
 				interval = resp.Interval
 				if len(resp.Error) > 0 {
 					err = errors.New(resp.Error)
@@ -183,6 +333,9 @@ func (t *HttpTracker) Announce(req *Request) (resp *Response, err error) {
 
 	if err == nil {
 		log.Infof("%s got %d peers for %s", t.Name(), len(resp.Peers), req.Infohash.Hex())
+		if resp.TrackerID != "" {
+			t.setTrackerID(req.Infohash, resp.TrackerID)
+		}
 	} else {
 		log.Warnf("%s got error while announcing: %s", t.Name(), err)
 	}
@@ -0,0 +1,435 @@
+package tracker
+
+import (
+	"errors"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/network"
+	"github.com/majestrate/XD/lib/version"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var errTestNetwork = errors.New("not supported by test network")
+
+// network that dials out over tcp for talking to a local test tracker
+type testNetwork struct{}
+
+func (testNetwork) Dial(n, a string) (net.Conn, error) { return net.Dial(n, a) }
+func (testNetwork) Lookup(name, port string) (net.Addr, error) {
+	return net.ResolveTCPAddr("tcp", net.JoinHostPort(name, port))
+}
+func (testNetwork) Accept() (net.Conn, error)              { return nil, errTestNetwork }
+func (testNetwork) ReadFrom([]byte) (int, net.Addr, error) { return 0, nil, errTestNetwork }
+func (testNetwork) WriteTo([]byte, net.Addr) (int, error)  { return 0, errTestNetwork }
+func (testNetwork) Open() error                            { return nil }
+func (testNetwork) Close() error                           { return nil }
+func (testNetwork) Addr() net.Addr                         { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881} }
+
+// test network where every name resolves to the same addresses, keeps track of what was dialed
+type multiNetwork struct {
+	testNetwork
+	addrs []net.Addr
+	dials []string
+}
+
+func (m *multiNetwork) Dial(n, a string) (net.Conn, error) {
+	m.dials = append(m.dials, a)
+	return net.Dial(n, a)
+}
+
+func (m *multiNetwork) LookupAll(name, port string) ([]net.Addr, error) {
+	return m.addrs, nil
+}
+
+// an address on localhost nothing is listening on
+func deadAddr(t *testing.T, network string) net.Addr {
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc.Close()
+		return pc.LocalAddr()
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr()
+}
+
+func TestHttpAnnounceKey(t *testing.T) {
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/announce")
+	tr := NewHttpTracker(u)
+	key := GenerateKey()
+	for _, noPeerID := range []bool{false, true} {
+		_, err := tr.Announce(&Request{
+			Key:        key,
+			NoPeerID:   noPeerID,
+			GetNetwork: func() network.Network { return testNetwork{} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(queries) != 2 {
+		t.Fatalf("tracker got %d announces, expected 2", len(queries))
+	}
+	for _, q := range queries {
+		if q.Get("key") != key {
+			t.Errorf("key is %q but expected %q", q.Get("key"), key)
+		}
+	}
+	if queries[0].Get("no_peer_id") != "" {
+		t.Error("no_peer_id sent when not asked for")
+	}
+	if queries[1].Get("no_peer_id") != "1" {
+		t.Error("no_peer_id not sent")
+	}
+}
+
+func TestHttpAnnounceUserAgent(t *testing.T) {
+	var agents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/announce")
+	tr := NewHttpTracker(u)
+	for _, ua := range []string{"", "Test/1.0"} {
+		_, err := tr.Announce(&Request{
+			UserAgent:  ua,
+			GetNetwork: func() network.Network { return testNetwork{} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(agents) != 2 {
+		t.Fatalf("tracker got %d announces, expected 2", len(agents))
+	}
+	if agents[0] != version.UserAgent() {
+		t.Errorf("default user agent is %q, expected %q", agents[0], version.UserAgent())
+	}
+	if agents[1] != "Test/1.0" {
+		t.Errorf("user agent is %q, expected %q", agents[1], "Test/1.0")
+	}
+}
+
+func TestHttpAnnounceRedirect(t *testing.T) {
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+"/announce?"+r.URL.RawQuery, http.StatusFound)
+	}))
+	defer redirect.Close()
+	u, _ := url.Parse(redirect.URL + "/announce")
+	tr := NewHttpTracker(u)
+	key := GenerateKey()
+	_, err := tr.Announce(&Request{
+		Key:        key,
+		GetNetwork: func() network.Network { return testNetwork{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 {
+		t.Fatalf("tracker got %d announces after redirect, expected 1", len(queries))
+	}
+	if queries[0].Get("key") != key {
+		t.Errorf("key is %q after redirect", queries[0].Get("key"))
+	}
+}
+
+func TestHttpAnnounceRedirectLoop(t *testing.T) {
+	var hits int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.Redirect(w, r, srv.URL+"/announce", http.StatusMovedPermanently)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/announce")
+	tr := NewHttpTracker(u)
+	_, err := tr.Announce(&Request{
+		GetNetwork: func() network.Network { return testNetwork{} },
+	})
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("announce gave %v, expected too many redirects", err)
+	}
+	if hits != MaxHttpRedirects+1 {
+		t.Errorf("tracker got %d requests, expected %d", hits, MaxHttpRedirects+1)
+	}
+}
+
+func TestHttpAnnounceKeepsQuery(t *testing.T) {
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/announce?passkey=secret&port=1")
+	tr := NewHttpTracker(u)
+	_, err := tr.Announce(&Request{
+		Port:       6881,
+		GetNetwork: func() network.Network { return testNetwork{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 {
+		t.Fatalf("tracker got %d announces, expected 1", len(queries))
+	}
+	q := queries[0]
+	if q.Get("passkey") != "secret" {
+		t.Errorf("passkey is %q, expected it kept from the announce url", q.Get("passkey"))
+	}
+	if len(q["port"]) != 1 || q.Get("port") != "6881" {
+		t.Errorf("port is %q, expected ours to replace the one in the url", q["port"])
+	}
+}
+
+func TestHttpAnnounceRewriteURL(t *testing.T) {
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/announce?passkey=old")
+	tr := NewHttpTracker(u)
+	passkey := "first"
+	req := &Request{
+		GetNetwork: func() network.Network { return testNetwork{} },
+		RewriteURL: func(u *url.URL) *url.URL {
+			q := u.Query()
+			q.Set("passkey", passkey)
+			u.RawQuery = q.Encode()
+			return u
+		},
+	}
+	for _, key := range []string{"first", "second"} {
+		passkey = key
+		if _, err := tr.Announce(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(queries) != 2 {
+		t.Fatalf("tracker got %d announces, expected 2", len(queries))
+	}
+	if queries[0].Get("passkey") != "first" || queries[1].Get("passkey") != "second" {
+		t.Errorf("announced with passkeys %q and %q, expected first and second", queries[0].Get("passkey"), queries[1].Get("passkey"))
+	}
+	if u.Query().Get("passkey") != "old" {
+		t.Error("rewriting changed the tracker's own url")
+	}
+}
+
+func TestHttpAnnounceTrackerID(t *testing.T) {
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Write([]byte("d8:intervali60e5:peers0:10:tracker id5:abcdee"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/announce")
+	tr := NewHttpTracker(u)
+	for idx := 0; idx < 2; idx++ {
+		resp, err := tr.Announce(&Request{
+			GetNetwork: func() network.Network { return testNetwork{} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TrackerID != "abcde" {
+			t.Errorf("tracker id in response is %q", resp.TrackerID)
+		}
+	}
+	if len(queries) != 2 {
+		t.Fatalf("tracker got %d announces, expected 2", len(queries))
+	}
+	if _, has := queries[0]["trackerid"]; has {
+		t.Error("tracker id sent before the tracker gave us one")
+	}
+	if queries[1].Get("trackerid") != "abcde" {
+		t.Errorf("tracker id sent back is %q", queries[1].Get("trackerid"))
+	}
+	// other torrents on the same tracker don't get it
+	var other common.Infohash
+	other[0] = 1
+	tr.Announce(&Request{
+		Infohash:   other,
+		GetNetwork: func() network.Network { return testNetwork{} },
+	})
+	if queries[2].Get("trackerid") != "" {
+		t.Error("tracker id sent for another torrent")
+	}
+}
+
+func TestHttpAnnounceSwarmCounts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:completei12e10:incompletei3e8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/announce")
+	tr := NewHttpTracker(u)
+	for _, compact := range []bool{false, true} {
+		resp, err := tr.Announce(&Request{
+			Compact:    compact,
+			GetNetwork: func() network.Network { return testNetwork{} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Complete != 12 || resp.Incomplete != 3 {
+			t.Errorf("compact=%v got %d seeders and %d leechers, expected 12 and 3", compact, resp.Complete, resp.Incomplete)
+		}
+	}
+}
+
+func TestHttpAnnounceFailover(t *testing.T) {
+	announces := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces++
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+	dead := deadAddr(t, "tcp")
+	live := srv.Listener.Addr()
+	n := &multiNetwork{addrs: []net.Addr{dead, live}}
+	_, port, _ := net.SplitHostPort(live.String())
+	u, _ := url.Parse("http://tracker.test:" + port + "/announce")
+	tr := NewHttpTracker(u)
+	for idx := 0; idx < 2; idx++ {
+		_, err := tr.Announce(&Request{
+			GetNetwork: func() network.Network { return n },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if announces != 2 {
+		t.Fatalf("tracker got %d announces, expected 2", announces)
+	}
+	// the address that worked is tried first the second time
+	expected := []string{dead.String(), live.String(), live.String()}
+	if strings.Join(n.dials, " ") != strings.Join(expected, " ") {
+		t.Errorf("dialed %v, expected %v", n.dials, expected)
+	}
+}
+
+func TestHttpAnnounceExternalIP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d11:external ip4:\xcb\x00\x71\x07" + "8:intervali60e5:peerslee"))
+	}))
+	defer srv.Close()
+	for _, path := range []string{"/announce", "/a"} {
+		u, _ := url.Parse(srv.URL + path)
+		resp, err := NewHttpTracker(u).Announce(&Request{
+			GetNetwork: func() network.Network { return testNetwork{} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.ExternalIP.Equal(net.IPv4(203, 0, 113, 7)) {
+			t.Errorf("%s: external ip is %s, expected 203.0.113.7", path, resp.ExternalIP)
+		}
+	}
+}
+
+func TestHttpAnnounceEscapesEveryByte(t *testing.T) {
+	var raw []string
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw = append(raw, r.URL.RawQuery)
+		queries = append(queries, r.URL.Query())
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+	// the tracker url already has one, ours replaces it
+	u, _ := url.Parse(srv.URL + "/announce?info_hash=stale")
+	tr := NewHttpTracker(u)
+	var ih common.Infohash
+	copy(ih[:], " %AZaz09-._~+&=\x00\x7f\x80\xff!")
+	var id common.PeerID
+	copy(id[:], "-XD0001- %abcdefghij")
+	_, err := tr.Announce(&Request{
+		Infohash:   ih,
+		PeerID:     id,
+		GetNetwork: func() network.Network { return testNetwork{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 1 {
+		t.Fatalf("tracker got %d announces, expected 1", len(raw))
+	}
+	expected := "info_hash=%20%25%41%5A%61%7A%30%39%2D%2E%5F%7E%2B%26%3D%00%7F%80%FF%21" +
+		"&peer_id=%2D%58%44%30%30%30%31%2D%20%25%61%62%63%64%65%66%67%68%69%6A&"
+	if !strings.HasPrefix(raw[0], expected) {
+		t.Errorf("query is %q, expected it to start with %q", raw[0], expected)
+	}
+	if got := queries[0]["info_hash"]; len(got) != 1 || got[0] != string(ih[:]) {
+		t.Errorf("tracker decoded info_hash %q", got)
+	}
+	if got := queries[0].Get("peer_id"); got != string(id[:]) {
+		t.Errorf("tracker decoded peer_id %q", got)
+	}
+}
+
+func TestHttpAnnounceAddrFamily(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 6881}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 6881}
+	for _, family := range []string{"tcp4", "tcp6"} {
+		host := "127.0.0.1"
+		if family == "tcp6" {
+			host = "::1"
+		}
+		l, err := net.Listen(family, net.JoinHostPort(host, "0"))
+		if err != nil {
+			t.Skipf("no %s: %s", family, err)
+		}
+		var ips []string
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ips = append(ips, r.URL.Query().Get("ip"))
+			w.Write([]byte("d8:intervali60e5:peers0:e"))
+		}))
+		srv.Listener.Close()
+		srv.Listener = l
+		srv.Start()
+		u, _ := url.Parse(srv.URL + "/announce")
+		_, err = NewHttpTracker(u).Announce(&Request{
+			Addr:       v4,
+			Addrs:      []net.Addr{v4, v6},
+			GetNetwork: func() network.Network { return testNetwork{} },
+		})
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := v4.IP.String()
+		if family == "tcp6" {
+			expected = v6.IP.String()
+		}
+		if len(ips) != 1 || ips[0] != expected {
+			t.Errorf("%s only tracker was told our ip is %q, expected %s", family, ips, expected)
+		}
+	}
+}
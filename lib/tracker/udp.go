@@ -0,0 +1,286 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/majestrate/XD/lib/common"
+	"github.com/majestrate/XD/lib/log"
+	"github.com/majestrate/XD/lib/network"
+	"github.com/majestrate/XD/lib/sync"
+	"net"
+	"net/url"
+	"time"
+)
+
+// UDPTimeout is how long we wait for each reply from a udp tracker
+const UDPTimeout = time.Second * 15
+
+// UDPConnectionLifetime is how long a connection id from a udp tracker can be used for
+const UDPConnectionLifetime = time.Minute
+
+// magic connection id of connect requests
+const udpProtocolID = 0x41727101980
+
+// udp tracker actions, BEP 15
+const (
+	udpConnect  = 0
+	udpAnnounce = 1
+	udpError    = 3
+)
+
+// udp announce option type for the url path and query, BEP 41
+const udpOptURLData = 2
+
+// longest data of one option
+const udpOptMaxLen = 255
+
+// ErrUDPBadResponse is returned when a udp tracker replies with something we did not ask for
+var ErrUDPBadResponse = errors.New("bad response from udp tracker")
+
+// ErrUDPNotSupported is returned when announcing to a udp tracker on a network without udp
+var ErrUDPNotSupported = errors.New("udp trackers are not supported on this network")
+
+// udp tracker, BEP 15
+type UDPTracker struct {
+	u *url.URL
+	// how long to wait for each reply
+	Timeout time.Duration
+	// connection id the tracker gave us and when it stops being good
+	connID      uint64
+	connExpires time.Time
+	// address the connection id is for
+	connAddr string
+	connMtx  sync.Mutex
+	// address of the tracker that last answered, tried first next time
+	lastAddr string
+}
+
+// create new udp tracker from url
+func NewUDPTracker(u *url.URL) *UDPTracker {
+	return &UDPTracker{
+		u:       u,
+		Timeout: UDPTimeout,
+	}
+}
+
+func (t *UDPTracker) Name() string {
+	return t.u.String()
+}
+
+// BEP 41 url data options for the path and query of the announce url
+// split up into as many options as it takes to fit
+func (t *UDPTracker) urlData(req *Request) (opts []byte) {
+	u := req.announceURL(t.u)
+	data := u.EscapedPath()
+	if u.RawQuery != "" {
+		data += "?" + u.RawQuery
+	}
+	for len(data) > 0 {
+		l := len(data)
+		if l > udpOptMaxLen {
+			l = udpOptMaxLen
+		}
+		opts = append(opts, udpOptURLData, byte(l))
+		opts = append(opts, data[:l]...)
+		data = data[l:]
+	}
+	return
+}
+
+// send a request and wait for the reply to it, returns the reply after the action and transaction id
+func (t *UDPTracker) transact(c net.Conn, connID uint64, action uint32, body []byte) (reply []byte, err error) {
+	var tid [4]byte
+	_, err = rand.Read(tid[:])
+	if err != nil {
+		return
+	}
+	msg := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint64(msg, connID)
+	binary.BigEndian.PutUint32(msg[8:], action)
+	copy(msg[12:], tid[:])
+	msg = append(msg, body...)
+	c.SetDeadline(time.Now().Add(t.Timeout))
+	_, err = c.Write(msg)
+	if err != nil {
+		return
+	}
+	var buff [2048]byte
+	for {
+		var n int
+		n, err = c.Read(buff[:])
+		if err != nil {
+			return
+		}
+		if n < 8 || string(buff[4:8]) != string(tid[:]) {
+			// not for this request
+			continue
+		}
+		got := binary.BigEndian.Uint32(buff[:])
+		if got == udpError {
+			err = errors.New(string(buff[8:n]))
+		} else if got != action {
+			err = ErrUDPBadResponse
+		} else {
+			reply = append(reply, buff[8:n]...)
+		}
+		return
+	}
+}
+
+// get a connection id, reuses the last one until it expires
+func (t *UDPTracker) connect(c net.Conn) (id uint64, err error) {
+	t.connMtx.Lock()
+	defer t.connMtx.Unlock()
+	addr := c.RemoteAddr().String()
+	if addr == t.connAddr && time.Now().Before(t.connExpires) {
+		id = t.connID
+		return
+	}
+	var reply []byte
+	reply, err = t.transact(c, udpProtocolID, udpConnect, nil)
+	if err == nil && len(reply) < 8 {
+		err = ErrUDPBadResponse
+	}
+	if err == nil {
+		id = binary.BigEndian.Uint64(reply)
+		t.connID = id
+		t.connAddr = addr
+		t.connExpires = time.Now().Add(UDPConnectionLifetime)
+	}
+	return
+}
+
+// resolve the tracker's addresses, the one that last answered first
+func (t *UDPTracker) resolve(n network.Network) (addrs []string, err error) {
+	var found []net.Addr
+	found, err = network.LookupAll(n, t.u.Hostname(), t.u.Port())
+	if err == nil && len(found) == 0 {
+		err = ErrNoAddrs
+	}
+	if err != nil {
+		return
+	}
+	t.connMtx.Lock()
+	last := t.lastAddr
+	t.connMtx.Unlock()
+	for _, a := range found {
+		if a.String() == last {
+			addrs = append([]string{last}, addrs...)
+		} else {
+			addrs = append(addrs, a.String())
+		}
+	}
+	return
+}
+
+// announce to one address of the tracker
+func (t *UDPTracker) announceTo(n network.Network, addr string, req *Request) (reply []byte, remote net.Addr, err error) {
+	var c net.Conn
+	c, err = n.Dial("udp", addr)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	remote = c.RemoteAddr()
+	var id uint64
+	id, err = t.connect(c)
+	if err == nil {
+		log.Debugf("%s announcing to %s", t.Name(), addr)
+		reply, err = t.transact(c, id, udpAnnounce, t.announceBody(req))
+		if err != nil {
+			// the connection id might be why, get a new one next time
+			t.connMtx.Lock()
+			t.connExpires = time.Time{}
+			t.connMtx.Unlock()
+		}
+	}
+	if err == nil && len(reply) < 12 {
+		err = ErrUDPBadResponse
+	}
+	if err == nil {
+		t.connMtx.Lock()
+		t.lastAddr = addr
+		t.connMtx.Unlock()
+	}
+	return
+}
+
+func udpEvent(ev Event) uint32 {
+	switch ev {
+	case Completed:
+		return 1
+	case Started:
+		return 2
+	case Stopped:
+		return 3
+	}
+	return 0
+}
+
+// body of an announce request
+func (t *UDPTracker) announceBody(req *Request) []byte {
+	body := make([]byte, 82)
+	copy(body, req.Infohash.Bytes())
+	copy(body[20:], req.PeerID.Bytes())
+	binary.BigEndian.PutUint64(body[40:], req.Downloaded)
+	binary.BigEndian.PutUint64(body[48:], req.Left)
+	binary.BigEndian.PutUint64(body[56:], req.Uploaded)
+	binary.BigEndian.PutUint32(body[64:], udpEvent(req.Event))
+	// ip is left as 0 so the tracker uses the one we send from
+	key, err := hex.DecodeString(req.Key)
+	if err == nil && len(key) == 4 {
+		copy(body[72:], key)
+	}
+	numwant := int32(req.NumWant)
+	if numwant <= 0 {
+		numwant = -1
+	}
+	binary.BigEndian.PutUint32(body[76:], uint32(numwant))
+	binary.BigEndian.PutUint16(body[80:], uint16(req.Port))
+	return append(body, t.urlData(req)...)
+}
+
+// send announce via udp
+func (t *UDPTracker) Announce(req *Request) (resp *Response, err error) {
+	resp = new(Response)
+	interval := 0
+	n := req.GetNetwork()
+	if a := n.Addr(); a != nil && a.Network() == "i2p" {
+		err = ErrUDPNotSupported
+	}
+	var addrs []string
+	if err == nil {
+		addrs, err = t.resolve(n)
+	}
+	var reply []byte
+	var remote net.Addr
+	// a dead address should not take the whole tracker down with it
+	for _, addr := range addrs {
+		reply, remote, err = t.announceTo(n, addr, req)
+		if err == nil {
+			break
+		}
+		log.Debugf("%s: announce to %s failed: %s", t.Name(), addr, err)
+	}
+	if err == nil {
+		interval = int(binary.BigEndian.Uint32(reply))
+		resp.Incomplete = int(binary.BigEndian.Uint32(reply[4:]))
+		resp.Complete = int(binary.BigEndian.Uint32(reply[8:]))
+		// peers are ipv6 if we asked over ipv6
+		enc := common.PeersIPv4
+		if ip := addrIP(remote); ip != nil && ip.To4() == nil {
+			enc = common.PeersIPv6
+		}
+		resp.Peers = common.ParsePeers(enc, reply[12:])
+		log.Infof("%s got %d peers for %s", t.Name(), len(resp.Peers), req.Infohash.Hex())
+	} else {
+		log.Warnf("%s got error while announcing: %s", t.Name(), err)
+	}
+	if interval == 0 {
+		interval = 60
+	}
+	resp.NextAnnounce = time.Now().Add(time.Second * time.Duration(interval))
+	return
+}
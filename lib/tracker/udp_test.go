@@ -0,0 +1,116 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/majestrate/XD/lib/network"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// run a udp tracker that gives out one peer and reports the options of each announce
+func testUDPTracker(t *testing.T) (net.PacketConn, chan []byte) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	announces := make(chan []byte, 4)
+	go func() {
+		var buff [2048]byte
+		for {
+			n, from, err := pc.ReadFrom(buff[:])
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+			action := binary.BigEndian.Uint32(buff[8:])
+			reply := make([]byte, 8)
+			binary.BigEndian.PutUint32(reply, action)
+			copy(reply[4:], buff[12:16])
+			switch action {
+			case udpConnect:
+				reply = append(reply, 0, 0, 0, 0, 0, 0, 0, 42)
+			case udpAnnounce:
+				if binary.BigEndian.Uint64(buff[:]) != 42 {
+					continue
+				}
+				announces <- append([]byte{}, buff[98:n]...)
+				// interval, leechers, seeders then one peer
+				reply = append(reply, 0, 0, 0, 60, 0, 0, 0, 1, 0, 0, 0, 0)
+				reply = append(reply, 10, 0, 0, 1, 0x1a, 0xe1)
+			}
+			pc.WriteTo(reply, from)
+		}
+	}()
+	return pc, announces
+}
+
+func TestUDPAnnounceURLData(t *testing.T) {
+	pc, announces := testUDPTracker(t)
+	defer pc.Close()
+	u, _ := url.Parse("udp://" + pc.LocalAddr().String() + "/announce?auth=secret")
+	tr := NewUDPTracker(u)
+	resp, err := tr.Announce(&Request{
+		Port:       6881,
+		GetNetwork: func() network.Network { return testNetwork{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := <-announces
+	data := "/announce?auth=secret"
+	expected := append([]byte{udpOptURLData, byte(len(data))}, data...)
+	if !bytes.Equal(opts, expected) {
+		t.Errorf("announce options are %q, expected %q", opts, expected)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].IP != "10.0.0.1" || resp.Peers[0].Port != 6881 {
+		t.Errorf("got peers %v", resp.Peers)
+	}
+}
+
+func TestUDPURLDataSplit(t *testing.T) {
+	path := "/" + strings.Repeat("a", 300)
+	u, _ := url.Parse("udp://tracker.example:6969" + path)
+	opts := NewUDPTracker(u).urlData(&Request{})
+	expected := append([]byte{udpOptURLData, 255}, path[:255]...)
+	expected = append(expected, udpOptURLData, byte(len(path)-255))
+	expected = append(expected, path[255:]...)
+	if !bytes.Equal(opts, expected) {
+		t.Errorf("long path encoded as %q", opts)
+	}
+}
+
+func TestUDPAnnounceFailover(t *testing.T) {
+	pc, announces := testUDPTracker(t)
+	defer pc.Close()
+	dead := deadAddr(t, "udp")
+	live := pc.LocalAddr()
+	n := &multiNetwork{addrs: []net.Addr{dead, live}}
+	_, port, _ := net.SplitHostPort(live.String())
+	u, _ := url.Parse("udp://tracker.test:" + port + "/announce")
+	tr := NewUDPTracker(u)
+	tr.Timeout = time.Second
+	for idx := 0; idx < 2; idx++ {
+		resp, err := tr.Announce(&Request{
+			Port:       6881,
+			GetNetwork: func() network.Network { return n },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-announces
+		if len(resp.Peers) != 1 {
+			t.Errorf("got peers %v", resp.Peers)
+		}
+	}
+	// the address that answered is tried first the second time
+	expected := []string{dead.String(), live.String(), live.String()}
+	if strings.Join(n.dials, " ") != strings.Join(expected, " ") {
+		t.Errorf("dialed %v, expected %v", n.dials, expected)
+	}
+}
@@ -0,0 +1,170 @@
+package util
+
+import (
+	"github.com/majestrate/XD/lib/sync"
+	"time"
+)
+
+// Clock tells the time and makes tickers so timing can be faked in tests
+type Clock interface {
+	// Now gets the current time
+	Now() time.Time
+	// NewTicker makes a ticker that ticks every d
+	NewTicker(d time.Duration) Ticker
+	// After gets a channel that gets the time once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker ticks at a fixed interval until stopped
+type Ticker interface {
+	// Chan gets the channel the ticks are sent on
+	Chan() <-chan time.Time
+	// Stop stops ticking, it does not close the channel
+	Stop()
+}
+
+// RealClock is the Clock that uses the actual time
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
+
+// FakeClock is a Clock that only moves when told to
+type FakeClock struct {
+	mtx     sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	afters  []fakeAfter
+}
+
+// NewFakeClock makes a FakeClock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now: now,
+	}
+}
+
+type fakeTicker struct {
+	clock   *FakeClock
+	c       chan time.Time
+	every   time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mtx.Lock()
+	t.stopped = true
+	t.clock.mtx.Unlock()
+}
+
+type fakeAfter struct {
+	c    chan time.Time
+	when time.Time
+}
+
+// Now implements Clock
+func (c *FakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// NewTicker implements Clock
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &fakeTicker{
+		clock: c,
+		c:     make(chan time.Time),
+		every: d,
+		next:  c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// After implements Clock
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ch := make(chan time.Time, 1)
+	c.afters = append(c.afters, fakeAfter{c: ch, when: c.now.Add(d)})
+	return ch
+}
+
+// Advance moves the time forward by d firing every tick and After that is due on the way
+// unlike time.Ticker no tick is dropped, Advance blocks until each one is read
+// so a running ticker must be read from or stopped
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	end := c.now.Add(d)
+	c.mtx.Unlock()
+	for {
+		c.mtx.Lock()
+		// find the next thing that is due
+		var ticker *fakeTicker
+		next := end
+		for _, a := range c.afters {
+			if a.when.Before(next) {
+				next = a.when
+			}
+		}
+		for _, t := range c.tickers {
+			if t.stopped {
+				continue
+			}
+			if t.next.Before(next) || ticker == nil && t.next.Equal(next) {
+				ticker = t
+				next = t.next
+			}
+		}
+		c.now = next
+		var afters []fakeAfter
+		for _, a := range c.afters {
+			if a.when.After(next) {
+				afters = append(afters, a)
+			} else {
+				a.c <- a.when
+			}
+		}
+		c.afters = afters
+		if ticker == nil {
+			c.mtx.Unlock()
+			if next.Equal(end) {
+				return
+			}
+			continue
+		}
+		ticker.next = next.Add(ticker.every)
+		c.mtx.Unlock()
+		ticker.c <- next
+	}
+}
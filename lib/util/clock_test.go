@@ -0,0 +1,56 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockTicker(t *testing.T) {
+	c := NewFakeClock(time.Unix(1000, 0))
+	tk := c.NewTicker(time.Second)
+	ticks := make(chan time.Time, 100)
+	done := make(chan bool)
+	go func() {
+		for tm := range tk.Chan() {
+			ticks <- tm
+		}
+	}()
+	after := c.After(time.Millisecond * 2500)
+	c.Advance(time.Second * 3)
+	if n := len(ticks); n < 2 {
+		// the last tick can still be on its way
+		t.Errorf("got %d ticks before the last one", n)
+	}
+	select {
+	case tm := <-after:
+		if !tm.Equal(time.Unix(1002, 500000000)) {
+			t.Errorf("after fired at %s", tm)
+		}
+	default:
+		t.Error("after did not fire")
+	}
+	if !c.Now().Equal(time.Unix(1003, 0)) {
+		t.Errorf("clock is at %s after advancing", c.Now())
+	}
+	tk.Stop()
+	// nothing reads the ticker any more so this would block if it still ticked
+	go func() {
+		c.Advance(time.Second * 10)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("advancing blocked on a stopped ticker")
+	}
+	for idx := 0; idx < 3; idx++ {
+		select {
+		case tm := <-ticks:
+			if !tm.Equal(time.Unix(int64(1001+idx), 0)) {
+				t.Errorf("tick %d at %s", idx, tm)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("only got %d ticks", idx)
+		}
+	}
+}
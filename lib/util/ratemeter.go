@@ -0,0 +1,100 @@
+package util
+
+import (
+	"github.com/majestrate/XD/lib/sync"
+	"time"
+)
+
+// DefaultRateWindow is the default time window rates are averaged over
+const DefaultRateWindow = time.Second * 10
+
+// RateMeter measures a rate in bytes per second as a moving average over a window of time
+type RateMeter struct {
+	mtx sync.Mutex
+	// bytes per second, buckets[head%len] is the current second
+	buckets []uint64
+	head    int64
+	started time.Time
+	total   uint64
+	now     func() time.Time
+}
+
+// NewRateMeter creates a RateMeter averaging over window, window is rounded to whole seconds
+func NewRateMeter(window time.Duration) *RateMeter {
+	return newRateMeter(window, time.Now)
+}
+
+func newRateMeter(window time.Duration, now func() time.Time) *RateMeter {
+	n := int(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	m := &RateMeter{
+		buckets: make([]uint64, n),
+		now:     now,
+	}
+	m.started = now()
+	m.head = m.started.Unix()
+	return m
+}
+
+// move the current bucket up to the second sec, clearing buckets we skipped over
+func (m *RateMeter) advance(sec int64) {
+	if sec <= m.head {
+		return
+	}
+	l := int64(len(m.buckets))
+	if sec-m.head >= l {
+		for idx := range m.buckets {
+			m.buckets[idx] = 0
+		}
+	} else {
+		for s := m.head + 1; s <= sec; s++ {
+			m.buckets[s%l] = 0
+		}
+	}
+	m.head = sec
+}
+
+// Add records n bytes transfered right now
+func (m *RateMeter) Add(n uint64) {
+	m.mtx.Lock()
+	m.advance(m.now().Unix())
+	m.buckets[m.head%int64(len(m.buckets))] += n
+	m.total += n
+	m.mtx.Unlock()
+}
+
+// Rate gets the average rate in bytes per second over the window
+func (m *RateMeter) Rate() float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := m.now()
+	m.advance(now.Unix())
+	var sum uint64
+	for _, n := range m.buckets {
+		sum += n
+	}
+	// full seconds in the window plus how far we are into the current one
+	span := float64(len(m.buckets)-1) + float64(now.Nanosecond())/float64(time.Second)
+	if elapsed := now.Sub(m.started).Seconds(); elapsed < span {
+		span = elapsed
+	}
+	if span < 1.0 {
+		span = 1.0
+	}
+	return float64(sum) / span
+}
+
+// Total gets the total number of bytes ever added
+func (m *RateMeter) Total() (total uint64) {
+	m.mtx.Lock()
+	total = m.total
+	m.mtx.Unlock()
+	return
+}
+
+// Window gets the time window rates are averaged over
+func (m *RateMeter) Window() time.Duration {
+	return time.Duration(len(m.buckets)) * time.Second
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func (c *testClock) sleep(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func expectRate(t *testing.T, m *RateMeter, expected, tolerance float64) {
+	rate := m.Rate()
+	if math.Abs(rate-expected) > expected*tolerance {
+		t.Errorf("rate is %s but expected %s", FormatRate(rate), FormatRate(expected))
+	}
+}
+
+func TestRateMeterSteady(t *testing.T) {
+	clock := &testClock{t: time.Unix(1000, 0)}
+	m := newRateMeter(time.Second*5, clock.now)
+	// 1000 bytes every 100ms is 10KB/s
+	for idx := 0; idx < 200; idx++ {
+		clock.sleep(time.Millisecond * 100)
+		m.Add(1000)
+	}
+	expectRate(t, m, 10000, 0.1)
+	if m.Total() != 200000 {
+		t.Errorf("total is %d", m.Total())
+	}
+	// go idle until the window is empty
+	clock.sleep(time.Second * 6)
+	if rate := m.Rate(); rate != 0 {
+		t.Errorf("idle rate is %s", FormatRate(rate))
+	}
+}
+
+func TestRateMeterChange(t *testing.T) {
+	clock := &testClock{t: time.Unix(1000, 0)}
+	m := newRateMeter(time.Second*2, clock.now)
+	for idx := 0; idx < 100; idx++ {
+		clock.sleep(time.Millisecond * 100)
+		m.Add(100)
+	}
+	expectRate(t, m, 1000, 0.1)
+	// rate goes up 10x, after a full window the old rate is gone
+	for idx := 0; idx < 30; idx++ {
+		clock.sleep(time.Millisecond * 100)
+		m.Add(1000)
+	}
+	expectRate(t, m, 10000, 0.1)
+}
+
+func TestRateMeterStartup(t *testing.T) {
+	clock := &testClock{t: time.Unix(1000, 0)}
+	m := newRateMeter(time.Second*10, clock.now)
+	// only 2 seconds of data in a 10 second window
+	for idx := 0; idx < 20; idx++ {
+		clock.sleep(time.Millisecond * 100)
+		m.Add(500)
+	}
+	expectRate(t, m, 5000, 0.1)
+	if m.Window() != time.Second*10 {
+		t.Errorf("window is %s", m.Window())
+	}
+}
@@ -15,6 +15,11 @@ var Patch = "2"
 
 var Git string
 
+// UserAgent gets what we call ourselves in http requests
+func UserAgent() string {
+	return fmt.Sprintf("%s/%s.%s.%s", Name, Major, Minor, Patch)
+}
+
 func Version() string {
 	v := fmt.Sprintf("%s-%s.%s.%s", Name, Major, Minor, Patch)
 	if len(Git) > 0 && constants.UseGitVersion {